@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"time"
@@ -217,6 +218,10 @@ func (am *MultitenantAlertmanager) addNewConfigs(cfgs map[string]configs.CortexC
 	// TODO: instrument how many configs we have, both valid & invalid.
 	log.Debugf("Adding %d configurations", len(cfgs))
 	for userID, config := range cfgs {
+		if config.DeletedAt != nil {
+			am.deleteUser(userID)
+			continue
+		}
 
 		err := am.setConfig(userID, config.Config)
 		if err != nil {
@@ -261,6 +266,27 @@ func (am *MultitenantAlertmanager) setConfig(userID string, config configs.Corte
 	return nil
 }
 
+// deleteUser stops the Alertmanager of a deleted user, if there is one, and
+// removes the user's notification log and silences from the data directory.
+func (am *MultitenantAlertmanager) deleteUser(userID string) {
+	am.alertmanagersMtx.Lock()
+	userAM, ok := am.alertmanagers[userID]
+	delete(am.alertmanagers, userID)
+	am.alertmanagersMtx.Unlock()
+	if ok {
+		// Stopping snapshots the state, so it is removed afterwards.
+		userAM.Stop()
+	}
+	delete(am.cfgs, userID)
+
+	for _, name := range []string{fmt.Sprintf("nflog:%s", userID), fmt.Sprintf("silences:%s", userID)} {
+		if err := os.Remove(filepath.Join(am.cfg.DataDir, name)); err != nil && !os.IsNotExist(err) {
+			log.Warnf("MultitenantAlertmanager: unable to remove state of deleted user %v: %v", userID, err)
+		}
+	}
+	log.Infof("MultitenantAlertmanager: deleted user %v", userID)
+}
+
 func (am *MultitenantAlertmanager) newAlertmanager(userID string, amConfig *amconfig.Config) (*Alertmanager, error) {
 	newAM, err := New(&Config{
 		UserID:      userID,
@@ -0,0 +1,241 @@
+package backfill
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+var (
+	errSampleOutOfRange  = errors.New("sample outside the backfill range")
+	errOverlapsIngesters = errors.New("backfill range overlaps samples still in ingesters")
+	errOverlapsStore     = errors.New("backfill range overlaps chunks of the same series already in the chunk store")
+)
+
+var backfilledSamples = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "backfill_total",
+	Help:      "Total count of samples, and chunks, written by backfills.",
+}, []string{"type"})
+
+func init() {
+	prometheus.MustRegister(backfilledSamples)
+}
+
+// Config configures the Backfiller.
+type Config struct {
+	ChunkEncoding string
+	MaxChunkAge   time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.ChunkEncoding, "backfill.chunk-encoding", "1", "Encoding version to use for chunks.")
+	f.DurationVar(&cfg.MaxChunkAge, "backfill.max-chunk-age", 12*time.Hour, "Maximum time range of a chunk, as with -ingester.max-chunk-age.")
+}
+
+// Ingesters queries the samples held in ingesters, e.g. the distributor.
+type Ingesters interface {
+	Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error)
+}
+
+// ChunkStore is the interface we need to check for and write chunks.
+type ChunkStore interface {
+	Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]chunk.Chunk, error)
+	Put(ctx context.Context, chunks []chunk.Chunk) error
+}
+
+// Backfiller writes samples older than the ingesters accept straight to the
+// chunk store, as chunks built like the ingesters would.  A backfill covers a
+// closed range, which mustn't overlap samples of the same metrics still in
+// the ingesters, as the ingesters would flush chunks overlapping it later.
+// Nor may the range overlap chunks of the same series already stored,
+// including those starting before it, so a backfill can't be written twice
+// or run into series which were already being written.
+//
+// Samples come as remote-write requests only; there is no reader for
+// Prometheus TSDB blocks here.
+type Backfiller struct {
+	cfg       Config
+	ingesters Ingesters
+	store     ChunkStore
+}
+
+// New makes a new Backfiller.
+func New(cfg Config, ingesters Ingesters, store ChunkStore) (*Backfiller, error) {
+	if err := prom_chunk.DefaultEncoding.Set(cfg.ChunkEncoding); err != nil {
+		return nil, err
+	}
+	return &Backfiller{
+		cfg:       cfg,
+		ingesters: ingesters,
+		store:     store,
+	}, nil
+}
+
+// Result counts what a backfill wrote.
+type Result struct {
+	Series  int `json:"series"`
+	Samples int `json:"samples"`
+	Chunks  int `json:"chunks"`
+}
+
+// Backfill writes the series, whose samples must all be in [from, through],
+// to the chunk store.  Nothing is written if any sample is invalid.
+func (b *Backfiller) Backfill(ctx context.Context, from, through model.Time, timeseries []cortex.TimeSeries) (Result, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// A series may be split across several TimeSeries.
+	series := map[model.Fingerprint]*model.SampleStream{}
+	names := map[model.LabelValue]struct{}{}
+	for _, ts := range timeseries {
+		m := util.FromLabelPairs(ts.Labels)
+		if err := util.ValidateSample(&model.Sample{Metric: m}); err != nil {
+			return Result{}, err
+		}
+		fp := m.Fingerprint()
+		ss, ok := series[fp]
+		if !ok {
+			ss = &model.SampleStream{Metric: m}
+			series[fp] = ss
+		}
+		for _, s := range ts.Samples {
+			t := model.Time(s.TimestampMs)
+			if t < from || through < t {
+				return Result{}, errSampleOutOfRange
+			}
+			ss.Values = append(ss.Values, model.SamplePair{Timestamp: t, Value: model.SampleValue(s.Value)})
+		}
+		names[m[model.MetricNameLabel]] = struct{}{}
+	}
+
+	for name := range names {
+		nameMatcher := &metric.LabelMatcher{Type: metric.Equal, Name: model.MetricNameLabel, Value: name}
+		matrix, err := b.ingesters.Query(ctx, from, through, nameMatcher)
+		if err != nil {
+			return Result{}, err
+		}
+		for _, ss := range matrix {
+			if len(ss.Values) > 0 {
+				return Result{}, errOverlapsIngesters
+			}
+		}
+
+		stored, err := b.store.Get(ctx, from, through, nameMatcher)
+		if err != nil {
+			return Result{}, err
+		}
+		for _, c := range stored {
+			if _, ok := series[c.Metric.Fingerprint()]; ok {
+				return Result{}, errOverlapsStore
+			}
+		}
+	}
+
+	result := Result{Series: len(series)}
+	chunks := []chunk.Chunk{}
+	for _, ss := range series {
+		samples := sortSamples(ss.Values)
+		result.Samples += len(samples)
+		for len(samples) > 0 {
+			n := 1
+			for n < len(samples) && (b.cfg.MaxChunkAge <= 0 || samples[n].Timestamp.Sub(samples[0].Timestamp) < b.cfg.MaxChunkAge) {
+				n++
+			}
+			cs, err := chunk.ChunksForSamples(userID, ss.Metric, samples[:n])
+			if err != nil {
+				return Result{}, err
+			}
+			chunks = append(chunks, cs...)
+			samples = samples[n:]
+		}
+	}
+	result.Chunks = len(chunks)
+
+	if err := b.store.Put(ctx, chunks); err != nil {
+		return Result{}, err
+	}
+	backfilledSamples.WithLabelValues("samples").Add(float64(result.Samples))
+	backfilledSamples.WithLabelValues("chunks").Add(float64(result.Chunks))
+	return result, nil
+}
+
+// Handler backfills the snappy-compressed remote-write request in the body,
+// for the range given by the from and through parameters.
+func (b *Backfiller) Handler(w http.ResponseWriter, r *http.Request) {
+	from, err := util.ParseTime(r.FormValue("from"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	through, err := util.ParseTime(r.FormValue("through"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if through < from {
+		http.Error(w, "through is before from", http.StatusBadRequest)
+		return
+	}
+
+	var req cortex.WriteRequest
+	if _, err := util.ParseProtoRequest(r.Context(), r, &req, true); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := b.Backfill(r.Context(), from, through, req.Timeseries)
+	switch err {
+	case nil:
+	case errOverlapsIngesters, errOverlapsStore:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errSampleOutOfRange, util.ErrMissingMetricName, util.ErrInvalidMetricName, util.ErrInvalidLabel,
+		util.ErrLabelNameTooLong, util.ErrLabelValueTooLong:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		log.Errorf("backfill err: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	util.WriteJSONResponse(w, result)
+}
+
+// sortSamples sorts the samples by time, keeping the last of those with the
+// same timestamp.
+func sortSamples(samples []model.SamplePair) []model.SamplePair {
+	sort.Stable(byTimestamp(samples))
+	result := samples[:0]
+	for _, s := range samples {
+		if len(result) > 0 && result[len(result)-1].Timestamp == s.Timestamp {
+			result[len(result)-1] = s
+			continue
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+type byTimestamp []model.SamplePair
+
+func (s byTimestamp) Len() int           { return len(s) }
+func (s byTimestamp) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byTimestamp) Less(i, j int) bool { return s[i].Timestamp < s[j].Timestamp }
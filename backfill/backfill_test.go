@@ -0,0 +1,125 @@
+package backfill
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+type mockIngesters map[model.LabelValue]model.Matrix
+
+func (m mockIngesters) Query(_ context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	result := model.Matrix{}
+	for _, ss := range m[matchers[0].Value] {
+		values := []model.SamplePair{}
+		for _, s := range ss.Values {
+			if from <= s.Timestamp && s.Timestamp <= to {
+				values = append(values, s)
+			}
+		}
+		result = append(result, &model.SampleStream{Metric: ss.Metric, Values: values})
+	}
+	return result, nil
+}
+
+type mockStore struct {
+	chunks []chunk.Chunk
+}
+
+func (m *mockStore) Get(_ context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]chunk.Chunk, error) {
+	var result []chunk.Chunk
+outer:
+	for _, c := range m.chunks {
+		if c.Through < from || through < c.From {
+			continue
+		}
+		for _, matcher := range matchers {
+			if !matcher.Match(c.Metric[matcher.Name]) {
+				continue outer
+			}
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+func (m *mockStore) Put(_ context.Context, chunks []chunk.Chunk) error {
+	m.chunks = append(m.chunks, chunks...)
+	return nil
+}
+
+func TestBackfill(t *testing.T) {
+	ingesters := mockIngesters{
+		"bar": {{Metric: model.Metric{model.MetricNameLabel: "bar"}, Values: []model.SamplePair{{Timestamp: model.TimeFromUnix(48 * 3600), Value: 1}}}},
+	}
+	store := &mockStore{}
+	backfiller, err := New(Config{ChunkEncoding: "1", MaxChunkAge: 12 * time.Hour}, ingesters, store)
+	require.NoError(t, err)
+	ctx := user.Inject(context.Background(), "1")
+
+	// A day of samples every 15m, out of order and split across requests,
+	// with a duplicate.
+	labels := util.ToLabelPairs(model.Metric{model.MetricNameLabel: "foo"})
+	first, second := cortex.TimeSeries{Labels: labels}, cortex.TimeSeries{Labels: labels}
+	for i := 95; i >= 0; i-- {
+		s := cortex.Sample{TimestampMs: int64(i) * 15 * 60 * 1000, Value: float64(i)}
+		if i%2 == 0 {
+			first.Samples = append(first.Samples, s)
+		} else {
+			second.Samples = append(second.Samples, s)
+		}
+	}
+	second.Samples = append(second.Samples, cortex.Sample{TimestampMs: 0, Value: 0})
+	from, through := model.Time(0), model.Time(95*15*60*1000)
+	result, err := backfiller.Backfill(ctx, from, through, []cortex.TimeSeries{first, second})
+	require.NoError(t, err)
+	assert.Equal(t, Result{Series: 1, Samples: 96, Chunks: 2}, result)
+
+	// Chunks are cut every 12h.
+	require.Len(t, store.chunks, 2)
+	matrix, err := chunk.ChunksToMatrix(store.chunks)
+	require.NoError(t, err)
+	require.Len(t, matrix, 1)
+	require.Len(t, matrix[0].Values, 96)
+	for i, v := range matrix[0].Values {
+		assert.Equal(t, model.SamplePair{Timestamp: model.Time(i * 15 * 60 * 1000), Value: model.SampleValue(i)}, v)
+	}
+	assert.Equal(t, model.TimeFromUnix(12*3600), store.chunks[1].From)
+
+	// Samples outside the range, or overlapping the ingesters, are refused.
+	_, err = backfiller.Backfill(ctx, from, through-1, []cortex.TimeSeries{second})
+	assert.Equal(t, errSampleOutOfRange, err)
+	bar := cortex.TimeSeries{
+		Labels:  util.ToLabelPairs(model.Metric{model.MetricNameLabel: "bar"}),
+		Samples: []cortex.Sample{{TimestampMs: 1000, Value: 1}},
+	}
+	_, err = backfiller.Backfill(ctx, 0, model.TimeFromUnix(72*3600), []cortex.TimeSeries{bar})
+	assert.Equal(t, errOverlapsIngesters, err)
+	_, err = backfiller.Backfill(ctx, 0, model.TimeFromUnix(24*3600), []cortex.TimeSeries{bar})
+	assert.NoError(t, err)
+	assert.Len(t, store.chunks, 3)
+
+	// Nor may the range overlap stored chunks of the same series, even ones
+	// starting before it; other series of the metric are fine.
+	late := cortex.TimeSeries{Labels: labels, Samples: []cortex.Sample{{TimestampMs: through.Add(time.Hour).Unix() * 1000, Value: 1}}}
+	_, err = backfiller.Backfill(ctx, through, through.Add(time.Hour), []cortex.TimeSeries{late})
+	assert.Equal(t, errOverlapsStore, err)
+	_, err = backfiller.Backfill(ctx, through+1, through.Add(time.Hour), []cortex.TimeSeries{late})
+	assert.NoError(t, err)
+	other := cortex.TimeSeries{
+		Labels:  util.ToLabelPairs(model.Metric{model.MetricNameLabel: "foo", "job": "other"}),
+		Samples: []cortex.Sample{{TimestampMs: 1000, Value: 1}},
+	}
+	_, err = backfiller.Backfill(ctx, from, through, []cortex.TimeSeries{other})
+	assert.NoError(t, err)
+}
@@ -7,7 +7,9 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"net/url"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -20,6 +22,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
 	"golang.org/x/net/context"
 
 	"github.com/weaveworks/common/instrument"
@@ -62,7 +65,7 @@ var (
 		Namespace: "cortex",
 		Name:      "dynamo_consumed_capacity_total",
 		Help:      "The capacity units consumed by operation.",
-	}, []string{"operation"})
+	}, []string{"operation", tableNameLabel})
 	dynamoFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "cortex",
 		Name:      "dynamo_failures_total",
@@ -81,6 +84,13 @@ func init() {
 	prometheus.MustRegister(dynamoConsumedCapacity)
 	prometheus.MustRegister(dynamoFailures)
 	prometheus.MustRegister(s3RequestDuration)
+
+	RegisterIndexClient("aws", func(cfg StorageClientConfig) (IndexClient, error) {
+		return NewDynamoDBIndexClient(cfg.DynamoDBConfig)
+	})
+	RegisterObjectClient("aws", func(cfg StorageClientConfig) (ObjectClient, error) {
+		return NewS3ObjectClient(cfg.AWSStorageConfig)
+	})
 }
 
 // DynamoDBConfig specifies config for a DynamoDB database.
@@ -123,16 +133,10 @@ func NewAWSStorageClient(cfg AWSStorageConfig) (StorageClient, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	if cfg.S3.URL == nil {
-		return nil, fmt.Errorf("no URL specified for S3")
-	}
-	s3Config, err := awsConfigFromURL(cfg.S3.URL)
+	s3Client, bucketName, err := s3ClientFromURL(cfg.S3.URL)
 	if err != nil {
 		return nil, err
 	}
-	s3Client := s3.New(session.New(s3Config))
-	bucketName := strings.TrimPrefix(cfg.S3.URL.Path, "/")
 
 	storageClient := awsStorageClient{
 		DynamoDB:   dynamoDB,
@@ -143,6 +147,48 @@ func NewAWSStorageClient(cfg AWSStorageConfig) (StorageClient, error) {
 	return storageClient, nil
 }
 
+// NewDynamoDBIndexClient makes an IndexClient backed by DynamoDB.
+func NewDynamoDBIndexClient(cfg DynamoDBConfig) (IndexClient, error) {
+	if cfg.DynamoDB.URL != nil {
+		path := strings.TrimPrefix(cfg.DynamoDB.URL.Path, "/")
+		if len(path) > 0 {
+			log.Warnf("Ignoring DynamoDB URL path: %v.", path)
+		}
+	}
+	dynamoDB, err := dynamoClientFromURL(cfg.DynamoDB.URL)
+	if err != nil {
+		return nil, err
+	}
+	storageClient := awsStorageClient{
+		DynamoDB: dynamoDB,
+	}
+	storageClient.queryRequestFn = storageClient.queryRequest
+	return storageClient, nil
+}
+
+// NewS3ObjectClient makes an ObjectClient backed by S3.
+func NewS3ObjectClient(cfg AWSStorageConfig) (ObjectClient, error) {
+	s3Client, bucketName, err := s3ClientFromURL(cfg.S3.URL)
+	if err != nil {
+		return nil, err
+	}
+	return awsStorageClient{
+		S3:         s3Client,
+		bucketName: bucketName,
+	}, nil
+}
+
+func s3ClientFromURL(s3URL *url.URL) (s3iface.S3API, string, error) {
+	if s3URL == nil {
+		return nil, "", fmt.Errorf("no URL specified for S3")
+	}
+	s3Config, err := awsConfigFromURL(s3URL)
+	if err != nil {
+		return nil, "", err
+	}
+	return s3.New(session.New(s3Config)), strings.TrimPrefix(s3URL.Path, "/"), nil
+}
+
 func (a awsStorageClient) NewWriteBatch() WriteBatch {
 	return dynamoDBWriteBatch(map[string][]*dynamodb.WriteRequest{})
 }
@@ -167,7 +213,7 @@ func (a awsStorageClient) BatchWrite(ctx context.Context, input WriteBatch) erro
 			return err
 		})
 		for _, cc := range resp.ConsumedCapacity {
-			dynamoConsumedCapacity.WithLabelValues("DynamoDB.BatchWriteItem").
+			dynamoConsumedCapacity.WithLabelValues("DynamoDB.BatchWriteItem", aws.StringValue(cc.TableName)).
 				Add(float64(*cc.CapacityUnits))
 		}
 
@@ -248,7 +294,7 @@ func (a awsStorageClient) QueryPages(ctx context.Context, entry IndexEntry, call
 		})
 
 		if cc := page.Data().(*dynamodb.QueryOutput).ConsumedCapacity; cc != nil {
-			dynamoConsumedCapacity.WithLabelValues("DynamoDB.QueryPages").
+			dynamoConsumedCapacity.WithLabelValues("DynamoDB.QueryPages", aws.StringValue(cc.TableName)).
 				Add(float64(*cc.CapacityUnits))
 		}
 
@@ -278,6 +324,65 @@ func (a awsStorageClient) QueryPages(ctx context.Context, entry IndexEntry, call
 	return nil
 }
 
+// ScanTable reads the table a page at a time, backing off when throttled.
+// DynamoDB still reads every item, but only returns those with the prefix.
+func (a awsStorageClient) ScanTable(ctx context.Context, tableName, hashPrefix string, callback func(entry IndexEntry) (shouldContinue bool)) error {
+	input := &dynamodb.ScanInput{
+		TableName:              aws.String(tableName),
+		ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+	}
+	if hashPrefix != "" {
+		input.FilterExpression = aws.String(fmt.Sprintf("begins_with(%s, :prefix)", hashKey))
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":prefix": {S: aws.String(hashPrefix)},
+		}
+	}
+	backoff := minBackoff
+	for {
+		var output *dynamodb.ScanOutput
+		err := instrument.TimeRequestHistogram(ctx, "DynamoDB.Scan", dynamoRequestDuration, func(ctx context.Context) error {
+			var err error
+			output, err = a.DynamoDB.ScanWithContext(ctx, input)
+			return err
+		})
+		if output != nil && output.ConsumedCapacity != nil {
+			dynamoConsumedCapacity.WithLabelValues("DynamoDB.Scan", tableName).
+				Add(aws.Float64Value(output.ConsumedCapacity.CapacityUnits))
+		}
+
+		if err != nil {
+			recordDynamoError(tableName, err)
+
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == provisionedThroughputExceededException {
+				time.Sleep(backoff)
+				backoff = nextBackoff(backoff)
+				continue
+			}
+			return fmt.Errorf("Scan error: table=%v, err=%v", tableName, err)
+		}
+		backoff = minBackoff
+
+		for _, item := range output.Items {
+			entry := IndexEntry{
+				TableName:  tableName,
+				HashValue:  aws.StringValue(item[hashKey].S),
+				RangeValue: item[rangeKey].B,
+			}
+			if value, ok := item[valueKey]; ok {
+				entry.Value = value.B
+			}
+			if !callback(entry) {
+				return nil
+			}
+		}
+
+		if len(output.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+}
+
 type dynamoDBRequest interface {
 	NextPage() dynamoDBRequest
 	Send() error
@@ -329,7 +434,9 @@ func (a awsStorageClient) GetChunk(ctx context.Context, key string) ([]byte, err
 		})
 		return err
 	})
-	if err != nil {
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, ErrStorageObjectNotFound
+	} else if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -351,6 +458,33 @@ func (a awsStorageClient) PutChunk(ctx context.Context, key string, buf []byte)
 	})
 }
 
+// ListChunks lists the bucket's keys starting with prefix, a page at a time.
+func (a awsStorageClient) ListChunks(ctx context.Context, prefix string, callback func(key string) (shouldContinue bool)) error {
+	return instrument.TimeRequestHistogram(ctx, "S3.ListObjects", s3RequestDuration, func(ctx context.Context) error {
+		return a.S3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(a.bucketName),
+			Prefix: aws.String(prefix),
+		}, func(output *s3.ListObjectsV2Output, _ bool) bool {
+			for _, object := range output.Contents {
+				if !callback(aws.StringValue(object.Key)) {
+					return false
+				}
+			}
+			return true
+		})
+	})
+}
+
+func (a awsStorageClient) DeleteChunk(ctx context.Context, key string) error {
+	return instrument.TimeRequestHistogram(ctx, "S3.DeleteObject", s3RequestDuration, func(ctx context.Context) error {
+		_, err := a.S3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(a.bucketName),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+}
+
 type dynamoDBWriteBatch map[string][]*dynamodb.WriteRequest
 
 func (b dynamoDBWriteBatch) Add(tableName, hashValue string, rangeValue []byte, value []byte) {
@@ -370,6 +504,17 @@ func (b dynamoDBWriteBatch) Add(tableName, hashValue string, rangeValue []byte,
 	})
 }
 
+func (b dynamoDBWriteBatch) Delete(tableName, hashValue string, rangeValue []byte) {
+	b[tableName] = append(b[tableName], &dynamodb.WriteRequest{
+		DeleteRequest: &dynamodb.DeleteRequest{
+			Key: map[string]*dynamodb.AttributeValue{
+				hashKey:  {S: aws.String(hashValue)},
+				rangeKey: {B: rangeValue},
+			},
+		},
+	})
+}
+
 type dynamoDBReadBatch []map[string]*dynamodb.AttributeValue
 
 func (b dynamoDBReadBatch) Len() int {
@@ -390,6 +535,11 @@ func (b dynamoDBReadBatch) Value(i int) []byte {
 
 type dynamoTableClient struct {
 	DynamoDB dynamodbiface.DynamoDBAPI
+
+	// Tables are only tagged through this client, so their tags are listed
+	// once and remembered, rather than listed on every sync.
+	tagsMtx *sync.Mutex
+	tags    map[string]Tags
 }
 
 // newDynamoTableClient makes a new DynamoTableClient.
@@ -400,6 +550,8 @@ func newDynamoTableClient(cfg DynamoDBConfig) (DynamoTableClient, error) {
 	}
 	return dynamoTableClient{
 		DynamoDB: dynamoDB,
+		tagsMtx:  &sync.Mutex{},
+		tags:     map[string]Tags{},
 	}, nil
 }
 
@@ -416,10 +568,10 @@ func (d dynamoTableClient) ListTables(ctx context.Context) ([]string, error) {
 	return table, err
 }
 
-func (d dynamoTableClient) CreateTable(ctx context.Context, name string, readCapacity, writeCapacity int64) error {
-	return instrument.TimeRequestHistogram(ctx, "DynamoDB.CreateTable", dynamoRequestDuration, func(_ context.Context) error {
+func (d dynamoTableClient) CreateTable(ctx context.Context, desc tableDescription) error {
+	return instrument.TimeRequestHistogram(ctx, "DynamoDB.CreateTable", dynamoRequestDuration, func(ctx context.Context) error {
 		input := &dynamodb.CreateTableInput{
-			TableName: aws.String(name),
+			TableName: aws.String(desc.name),
 			AttributeDefinitions: []*dynamodb.AttributeDefinition{
 				{
 					AttributeName: aws.String(hashKey),
@@ -441,40 +593,189 @@ func (d dynamoTableClient) CreateTable(ctx context.Context, name string, readCap
 				},
 			},
 			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-				ReadCapacityUnits:  aws.Int64(readCapacity),
-				WriteCapacityUnits: aws.Int64(writeCapacity),
+				ReadCapacityUnits:  aws.Int64(desc.provisionedRead),
+				WriteCapacityUnits: aws.Int64(desc.provisionedWrite),
 			},
 		}
-		_, err := d.DynamoDB.CreateTable(input)
+		if desc.onDemand {
+			input.BillingMode = aws.String(dynamodb.BillingModePayPerRequest)
+			input.ProvisionedThroughput = nil
+		}
+		if desc.encrypted {
+			input.SSESpecification = &dynamodb.SSESpecification{Enabled: aws.Bool(true)}
+		}
+		if len(desc.tags) > 0 {
+			input.Tags = desc.tags.dynamoTags()
+		}
+		_, err := d.DynamoDB.CreateTableWithContext(ctx, input)
 		return err
 	})
 }
 
-func (d dynamoTableClient) DescribeTable(ctx context.Context, name string) (readCapacity, writeCapacity int64, status string, err error) {
-	var out *dynamodb.DescribeTableOutput
-	instrument.TimeRequestHistogram(ctx, "DynamoDB.DescribeTable", dynamoRequestDuration, func(_ context.Context) error {
-		out, err = d.DynamoDB.DescribeTable(&dynamodb.DescribeTableInput{
+func (d dynamoTableClient) DescribeTable(ctx context.Context, name string) (desc tableDescription, status string, err error) {
+	var arn string
+	err = instrument.TimeRequestHistogram(ctx, "DynamoDB.DescribeTable", dynamoRequestDuration, func(ctx context.Context) error {
+		out, err := d.DynamoDB.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
 			TableName: aws.String(name),
 		})
-		readCapacity = *out.Table.ProvisionedThroughput.ReadCapacityUnits
-		writeCapacity = *out.Table.ProvisionedThroughput.WriteCapacityUnits
-		status = *out.Table.TableStatus
-		return err
+		if err != nil {
+			return err
+		}
+		desc.name = name
+		if out.Table != nil {
+			if out.Table.ProvisionedThroughput != nil {
+				desc.provisionedRead = aws.Int64Value(out.Table.ProvisionedThroughput.ReadCapacityUnits)
+				desc.provisionedWrite = aws.Int64Value(out.Table.ProvisionedThroughput.WriteCapacityUnits)
+			}
+			if out.Table.BillingModeSummary != nil {
+				desc.onDemand = aws.StringValue(out.Table.BillingModeSummary.BillingMode) == dynamodb.BillingModePayPerRequest
+			}
+			if out.Table.SSEDescription != nil {
+				switch aws.StringValue(out.Table.SSEDescription.Status) {
+				case dynamodb.SSEStatusEnabled, dynamodb.SSEStatusEnabling:
+					desc.encrypted = true
+				}
+			}
+			status = aws.StringValue(out.Table.TableStatus)
+			arn = aws.StringValue(out.Table.TableArn)
+		}
+		return nil
 	})
+	if err != nil {
+		return
+	}
+	desc.tags, err = d.cachedTags(ctx, name, arn)
 	return
 }
 
-func (d dynamoTableClient) UpdateTable(ctx context.Context, name string, readCapacity, writeCapacity int64) error {
-	return instrument.TimeRequestHistogram(ctx, "DynamoDB.UpdateTable", dynamoRequestDuration, func(_ context.Context) error {
-		_, err := d.DynamoDB.UpdateTable(&dynamodb.UpdateTableInput{
-			TableName: aws.String(name),
-			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-				ReadCapacityUnits:  aws.Int64(readCapacity),
-				WriteCapacityUnits: aws.Int64(writeCapacity),
-			},
+// cachedTags returns the tags on a table, only listing them the first time.
+func (d dynamoTableClient) cachedTags(ctx context.Context, name, arn string) (Tags, error) {
+	d.tagsMtx.Lock()
+	tags, ok := d.tags[name]
+	d.tagsMtx.Unlock()
+	if ok {
+		return tags.copy(), nil
+	}
+
+	tags, err := d.listTags(ctx, arn)
+	if err != nil {
+		return nil, err
+	}
+	d.tagsMtx.Lock()
+	d.tags[name] = tags
+	d.tagsMtx.Unlock()
+	return tags.copy(), nil
+}
+
+func (d dynamoTableClient) listTags(ctx context.Context, arn string) (Tags, error) {
+	tags := Tags{}
+	input := &dynamodb.ListTagsOfResourceInput{
+		ResourceArn: aws.String(arn),
+	}
+	for {
+		var out *dynamodb.ListTagsOfResourceOutput
+		err := instrument.TimeRequestHistogram(ctx, "DynamoDB.ListTagsOfResource", dynamoRequestDuration, func(ctx context.Context) error {
+			var err error
+			out, err = d.DynamoDB.ListTagsOfResourceWithContext(ctx, input)
+			return err
 		})
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range out.Tags {
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		if out.NextToken == nil {
+			return tags, nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+func (d dynamoTableClient) UpdateTable(ctx context.Context, current, expected tableDescription) error {
+	input := &dynamodb.UpdateTableInput{
+		TableName: aws.String(expected.name),
+	}
+	if expected.onDemand {
+		if !current.onDemand {
+			input.BillingMode = aws.String(dynamodb.BillingModePayPerRequest)
+		}
+	} else if current.onDemand || current.provisionedRead != expected.provisionedRead || current.provisionedWrite != expected.provisionedWrite {
+		input.ProvisionedThroughput = &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(expected.provisionedRead),
+			WriteCapacityUnits: aws.Int64(expected.provisionedWrite),
+		}
+		if current.onDemand {
+			input.BillingMode = aws.String(dynamodb.BillingModeProvisioned)
+		}
+	}
+	if current.encrypted != expected.encrypted {
+		input.SSESpecification = &dynamodb.SSESpecification{Enabled: aws.Bool(expected.encrypted)}
+	}
+
+	if input.ProvisionedThroughput != nil || input.BillingMode != nil || input.SSESpecification != nil {
+		err := instrument.TimeRequestHistogram(ctx, "DynamoDB.UpdateTable", dynamoRequestDuration, func(ctx context.Context) error {
+			_, err := d.DynamoDB.UpdateTableWithContext(ctx, input)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	missing := current.tags.missing(expected.tags)
+	if len(missing) == 0 {
+		return nil
+	}
+	var arn string
+	err := instrument.TimeRequestHistogram(ctx, "DynamoDB.DescribeTable", dynamoRequestDuration, func(ctx context.Context) error {
+		out, err := d.DynamoDB.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+			TableName: aws.String(expected.name),
+		})
+		if err == nil && out.Table != nil {
+			arn = aws.StringValue(out.Table.TableArn)
+		}
 		return err
 	})
+	if err != nil {
+		return err
+	}
+	err = instrument.TimeRequestHistogram(ctx, "DynamoDB.TagResource", dynamoRequestDuration, func(ctx context.Context) error {
+		_, err := d.DynamoDB.TagResourceWithContext(ctx, &dynamodb.TagResourceInput{
+			ResourceArn: aws.String(arn),
+			Tags:        missing.dynamoTags(),
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	tags := current.tags.copy()
+	for k, v := range missing {
+		tags[k] = v
+	}
+	d.tagsMtx.Lock()
+	d.tags[expected.name] = tags
+	d.tagsMtx.Unlock()
+	return nil
+}
+
+func (t Tags) dynamoTags() []*dynamodb.Tag {
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := make([]*dynamodb.Tag, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, &dynamodb.Tag{
+			Key:   aws.String(k),
+			Value: aws.String(t[k]),
+		})
+	}
+	return result
 }
 
 func nextBackoff(lastBackoff time.Duration) time.Duration {
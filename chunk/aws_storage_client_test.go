@@ -2,13 +2,19 @@ package chunk
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
 	"github.com/stretchr/testify/assert"
@@ -73,6 +79,19 @@ func (m *mockDynamoDBClient) BatchWriteItem(input *dynamodb.BatchWriteItemInput)
 				continue
 			}
 
+			if writeRequest.DeleteRequest != nil {
+				hashValue := *writeRequest.DeleteRequest.Key[hashKey].S
+				rangeValue := writeRequest.DeleteRequest.Key[rangeKey].B
+				items := table.items[hashValue]
+				for i := range items {
+					if bytes.Equal(items[i][rangeKey].B, rangeValue) {
+						table.items[hashValue] = append(items[:i], items[i+1:]...)
+						break
+					}
+				}
+				continue
+			}
+
 			hashValue := *writeRequest.PutRequest.Item[hashKey].S
 			rangeValue := writeRequest.PutRequest.Item[rangeKey].B
 
@@ -134,6 +153,62 @@ func (m *dynamoDBMockRequest) HasNextPage() bool {
 	return false
 }
 
+// ScanWithContext returns pages of up to mockDynamoDBScanPageSize items, in
+// hash then range order.  The only filter it understands is the hash prefix
+// ScanTable asks for; like DynamoDB's, it is applied after paging.
+func (m *mockDynamoDBClient) ScanWithContext(_ aws.Context, input *dynamodb.ScanInput, _ ...request.Option) (*dynamodb.ScanOutput, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+
+	table, ok := m.tables[*input.TableName]
+	if !ok {
+		return nil, fmt.Errorf("table not found")
+	}
+	var hashValues []string
+	for hashValue := range table.items {
+		hashValues = append(hashValues, hashValue)
+	}
+	sort.Strings(hashValues)
+
+	prefix := ""
+	if input.FilterExpression != nil {
+		prefix = *input.ExpressionAttributeValues[":prefix"].S
+	}
+
+	// The start key may have been deleted since, so paging carries on from
+	// the first item after it.
+	after := func(hashValue string, rangeValue []byte) bool {
+		if input.ExclusiveStartKey == nil {
+			return true
+		}
+		startHash := *input.ExclusiveStartKey[hashKey].S
+		return hashValue > startHash || hashValue == startHash && bytes.Compare(rangeValue, input.ExclusiveStartKey[rangeKey].B) > 0
+	}
+
+	output := &dynamodb.ScanOutput{}
+	var last map[string]*dynamodb.AttributeValue
+	scanned := 0
+	for _, hashValue := range hashValues {
+		for _, item := range table.items[hashValue] {
+			if !after(hashValue, item[rangeKey].B) {
+				continue
+			}
+			if scanned == mockDynamoDBScanPageSize {
+				output.LastEvaluatedKey = map[string]*dynamodb.AttributeValue{hashKey: last[hashKey], rangeKey: last[rangeKey]}
+				return output, nil
+			}
+			last = item
+			scanned++
+			if strings.HasPrefix(hashValue, prefix) {
+				output.Items = append(output.Items, item)
+			}
+		}
+	}
+	return output, nil
+}
+
+const mockDynamoDBScanPageSize = 7
+
 func TestDynamoDBClient(t *testing.T) {
 	dynamoDB := newMockDynamoDB(0, 0)
 	client := awsStorageClient{
@@ -168,6 +243,34 @@ func TestDynamoDBClient(t *testing.T) {
 			{RangeValue: []byte(fmt.Sprintf("range%d", i))},
 		}, have)
 	}
+
+	batch = client.NewWriteBatch()
+	for i := 0; i < 10; i++ {
+		batch.Delete("table", fmt.Sprintf("hash%d", i), []byte(fmt.Sprintf("range%d", i)))
+	}
+	require.NoError(t, client.BatchWrite(context.Background(), batch))
+
+	scanned := map[string]string{}
+	require.NoError(t, client.ScanTable(context.Background(), "table", "", func(entry IndexEntry) bool {
+		assert.Equal(t, "table", entry.TableName)
+		scanned[entry.HashValue] = string(entry.RangeValue)
+		return true
+	}))
+	require.Len(t, scanned, 20)
+	for i := 10; i < 30; i++ {
+		assert.Equal(t, fmt.Sprintf("range%d", i), scanned[fmt.Sprintf("hash%d", i)])
+	}
+
+	// hash2, hash20 ... hash29, across several pages.
+	scanned = map[string]string{}
+	require.NoError(t, client.ScanTable(context.Background(), "table", "hash2", func(entry IndexEntry) bool {
+		scanned[entry.HashValue] = string(entry.RangeValue)
+		return true
+	}))
+	assert.Len(t, scanned, 10)
+	for hashValue := range scanned {
+		assert.True(t, strings.HasPrefix(hashValue, "hash2"), hashValue)
+	}
 }
 
 func TestAWSConfigFromURL(t *testing.T) {
@@ -249,3 +352,94 @@ func TestAWSConfigFromURL(t *testing.T) {
 		}
 	}
 }
+
+func TestDynamoTableClientBillingEncryptionAndTags(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		requests = map[string][]map[string]interface{}{}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+		body := map[string]interface{}{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		mtx.Lock()
+		requests[operation] = append(requests[operation], body)
+		mtx.Unlock()
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		switch operation {
+		case "DescribeTable":
+			fmt.Fprint(w, `{"Table":{"TableName":"table","TableStatus":"ACTIVE","TableArn":"arn:table",
+				"ProvisionedThroughput":{"ReadCapacityUnits":0,"WriteCapacityUnits":0},
+				"BillingModeSummary":{"BillingMode":"PAY_PER_REQUEST"},
+				"SSEDescription":{"Status":"ENABLED"}}}`)
+		case "ListTagsOfResource":
+			if body["NextToken"] == nil {
+				fmt.Fprint(w, `{"Tags":[{"Key":"team","Value":"cortex"}],"NextToken":"more"}`)
+			} else {
+				fmt.Fprint(w, `{"Tags":[{"Key":"owner","Value":"someone"}]}`)
+			}
+		default:
+			fmt.Fprint(w, `{}`)
+		}
+	}))
+	defer server.Close()
+
+	u, err := url.Parse("http://id:secret@" + strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	dynamoDB, err := dynamoClientFromURL(u)
+	require.NoError(t, err)
+	client := dynamoTableClient{DynamoDB: dynamoDB, tagsMtx: &sync.Mutex{}, tags: map[string]Tags{}}
+	ctx := context.Background()
+
+	require.NoError(t, client.CreateTable(ctx, tableDescription{
+		name:      "table",
+		onDemand:  true,
+		encrypted: true,
+		tags:      Tags{"team": "cortex"},
+	}))
+	create := requests["CreateTable"][0]
+	assert.Equal(t, "table", create["TableName"])
+	assert.Equal(t, "PAY_PER_REQUEST", create["BillingMode"])
+	assert.NotContains(t, create, "ProvisionedThroughput")
+	assert.Equal(t, map[string]interface{}{"Enabled": true}, create["SSESpecification"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"Key": "team", "Value": "cortex"}}, create["Tags"])
+	assert.Len(t, create["KeySchema"], 2)
+
+	desc, status, err := client.DescribeTable(ctx, "table")
+	require.NoError(t, err)
+	assert.Equal(t, "ACTIVE", status)
+	assert.Equal(t, tableDescription{
+		name:      "table",
+		onDemand:  true,
+		encrypted: true,
+		tags:      Tags{"team": "cortex", "owner": "someone"},
+	}, desc)
+	assert.Equal(t, "arn:table", requests["ListTagsOfResource"][0]["ResourceArn"])
+
+	// The tags are only listed the first time.
+	_, _, err = client.DescribeTable(ctx, "table")
+	require.NoError(t, err)
+	assert.Len(t, requests["ListTagsOfResource"], 2)
+
+	require.NoError(t, client.UpdateTable(ctx, desc, tableDescription{
+		name:             "table",
+		provisionedRead:  10,
+		provisionedWrite: 20,
+		tags:             Tags{"team": "cortex", "env": "prod"},
+	}))
+	update := requests["UpdateTable"][0]
+	assert.Equal(t, "PROVISIONED", update["BillingMode"])
+	assert.Equal(t, map[string]interface{}{"ReadCapacityUnits": float64(10), "WriteCapacityUnits": float64(20)}, update["ProvisionedThroughput"])
+	assert.Equal(t, map[string]interface{}{"Enabled": false}, update["SSESpecification"])
+	assert.Equal(t, map[string]interface{}{
+		"ResourceArn": "arn:table",
+		"Tags":        []interface{}{map[string]interface{}{"Key": "env", "Value": "prod"}},
+	}, requests["TagResource"][0])
+
+	// The tags just set are remembered.
+	desc, _, err = client.DescribeTable(ctx, "table")
+	require.NoError(t, err)
+	assert.Equal(t, Tags{"team": "cortex", "owner": "someone", "env": "prod"}, desc.tags)
+	assert.Len(t, requests["ListTagsOfResource"], 2)
+}
@@ -90,3 +90,69 @@ func nWayIntersect(sets []ByKey) ByKey {
 		return nWayIntersect([]ByKey{left, right})
 	}
 }
+
+// uniqueStrings will remove duplicates from the sorted input.
+func uniqueStrings(ss []string) []string {
+	if len(ss) == 0 {
+		return nil
+	}
+
+	result := make([]string, 1, len(ss))
+	result[0] = ss[0]
+	for _, s := range ss[1:] {
+		if result[len(result)-1] != s {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// mergeStrings will merge & dedupe two sorted lists of strings.
+func mergeStrings(a, b []string) []string {
+	result := make([]string, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] < b[j] {
+			result = append(result, a[i])
+			i++
+		} else if a[i] > b[j] {
+			result = append(result, b[j])
+			j++
+		} else {
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	result = append(result, b[j:]...)
+	return result
+}
+
+// nWayIntersectStrings will intersect n sorted lists of strings.
+func nWayIntersectStrings(sets [][]string) []string {
+	if len(sets) == 0 {
+		return nil
+	}
+
+	result := sets[0]
+	for _, set := range sets[1:] {
+		var (
+			i, j         = 0, 0
+			intersection = []string{}
+		)
+		for i < len(result) && j < len(set) {
+			if result[i] == set[j] {
+				intersection = append(intersection, result[i])
+				i++
+				j++
+			} else if result[i] < set[j] {
+				i++
+			} else {
+				j++
+			}
+		}
+		result = intersection
+	}
+	return result
+}
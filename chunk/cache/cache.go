@@ -0,0 +1,64 @@
+// Package cache provides the caches used by the chunk store: an in-process
+// LRU, memcached and Redis, which can be composed into tiers.
+package cache
+
+import (
+	"flag"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Cache byte arrays by key.
+type Cache interface {
+	// Fetch returns the values of the keys which were found.  An error means
+	// the cache as a whole couldn't be read.
+	Fetch(ctx context.Context, keys []string) (map[string][]byte, error)
+
+	// Store the values of the keys, for expiration; zero means until
+	// evicted.  Caches store the batch in as few requests as they can.
+	Store(ctx context.Context, keys []string, bufs [][]byte, expiration time.Duration) error
+
+	Stop()
+}
+
+// Config for building Caches.
+type Config struct {
+	LRUSizeBytes       int
+	BackfillExpiration time.Duration
+
+	Memcache MemcacheConfig
+	Redis    RedisConfig
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.LRUSizeBytes, "cache.lru-size-bytes", 0, "Size in bytes of the in-process LRU cache, which sits in front of memcached and Redis (0 = disabled).")
+	f.DurationVar(&cfg.BackfillExpiration, "cache.backfill-expiration", 5*time.Minute, "How long values found in memcached or Redis are kept in the caches in front of them; should not exceed -memcache.index-cache-validity.")
+	cfg.Memcache.RegisterFlags(f)
+	cfg.Redis.RegisterFlags(f)
+}
+
+// New makes the configured caches, fastest first, as tiers of one Cache.  It
+// returns nil if no cache is configured.
+func New(cfg Config) Cache {
+	var tiers []Cache
+	if cfg.LRUSizeBytes > 0 {
+		tiers = append(tiers, Instrument("lru", NewLRU(cfg.LRUSizeBytes)))
+	}
+	if cfg.Memcache.Host != "" {
+		tiers = append(tiers, Instrument("memcached", NewMemcached(NewMemcacheClient(cfg.Memcache))))
+	}
+	if cfg.Redis.Endpoint != "" {
+		tiers = append(tiers, Instrument("redis", NewRedis(cfg.Redis)))
+	}
+
+	switch len(tiers) {
+	case 0:
+		return nil
+	case 1:
+		return tiers[0]
+	default:
+		return NewTiered(tiers, cfg.BackfillExpiration)
+	}
+}
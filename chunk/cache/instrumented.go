@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "cache_requests_total",
+		Help:      "Total count of keys requested from each cache.",
+	}, []string{"name"})
+
+	hits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "cache_hits_total",
+		Help:      "Total count of keys found in each cache.",
+	}, []string{"name"})
+)
+
+func init() {
+	prometheus.MustRegister(requests)
+	prometheus.MustRegister(hits)
+}
+
+type instrumented struct {
+	Cache
+	requests, hits prometheus.Counter
+}
+
+// Instrument counts the keys requested from and found in c, labelled with
+// name.
+func Instrument(name string, c Cache) Cache {
+	return &instrumented{
+		Cache:    c,
+		requests: requests.WithLabelValues(name),
+		hits:     hits.WithLabelValues(name),
+	}
+}
+
+func (i *instrumented) Fetch(ctx context.Context, keys []string) (map[string][]byte, error) {
+	i.requests.Add(float64(len(keys)))
+	found, err := i.Cache.Fetch(ctx, keys)
+	i.hits.Add(float64(len(found)))
+	return found, err
+}
@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// lru is an in-process Cache holding at most maxSizeBytes of keys and values,
+// evicting the least recently used.
+type lru struct {
+	mtx          sync.Mutex
+	maxSizeBytes int
+	sizeBytes    int
+	entries      map[string]*list.Element
+	order        *list.List // Most recently used at the front.
+}
+
+type lruEntry struct {
+	key     string
+	buf     []byte
+	expires time.Time
+}
+
+func (e *lruEntry) size() int {
+	return len(e.key) + len(e.buf)
+}
+
+// NewLRU makes a new in-process Cache of at most maxSizeBytes.
+func NewLRU(maxSizeBytes int) Cache {
+	return &lru{
+		maxSizeBytes: maxSizeBytes,
+		entries:      map[string]*list.Element{},
+		order:        list.New(),
+	}
+}
+
+func (c *lru) Fetch(_ context.Context, keys []string) (map[string][]byte, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	now := time.Now()
+	found := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		elem, ok := c.entries[key]
+		if !ok {
+			continue
+		}
+		entry := elem.Value.(*lruEntry)
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			c.remove(elem)
+			continue
+		}
+		c.order.MoveToFront(elem)
+		found[key] = entry.buf
+	}
+	return found, nil
+}
+
+func (c *lru) Store(_ context.Context, keys []string, bufs [][]byte, expiration time.Duration) error {
+	var expires time.Time
+	if expiration > 0 {
+		expires = time.Now().Add(expiration)
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for i := range keys {
+		c.store(&lruEntry{key: keys[i], buf: bufs[i], expires: expires})
+	}
+	return nil
+}
+
+// store adds the entry, evicting others to make room.  The caller must hold
+// c.mtx.
+func (c *lru) store(entry *lruEntry) {
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	// Values which would evict everything else aren't worth caching.
+	if entry.size() > c.maxSizeBytes {
+		return
+	}
+	for c.sizeBytes+entry.size() > c.maxSizeBytes {
+		c.remove(c.order.Back())
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.sizeBytes += entry.size()
+}
+
+func (c *lru) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*lruEntry)
+	delete(c.entries, entry.key)
+	c.sizeBytes -= entry.size()
+}
+
+func (c *lru) Stop() {}
@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestLRU(t *testing.T) {
+	ctx := context.Background()
+	// Room for three 10 byte entries: 2 byte keys, 8 byte values.
+	c := NewLRU(30)
+
+	store := func(key string) {
+		require.NoError(t, c.Store(ctx, []string{key}, [][]byte{[]byte(fmt.Sprintf("value-%s", key))}, 0))
+	}
+	fetch := func(keys ...string) []string {
+		found, err := c.Fetch(ctx, keys)
+		require.NoError(t, err)
+		result := []string{}
+		for _, key := range keys {
+			if buf, ok := found[key]; ok {
+				assert.Equal(t, fmt.Sprintf("value-%s", key), string(buf))
+				result = append(result, key)
+			}
+		}
+		return result
+	}
+
+	store("k1")
+	store("k2")
+	store("k3")
+	assert.Equal(t, []string{"k1", "k2", "k3"}, fetch("k1", "k2", "k3", "k4"))
+
+	// k1 was used least recently, so is evicted first.
+	store("k4")
+	assert.Equal(t, []string{"k2", "k3", "k4"}, fetch("k1", "k2", "k3", "k4"))
+
+	// Using k2 keeps it, so k3 goes next.
+	fetch("k2")
+	store("k5")
+	assert.Equal(t, []string{"k2", "k4", "k5"}, fetch("k2", "k3", "k4", "k5"))
+
+	// Overwriting an entry doesn't count it twice.
+	store("k5")
+	assert.Equal(t, []string{"k2", "k4", "k5"}, fetch("k2", "k4", "k5"))
+
+	// Values bigger than the whole cache aren't stored, and evict nothing.
+	require.NoError(t, c.Store(ctx, []string{"big"}, [][]byte{make([]byte, 31)}, 0))
+	assert.Equal(t, []string{"k2", "k4", "k5"}, fetch("big", "k2", "k4", "k5"))
+}
+
+func TestLRUExpiration(t *testing.T) {
+	ctx := context.Background()
+	c := NewLRU(100)
+
+	require.NoError(t, c.Store(ctx, []string{"short"}, [][]byte{[]byte("a")}, time.Millisecond))
+	require.NoError(t, c.Store(ctx, []string{"forever"}, [][]byte{[]byte("b")}, 0))
+	time.Sleep(5 * time.Millisecond)
+
+	found, err := c.Fetch(ctx, []string{"short", "forever"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"forever": []byte("b")}, found)
+	assert.Equal(t, len("forever")+1, c.(*lru).sizeBytes)
+}
@@ -0,0 +1,263 @@
+package cache
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+var memcacheServerRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "cortex",
+	Name:      "memcache_server_request_duration_seconds",
+	Help:      "Time spent in seconds doing requests to each memcache server.",
+	Buckets:   prometheus.ExponentialBuckets(0.000016, 4, 8),
+}, []string{"server", "method", "status_code"})
+
+func init() {
+	prometheus.MustRegister(memcacheServerRequestDuration)
+}
+
+// MemcacheClient is a memcache client that gets its server list from SRV
+// records, and periodically updates that server list.  Keys are spread over
+// the servers by consistent hashing.
+type MemcacheClient struct {
+	*memcache.Client
+	selector    *ketamaSelector
+	hostname    string
+	service     string
+	batchSize   int
+	parallelism int
+
+	quit chan struct{}
+	wait sync.WaitGroup
+}
+
+// MemcacheConfig defines how a MemcacheClient should be constructed.
+type MemcacheConfig struct {
+	Host           string
+	Service        string
+	Timeout        time.Duration
+	UpdateInterval time.Duration
+
+	BatchSize   int
+	Parallelism int
+
+	EjectAfterTimeouts int
+	EjectionDuration   time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *MemcacheConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Host, "memcached.hostname", "", "Hostname for memcached service to use when caching chunks. If empty, no memcached will be used.")
+	f.StringVar(&cfg.Service, "memcached.service", "memcached", "SRV service used to discover memcache servers.")
+	f.DurationVar(&cfg.Timeout, "memcached.timeout", 100*time.Millisecond, "Maximum time to wait before giving up on memcached requests.")
+	f.DurationVar(&cfg.UpdateInterval, "memcached.update-interval", 1*time.Minute, "Period with which to poll DNS for memcache servers.")
+	f.IntVar(&cfg.BatchSize, "memcached.batch-size", 1024, "Maximum number of keys to fetch from one memcached server per request.")
+	f.IntVar(&cfg.Parallelism, "memcached.parallelism", 100, "Maximum number of requests to memcached servers in flight for one fetch or store.")
+	f.IntVar(&cfg.EjectAfterTimeouts, "memcached.eject-after-timeouts", 3, "Eject a memcached server after this many consecutive timeouts (0 = never).")
+	f.DurationVar(&cfg.EjectionDuration, "memcached.ejection-duration", 30*time.Second, "How long an ejected memcached server's keys go to the next server.")
+}
+
+// NewMemcacheClient creates a new MemcacheClient that gets its server list
+// from SRV and updates the server list on a regular basis.
+func NewMemcacheClient(cfg MemcacheConfig) *MemcacheClient {
+	selector := newKetamaSelector(cfg.EjectAfterTimeouts, cfg.EjectionDuration)
+	client := memcache.NewFromSelector(selector)
+	client.Timeout = cfg.Timeout
+
+	newClient := &MemcacheClient{
+		Client:      client,
+		selector:    selector,
+		hostname:    cfg.Host,
+		service:     cfg.Service,
+		batchSize:   cfg.BatchSize,
+		parallelism: cfg.Parallelism,
+		quit:        make(chan struct{}),
+	}
+	err := newClient.updateMemcacheServers()
+	if err != nil {
+		log.Errorf("Error setting memcache servers to '%v': %v", cfg.Host, err)
+	}
+
+	newClient.wait.Add(1)
+	go newClient.updateLoop(cfg.UpdateInterval)
+	return newClient
+}
+
+// Stop the memcache client.
+func (c *MemcacheClient) Stop() {
+	close(c.quit)
+	c.wait.Wait()
+}
+
+func (c *MemcacheClient) updateLoop(updateInterval time.Duration) error {
+	defer c.wait.Done()
+	ticker := time.NewTicker(updateInterval)
+	var err error
+	for {
+		select {
+		case <-ticker.C:
+			err = c.updateMemcacheServers()
+			if err != nil {
+				log.Warnf("Error updating memcache servers: %v", err)
+			}
+		case <-c.quit:
+			ticker.Stop()
+			return nil
+		}
+	}
+}
+
+// updateMemcacheServers sets a memcache server list from SRV records. SRV
+// priority & weight are ignored.
+func (c *MemcacheClient) updateMemcacheServers() error {
+	_, addrs, err := net.LookupSRV(c.service, "tcp", c.hostname)
+	if err != nil {
+		return err
+	}
+	var servers []string
+	for _, srv := range addrs {
+		servers = append(servers, fmt.Sprintf("%s:%d", srv.Target, srv.Port))
+	}
+	// The ring doesn't depend on the order of the servers, but sorting keeps
+	// Each's order stable.
+	sort.Strings(servers)
+	return c.selector.SetServers(servers...)
+}
+
+// GetMulti looks the keys up in batches of at most batchSize keys per server,
+// with at most parallelism requests in flight.  A server failing only makes
+// its keys miss; an error is returned if every request failed.
+func (c *MemcacheClient) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	byServer := map[net.Addr][]string{}
+	for _, key := range keys {
+		addr, err := c.selector.PickServer(key)
+		if err != nil {
+			return nil, err
+		}
+		byServer[addr] = append(byServer[addr], key)
+	}
+
+	type batch struct {
+		addr net.Addr
+		keys []string
+	}
+	var batches []batch
+	for addr, keys := range byServer {
+		for len(keys) > 0 {
+			n := len(keys)
+			if c.batchSize > 0 && n > c.batchSize {
+				n = c.batchSize
+			}
+			batches = append(batches, batch{addr: addr, keys: keys[:n]})
+			keys = keys[n:]
+		}
+	}
+
+	var (
+		mtx     sync.Mutex
+		result  = make(map[string]*memcache.Item, len(keys))
+		lastErr error
+		failed  int
+	)
+	c.parallel(len(batches), func(i int) {
+		b := batches[i]
+		var items map[string]*memcache.Item
+		err := c.timeServer(b.addr, "GetMulti", func() error {
+			var err error
+			items, err = c.Client.GetMulti(b.keys)
+			return err
+		})
+
+		mtx.Lock()
+		defer mtx.Unlock()
+		for key, item := range items {
+			result[key] = item
+		}
+		if err != nil {
+			lastErr = err
+			failed++
+		}
+	})
+
+	if failed > 0 && failed == len(batches) {
+		return nil, lastErr
+	}
+	if lastErr != nil {
+		log.Warnf("Error fetching %d of %d batches from memcache: %v", failed, len(batches), lastErr)
+	}
+	return result, nil
+}
+
+// Set stores item on the server its key hashes to.
+func (c *MemcacheClient) Set(item *memcache.Item) error {
+	addr, err := c.selector.PickServer(item.Key)
+	if err != nil {
+		return err
+	}
+	return c.timeServer(addr, "Set", func() error {
+		return c.Client.Set(item)
+	})
+}
+
+// SetMulti stores the items, each on the server its key hashes to, with at
+// most parallelism requests in flight, as memcached has no multi-key set.  It
+// returns the last error.
+func (c *MemcacheClient) SetMulti(items []*memcache.Item) error {
+	var (
+		mtx     sync.Mutex
+		lastErr error
+	)
+	c.parallel(len(items), func(i int) {
+		if err := c.Set(items[i]); err != nil {
+			mtx.Lock()
+			lastErr = err
+			mtx.Unlock()
+		}
+	})
+	return lastErr
+}
+
+// parallel calls f for each i in [0, n), with at most parallelism calls at
+// once.
+func (c *MemcacheClient) parallel(n int, f func(i int)) {
+	parallelism := c.parallelism
+	if parallelism <= 0 || parallelism > n {
+		parallelism = n
+	}
+	var (
+		wg   sync.WaitGroup
+		work = make(chan int)
+	)
+	wg.Add(parallelism)
+	for j := 0; j < parallelism; j++ {
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+}
+
+// timeServer records the duration and outcome of a request to addr, and
+// tells the selector whether it timed out.
+func (c *MemcacheClient) timeServer(addr net.Addr, method string, f func() error) error {
+	start := time.Now()
+	err := f()
+	memcacheServerRequestDuration.WithLabelValues(addr.String(), method, memcacheStatusCode(err)).Observe(time.Since(start).Seconds())
+	c.selector.observe(addr, err)
+	return err
+}
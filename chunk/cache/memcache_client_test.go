@@ -0,0 +1,218 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKetamaSelectorRemapping(t *testing.T) {
+	servers := []string{}
+	for i := 0; i < 10; i++ {
+		servers = append(servers, fmt.Sprintf("127.0.0.%d:11211", i+1))
+	}
+	pick := func(s *ketamaSelector, key string) string {
+		addr, err := s.PickServer(key)
+		require.NoError(t, err)
+		return addr.String()
+	}
+
+	before, after := newKetamaSelector(0, 0), newKetamaSelector(0, 0)
+	require.NoError(t, before.SetServers(servers...))
+	require.NoError(t, after.SetServers(servers[1:]...))
+
+	// Only the keys of the removed server move, and they spread over the rest.
+	const numKeys = 10000
+	moved, used := 0, map[string]bool{}
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("key%d", i)
+		from, to := pick(before, key), pick(after, key)
+		used[from] = true
+		if from != to {
+			assert.Equal(t, servers[0], from)
+			moved++
+		}
+	}
+	assert.Len(t, used, len(servers))
+	assert.InDelta(t, numKeys/len(servers), moved, float64(numKeys/len(servers)/2))
+}
+
+func TestKetamaSelectorEjection(t *testing.T) {
+	s := newKetamaSelector(2, 50*time.Millisecond)
+	require.NoError(t, s.SetServers("127.0.0.1:11211", "127.0.0.2:11211"))
+
+	addr, err := s.PickServer("key")
+	require.NoError(t, err)
+	timeout := &memcache.ConnectTimeoutError{Addr: addr}
+
+	// A success resets the count of consecutive timeouts.
+	s.observe(addr, timeout)
+	s.observe(addr, nil)
+	s.observe(addr, timeout)
+	same, err := s.PickServer("key")
+	require.NoError(t, err)
+	assert.Equal(t, addr, same)
+
+	s.observe(addr, timeout)
+	other, err := s.PickServer("key")
+	require.NoError(t, err)
+	assert.NotEqual(t, addr.String(), other.String())
+
+	// With every server ejected, there is nowhere to send keys.
+	s.observe(other, timeout)
+	s.observe(other, timeout)
+	_, err = s.PickServer("key")
+	assert.Equal(t, memcache.ErrNoServers, err)
+
+	time.Sleep(100 * time.Millisecond)
+	back, err := s.PickServer("key")
+	require.NoError(t, err)
+	assert.Equal(t, addr, back)
+}
+
+// fakeMemcached serves gets and sets over the memcache text protocol,
+// recording how many keys each get asked for.
+type fakeMemcached struct {
+	listener net.Listener
+
+	mtx      sync.Mutex
+	contents map[string]string
+	gets     []int
+}
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	m := &fakeMemcached{
+		listener: listener,
+		contents: map[string]string{},
+	}
+	go m.serve()
+	return m
+}
+
+func (m *fakeMemcached) serve() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		go m.handle(conn)
+	}
+}
+
+func (m *fakeMemcached) handle(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return
+		}
+
+		m.mtx.Lock()
+		switch fields[0] {
+		case "gets":
+			m.gets = append(m.gets, len(fields)-1)
+			for _, key := range fields[1:] {
+				if value, ok := m.contents[key]; ok {
+					fmt.Fprintf(rw, "VALUE %s 0 %d 0\r\n%s\r\n", key, len(value), value)
+				}
+			}
+			fmt.Fprintf(rw, "END\r\n")
+		case "set":
+			var size int
+			fmt.Sscanf(fields[4], "%d", &size)
+			buf := make([]byte, size+2)
+			if _, err := io.ReadFull(rw, buf); err != nil {
+				m.mtx.Unlock()
+				return
+			}
+			m.contents[fields[1]] = string(buf[:size])
+			fmt.Fprintf(rw, "STORED\r\n")
+		}
+		m.mtx.Unlock()
+		rw.Flush()
+	}
+}
+
+func TestMemcacheClientGetMultiBatches(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.listener.Close()
+
+	selector := newKetamaSelector(0, 0)
+	require.NoError(t, selector.SetServers(server.listener.Addr().String()))
+	client := memcache.NewFromSelector(selector)
+	client.Timeout = time.Second
+	c := &MemcacheClient{
+		Client:      client,
+		selector:    selector,
+		batchSize:   3,
+		parallelism: 2,
+	}
+
+	keys := []string{}
+	for i := 0; i < 8; i++ {
+		key := fmt.Sprintf("key%d", i)
+		keys = append(keys, key)
+		require.NoError(t, c.Set(&memcache.Item{Key: key, Value: []byte(key)}))
+	}
+
+	items, err := c.GetMulti(append(keys, "missing"))
+	require.NoError(t, err)
+	assert.Len(t, items, len(keys))
+	for _, key := range keys {
+		assert.Equal(t, key, string(items[key].Value))
+	}
+	// 9 keys in batches of at most 3.
+	total := 0
+	for _, n := range server.gets {
+		assert.True(t, n <= 3, "%d keys in one request", n)
+		total += n
+	}
+	assert.Equal(t, 9, total)
+	assert.Len(t, server.gets, 3)
+}
+
+func TestMemcacheClientSetMulti(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.listener.Close()
+
+	selector := newKetamaSelector(0, 0)
+	require.NoError(t, selector.SetServers(server.listener.Addr().String()))
+	client := memcache.NewFromSelector(selector)
+	client.Timeout = time.Second
+	c := &MemcacheClient{
+		Client:      client,
+		selector:    selector,
+		parallelism: 2,
+	}
+
+	items := []*memcache.Item{}
+	for i := 0; i < 8; i++ {
+		key := fmt.Sprintf("key%d", i)
+		items = append(items, &memcache.Item{Key: key, Value: []byte(key)})
+	}
+	require.NoError(t, c.SetMulti(items))
+	require.NoError(t, c.SetMulti(nil))
+
+	server.mtx.Lock()
+	defer server.mtx.Unlock()
+	assert.Len(t, server.contents, len(items))
+	for _, item := range items {
+		assert.Equal(t, item.Key, server.contents[item.Key])
+	}
+}
@@ -0,0 +1,202 @@
+package cache
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Each server gets ketamaPointsPerHash points on the ring for each of
+// ketamaHashesPerServer hashes, as in libketama.
+const (
+	ketamaHashesPerServer = 40
+	ketamaPointsPerHash   = 4
+)
+
+var memcacheServerEjections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "memcache_server_ejections_total",
+	Help:      "Total count of times a memcache server was ejected for timing out.",
+}, []string{"server"})
+
+func init() {
+	prometheus.MustRegister(memcacheServerEjections)
+}
+
+// ketamaSelector is a memcache.ServerSelector which places servers on a hash
+// ring, so that changing the server list only remaps the keys of the servers
+// added or removed.  Servers which keep timing out are ejected for a while,
+// their keys going to the next server on the ring.
+type ketamaSelector struct {
+	ejectAfterTimeouts int
+	ejectionDuration   time.Duration
+
+	mtx      sync.RWMutex
+	ring     []ringPoint // Sorted by hash.
+	addrs    []net.Addr
+	timeouts map[string]int
+	ejected  map[string]time.Time // Ejected servers, and when they come back.
+}
+
+type ringPoint struct {
+	hash uint32
+	addr net.Addr
+}
+
+type byHash []ringPoint
+
+func (r byHash) Len() int           { return len(r) }
+func (r byHash) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byHash) Less(i, j int) bool { return r[i].hash < r[j].hash }
+
+func newKetamaSelector(ejectAfterTimeouts int, ejectionDuration time.Duration) *ketamaSelector {
+	return &ketamaSelector{
+		ejectAfterTimeouts: ejectAfterTimeouts,
+		ejectionDuration:   ejectionDuration,
+		timeouts:           map[string]int{},
+		ejected:            map[string]time.Time{},
+	}
+}
+
+// staticAddr caches the Network() and String() of an address, as
+// memcache.ServerList does.
+type staticAddr struct {
+	network, str string
+}
+
+func (a *staticAddr) Network() string { return a.network }
+func (a *staticAddr) String() string  { return a.str }
+
+func resolveServer(server string) (net.Addr, error) {
+	if strings.Contains(server, "/") {
+		addr, err := net.ResolveUnixAddr("unix", server)
+		if err != nil {
+			return nil, err
+		}
+		return &staticAddr{addr.Network(), addr.String()}, nil
+	}
+	addr, err := net.ResolveTCPAddr("tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	return &staticAddr{addr.Network(), addr.String()}, nil
+}
+
+// SetServers replaces the servers on the ring.  Ejections of servers which
+// remain are kept.
+func (s *ketamaSelector) SetServers(servers ...string) error {
+	addrs := make([]net.Addr, 0, len(servers))
+	ring := make([]ringPoint, 0, len(servers)*ketamaHashesPerServer*ketamaPointsPerHash)
+	for _, server := range servers {
+		addr, err := resolveServer(server)
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+		for i := 0; i < ketamaHashesPerServer; i++ {
+			digest := md5.Sum([]byte(server + "-" + strconv.Itoa(i)))
+			for j := 0; j < ketamaPointsPerHash; j++ {
+				ring = append(ring, ringPoint{
+					hash: binary.LittleEndian.Uint32(digest[j*4:]),
+					addr: addr,
+				})
+			}
+		}
+	}
+	sort.Sort(byHash(ring))
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.ring = ring
+	s.addrs = addrs
+	current := map[string]bool{}
+	for _, addr := range addrs {
+		current[addr.String()] = true
+	}
+	for server := range s.ejected {
+		if !current[server] {
+			delete(s.ejected, server)
+		}
+	}
+	for server := range s.timeouts {
+		if !current[server] {
+			delete(s.timeouts, server)
+		}
+	}
+	return nil
+}
+
+func ketamaHash(key string) uint32 {
+	digest := md5.Sum([]byte(key))
+	return binary.LittleEndian.Uint32(digest[:4])
+}
+
+// PickServer returns the first server on the ring at or after the key's hash
+// which isn't ejected.
+func (s *ketamaSelector) PickServer(key string) (net.Addr, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	if len(s.ring) == 0 {
+		return nil, memcache.ErrNoServers
+	}
+
+	now := time.Now()
+	hash := ketamaHash(key)
+	start := sort.Search(len(s.ring), func(i int) bool {
+		return s.ring[i].hash >= hash
+	})
+	for i := 0; i < len(s.ring); i++ {
+		addr := s.ring[(start+i)%len(s.ring)].addr
+		if until, ok := s.ejected[addr.String()]; !ok || now.After(until) {
+			return addr, nil
+		}
+	}
+	return nil, memcache.ErrNoServers
+}
+
+// Each iterates over each server calling the given function
+func (s *ketamaSelector) Each(f func(net.Addr) error) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	for _, addr := range s.addrs {
+		if err := f(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isTimeout(err error) bool {
+	if _, ok := err.(*memcache.ConnectTimeoutError); ok {
+		return true
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// observe records the outcome of a request to addr, ejecting it after
+// ejectAfterTimeouts consecutive timeouts.
+func (s *ketamaSelector) observe(addr net.Addr, err error) {
+	server := addr.String()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !isTimeout(err) {
+		delete(s.timeouts, server)
+		return
+	}
+	s.timeouts[server]++
+	if s.ejectAfterTimeouts > 0 && s.timeouts[server] >= s.ejectAfterTimeouts {
+		delete(s.timeouts, server)
+		s.ejected[server] = time.Now().Add(s.ejectionDuration)
+		memcacheServerEjections.WithLabelValues(server).Inc()
+	}
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/instrument"
+)
+
+var memcacheRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "cortex",
+	Name:      "memcache_request_duration_seconds",
+	Help:      "Total time spent in seconds doing memcache requests.",
+	// Memecache requests are very quick: smallest bucket is 16us, biggest is 1s
+	Buckets: prometheus.ExponentialBuckets(0.000016, 4, 8),
+}, []string{"method", "status_code"})
+
+func init() {
+	prometheus.MustRegister(memcacheRequestDuration)
+}
+
+// Memcache caches things
+type Memcache interface {
+	GetMulti(keys []string) (map[string]*memcache.Item, error)
+	SetMulti(items []*memcache.Item) error
+}
+
+type memcached struct {
+	memcache Memcache
+}
+
+// NewMemcached makes a Cache backed by memcached.
+func NewMemcached(client Memcache) Cache {
+	return &memcached{
+		memcache: client,
+	}
+}
+
+func memcacheStatusCode(err error) string {
+	// See https://godoc.org/github.com/bradfitz/gomemcache/memcache#pkg-variables
+	switch err {
+	case nil:
+		return "200"
+	case memcache.ErrCacheMiss:
+		return "404"
+	case memcache.ErrMalformedKey:
+		return "400"
+	default:
+		return "500"
+	}
+}
+
+func (c *memcached) Fetch(ctx context.Context, keys []string) (map[string][]byte, error) {
+	var items map[string]*memcache.Item
+	err := instrument.TimeRequestHistogramStatus(ctx, "Memcache.Get", memcacheRequestDuration, memcacheStatusCode, func(_ context.Context) error {
+		var err error
+		items, err = c.memcache.GetMulti(keys)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string][]byte, len(items))
+	for key, item := range items {
+		found[key] = item.Value
+	}
+	return found, nil
+}
+
+func (c *memcached) Store(ctx context.Context, keys []string, bufs [][]byte, expiration time.Duration) error {
+	items := make([]*memcache.Item, 0, len(keys))
+	for i := range keys {
+		items = append(items, &memcache.Item{
+			Key:        keys[i],
+			Value:      bufs[i],
+			Expiration: int32(expiration.Seconds()),
+		})
+	}
+	return instrument.TimeRequestHistogramStatus(ctx, "Memcache.Put", memcacheRequestDuration, memcacheStatusCode, func(_ context.Context) error {
+		return c.memcache.SetMulti(items)
+	})
+}
+
+func (c *memcached) Stop() {
+	if client, ok := c.memcache.(interface {
+		Stop()
+	}); ok {
+		client.Stop()
+	}
+}
@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"flag"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/instrument"
+)
+
+var redisRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "cortex",
+	Name:      "redis_request_duration_seconds",
+	Help:      "Total time spent in seconds doing Redis requests.",
+	Buckets:   prometheus.ExponentialBuckets(0.000016, 4, 8),
+}, []string{"method", "status_code"})
+
+func init() {
+	prometheus.MustRegister(redisRequestDuration)
+}
+
+// RedisConfig defines how a Redis cache should be constructed.
+type RedisConfig struct {
+	Endpoint     string
+	Timeout      time.Duration
+	MaxIdleConns int
+	IdleTimeout  time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *RedisConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Endpoint, "redis.endpoint", "", "Host:port of the Redis server to use as a cache. If empty, no Redis will be used.")
+	f.DurationVar(&cfg.Timeout, "redis.timeout", 100*time.Millisecond, "Maximum time to wait before giving up on Redis requests.")
+	f.IntVar(&cfg.MaxIdleConns, "redis.max-idle-conns", 80, "Maximum number of idle connections to Redis to keep open.")
+	f.DurationVar(&cfg.IdleTimeout, "redis.idle-timeout", 5*time.Minute, "Close idle connections to Redis after this long.")
+}
+
+type redisCache struct {
+	pool *redis.Pool
+}
+
+// NewRedis makes a Cache backed by Redis.
+func NewRedis(cfg RedisConfig) Cache {
+	return &redisCache{
+		pool: &redis.Pool{
+			MaxIdle:     cfg.MaxIdleConns,
+			IdleTimeout: cfg.IdleTimeout,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", cfg.Endpoint,
+					redis.DialConnectTimeout(cfg.Timeout),
+					redis.DialReadTimeout(cfg.Timeout),
+					redis.DialWriteTimeout(cfg.Timeout))
+			},
+		},
+	}
+}
+
+func (c *redisCache) Fetch(ctx context.Context, keys []string) (map[string][]byte, error) {
+	// MGET with no keys is an error.
+	if len(keys) == 0 {
+		return map[string][]byte{}, nil
+	}
+
+	var values [][]byte
+	err := instrument.TimeRequestHistogram(ctx, "Redis.MGET", redisRequestDuration, func(_ context.Context) error {
+		conn := c.pool.Get()
+		defer conn.Close()
+
+		var err error
+		values, err = redis.ByteSlices(conn.Do("MGET", redis.Args{}.AddFlat(keys)...))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string][]byte, len(keys))
+	for i, value := range values {
+		// Missing keys come back as nil.
+		if value != nil {
+			found[keys[i]] = value
+		}
+	}
+	return found, nil
+}
+
+// Store pipelines a SET per key, as MSET can't set expirations.
+func (c *redisCache) Store(ctx context.Context, keys []string, bufs [][]byte, expiration time.Duration) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return instrument.TimeRequestHistogram(ctx, "Redis.SET", redisRequestDuration, func(_ context.Context) error {
+		conn := c.pool.Get()
+		defer conn.Close()
+		for i := range keys {
+			args := redis.Args{}.Add(keys[i], bufs[i])
+			if expiration > 0 {
+				args = args.Add("PX", int64(expiration/time.Millisecond))
+			}
+			if err := conn.Send("SET", args...); err != nil {
+				return err
+			}
+		}
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+		for range keys {
+			if _, err := conn.Receive(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *redisCache) Stop() {
+	c.pool.Close()
+}
@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestRedis(t *testing.T) {
+	ctx := context.Background()
+	server, err := miniredis.Run()
+	require.NoError(t, err)
+	defer server.Close()
+
+	c := NewRedis(RedisConfig{
+		Endpoint:     server.Addr(),
+		Timeout:      time.Second,
+		MaxIdleConns: 1,
+	})
+	defer c.Stop()
+
+	require.NoError(t, c.Store(ctx, []string{"forever"}, [][]byte{[]byte("a")}, 0))
+	require.NoError(t, c.Store(ctx, []string{"expiring", "expiring2"}, [][]byte{[]byte("b"), []byte("c")}, time.Minute))
+	assert.Equal(t, time.Duration(0), server.TTL("forever"))
+	assert.Equal(t, time.Minute, server.TTL("expiring"))
+	assert.Equal(t, time.Minute, server.TTL("expiring2"))
+
+	found, err := c.Fetch(ctx, []string{"forever", "expiring", "missing"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"forever": []byte("a"), "expiring": []byte("b")}, found)
+
+	// No keys is no request at all, as Redis rejects an empty MGET.
+	require.NoError(t, c.Store(ctx, nil, nil, 0))
+	found, err = c.Fetch(ctx, nil)
+	require.NoError(t, err)
+	assert.Empty(t, found)
+
+	server.FastForward(2 * time.Minute)
+	found, err = c.Fetch(ctx, []string{"forever", "expiring"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"forever": []byte("a")}, found)
+
+	// Errors are returned, so a tiered cache can skip Redis.
+	server.Close()
+	_, err = c.Fetch(ctx, []string{"forever"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+)
+
+// tiered looks keys up in each cache in turn, fastest first.
+type tiered struct {
+	tiers              []Cache
+	backfillExpiration time.Duration
+}
+
+// NewTiered makes a Cache from tiers, fastest first.  Values are stored in
+// every tier; values found in a slower tier are copied into the tiers in front
+// of it for backfillExpiration, as their original expiration isn't known.
+func NewTiered(tiers []Cache, backfillExpiration time.Duration) Cache {
+	return &tiered{
+		tiers:              tiers,
+		backfillExpiration: backfillExpiration,
+	}
+}
+
+// Fetch only fails if every tier does; a failing tier is skipped.
+func (t *tiered) Fetch(ctx context.Context, keys []string) (map[string][]byte, error) {
+	result := make(map[string][]byte, len(keys))
+	missing := keys
+	var lastErr error
+	failed := 0
+	for i, c := range t.tiers {
+		if len(missing) == 0 {
+			break
+		}
+
+		found, err := c.Fetch(ctx, missing)
+		if err != nil {
+			log.Warnf("Error fetching from cache tier %d: %v", i, err)
+			lastErr = err
+			failed++
+			continue
+		}
+
+		stillMissing := make([]string, 0, len(missing)-len(found))
+		foundKeys := make([]string, 0, len(found))
+		foundBufs := make([][]byte, 0, len(found))
+		for _, key := range missing {
+			buf, ok := found[key]
+			if !ok {
+				stillMissing = append(stillMissing, key)
+				continue
+			}
+			result[key] = buf
+			foundKeys = append(foundKeys, key)
+			foundBufs = append(foundBufs, buf)
+		}
+		if len(foundKeys) > 0 {
+			for _, faster := range t.tiers[:i] {
+				if err := faster.Store(ctx, foundKeys, foundBufs, t.backfillExpiration); err != nil {
+					log.Warnf("Error backfilling cache: %v", err)
+				}
+			}
+		}
+		missing = stillMissing
+	}
+
+	if failed == len(t.tiers) {
+		return nil, lastErr
+	}
+	return result, nil
+}
+
+// Store tries every tier, returning the last error.
+func (t *tiered) Store(ctx context.Context, keys []string, bufs [][]byte, expiration time.Duration) error {
+	var lastErr error
+	for _, c := range t.tiers {
+		if err := c.Store(ctx, keys, bufs, expiration); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (t *tiered) Stop() {
+	for _, c := range t.tiers {
+		c.Stop()
+	}
+}
@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// mockCache records how it is used, and can be made to fail.
+type mockCache struct {
+	Cache
+	fetched     []string
+	stored      map[string]time.Duration
+	failFetches bool
+}
+
+func newMockCache() *mockCache {
+	return &mockCache{
+		Cache:  NewLRU(1024),
+		stored: map[string]time.Duration{},
+	}
+}
+
+func (m *mockCache) Fetch(ctx context.Context, keys []string) (map[string][]byte, error) {
+	m.fetched = append(m.fetched, keys...)
+	if m.failFetches {
+		return nil, fmt.Errorf("fetch failed")
+	}
+	return m.Cache.Fetch(ctx, keys)
+}
+
+func (m *mockCache) Store(ctx context.Context, keys []string, bufs [][]byte, expiration time.Duration) error {
+	for _, key := range keys {
+		m.stored[key] = expiration
+	}
+	return m.Cache.Store(ctx, keys, bufs, expiration)
+}
+
+func TestTiered(t *testing.T) {
+	ctx := context.Background()
+	local, remote := newMockCache(), newMockCache()
+	c := NewTiered([]Cache{local, remote}, time.Minute)
+
+	// Stores go to every tier.
+	require.NoError(t, c.Store(ctx, []string{"both"}, [][]byte{[]byte("both")}, time.Hour))
+	assert.Equal(t, map[string]time.Duration{"both": time.Hour}, local.stored)
+	assert.Equal(t, map[string]time.Duration{"both": time.Hour}, remote.stored)
+
+	// Keys found in the first tier aren't looked up in the second.
+	require.NoError(t, remote.Store(ctx, []string{"remote"}, [][]byte{[]byte("remote")}, time.Hour))
+	found, err := c.Fetch(ctx, []string{"both", "remote", "neither"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"both": []byte("both"), "remote": []byte("remote")}, found)
+	assert.Equal(t, []string{"both", "remote", "neither"}, local.fetched)
+	assert.Equal(t, []string{"remote", "neither"}, remote.fetched)
+
+	// Keys found in the second tier are backfilled into the first.
+	assert.Equal(t, time.Minute, local.stored["remote"])
+	local.fetched, remote.fetched = nil, nil
+	found, err = c.Fetch(ctx, []string{"remote"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"remote": []byte("remote")}, found)
+	assert.Empty(t, remote.fetched)
+
+	// A failing tier is skipped; only if every tier fails does Fetch.
+	local.failFetches = true
+	found, err = c.Fetch(ctx, []string{"remote"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"remote": []byte("remote")}, found)
+	remote.failFetches = true
+	_, err = c.Fetch(ctx, []string{"remote"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,153 @@
+// +build integration
+
+package chunk
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+// These tests need a Cassandra at cassandra.cortex.local; see the
+// chunk-integration-test Makefile target.
+func cassandraTestConfig() CassandraConfig {
+	return CassandraConfig{
+		Addresses:                "cassandra.cortex.local",
+		Port:                     9042,
+		Keyspace:                 fmt.Sprintf("cortex_test_%d", time.Now().UnixNano()),
+		Consistency:              "ONE",
+		ReplicationFactor:        1,
+		DisableInitialHostLookup: true,
+		Timeout:                  10 * time.Second,
+		ChunkTable:               "chunks",
+		PageSize:                 2,
+	}
+}
+
+func TestCassandraStorageClient(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	cfg := cassandraTestConfig()
+
+	tableClient, err := NewCassandraTableClient(cfg)
+	require.NoError(t, err)
+	require.NoError(t, tableClient.CreateTable(ctx, tableDescription{name: "index", provisionedRead: 1, provisionedWrite: 1}))
+	tables, err := tableClient.ListTables(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"index"}, tables)
+
+	client, err := NewCassandraStorageClient(cfg)
+	require.NoError(t, err)
+
+	batch := client.NewWriteBatch()
+	for _, rangeValue := range []string{"a1", "a2", "b1", "b2", "c1"} {
+		batch.Add("index", "hash", []byte(rangeValue), []byte("value-"+rangeValue))
+	}
+	batch.Add("index", "other", []byte("a1"), nil)
+	require.NoError(t, client.BatchWrite(ctx, batch))
+
+	for _, tc := range []struct {
+		name     string
+		entry    IndexEntry
+		expected []string
+	}{
+		{"whole row", IndexEntry{TableName: "index", HashValue: "hash"}, []string{"a1", "a2", "b1", "b2", "c1"}},
+		{"prefix", IndexEntry{TableName: "index", HashValue: "hash", RangeValuePrefix: []byte("b")}, []string{"b1", "b2"}},
+		{"start", IndexEntry{TableName: "index", HashValue: "hash", RangeValueStart: []byte("b2")}, []string{"b2", "c1"}},
+		{"other row", IndexEntry{TableName: "index", HashValue: "other"}, []string{"a1"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var rangeValues []string
+			require.NoError(t, client.QueryPages(ctx, tc.entry, func(resp ReadBatch, lastPage bool) bool {
+				for i := 0; i < resp.Len(); i++ {
+					rangeValues = append(rangeValues, string(resp.RangeValue(i)))
+					if tc.entry.HashValue == "hash" {
+						assert.Equal(t, "value-"+string(resp.RangeValue(i)), string(resp.Value(i)))
+					}
+				}
+				return !lastPage
+			}))
+			assert.Equal(t, tc.expected, rangeValues)
+		})
+	}
+
+	// Rows are read a page at a time, until the callback has seen enough.
+	pages := 0
+	require.NoError(t, client.QueryPages(ctx, IndexEntry{TableName: "index", HashValue: "hash"}, func(resp ReadBatch, lastPage bool) bool {
+		pages++
+		assert.Equal(t, 2, resp.Len())
+		assert.False(t, lastPage)
+		return false
+	}))
+	assert.Equal(t, 1, pages)
+
+	// The index and object clients for a config share a session.
+	indexClient, err := sharedCassandraStorageClient(cfg)
+	require.NoError(t, err)
+	objectClient, err := sharedCassandraStorageClient(cfg)
+	require.NoError(t, err)
+	assert.True(t, indexClient == objectClient)
+
+	require.NoError(t, client.PutChunk(ctx, "key", []byte("chunk")))
+	buf, err := client.GetChunk(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("chunk"), buf)
+	_, err = client.GetChunk(ctx, "missing")
+	assert.Equal(t, ErrStorageObjectNotFound, err)
+
+	require.NoError(t, client.PutChunk(ctx, "other/key", []byte("chunk")))
+	keys := []string{}
+	require.NoError(t, client.ListChunks(ctx, "ke", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	assert.Equal(t, []string{"key"}, keys)
+
+	require.NoError(t, client.DeleteChunk(ctx, "key"))
+	require.NoError(t, client.DeleteChunk(ctx, "key"))
+	_, err = client.GetChunk(ctx, "key")
+	assert.Equal(t, ErrStorageObjectNotFound, err)
+}
+
+func TestCassandraChunkStore(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	cfg := cassandraTestConfig()
+
+	tableClient, err := NewCassandraTableClient(cfg)
+	require.NoError(t, err)
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{}, tableClient)
+	require.NoError(t, err)
+	require.NoError(t, tableManager.syncTables(ctx))
+
+	client, err := NewCassandraStorageClient(cfg)
+	require.NoError(t, err)
+	store, err := NewStore(StoreConfig{schemaFactory: v6Schema}, client)
+	require.NoError(t, err)
+
+	chunks := []Chunk{
+		dummyChunkFor(model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}),
+		dummyChunkFor(model.Metric{model.MetricNameLabel: "foo", "bar": "qux"}),
+	}
+	require.NoError(t, store.Put(ctx, chunks))
+
+	now := model.Now()
+	result, err := store.Get(ctx, now.Add(-time.Hour), now,
+		mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"),
+		mustNewLabelMatcher(metric.Equal, "bar", "qux"))
+	require.NoError(t, err)
+	require.Len(t, result, 1)
+	assert.Equal(t, chunks[1].Metric, result[0].Metric)
+
+	values, err := store.LabelValuesForMetricName(ctx, now.Add(-time.Hour), now, "foo", "bar")
+	require.NoError(t, err)
+	sort.Sort(values)
+	assert.Equal(t, model.LabelValues{"baz", "qux"}, values)
+}
@@ -0,0 +1,400 @@
+package chunk
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/gocql/gocql"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/instrument"
+)
+
+var cassandraRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "cortex",
+	Name:      "cassandra_request_duration_seconds",
+	Help:      "Time spent doing Cassandra requests.",
+	Buckets:   prometheus.ExponentialBuckets(0.001, 4, 6),
+}, []string{"operation", "status_code"})
+
+func init() {
+	prometheus.MustRegister(cassandraRequestDuration)
+
+	RegisterIndexClient("cassandra", func(cfg StorageClientConfig) (IndexClient, error) {
+		return sharedCassandraStorageClient(cfg.CassandraConfig)
+	})
+	RegisterObjectClient("cassandra", func(cfg StorageClientConfig) (ObjectClient, error) {
+		return sharedCassandraStorageClient(cfg.CassandraConfig)
+	})
+}
+
+var (
+	cassandraClientsMtx sync.Mutex
+	cassandraClients    = map[CassandraConfig]StorageClient{}
+)
+
+// sharedCassandraStorageClient returns the client for the given config, making
+// it the first time, so the index and chunks share one session.
+func sharedCassandraStorageClient(cfg CassandraConfig) (StorageClient, error) {
+	cassandraClientsMtx.Lock()
+	defer cassandraClientsMtx.Unlock()
+	if client, ok := cassandraClients[cfg]; ok {
+		return client, nil
+	}
+	client, err := NewCassandraStorageClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cassandraClients[cfg] = client
+	return client, nil
+}
+
+// CassandraConfig specifies config for a Cassandra cluster.
+type CassandraConfig struct {
+	Addresses                string
+	Port                     int
+	Keyspace                 string
+	Consistency              string
+	ReplicationFactor        int
+	DisableInitialHostLookup bool
+	Timeout                  time.Duration
+	ChunkTable               string
+	PageSize                 int
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *CassandraConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Addresses, "cassandra.addresses", "", "Comma-separated hostnames or IPs of Cassandra instances.")
+	f.IntVar(&cfg.Port, "cassandra.port", 9042, "Port that Cassandra is running on.")
+	f.StringVar(&cfg.Keyspace, "cassandra.keyspace", "cortex", "Keyspace to use in Cassandra; created if it doesn't exist.")
+	f.StringVar(&cfg.Consistency, "cassandra.consistency", "QUORUM", "Consistency level for Cassandra reads and writes.")
+	f.IntVar(&cfg.ReplicationFactor, "cassandra.replication-factor", 1, "Replication factor to use when creating the keyspace.")
+	f.BoolVar(&cfg.DisableInitialHostLookup, "cassandra.disable-initial-host-lookup", false, "Only connect to the given addresses, instead of discovering the rest of the cluster.")
+	f.DurationVar(&cfg.Timeout, "cassandra.timeout", 600*time.Millisecond, "Timeout for Cassandra requests.")
+	f.StringVar(&cfg.ChunkTable, "cassandra.chunk-table", "chunks", "Name of the Cassandra table chunks are stored in.")
+	f.IntVar(&cfg.PageSize, "cassandra.page-size", 5000, "Number of index entries read from Cassandra per request.")
+}
+
+func (cfg *CassandraConfig) cluster() (*gocql.ClusterConfig, error) {
+	if cfg.Addresses == "" {
+		return nil, fmt.Errorf("no addresses specified for Cassandra")
+	}
+	consistency, err := gocql.ParseConsistencyWrapper(cfg.Consistency)
+	if err != nil {
+		return nil, err
+	}
+
+	cluster := gocql.NewCluster(strings.Split(cfg.Addresses, ",")...)
+	cluster.Port = cfg.Port
+	cluster.Consistency = consistency
+	cluster.Timeout = cfg.Timeout
+	cluster.DisableInitialHostLookup = cfg.DisableInitialHostLookup
+	if cfg.PageSize > 0 {
+		cluster.PageSize = cfg.PageSize
+	}
+	return cluster, nil
+}
+
+// session connects to the keyspace, creating it if need be.
+func (cfg *CassandraConfig) session() (*gocql.Session, error) {
+	cluster, err := cfg.cluster()
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return nil, err
+	}
+	err = session.Query(fmt.Sprintf(
+		`CREATE KEYSPACE IF NOT EXISTS %s
+		 WITH replication = {'class': 'SimpleStrategy', 'replication_factor': %d}`,
+		cfg.Keyspace, cfg.ReplicationFactor)).Exec()
+	session.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	cluster.Keyspace = cfg.Keyspace
+	return cluster.CreateSession()
+}
+
+// cassandraStorageClient stores index entries in a table per index table,
+// partitioned by hash value and clustered by range value, and chunks in a
+// single blob table.
+type cassandraStorageClient struct {
+	cfg     CassandraConfig
+	session *gocql.Session
+}
+
+// NewCassandraStorageClient makes a new Cassandra-backed StorageClient.
+func NewCassandraStorageClient(cfg CassandraConfig) (StorageClient, error) {
+	session, err := cfg.session()
+	if err != nil {
+		return nil, err
+	}
+
+	err = session.Query(fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s (key text PRIMARY KEY, value blob)`,
+		cfg.ChunkTable)).Exec()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return &cassandraStorageClient{
+		cfg:     cfg,
+		session: session,
+	}, nil
+}
+
+type cassandraWriteBatch struct {
+	entries, deletes []IndexEntry
+}
+
+func (b *cassandraWriteBatch) Add(tableName, hashValue string, rangeValue []byte, value []byte) {
+	b.entries = append(b.entries, IndexEntry{
+		TableName:  tableName,
+		HashValue:  hashValue,
+		RangeValue: rangeValue,
+		Value:      value,
+	})
+}
+
+func (b *cassandraWriteBatch) Delete(tableName, hashValue string, rangeValue []byte) {
+	b.deletes = append(b.deletes, IndexEntry{
+		TableName:  tableName,
+		HashValue:  hashValue,
+		RangeValue: rangeValue,
+	})
+}
+
+func (s *cassandraStorageClient) NewWriteBatch() WriteBatch {
+	return &cassandraWriteBatch{}
+}
+
+// BatchWrite writes the entries one at a time; Cassandra batches spanning
+// partitions are slower than individual writes.
+func (s *cassandraStorageClient) BatchWrite(ctx context.Context, batch WriteBatch) error {
+	b := batch.(*cassandraWriteBatch)
+	for _, entry := range b.entries {
+		err := instrument.TimeRequestHistogram(ctx, "Cassandra.Insert", cassandraRequestDuration, func(ctx context.Context) error {
+			return s.session.Query(fmt.Sprintf("INSERT INTO %s (hash, range, value) VALUES (?, ?, ?)", entry.TableName),
+				entry.HashValue, entry.RangeValue, entry.Value).WithContext(ctx).Exec()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, entry := range b.deletes {
+		err := instrument.TimeRequestHistogram(ctx, "Cassandra.Delete", cassandraRequestDuration, func(ctx context.Context) error {
+			return s.session.Query(fmt.Sprintf("DELETE FROM %s WHERE hash = ? AND range = ?", entry.TableName),
+				entry.HashValue, entry.RangeValue).WithContext(ctx).Exec()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *cassandraStorageClient) QueryPages(ctx context.Context, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error {
+	var q *gocql.Query
+	switch {
+	case entry.RangeValuePrefix != nil:
+		if bound := prefixUpperBound(entry.RangeValuePrefix); bound != nil {
+			q = s.session.Query(fmt.Sprintf("SELECT range, value FROM %s WHERE hash = ? AND range >= ? AND range < ?", entry.TableName),
+				entry.HashValue, entry.RangeValuePrefix, bound)
+		} else {
+			q = s.session.Query(fmt.Sprintf("SELECT range, value FROM %s WHERE hash = ? AND range >= ?", entry.TableName),
+				entry.HashValue, entry.RangeValuePrefix)
+		}
+	case entry.RangeValueStart != nil:
+		q = s.session.Query(fmt.Sprintf("SELECT range, value FROM %s WHERE hash = ? AND range >= ?", entry.TableName),
+			entry.HashValue, entry.RangeValueStart)
+	default:
+		q = s.session.Query(fmt.Sprintf("SELECT range, value FROM %s WHERE hash = ?", entry.TableName),
+			entry.HashValue)
+	}
+
+	// Fetch a page at a time, so the callback can stop us early.
+	var pageState []byte
+	for {
+		var batch cassandraReadBatch
+		err := instrument.TimeRequestHistogram(ctx, "Cassandra.Select", cassandraRequestDuration, func(ctx context.Context) error {
+			iter := q.WithContext(ctx).PageState(pageState).Iter()
+			var rangeValue, value []byte
+			for iter.Scan(&rangeValue, &value) {
+				batch = append(batch, cassandraRow{rangeValue, value})
+				rangeValue, value = nil, nil
+			}
+			pageState = iter.PageState()
+			return iter.Close()
+		})
+		if err != nil {
+			return err
+		}
+		lastPage := len(pageState) == 0
+		if !callback(batch, lastPage) || lastPage {
+			return nil
+		}
+	}
+}
+
+// ScanTable pages through the whole table; the callback is called as rows
+// arrive.  Rows are spread over the cluster by a hash of their hash value, so
+// the prefix can't narrow the scan, and is only filtered on here.
+func (s *cassandraStorageClient) ScanTable(ctx context.Context, tableName, hashPrefix string, callback func(entry IndexEntry) (shouldContinue bool)) error {
+	return instrument.TimeRequestHistogram(ctx, "Cassandra.Scan", cassandraRequestDuration, func(ctx context.Context) error {
+		iter := s.session.Query(fmt.Sprintf("SELECT hash, range, value FROM %s", tableName)).WithContext(ctx).Iter()
+		var (
+			hashValue         string
+			rangeValue, value []byte
+		)
+		for iter.Scan(&hashValue, &rangeValue, &value) {
+			if !strings.HasPrefix(hashValue, hashPrefix) {
+				continue
+			}
+			if !callback(IndexEntry{
+				TableName:  tableName,
+				HashValue:  hashValue,
+				RangeValue: rangeValue,
+				Value:      value,
+			}) {
+				break
+			}
+			rangeValue, value = nil, nil
+		}
+		return iter.Close()
+	})
+}
+
+type cassandraRow struct {
+	rangeValue, value []byte
+}
+
+type cassandraReadBatch []cassandraRow
+
+func (b cassandraReadBatch) Len() int {
+	return len(b)
+}
+
+func (b cassandraReadBatch) RangeValue(i int) []byte {
+	return b[i].rangeValue
+}
+
+func (b cassandraReadBatch) Value(i int) []byte {
+	return b[i].value
+}
+
+func (s *cassandraStorageClient) PutChunk(ctx context.Context, key string, buf []byte) error {
+	return instrument.TimeRequestHistogram(ctx, "Cassandra.PutChunk", cassandraRequestDuration, func(ctx context.Context) error {
+		return s.session.Query(fmt.Sprintf("INSERT INTO %s (key, value) VALUES (?, ?)", s.cfg.ChunkTable),
+			key, buf).WithContext(ctx).Exec()
+	})
+}
+
+func (s *cassandraStorageClient) GetChunk(ctx context.Context, key string) ([]byte, error) {
+	var buf []byte
+	err := instrument.TimeRequestHistogram(ctx, "Cassandra.GetChunk", cassandraRequestDuration, func(ctx context.Context) error {
+		return s.session.Query(fmt.Sprintf("SELECT value FROM %s WHERE key = ?", s.cfg.ChunkTable),
+			key).WithContext(ctx).Scan(&buf)
+	})
+	if err == gocql.ErrNotFound {
+		return nil, ErrStorageObjectNotFound
+	}
+	return buf, err
+}
+
+// ListChunks scans the whole chunk table, as keys are hashed across the
+// cluster; only the keys are read.
+func (s *cassandraStorageClient) ListChunks(ctx context.Context, prefix string, callback func(key string) (shouldContinue bool)) error {
+	return instrument.TimeRequestHistogram(ctx, "Cassandra.ListChunks", cassandraRequestDuration, func(ctx context.Context) error {
+		iter := s.session.Query(fmt.Sprintf("SELECT key FROM %s", s.cfg.ChunkTable)).WithContext(ctx).Iter()
+		var key string
+		for iter.Scan(&key) {
+			if strings.HasPrefix(key, prefix) && !callback(key) {
+				break
+			}
+		}
+		return iter.Close()
+	})
+}
+
+func (s *cassandraStorageClient) DeleteChunk(ctx context.Context, key string) error {
+	return instrument.TimeRequestHistogram(ctx, "Cassandra.DeleteChunk", cassandraRequestDuration, func(ctx context.Context) error {
+		return s.session.Query(fmt.Sprintf("DELETE FROM %s WHERE key = ?", s.cfg.ChunkTable),
+			key).WithContext(ctx).Exec()
+	})
+}
+
+// cassandraTableClient manages the index tables.  Cassandra has no
+// provisioned throughput, billing modes or tags, so they are only remembered,
+// to keep the table manager from updating the tables on every sync.
+type cassandraTableClient struct {
+	cfg     CassandraConfig
+	session *gocql.Session
+
+	mtx    sync.Mutex
+	tables map[string]tableDescription
+}
+
+// NewCassandraTableClient makes a new DynamoTableClient which manages tables
+// in Cassandra.
+func NewCassandraTableClient(cfg CassandraConfig) (DynamoTableClient, error) {
+	session, err := cfg.session()
+	if err != nil {
+		return nil, err
+	}
+	return &cassandraTableClient{
+		cfg:     cfg,
+		session: session,
+		tables:  map[string]tableDescription{},
+	}, nil
+}
+
+func (c *cassandraTableClient) ListTables(ctx context.Context) ([]string, error) {
+	md, err := c.session.KeyspaceMetadata(c.cfg.Keyspace)
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for name := range md.Tables {
+		// The chunk table isn't an index table.
+		if name == c.cfg.ChunkTable {
+			continue
+		}
+		result = append(result, name)
+	}
+	return result, nil
+}
+
+func (c *cassandraTableClient) CreateTable(ctx context.Context, desc tableDescription) error {
+	err := c.session.Query(fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS %s (hash text, range blob, value blob, PRIMARY KEY (hash, range))`,
+		desc.name)).WithContext(ctx).Exec()
+	if err != nil {
+		return err
+	}
+	return c.UpdateTable(ctx, tableDescription{}, desc)
+}
+
+func (c *cassandraTableClient) DescribeTable(ctx context.Context, name string) (desc tableDescription, status string, err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	desc = c.tables[name]
+	desc.name = name
+	return desc, dynamodb.TableStatusActive, nil
+}
+
+func (c *cassandraTableClient) UpdateTable(ctx context.Context, current, expected tableDescription) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.tables[expected.name] = expected
+	return nil
+}
@@ -1,62 +1,49 @@
 package chunk
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"sync"
 	"time"
 
-	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
-	"github.com/weaveworks/common/instrument"
 	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk/cache"
 )
 
 var (
 	memcacheRequests = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "cortex",
 		Name:      "memcache_requests_total",
-		Help:      "Total count of chunks requested from memcache.",
+		Help:      "Total count of chunks requested from the cache.",
 	})
 
 	memcacheHits = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "cortex",
 		Name:      "memcache_hits_total",
-		Help:      "Total count of chunks found in memcache.",
+		Help:      "Total count of chunks found in the cache.",
 	})
 
 	memcacheCorrupt = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "cortex",
 		Name:      "memcache_corrupt_chunks_total",
-		Help:      "Total count of corrupt chunks found in memcache.",
+		Help:      "Total count of corrupt chunks found in the cache.",
 	})
 
 	memcacheDroppedWriteBack = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "cortex",
 		Name:      "memcache_dropped_write_back",
-		Help:      "Total count of dropped write backs to memcache.",
+		Help:      "Total count of dropped write backs to the cache.",
 	})
-
-	memcacheRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Namespace: "cortex",
-		Name:      "memcache_request_duration_seconds",
-		Help:      "Total time spent in seconds doing memcache requests.",
-		// Memecache requests are very quick: smallest bucket is 16us, biggest is 1s
-		Buckets: prometheus.ExponentialBuckets(0.000016, 4, 8),
-	}, []string{"method", "status_code"})
 )
 
 func init() {
 	prometheus.MustRegister(memcacheRequests)
 	prometheus.MustRegister(memcacheHits)
 	prometheus.MustRegister(memcacheCorrupt)
-	prometheus.MustRegister(memcacheRequestDuration)
-}
-
-// Memcache caches things
-type Memcache interface {
-	GetMulti(keys []string) (map[string]*memcache.Item, error)
-	Set(item *memcache.Item) error
 }
 
 // CacheConfig is config to make a Cache
@@ -64,21 +51,37 @@ type CacheConfig struct {
 	Expiration          time.Duration
 	WriteBackGoroutines int
 	WriteBackBuffer     int
-	memcacheConfig      MemcacheConfig
+	cacheConfig         cache.Config
+
+	// Record the chunks and index entries written, so that replicas of the
+	// same chunk don't all write them.
+	WriteDedupe           bool
+	WriteDedupeExpiration time.Duration
+
+	// Cache the results of index queries.  Queries of buckets which may still
+	// be written to are only cached for IndexCacheValidity.
+	IndexCache           bool
+	IndexCacheValidity   time.Duration
+	IndexBucketsWritable time.Duration
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *CacheConfig) RegisterFlags(f *flag.FlagSet) {
-	f.DurationVar(&cfg.Expiration, "memcached.expiration", 0, "How long chunks stay in the memcache.")
-	f.IntVar(&cfg.WriteBackGoroutines, "memcache.write-back-goroutines", 10, "How many goroutines to use to write back to memcache.")
+	f.DurationVar(&cfg.Expiration, "memcached.expiration", 0, "How long chunks stay in the cache.")
+	f.IntVar(&cfg.WriteBackGoroutines, "memcache.write-back-goroutines", 10, "How many goroutines to use to write back to the cache.")
 	f.IntVar(&cfg.WriteBackBuffer, "memcache.write-back-buffer", 10000, "How many chunks to buffer for background write back.")
-	cfg.memcacheConfig.RegisterFlags(f)
+	f.BoolVar(&cfg.WriteDedupe, "memcache.write-dedupe", false, "Use the cache to skip writing chunks and index entries which have already been written by another replica.")
+	f.DurationVar(&cfg.WriteDedupeExpiration, "memcache.write-dedupe-expiration", 6*time.Hour, "How long to remember that chunks and index entries have been written.")
+	f.BoolVar(&cfg.IndexCache, "memcache.index-cache", false, "Cache the results of index queries.")
+	f.DurationVar(&cfg.IndexCacheValidity, "memcache.index-cache-validity", 5*time.Minute, "How long to cache index queries of buckets which may still be written to.")
+	f.DurationVar(&cfg.IndexBucketsWritable, "memcache.index-buckets-writable", 36*time.Hour, "How long after it ends an index bucket may still be written to; should exceed the ingesters' max chunk age plus idle time.")
+	cfg.cacheConfig.RegisterFlags(f)
 }
 
 // Cache type caches chunks
 type Cache struct {
-	cfg      CacheConfig
-	memcache Memcache
+	cfg   CacheConfig
+	cache cache.Cache
 
 	wg       sync.WaitGroup
 	quit     chan struct{}
@@ -92,13 +95,9 @@ type backgroundWrite struct {
 
 // NewCache makes a new Cache
 func NewCache(cfg CacheConfig) *Cache {
-	var memcache Memcache
-	if cfg.memcacheConfig.Host != "" {
-		memcache = NewMemcacheClient(cfg.memcacheConfig)
-	}
 	c := &Cache{
 		cfg:      cfg,
-		memcache: memcache,
+		cache:    cache.New(cfg.cacheConfig),
 		quit:     make(chan struct{}),
 		bgWrites: make(chan backgroundWrite, cfg.WriteBackBuffer),
 	}
@@ -109,29 +108,29 @@ func NewCache(cfg CacheConfig) *Cache {
 	return c
 }
 
-// Stop the background flushing goroutines.
+// Stop the background flushing goroutines, and the cache.
 func (c *Cache) Stop() {
 	close(c.quit)
 	c.wg.Wait()
+	if c.cache != nil {
+		c.cache.Stop()
+	}
 }
 
-func memcacheStatusCode(err error) string {
-	// See https://godoc.org/github.com/bradfitz/gomemcache/memcache#pkg-variables
-	switch err {
-	case nil:
-		return "200"
-	case memcache.ErrCacheMiss:
-		return "404"
-	case memcache.ErrMalformedKey:
-		return "400"
-	default:
-		return "500"
+// hashedMemcacheKey returns a memcache key for the thing identified by parts.
+// It is hashed, as memcache keys are limited in length and charset.
+func hashedMemcacheKey(prefix string, parts ...[]byte) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write(part)
+		h.Write([]byte{0})
 	}
+	return prefix + ":" + hex.EncodeToString(h.Sum(nil))
 }
 
 // FetchChunkData gets chunks from the chunk cache.
 func (c *Cache) FetchChunkData(ctx context.Context, chunks []Chunk) (found []Chunk, missing []Chunk, err error) {
-	if c.memcache == nil {
+	if c.cache == nil {
 		return nil, chunks, nil
 	}
 
@@ -142,24 +141,19 @@ func (c *Cache) FetchChunkData(ctx context.Context, chunks []Chunk) (found []Chu
 		keys = append(keys, chunk.externalKey())
 	}
 
-	var items map[string]*memcache.Item
-	err = instrument.TimeRequestHistogramStatus(ctx, "Memcache.Get", memcacheRequestDuration, memcacheStatusCode, func(_ context.Context) error {
-		var err error
-		items, err = c.memcache.GetMulti(keys)
-		return err
-	})
+	bufs, err := c.cache.Fetch(ctx, keys)
 	if err != nil {
 		return nil, chunks, err
 	}
 
 	for i, externalKey := range keys {
-		item, ok := items[externalKey]
+		buf, ok := bufs[externalKey]
 		if !ok {
 			missing = append(missing, chunks[i])
 			continue
 		}
 
-		if err := chunks[i].decode(item.Value); err != nil {
+		if err := chunks[i].decode(buf); err != nil {
 			memcacheCorrupt.Inc()
 			log.Errorf("Failed to decode chunk from cache: %v", err)
 			missing = append(missing, chunks[i])
@@ -175,18 +169,10 @@ func (c *Cache) FetchChunkData(ctx context.Context, chunks []Chunk) (found []Chu
 
 // StoreChunk serializes and stores a chunk in the chunk cache.
 func (c *Cache) StoreChunk(ctx context.Context, key string, buf []byte) error {
-	if c.memcache == nil {
+	if c.cache == nil {
 		return nil
 	}
-
-	return instrument.TimeRequestHistogramStatus(ctx, "Memcache.Put", memcacheRequestDuration, memcacheStatusCode, func(_ context.Context) error {
-		item := memcache.Item{
-			Key:        key,
-			Value:      buf,
-			Expiration: int32(c.cfg.Expiration.Seconds()),
-		}
-		return c.memcache.Set(&item)
-	})
+	return c.cache.Store(ctx, []string{key}, [][]byte{buf}, c.cfg.Expiration)
 }
 
 // BackgroundWrite writes chunks for the cache in the background
@@ -210,7 +196,7 @@ func (c *Cache) writeBackLoop() {
 		case bgWrite := <-c.bgWrites:
 			err := c.StoreChunk(context.Background(), bgWrite.key, bgWrite.buf)
 			if err != nil {
-				log.Errorf("Error writing to memcache: %v", err)
+				log.Errorf("Error writing to cache: %v", err)
 			}
 		case <-c.quit:
 			return
@@ -10,6 +10,8 @@ import (
 	"github.com/prometheus/prometheus/storage/local/chunk"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk/cache"
 )
 
 type mockMemcache struct {
@@ -37,16 +39,18 @@ func (m *mockMemcache) GetMulti(keys []string) (map[string]*memcache.Item, error
 	return result, nil
 }
 
-func (m *mockMemcache) Set(item *memcache.Item) error {
+func (m *mockMemcache) SetMulti(items []*memcache.Item) error {
 	m.Lock()
 	defer m.Unlock()
-	m.contents[item.Key] = item.Value
+	for _, item := range items {
+		m.contents[item.Key] = item.Value
+	}
 	return nil
 }
 
 func TestChunkCache(t *testing.T) {
 	c := Cache{
-		memcache: newMockMemcache(),
+		cache: cache.NewMemcached(newMockMemcache()),
 	}
 
 	const (
@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"sort"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
@@ -44,6 +45,15 @@ func init() {
 type StoreConfig struct {
 	SchemaConfig
 	CacheConfig
+	QueryLimitsConfig
+
+	// Queries without a metric name are run once per matching metric name, up
+	// to this many.
+	MaxMetricNamesPerQuery int
+
+	// Number of index rows whose sizes are remembered, to plan which matchers
+	// to look up in the index.  Zero disables planning.
+	PlannerRowSizeCacheSize int
 
 	// For injecting different schemas in tests.
 	schemaFactory func(cfg SchemaConfig) Schema
@@ -53,15 +63,24 @@ type StoreConfig struct {
 func (cfg *StoreConfig) RegisterFlags(f *flag.FlagSet) {
 	cfg.SchemaConfig.RegisterFlags(f)
 	cfg.CacheConfig.RegisterFlags(f)
+	cfg.QueryLimitsConfig.RegisterFlags(f)
+	f.IntVar(&cfg.MaxMetricNamesPerQuery, "chunk.max-metric-names-per-query", 100, "Maximum number of metric names a query without a metric name may match (0 = unlimited).")
+	f.IntVar(&cfg.PlannerRowSizeCacheSize, "chunk.planner-row-size-cache-size", 10000, "Number of index row sizes to remember for planning matcher lookups (0 = look up every matcher).")
 }
 
 // Store implements Store
 type Store struct {
 	cfg StoreConfig
 
-	storage StorageClient
-	cache   *Cache
-	schema  Schema
+	storage  StorageClient
+	cache    *Cache
+	schema   Schema
+	periods  SchemaPeriods
+	rowSizes *rowSizeCache
+
+	// Tables known to have been compacted, which they stay.
+	compactedMtx sync.Mutex
+	compacted    map[string]bool
 }
 
 // NewStore makes a new ChunkStore
@@ -76,12 +95,27 @@ func NewStore(cfg StoreConfig, storage StorageClient) (*Store, error) {
 	if err != nil {
 		return nil, err
 	}
+	periods, err := cfg.SchemaConfig.EffectivePeriods()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.loadOverrides(); err != nil {
+		return nil, err
+	}
+
+	var rowSizes *rowSizeCache
+	if cfg.PlannerRowSizeCacheSize > 0 {
+		rowSizes = newRowSizeCache(cfg.PlannerRowSizeCacheSize)
+	}
 
 	return &Store{
-		cfg:     cfg,
-		storage: storage,
-		schema:  schema,
-		cache:   NewCache(cfg.CacheConfig),
+		cfg:       cfg,
+		storage:   storage,
+		schema:    schema,
+		cache:     NewCache(cfg.CacheConfig),
+		periods:   periods,
+		rowSizes:  rowSizes,
+		compacted: map[string]bool{},
 	}, nil
 }
 
@@ -90,6 +124,11 @@ func (c *Store) Stop() {
 	c.cache.Stop()
 }
 
+// QueryLimits returns the limits on the given tenant's queries.
+func (c *Store) QueryLimits(userID string) QueryLimits {
+	return c.cfg.ForUser(userID)
+}
+
 // Put implements ChunkStore
 func (c *Store) Put(ctx context.Context, chunks []Chunk) error {
 	userID, err := user.Extract(ctx)
@@ -109,12 +148,41 @@ func (c *Store) Put(ctx context.Context, chunks []Chunk) error {
 		keys = append(keys, chunks[i].externalKey())
 	}
 
+	// Skip the chunks a replica has already written for the same series and
+	// time range; as chunks are only marked written once their index entries
+	// are, there's nothing left to do for them.
+	dedupeKeys := make([]string, 0, len(chunks))
+	for _, chunk := range chunks {
+		dedupeKeys = append(dedupeKeys, chunkDedupeKey(userID, chunk))
+	}
+	if written := c.cache.Written(ctx, dedupeKeys); len(written) > 0 {
+		var unwrittenChunks []Chunk
+		var unwrittenKeys, unwrittenDedupeKeys []string
+		var unwrittenBufs [][]byte
+		for i := range chunks {
+			if written[dedupeKeys[i]] {
+				dedupedChunks.Inc()
+				continue
+			}
+			unwrittenChunks = append(unwrittenChunks, chunks[i])
+			unwrittenKeys = append(unwrittenKeys, keys[i])
+			unwrittenDedupeKeys = append(unwrittenDedupeKeys, dedupeKeys[i])
+			unwrittenBufs = append(unwrittenBufs, bufs[i])
+		}
+		chunks, keys, dedupeKeys, bufs = unwrittenChunks, unwrittenKeys, unwrittenDedupeKeys, unwrittenBufs
+	}
+
 	err = c.putChunks(ctx, keys, bufs)
 	if err != nil {
 		return err
 	}
 
-	return c.updateIndex(ctx, userID, chunks)
+	if err := c.updateIndex(ctx, userID, chunks); err != nil {
+		return err
+	}
+
+	c.cache.MarkWritten(ctx, dedupeKeys)
+	return nil
 }
 
 // putChunks writes a collection of chunks to S3 in parallel.
@@ -150,36 +218,59 @@ func (c *Store) putChunk(ctx context.Context, key string, buf []byte) error {
 }
 
 func (c *Store) updateIndex(ctx context.Context, userID string, chunks []Chunk) error {
-	writeReqs, err := c.calculateDynamoWrites(userID, chunks)
+	entries, err := c.calculateIndexEntries(userID, chunks)
 	if err != nil {
 		return err
 	}
 
-	return c.storage.BatchWrite(ctx, writeReqs)
+	// Skip entries which are already written; with schemas which don't put the
+	// chunk ID in every entry, replicas write many of the same entries.
+	dedupeKeys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		dedupeKeys = append(dedupeKeys, indexEntryDedupeKey(entry))
+	}
+	written := c.cache.Written(ctx, dedupeKeys)
+
+	writeReqs := c.storage.NewWriteBatch()
+	unwrittenKeys := make([]string, 0, len(entries))
+	for i, entry := range entries {
+		if written[dedupeKeys[i]] {
+			dedupedIndexEntries.Inc()
+			continue
+		}
+		rowWrites.Observe(entry.HashValue, 1)
+		writeReqs.Add(entry.TableName, entry.HashValue, entry.RangeValue, entry.Value)
+		unwrittenKeys = append(unwrittenKeys, dedupeKeys[i])
+	}
+	if len(unwrittenKeys) == 0 {
+		return nil
+	}
+
+	if err := c.storage.BatchWrite(ctx, writeReqs); err != nil {
+		return err
+	}
+	c.cache.MarkWritten(ctx, unwrittenKeys)
+	return nil
 }
 
-// calculateDynamoWrites creates a set of batched WriteRequests to dynamo for all
+// calculateIndexEntries creates the set of index entries to write for all
 // the chunks it is given.
-func (c *Store) calculateDynamoWrites(userID string, chunks []Chunk) (WriteBatch, error) {
-	writeReqs := c.storage.NewWriteBatch()
+func (c *Store) calculateIndexEntries(userID string, chunks []Chunk) ([]IndexEntry, error) {
+	var result []IndexEntry
 	for _, chunk := range chunks {
 		metricName, err := util.ExtractMetricNameFromMetric(chunk.Metric)
 		if err != nil {
 			return nil, err
 		}
 
-		entries, err := c.schema.GetWriteEntries(chunk.From, chunk.Through, userID, metricName, chunk.Metric, chunk.externalKey())
+		entries, err := c.schema.GetWriteEntries(chunk.From, chunk.Through, indexUserID(userID, chunk.Metric), metricName, chunk.Metric, chunk.externalKey())
 		if err != nil {
 			return nil, err
 		}
 		indexEntriesPerChunk.Observe(float64(len(entries)))
-
-		for _, entry := range entries {
-			rowWrites.Observe(entry.HashValue, 1)
-			writeReqs.Add(entry.TableName, entry.HashValue, entry.RangeValue, entry.Value)
-		}
+		result = append(result, entries...)
 	}
-	return writeReqs, nil
+	return result, nil
 }
 
 // Get implements ChunkStore
@@ -188,13 +279,28 @@ func (c *Store) Get(ctx context.Context, from, through model.Time, allMatchers .
 		return nil, fmt.Errorf("invalid query, through < from (%d < %d)", through, from)
 	}
 
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ctx = withQueryLimiter(ctx, c.cfg.ForUser(userID))
+	limiter := queryLimiterFrom(ctx)
 	filters, matchers := util.SplitFiltersAndMatchers(allMatchers)
 
+	// Downsampled series are looked up in an index of their own.
+	indexUser := userID
+	if resolution, aggregate, ok, err := downsampledSelection(allMatchers); err != nil {
+		return nil, err
+	} else if ok {
+		indexUser = downsampledIndexUserID(userID, resolution, aggregate)
+	}
+
 	// Fetch chunk descriptors (just ID really) from storage
-	chunks, err := c.lookupMatchers(ctx, from, through, matchers)
+	chunks, deferred, err := c.lookupMatchers(ctx, indexUser, from, through, matchers)
 	if err != nil {
 		return nil, promql.ErrStorage(err)
 	}
+	filters = append(filters, deferred...)
 
 	// Filter out chunks that are not in the selected time range.
 	filtered := make([]Chunk, 0, len(chunks))
@@ -204,12 +310,21 @@ func (c *Store) Get(ctx context.Context, from, through model.Time, allMatchers .
 		}
 		filtered = append(filtered, chunk)
 	}
+	if err := limiter.addChunks(len(filtered)); err != nil {
+		return nil, err
+	}
 
 	// Now fetch the actual chunk data from Memcache / S3
+	limiter.filters = filters
 	fromCache, missing, err := c.cache.FetchChunkData(ctx, filtered)
 	if err != nil {
 		log.Warnf("Error fetching from cache: %v", err)
 	}
+	for _, chunk := range fromCache {
+		if err := limiter.addChunk(chunk); err != nil {
+			return nil, err
+		}
+	}
 
 	fromS3, err := c.fetchChunkData(ctx, missing)
 	if err != nil {
@@ -241,129 +356,317 @@ outer:
 	return filteredChunks, nil
 }
 
-func (c *Store) lookupMatchers(ctx context.Context, from, through model.Time, matchers []*metric.LabelMatcher) ([]Chunk, error) {
-	metricName, matchers, err := util.ExtractMetricNameFromMatchers(matchers)
-	if err != nil {
-		return nil, err
+// lookupMatchers finds the chunks matching the matchers in the index of the
+// given user ID.  Matchers which it was cheaper not to look up in the index
+// are returned, to be applied to the chunks' metrics instead.
+func (c *Store) lookupMatchers(ctx context.Context, userID string, from, through model.Time, matchers []*metric.LabelMatcher) ([]Chunk, []*metric.LabelMatcher, error) {
+	nameMatchers, matchers := util.SplitMetricNameMatchers(matchers)
+	if metricName, ok := util.EqualMetricName(nameMatchers); ok {
+		metricNames, err := util.MatchingMetricNames(model.LabelValues{metricName}, nameMatchers, 0)
+		if err != nil || len(metricNames) == 0 {
+			return nil, nil, err
+		}
+		return c.lookupMatchersForMetric(ctx, userID, from, through, metricName, matchers)
 	}
 
-	userID, err := user.Extract(ctx)
+	// Without a metric name, run the query for every metric name listed in
+	// the index which matches all the metric name matchers.
+	metricNames, err := c.metricNames(ctx, userID, from, through)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	metricNames, err = util.MatchingMetricNames(metricNames, nameMatchers, c.cfg.MaxMetricNamesPerQuery)
+	if err != nil {
+		return nil, nil, err
 	}
 
+	type lookupResult struct {
+		chunks   ByKey
+		deferred []*metric.LabelMatcher
+	}
+	incomingResults := make(chan lookupResult)
+	incomingErrors := make(chan error)
+	for _, metricName := range metricNames {
+		go func(metricName model.LabelValue) {
+			chunks, deferred, err := c.lookupMatchersForMetric(ctx, userID, from, through, metricName, matchers)
+			if err != nil {
+				incomingErrors <- err
+			} else {
+				incomingResults <- lookupResult{chunks, deferred}
+			}
+		}(metricName)
+	}
+
+	// Every matcher applies to every chunk, so matchers deferred for one
+	// metric name can be applied to all of them.
+	var chunks ByKey
+	var deferred []*metric.LabelMatcher
+	deferredSet := map[*metric.LabelMatcher]struct{}{}
+	var lastErr error
+	for i := 0; i < len(metricNames); i++ {
+		select {
+		case incoming := <-incomingResults:
+			chunks = merge(chunks, incoming.chunks)
+			for _, matcher := range incoming.deferred {
+				if _, ok := deferredSet[matcher]; !ok {
+					deferredSet[matcher] = struct{}{}
+					deferred = append(deferred, matcher)
+				}
+			}
+		case err := <-incomingErrors:
+			lastErr = err
+		}
+	}
+	return chunks, deferred, lastErr
+}
+
+func (c *Store) lookupMatchersForMetric(ctx context.Context, userID string, from, through model.Time, metricName model.LabelValue, matchers []*metric.LabelMatcher) (ByKey, []*metric.LabelMatcher, error) {
 	if len(matchers) == 0 {
 		entries, err := c.schema.GetReadEntriesForMetric(from, through, userID, metricName)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		chunks, seriesIDs, err := c.lookupEntries(ctx, entries, nil)
+		if err != nil {
+			return nil, nil, err
 		}
-		return c.lookupEntries(ctx, entries, nil)
+		chunks, err = c.lookupSeriesChunks(ctx, from, through, userID, chunks, seriesIDs)
+		return chunks, nil, err
 	}
 
-	incomingChunkSets := make(chan ByKey)
-	incomingErrors := make(chan error)
+	lookups := make([]matcherLookup, 0, len(matchers))
 	for _, matcher := range matchers {
-		go func(matcher *metric.LabelMatcher) {
-			var entries []IndexEntry
-			var err error
-			if matcher.Type != metric.Equal {
-				entries, err = c.schema.GetReadEntriesForMetricLabel(from, through, userID, metricName, matcher.Name)
-			} else {
-				entries, err = c.schema.GetReadEntriesForMetricLabelValue(from, through, userID, metricName, matcher.Name, matcher.Value)
-			}
+		var entries []IndexEntry
+		var err error
+		if matcher.Type != metric.Equal {
+			entries, err = c.schema.GetReadEntriesForMetricLabel(from, through, userID, metricName, matcher.Name)
+		} else {
+			entries, err = c.schema.GetReadEntriesForMetricLabelValue(from, through, userID, metricName, matcher.Name, matcher.Value)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		lookups = append(lookups, matcherLookup{matcher: matcher, entries: entries})
+	}
+
+	var chunkSets []ByKey
+	var seriesIDSets [][]string
+	var deferred []*metric.LabelMatcher
+
+	// When the cheapest lookup's cost is known, run it first; the others are
+	// only run if they read fewer rows than the candidates it finds.
+	if c.rowSizes != nil {
+		var first *matcherLookup
+		first, lookups = c.rowSizes.planLookups(lookups)
+		if first != nil {
+			chunks, seriesIDs, err := c.lookupEntries(ctx, first.entries, first.matcher)
 			if err != nil {
-				incomingErrors <- err
-				return
+				return nil, nil, err
 			}
-			incoming, err := c.lookupEntries(ctx, entries, matcher)
+			chunkSets = append(chunkSets, chunks)
+			seriesIDSets = append(seriesIDSets, seriesIDs)
+			lookups, deferred = deferLookups(lookups, len(chunks)+len(seriesIDs))
+		}
+	}
+
+	type lookupResult struct {
+		chunks    ByKey
+		seriesIDs []string
+	}
+	incomingResults := make(chan lookupResult)
+	incomingErrors := make(chan error)
+	for _, lookup := range lookups {
+		go func(lookup matcherLookup) {
+			chunks, seriesIDs, err := c.lookupEntries(ctx, lookup.entries, lookup.matcher)
 			if err != nil {
 				incomingErrors <- err
 			} else {
-				incomingChunkSets <- incoming
+				incomingResults <- lookupResult{chunks, seriesIDs}
 			}
-		}(matcher)
+		}(lookup)
 	}
 
-	var chunkSets []ByKey
 	var lastErr error
-	for i := 0; i < len(matchers); i++ {
+	for i := 0; i < len(lookups); i++ {
 		select {
-		case incoming := <-incomingChunkSets:
-			chunkSets = append(chunkSets, incoming)
+		case incoming := <-incomingResults:
+			chunkSets = append(chunkSets, incoming.chunks)
+			seriesIDSets = append(seriesIDSets, incoming.seriesIDs)
 		case err := <-incomingErrors:
 			lastErr = err
 		}
 	}
+	if lastErr != nil {
+		return nil, nil, lastErr
+	}
+
+	// Chunk IDs come from schemas before v7 and series IDs from v7 onwards, so
+	// each is intersected separately.
+	chunks, err := c.lookupSeriesChunks(ctx, from, through, userID, nWayIntersect(chunkSets), nWayIntersectStrings(seriesIDSets))
+	return chunks, deferred, err
+}
+
+// lookupSeriesChunks finds the chunks for the given series IDs, and merges
+// them with the chunks already found.
+func (c *Store) lookupSeriesChunks(ctx context.Context, from, through model.Time, userID string, chunks ByKey, seriesIDs []string) (ByKey, error) {
+	if len(seriesIDs) == 0 {
+		return chunks, nil
+	}
 
-	return nWayIntersect(chunkSets), lastErr
+	var entries []IndexEntry
+	for _, seriesID := range seriesIDs {
+		seriesEntries, err := c.schema.GetChunksForSeries(from, through, userID, []byte(seriesID))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, seriesEntries...)
+	}
+
+	seriesChunks, _, err := c.lookupEntries(ctx, entries, nil)
+	if err != nil {
+		return nil, err
+	}
+	return merge(chunks, seriesChunks), nil
 }
 
-func (c *Store) lookupEntries(ctx context.Context, entries []IndexEntry, matcher *metric.LabelMatcher) (ByKey, error) {
-	incomingChunkSets := make(chan ByKey)
+func (c *Store) lookupEntries(ctx context.Context, entries []IndexEntry, matcher *metric.LabelMatcher) (ByKey, []string, error) {
+	type lookupResult struct {
+		chunks    ByKey
+		seriesIDs []string
+	}
+	incomingResults := make(chan lookupResult)
 	incomingErrors := make(chan error)
 	for _, entry := range entries {
 		go func(entry IndexEntry) {
-			incoming, err := c.lookupEntry(ctx, entry, matcher)
+			chunks, seriesIDs, err := c.lookupEntry(ctx, entry, matcher)
 			if err != nil {
 				incomingErrors <- err
 			} else {
-				incomingChunkSets <- incoming
+				incomingResults <- lookupResult{chunks, seriesIDs}
 			}
 		}(entry)
 	}
 
 	var chunks ByKey
+	var seriesIDs []string
 	var lastErr error
 	for i := 0; i < len(entries); i++ {
 		select {
-		case incoming := <-incomingChunkSets:
-			chunks = merge(chunks, incoming)
+		case incoming := <-incomingResults:
+			chunks = merge(chunks, incoming.chunks)
+			seriesIDs = mergeStrings(seriesIDs, incoming.seriesIDs)
 		case err := <-incomingErrors:
 			lastErr = err
 		}
 	}
 
-	return chunks, lastErr
+	return chunks, seriesIDs, lastErr
 }
 
-func (c *Store) lookupEntry(ctx context.Context, entry IndexEntry, matcher *metric.LabelMatcher) (ByKey, error) {
+// queryPages is StorageClient.QueryPages, through the index query cache if
+// enabled, counting the entries read against the query's limit.  With the
+// cache, the callback sees all pages as one, and rows cut short by the limit
+// aren't cached.
+func (c *Store) queryPages(ctx context.Context, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error {
+	limiter := queryLimiterFrom(ctx)
+	var limitErr error
+	if !c.cfg.IndexCache {
+		if err := c.storage.QueryPages(ctx, entry, func(resp ReadBatch, lastPage bool) (shouldContinue bool) {
+			if limitErr = limiter.addIndexEntries(resp.Len()); limitErr != nil {
+				return false
+			}
+			return callback(resp, lastPage)
+		}); err != nil {
+			return err
+		}
+		return limitErr
+	}
+
+	if batch, ok := c.cache.FetchIndexQuery(ctx, entry); ok {
+		if err := limiter.addIndexEntries(batch.Len()); err != nil {
+			return err
+		}
+		callback(batch, true)
+		return nil
+	}
+
+	var batch readBatch
+	if err := c.storage.QueryPages(ctx, entry, func(resp ReadBatch, lastPage bool) (shouldContinue bool) {
+		if limitErr = limiter.addIndexEntries(resp.Len()); limitErr != nil {
+			return false
+		}
+		batch.addBatch(resp)
+		return !lastPage
+	}); err != nil {
+		return err
+	} else if limitErr != nil {
+		return limitErr
+	}
+
+	c.cache.StoreIndexQuery(ctx, entry, batch)
+	callback(batch, true)
+	return nil
+}
+
+func (c *Store) lookupEntry(ctx context.Context, entry IndexEntry, matcher *metric.LabelMatcher) (ByKey, []string, error) {
 	var chunkSet ByKey
+	var seriesIDs []string
 	var processingError error
-	if err := c.storage.QueryPages(ctx, entry, func(resp ReadBatch, lastPage bool) (shouldContinue bool) {
-		processingError = processResponse(ctx, resp, &chunkSet, matcher)
+	rowSize := 0
+	if err := c.queryPages(ctx, entry, func(resp ReadBatch, lastPage bool) (shouldContinue bool) {
+		rowSize += resp.Len()
+		processingError = processResponse(ctx, resp, &chunkSet, &seriesIDs, matcher)
 		return processingError == nil && !lastPage
 	}); err != nil {
 		log.Errorf("Error querying storage: %v", err)
-		return nil, err
+		return nil, nil, err
 	} else if processingError != nil {
 		log.Errorf("Error processing storage response: %v", processingError)
-		return nil, processingError
+		return nil, nil, processingError
+	}
+	if c.rowSizes != nil {
+		c.rowSizes.observe(entry, rowSize)
 	}
 	sort.Sort(ByKey(chunkSet))
 	chunkSet = unique(chunkSet)
-	return chunkSet, nil
+	sort.Strings(seriesIDs)
+	seriesIDs = uniqueStrings(seriesIDs)
+	return chunkSet, seriesIDs, nil
 }
 
-func processResponse(ctx context.Context, resp ReadBatch, chunkSet *ByKey, matcher *metric.LabelMatcher) error {
+func processResponse(ctx context.Context, resp ReadBatch, chunkSet *ByKey, seriesIDs *[]string, matcher *metric.LabelMatcher) error {
 	userID, err := user.Extract(ctx)
 	if err != nil {
 		return err
 	}
 
 	for i := 0; i < resp.Len(); i++ {
-		chunkKey, labelValue, metadataInIndex, err := parseRangeValue(resp.RangeValue(i), resp.Value(i))
+		key, labelValue, kind, err := parseRangeValue(resp.RangeValue(i), resp.Value(i))
 		if err != nil {
 			return err
 		}
 
-		chunk, err := parseExternalKey(userID, chunkKey)
+		// Metric name entries are read by MetricNames.
+		if kind == metricNameEntry {
+			continue
+		}
+
+		if kind == seriesEntry {
+			if matcher != nil && !matcher.Match(labelValue) {
+				continue
+			}
+			*seriesIDs = append(*seriesIDs, key)
+			continue
+		}
+
+		chunk, err := parseExternalKey(userID, key)
 		if err != nil {
 			return err
 		}
 
 		// This can be removed in Dev 2017, 13 months after the last chunks
 		// was written with metadata in the index.
-		if metadataInIndex && resp.Value(i) != nil {
+		if kind == chunkEntryMetadataInIndex && resp.Value(i) != nil {
 			if err := json.Unmarshal(resp.Value(i), &chunk); err != nil {
 				return err
 			}
@@ -379,36 +682,299 @@ func processResponse(ctx context.Context, resp ReadBatch, chunkSet *ByKey, match
 	return nil
 }
 
-func (c *Store) fetchChunkData(ctx context.Context, chunkSet []Chunk) ([]Chunk, error) {
-	incomingChunks := make(chan Chunk)
+// LabelValuesForMetricName returns the values of the named label for series
+// of the given metric with chunks between from and through.  They are read from
+// the index alone.
+func (c *Store) LabelValuesForMetricName(ctx context.Context, from, through model.Time, metricName model.LabelValue, labelName model.LabelName) (model.LabelValues, error) {
+	if labelName == model.MetricNameLabel {
+		return model.LabelValues{metricName}, nil
+	}
+
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := c.schema.GetReadEntriesForMetricLabel(from, through, userID, metricName, labelName)
+	if err != nil {
+		return nil, err
+	}
+
+	incomingValues := make(chan []model.LabelValue)
 	incomingErrors := make(chan error)
-	for _, chunk := range chunkSet {
-		go func(chunk Chunk) {
-			buf, err := c.storage.GetChunk(ctx, chunk.externalKey())
-			if err != nil {
+	for _, entry := range entries {
+		go func(entry IndexEntry) {
+			var values []model.LabelValue
+			var processingError error
+			if err := c.queryPages(ctx, entry, func(resp ReadBatch, lastPage bool) (shouldContinue bool) {
+				for i := 0; i < resp.Len(); i++ {
+					_, labelValue, _, err := parseRangeValue(resp.RangeValue(i), resp.Value(i))
+					if err != nil {
+						processingError = err
+						return false
+					}
+					values = append(values, labelValue)
+				}
+				return !lastPage
+			}); err != nil {
 				incomingErrors <- err
-				return
+			} else if processingError != nil {
+				incomingErrors <- processingError
+			} else {
+				incomingValues <- values
 			}
-			if err := chunk.decode(buf); err != nil {
-				incomingErrors <- err
-				return
+		}(entry)
+	}
+
+	valueSet := map[model.LabelValue]struct{}{}
+	var lastErr error
+	for i := 0; i < len(entries); i++ {
+		select {
+		case values := <-incomingValues:
+			for _, v := range values {
+				// Rows written by v4+ schemas include entries without a label value.
+				if v != "" {
+					valueSet[v] = struct{}{}
+				}
+			}
+		case err := <-incomingErrors:
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return nil, lastErr
+	}
+
+	result := make(model.LabelValues, 0, len(valueSet))
+	for v := range valueSet {
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+// MetricNames returns the metric names with chunks between from and through.
+// Only schemas from v7 onwards list metric names in the index, so if any of
+// the range uses an earlier schema it returns ErrMetricNamesNotIndexed.
+func (c *Store) MetricNames(ctx context.Context, from, through model.Time) (model.LabelValues, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.metricNames(ctx, userID, from, through)
+}
+
+// MetricNamesIndexed returns whether the schemas of the range list metric
+// names in the index, without reading it.
+func (c *Store) MetricNamesIndexed(from, through model.Time) bool {
+	_, err := c.schema.GetReadEntriesForMetricNames(from, through, "")
+	return err != ErrMetricNamesNotIndexed
+}
+
+func (c *Store) metricNames(ctx context.Context, userID string, from, through model.Time) (model.LabelValues, error) {
+	entries, err := c.schema.GetReadEntriesForMetricNames(from, through, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	nameSet := map[model.LabelValue]struct{}{}
+	for _, entry := range entries {
+		var processingError error
+		if err := c.queryPages(ctx, entry, func(resp ReadBatch, lastPage bool) (shouldContinue bool) {
+			for i := 0; i < resp.Len(); i++ {
+				_, metricName, _, err := parseRangeValue(resp.RangeValue(i), resp.Value(i))
+				if err != nil {
+					processingError = err
+					return false
+				}
+				nameSet[metricName] = struct{}{}
+			}
+			return !lastPage
+		}); err != nil {
+			return nil, err
+		} else if processingError != nil {
+			return nil, processingError
+		}
+	}
+
+	result := make(model.LabelValues, 0, len(nameSet))
+	for name := range nameSet {
+		result = append(result, name)
+	}
+	sort.Sort(result)
+	return result, nil
+}
+
+// LabelNamesForMetricName returns the label names of series of the given
+// metric with chunks between from and through.  The v7 schema lists each
+// series' label names in the metric's row; for series from earlier schemas,
+// or written before it did so, one chunk of each series is fetched instead.
+func (c *Store) LabelNamesForMetricName(ctx context.Context, from, through model.Time, metricName model.LabelValue) (model.LabelNames, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := c.schema.GetReadEntriesForMetric(from, through, userID, metricName)
+	if err != nil {
+		return nil, err
+	}
+
+	nameSet := map[model.LabelName]struct{}{model.MetricNameLabel: {}}
+	var chunks ByKey
+	var seriesIDs []string
+	for _, entry := range entries {
+		var processingError error
+		if err := c.queryPages(ctx, entry, func(resp ReadBatch, lastPage bool) (shouldContinue bool) {
+			for i := 0; i < resp.Len(); i++ {
+				key, _, kind, err := parseRangeValue(resp.RangeValue(i), resp.Value(i))
+				if err != nil {
+					processingError = err
+					return false
+				}
+				switch kind {
+				case metricNameEntry:
+				case seriesEntry:
+					if len(resp.Value(i)) == 0 {
+						seriesIDs = append(seriesIDs, key)
+						continue
+					}
+					for _, name := range decodeLabelNames(resp.Value(i)) {
+						nameSet[name] = struct{}{}
+					}
+				default:
+					chunk, err := parseExternalKey(userID, key)
+					if err != nil {
+						processingError = err
+						return false
+					}
+					if kind == chunkEntryMetadataInIndex && resp.Value(i) != nil {
+						if err := json.Unmarshal(resp.Value(i), &chunk); err != nil {
+							processingError = err
+							return false
+						}
+						for name := range chunk.Metric {
+							nameSet[name] = struct{}{}
+						}
+						continue
+					}
+					chunks = append(chunks, chunk)
+				}
 			}
-			incomingChunks <- chunk
-		}(chunk)
+			return !lastPage
+		}); err != nil {
+			return nil, err
+		} else if processingError != nil {
+			return nil, processingError
+		}
 	}
 
+	sort.Strings(seriesIDs)
+	chunks, err = c.lookupSeriesChunks(ctx, from, through, userID, chunks, uniqueStrings(seriesIDs))
+	if err != nil {
+		return nil, err
+	}
+
+	// Every chunk of a series has the same labels, so one is enough.
+	seen := map[model.Fingerprint]struct{}{}
+	toFetch := make([]Chunk, 0, len(chunks))
+	for _, chunk := range chunks {
+		if chunk.Through < from || through < chunk.From {
+			continue
+		}
+		if _, ok := seen[chunk.Fingerprint]; ok {
+			continue
+		}
+		seen[chunk.Fingerprint] = struct{}{}
+		toFetch = append(toFetch, chunk)
+	}
+
+	fromCache, missing, err := c.cache.FetchChunkData(ctx, toFetch)
+	if err != nil {
+		log.Warnf("Error fetching from cache: %v", err)
+	}
+	fromStore, err := c.fetchChunkData(ctx, missing)
+	if err != nil {
+		return nil, promql.ErrStorage(err)
+	}
+	for _, chunk := range append(fromCache, fromStore...) {
+		for name := range chunk.Metric {
+			nameSet[name] = struct{}{}
+		}
+	}
+
+	result := make(model.LabelNames, 0, len(nameSet))
+	for name := range nameSet {
+		result = append(result, name)
+	}
+	return result, nil
+}
+
+// fetchChunkData fetches and decodes the chunks from storage, with at most
+// ChunkFetchParallelism requests in flight.
+func (c *Store) fetchChunkData(ctx context.Context, chunkSet []Chunk) ([]Chunk, error) {
+	limiter := queryLimiterFrom(ctx)
+	workers := c.cfg.ChunkFetchParallelism
+	if workers <= 0 || workers > len(chunkSet) {
+		workers = len(chunkSet)
+	}
+
+	// Once a fetch fails, the remaining chunks are skipped.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	toFetch := make(chan Chunk)
+	incomingChunks := make(chan Chunk)
+	incomingErrors := make(chan error)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for chunk := range toFetch {
+				if err := ctx.Err(); err != nil {
+					incomingErrors <- err
+					continue
+				}
+				buf, err := c.storage.GetChunk(ctx, chunk.externalKey())
+				if err != nil {
+					incomingErrors <- err
+					continue
+				}
+				if err := limiter.addChunkBytes(len(buf)); err != nil {
+					incomingErrors <- err
+					continue
+				}
+				if err := chunk.decode(buf); err != nil {
+					incomingErrors <- err
+					continue
+				}
+				if err := limiter.addChunk(chunk); err != nil {
+					incomingErrors <- err
+					continue
+				}
+				incomingChunks <- chunk
+			}
+		}()
+	}
+	go func() {
+		for _, chunk := range chunkSet {
+			toFetch <- chunk
+		}
+		close(toFetch)
+	}()
+
 	chunks := []Chunk{}
-	errors := []error{}
+	var firstErr error
 	for i := 0; i < len(chunkSet); i++ {
 		select {
 		case chunk := <-incomingChunks:
 			chunks = append(chunks, chunk)
 		case err := <-incomingErrors:
-			errors = append(errors, err)
+			if firstErr == nil {
+				firstErr = err
+				cancel()
+			}
 		}
 	}
-	if len(errors) > 0 {
-		return nil, errors[0]
+	if firstErr != nil {
+		return nil, firstErr
 	}
 	return chunks, nil
 }
@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"math/rand"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
 
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/storage/local/chunk"
 	"github.com/prometheus/prometheus/storage/metric"
 	"github.com/stretchr/testify/assert"
@@ -17,6 +19,7 @@ import (
 
 	"github.com/weaveworks/common/test"
 	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/chunk/cache"
 )
 
 // newTestStore creates a new Store for testing.
@@ -56,6 +59,7 @@ func TestChunkStore(t *testing.T) {
 		{"v4 schema", v4Schema},
 		{"v5 schema", v5Schema},
 		{"v6 schema", v6Schema},
+		{"v7 schema", v7Schema},
 	}
 
 	nameMatcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
@@ -159,6 +163,7 @@ func TestChunkStoreRandom(t *testing.T) {
 		{name: "v4 schema", fn: v4Schema},
 		{name: "v5 schema", fn: v5Schema},
 		{name: "v6 schema", fn: v6Schema},
+		{name: "v7 schema", fn: v7Schema},
 	}
 
 	for i := range schemas {
@@ -287,3 +292,245 @@ func TestChunkStoreLeastRead(t *testing.T) {
 		assert.Equal(t, int(numChunks), len(chunks))
 	}
 }
+
+func TestChunkStoreLabelNamesAndValues(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	now := model.Now()
+	chunk1 := dummyChunkFor(model.Metric{
+		model.MetricNameLabel: "foo",
+		"bar":  "baz",
+		"toms": "code",
+		"flip": "flop",
+	})
+	chunk2 := dummyChunkFor(model.Metric{
+		model.MetricNameLabel: "foo",
+		"bar":  "beep",
+		"toms": "code",
+	})
+
+	for _, schema := range []struct {
+		name string
+		fn   func(cfg SchemaConfig) Schema
+	}{
+		{"v1 schema", v1Schema},
+		{"v2 schema", v2Schema},
+		{"v3 schema", v3Schema},
+		{"v4 schema", v4Schema},
+		{"v5 schema", v5Schema},
+		{"v6 schema", v6Schema},
+		{"v7 schema", v7Schema},
+	} {
+		t.Run(schema.name, func(t *testing.T) {
+			store := newTestChunkStore(t, StoreConfig{
+				schemaFactory: schema.fn,
+			})
+			require.NoError(t, store.Put(ctx, []Chunk{chunk1, chunk2}))
+
+			values, err := store.LabelValuesForMetricName(ctx, now.Add(-time.Hour), now, "foo", "bar")
+			require.NoError(t, err)
+			sort.Sort(values)
+			assert.Equal(t, model.LabelValues{"baz", "beep"}, values)
+
+			values, err = store.LabelValuesForMetricName(ctx, now.Add(-time.Hour), now, "foo", "flip")
+			require.NoError(t, err)
+			assert.Equal(t, model.LabelValues{"flop"}, values)
+
+			names, err := store.LabelNamesForMetricName(ctx, now.Add(-time.Hour), now, "foo")
+			require.NoError(t, err)
+			sort.Sort(names)
+			assert.Equal(t, model.LabelNames{model.MetricNameLabel, "bar", "flip", "toms"}, names)
+		})
+	}
+}
+
+func TestChunkStoreLabelNamesFromIndex(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	now := model.Now()
+	storage := NewMockStorage()
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{}, storage)
+	require.NoError(t, err)
+	require.NoError(t, tableManager.syncTables(context.Background()))
+	store, err := NewStore(StoreConfig{schemaFactory: v7Schema}, storage)
+	require.NoError(t, err)
+	chunk := dummyChunkFor(model.Metric{
+		model.MetricNameLabel: "foo",
+		"bar":  "baz",
+		"toms": "code",
+	})
+	require.NoError(t, store.Put(ctx, []Chunk{chunk}))
+
+	// With the chunk gone, the names can only come from the index.
+	require.NoError(t, storage.DeleteChunk(ctx, chunk.externalKey()))
+	names, err := store.LabelNamesForMetricName(ctx, now.Add(-time.Hour), now, "foo")
+	require.NoError(t, err)
+	sort.Sort(names)
+	assert.Equal(t, model.LabelNames{model.MetricNameLabel, "bar", "toms"}, names)
+}
+
+func TestChunkStoreWithoutMetricName(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	now := model.Now()
+	chunk1 := dummyChunkFor(model.Metric{
+		model.MetricNameLabel: "http_requests_total",
+		"job": "api",
+	})
+	chunk2 := dummyChunkFor(model.Metric{
+		model.MetricNameLabel: "http_request_duration_seconds",
+		"job": "api",
+	})
+	chunk3 := dummyChunkFor(model.Metric{
+		model.MetricNameLabel: "up",
+		"job": "db",
+	})
+
+	store := newTestChunkStore(t, StoreConfig{
+		schemaFactory: v7Schema,
+	})
+	require.NoError(t, store.Put(ctx, []Chunk{chunk1, chunk2, chunk3}))
+
+	names, err := store.MetricNames(ctx, now.Add(-time.Hour), now)
+	require.NoError(t, err)
+	assert.Equal(t, model.LabelValues{"http_request_duration_seconds", "http_requests_total", "up"}, names)
+
+	for _, tc := range []struct {
+		query  string
+		expect []Chunk
+	}{
+		{
+			`{job="api"}`,
+			[]Chunk{chunk1, chunk2},
+		},
+		{
+			`{__name__=~"http_.*"}`,
+			[]Chunk{chunk1, chunk2},
+		},
+		{
+			`{__name__=~"http_.*", job="db"}`,
+			nil,
+		},
+		{
+			`{__name__!="up", job=~"api|db"}`,
+			[]Chunk{chunk1, chunk2},
+		},
+		{
+			`{__name__=~"http_.*", __name__!="http_requests_total"}`,
+			[]Chunk{chunk2},
+		},
+		{
+			`{__name__="up", __name__=~"http_.*"}`,
+			nil,
+		},
+	} {
+		t.Run(tc.query, func(t *testing.T) {
+			matchers, err := promql.ParseMetricSelector(tc.query)
+			require.NoError(t, err)
+
+			chunks, err := store.Get(ctx, now.Add(-time.Hour), now, matchers...)
+			require.NoError(t, err)
+
+			want, have := []string{}, []string{}
+			for _, c := range tc.expect {
+				want = append(want, c.Metric.String())
+			}
+			for _, c := range chunks {
+				have = append(have, c.Metric.String())
+			}
+			sort.Strings(want)
+			sort.Strings(have)
+			assert.Equal(t, want, have)
+		})
+	}
+
+	// Queries may only expand to a limited number of metric names.
+	store.cfg.MaxMetricNamesPerQuery = 1
+	matchers, err := promql.ParseMetricSelector(`{job="api"}`)
+	require.NoError(t, err)
+	_, err = store.Get(ctx, now.Add(-time.Hour), now, matchers...)
+	require.Error(t, err)
+
+	// Earlier schemas don't list metric names, so can't answer such queries.
+	oldStore := newTestChunkStore(t, StoreConfig{
+		schemaFactory: v6Schema,
+	})
+	require.NoError(t, oldStore.Put(ctx, []Chunk{chunk1}))
+	_, err = oldStore.MetricNames(ctx, now.Add(-time.Hour), now)
+	assert.Equal(t, ErrMetricNamesNotIndexed, err)
+	assert.False(t, oldStore.MetricNamesIndexed(now.Add(-time.Hour), now))
+	assert.True(t, store.MetricNamesIndexed(now.Add(-time.Hour), now))
+	_, err = oldStore.Get(ctx, now.Add(-time.Hour), now, matchers...)
+	assert.Error(t, err)
+}
+
+type countingStorage struct {
+	StorageClient
+	chunkPuts, indexWrites int
+}
+
+func (s *countingStorage) PutChunk(ctx context.Context, key string, buf []byte) error {
+	s.chunkPuts++
+	return s.StorageClient.PutChunk(ctx, key, buf)
+}
+
+func (s *countingStorage) BatchWrite(ctx context.Context, batch WriteBatch) error {
+	s.indexWrites += len(batch.(*mockWriteBatch).adds)
+	return s.StorageClient.BatchWrite(ctx, batch)
+}
+
+func TestChunkStoreWriteDedupe(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	mockStorage := NewMockStorage()
+	storage := &countingStorage{StorageClient: mockStorage}
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{}, mockStorage)
+	require.NoError(t, err)
+	require.NoError(t, tableManager.syncTables(context.Background()))
+
+	// Two stores sharing a memcache, as replicas would.
+	memcache := newMockMemcache()
+	newStore := func() *Store {
+		store, err := NewStore(StoreConfig{
+			CacheConfig:   CacheConfig{WriteDedupe: true},
+			schemaFactory: v6Schema,
+		}, storage)
+		require.NoError(t, err)
+		store.cache.cache = cache.NewMemcached(memcache)
+		return store
+	}
+	store1, store2 := newStore(), newStore()
+
+	chunk1 := dummyChunk()
+	require.NoError(t, store1.Put(ctx, []Chunk{chunk1}))
+	assert.Equal(t, 1, storage.chunkPuts)
+	indexWrites := storage.indexWrites
+	assert.True(t, indexWrites > 0)
+
+	// The same chunk from a replica is skipped entirely.
+	require.NoError(t, store2.Put(ctx, []Chunk{chunk1}))
+	assert.Equal(t, 1, storage.chunkPuts)
+	assert.Equal(t, indexWrites, storage.indexWrites)
+
+	// As is a replica's chunk for the same series and range, with other bytes.
+	cs, err := chunk.New().Add(model.SamplePair{Timestamp: chunk1.Through, Value: 1})
+	require.NoError(t, err)
+	replica := NewChunk(userID, chunk1.Fingerprint, chunk1.Metric, cs[0], chunk1.From, chunk1.Through)
+	for _, c := range []*Chunk{&chunk1, &replica} {
+		_, err := c.encode()
+		require.NoError(t, err)
+	}
+	assert.NotEqual(t, chunk1.externalKey(), replica.externalKey())
+	require.NoError(t, store2.Put(ctx, []Chunk{replica}))
+	assert.Equal(t, 1, storage.chunkPuts)
+	assert.Equal(t, indexWrites, storage.indexWrites)
+
+	// A different chunk for the same series is written.
+	chunk2 := dummyChunk()
+	chunk2.Through = chunk2.Through.Add(time.Minute)
+	require.NoError(t, store2.Put(ctx, []Chunk{chunk2}))
+	assert.Equal(t, 2, storage.chunkPuts)
+	assert.True(t, storage.indexWrites > indexWrites)
+
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	require.NoError(t, err)
+	chunks, err := store2.Get(ctx, chunk1.From, chunk2.Through, matcher)
+	require.NoError(t, err)
+	assert.Len(t, chunks, 2)
+}
@@ -0,0 +1,398 @@
+package chunk
+
+import (
+	"flag"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/instrument"
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+var (
+	compactTableDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cortex",
+		Name:      "compactor_compact_table_seconds",
+		Help:      "Time spent compacting a table.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"operation", "status_code"})
+	compactedChunks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "compactor_chunks_total",
+		Help:      "Total count of chunks removed from the index, and written, by the compactor.",
+	}, []string{"action"})
+)
+
+func init() {
+	prometheus.MustRegister(compactTableDuration)
+	prometheus.MustRegister(compactedChunks)
+}
+
+// CompactorConfig configures the Compactor.
+type CompactorConfig struct {
+	Interval    time.Duration
+	GracePeriod time.Duration
+	MaxTableAge time.Duration
+	Concurrency int
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *CompactorConfig) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.Interval, "compactor.interval", time.Hour, "How often to look for tables to compact.")
+	f.DurationVar(&cfg.GracePeriod, "compactor.grace-period", 24*time.Hour, "How long after a table's period ends it is compacted.  Must exceed the ingesters' max chunk age, so no more chunks are written to it.")
+	f.DurationVar(&cfg.MaxTableAge, "compactor.max-table-age", 7*24*time.Hour, "Tables whose period ended longer ago than this aren't compacted.")
+	f.IntVar(&cfg.Concurrency, "compactor.concurrency", 10, "Number of series compacted at once.")
+}
+
+// Compactor rewrites the chunks of periodic tables once no more are being
+// written to them.  The chunks each replica of a series was flushed as are
+// merged into one sequence of chunks, and the series is downsampled to each
+// of the Resolutions, as separate series with ResolutionLabel and
+// AggregateLabel.  Tables are marked once compacted, for queriers to know
+// where downsampled series can be read; compacting a table again changes
+// nothing.
+type Compactor struct {
+	cfg     CompactorConfig
+	store   *Store
+	periods SchemaPeriods
+
+	done chan struct{}
+	wait sync.WaitGroup
+}
+
+// NewCompactor makes a new Compactor for the store's tables.
+func NewCompactor(cfg CompactorConfig, store *Store) (*Compactor, error) {
+	periods, err := store.cfg.SchemaConfig.EffectivePeriods()
+	if err != nil {
+		return nil, err
+	}
+	return &Compactor{
+		cfg:     cfg,
+		store:   store,
+		periods: periods,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Start the Compactor
+func (c *Compactor) Start() {
+	c.wait.Add(1)
+	go c.loop()
+}
+
+// Stop the Compactor
+func (c *Compactor) Stop() {
+	close(c.done)
+	c.wait.Wait()
+}
+
+func (c *Compactor) loop() {
+	defer c.wait.Done()
+
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+
+	c.compactTables(context.Background())
+	for {
+		select {
+		case <-ticker.C:
+			c.compactTables(context.Background())
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Compactor) compactTables(ctx context.Context) {
+	for _, table := range c.tablesToCompact() {
+		compacted, err := c.store.isCompacted(ctx, table.name)
+		if err != nil {
+			log.Errorf("Error checking whether table %s is compacted: %v", table.name, err)
+			continue
+		} else if compacted {
+			continue
+		}
+
+		log.Infof("Compacting table %s", table.name)
+		if err := instrument.TimeRequestHistogram(ctx, "Compactor.compactTable", compactTableDuration, func(ctx context.Context) error {
+			if err := c.compactTable(ctx, table); err != nil {
+				return err
+			}
+			return c.store.markCompacted(ctx, table.name)
+		}); err != nil {
+			log.Errorf("Error compacting table %s: %v", table.name, err)
+		}
+	}
+}
+
+// tablesToCompact returns the periodic tables whose periods ended between
+// MaxTableAge and GracePeriod ago.
+func (c *Compactor) tablesToCompact() []periodTable {
+	var (
+		now    = mtime.Now()
+		newest = model.TimeFromUnixNano(now.Add(-c.cfg.GracePeriod).UnixNano())
+		oldest = model.TimeFromUnixNano(now.Add(-c.cfg.MaxTableAge).UnixNano())
+		result = []periodTable{}
+	)
+	for _, table := range c.periods.tables(oldest, newest) {
+		if table.periodic && oldest < table.through && table.through <= newest {
+			result = append(result, table)
+		}
+	}
+	return result
+}
+
+// seriesKey identifies a series in the index.
+type seriesKey struct {
+	userID      string
+	fingerprint model.Fingerprint
+}
+
+// tableSeries is what the index says about a series in a table.
+type tableSeries struct {
+	chunks []Chunk
+	// The entries in the table referring to each chunk, by chunk ID.
+	refs map[string][]IndexEntry
+}
+
+func (c *Compactor) compactTable(ctx context.Context, table periodTable) error {
+	series, err := c.scanTable(ctx, table.name)
+	if err != nil {
+		return err
+	}
+	log.Infof("Table %s has %d series", table.name, len(series))
+
+	workers := c.cfg.Concurrency
+	if workers <= 0 {
+		workers = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		mtx      sync.Mutex
+		firstErr error
+		toDo     = make(chan seriesKey)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range toDo {
+				if err := c.compactSeries(ctx, table, key.userID, series[key]); err != nil {
+					mtx.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mtx.Unlock()
+				}
+			}
+		}()
+	}
+	for key := range series {
+		toDo <- key
+	}
+	close(toDo)
+	wg.Wait()
+	return firstErr
+}
+
+// scanTable reads the chunk entries of the table, grouped by series.  Very
+// old entries with the chunk metadata in the index are skipped.
+func (c *Compactor) scanTable(ctx context.Context, tableName string) (map[seriesKey]*tableSeries, error) {
+	series := map[seriesKey]*tableSeries{}
+	err := c.store.storage.ScanTable(ctx, tableName, "", func(entry IndexEntry) bool {
+		if entry.HashValue == compactedHashValue {
+			return true
+		}
+		chunkID, _, kind, err := parseRangeValue(entry.RangeValue, entry.Value)
+		if err != nil {
+			log.Warnf("Skipping index entry %s/%x in %s: %v", entry.HashValue, entry.RangeValue, tableName, err)
+			return true
+		}
+		if kind != chunkEntry {
+			return true
+		}
+
+		i := strings.Index(entry.HashValue, ":")
+		if i < 0 {
+			log.Warnf("Skipping index entry %s/%x in %s: no user ID", entry.HashValue, entry.RangeValue, tableName)
+			return true
+		}
+		userID := entry.HashValue[:i]
+		chunk, err := parseExternalKey(userID, chunkID)
+		if err != nil {
+			log.Warnf("Skipping index entry %s/%x in %s: %v", entry.HashValue, entry.RangeValue, tableName, err)
+			return true
+		}
+
+		key := seriesKey{userID, chunk.Fingerprint}
+		s, ok := series[key]
+		if !ok {
+			s = &tableSeries{refs: map[string][]IndexEntry{}}
+			series[key] = s
+		}
+		if _, ok := s.refs[chunkID]; !ok {
+			s.chunks = append(s.chunks, chunk)
+		}
+		s.refs[chunkID] = append(s.refs[chunkID], entry)
+		return true
+	})
+	return series, err
+}
+
+// compactSeries rewrites the series' chunks if they overlap, then writes its
+// downsampled series.  Only the samples in the table's period are used; the
+// series' chunks which run into other tables' periods are still referred to
+// by those tables.
+func (c *Compactor) compactSeries(ctx context.Context, table periodTable, userID string, series *tableSeries) error {
+	ctx = user.Inject(ctx, userID)
+	chunks, err := c.store.fetchChunkData(ctx, series.chunks)
+	if err != nil {
+		return err
+	}
+	if len(chunks) == 0 || IsDownsampled(chunks[0].Metric) {
+		return nil
+	}
+	metric := chunks[0].Metric
+
+	sort.Sort(byFrom(chunks))
+	var (
+		samples     []model.SamplePair
+		overlapping bool
+		through     model.Time
+	)
+	for i, chunk := range chunks {
+		if i > 0 && chunk.From <= through {
+			overlapping = true
+		}
+		if i == 0 || chunk.Through > through {
+			through = chunk.Through
+		}
+		chunkSamples, err := chunk.samples()
+		if err != nil {
+			return err
+		}
+		samples = util.MergeSamples(samples, chunkSamples)
+	}
+	samples = util.SamplesBetween(samples, table.from, table.through)
+
+	if overlapping {
+		merged, err := ChunksForSamples(userID, metric, samples)
+		if err != nil {
+			return err
+		}
+		if err := c.store.Put(ctx, merged); err != nil {
+			return err
+		}
+
+		written := map[string]bool{}
+		for _, chunk := range merged {
+			written[chunk.externalKey()] = true
+		}
+		batch := c.store.storage.NewWriteBatch()
+		removed := 0
+		for chunkID, entries := range series.refs {
+			if written[chunkID] {
+				continue
+			}
+			for _, entry := range entries {
+				batch.Delete(entry.TableName, entry.HashValue, entry.RangeValue)
+			}
+			removed++
+		}
+		if err := c.store.storage.BatchWrite(ctx, batch); err != nil {
+			return err
+		}
+		compactedChunks.WithLabelValues("removed").Add(float64(removed))
+		compactedChunks.WithLabelValues("written").Add(float64(len(merged)))
+	}
+
+	for _, resolution := range Resolutions {
+		for aggregate, aggregated := range Downsample(samples, resolution) {
+			downsampled, err := ChunksForSamples(userID, DownsampledMetric(metric, resolution, aggregate), aggregated)
+			if err != nil {
+				return err
+			}
+			if err := c.store.Put(ctx, downsampled); err != nil {
+				return err
+			}
+			compactedChunks.WithLabelValues("downsampled").Add(float64(len(downsampled)))
+		}
+	}
+	return nil
+}
+
+// compactedHashValue is the row the compactor marks tables compacted in.
+// User IDs prefix every other row, so it can't clash with them.
+const compactedHashValue = ":compacted"
+
+// markCompacted records that the compactor has finished with the table.
+func (c *Store) markCompacted(ctx context.Context, tableName string) error {
+	batch := c.storage.NewWriteBatch()
+	batch.Add(tableName, compactedHashValue, []byte("1"), nil)
+	if err := c.storage.BatchWrite(ctx, batch); err != nil {
+		return err
+	}
+	c.compactedMtx.Lock()
+	c.compacted[tableName] = true
+	c.compactedMtx.Unlock()
+	return nil
+}
+
+// isCompacted says whether the compactor has finished with the table.
+func (c *Store) isCompacted(ctx context.Context, tableName string) (bool, error) {
+	c.compactedMtx.Lock()
+	compacted := c.compacted[tableName]
+	c.compactedMtx.Unlock()
+	if compacted {
+		return true, nil
+	}
+
+	// Not through the index cache, which would remember the table wasn't.
+	err := c.storage.QueryPages(ctx, IndexEntry{TableName: tableName, HashValue: compactedHashValue}, func(resp ReadBatch, lastPage bool) bool {
+		compacted = resp.Len() > 0
+		return !compacted && !lastPage
+	})
+	if err != nil || !compacted {
+		return false, err
+	}
+	c.compactedMtx.Lock()
+	c.compacted[tableName] = true
+	c.compactedMtx.Unlock()
+	return true, nil
+}
+
+// CompactedThrough returns the time up to which the tables holding
+// [from, through) have been compacted, in turn from the first, so have
+// downsampled series.  It is from if the first table hasn't been.
+func (c *Store) CompactedThrough(ctx context.Context, from, through model.Time) (model.Time, error) {
+	result := from
+	for _, table := range c.periods.tables(from, through) {
+		if !table.periodic {
+			break
+		}
+		compacted, err := c.isCompacted(ctx, table.name)
+		if err != nil {
+			return 0, err
+		}
+		if !compacted {
+			break
+		}
+		result = table.through
+	}
+	return result, nil
+}
+
+type byFrom []Chunk
+
+func (cs byFrom) Len() int           { return len(cs) }
+func (cs byFrom) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
+func (cs byFrom) Less(i, j int) bool { return cs[i].From < cs[j].From }
@@ -0,0 +1,158 @@
+package chunk
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+const day = 24 * time.Hour
+
+func newTestCompactor(t *testing.T) *Compactor {
+	storage := NewMockStorage()
+	for _, name := range []string{"", tablePrefix + "0", tablePrefix + "1", tablePrefix + "2", tablePrefix + "3"} {
+		require.NoError(t, storage.CreateTable(context.Background(), tableDescription{name: name}))
+	}
+
+	store, err := NewStore(StoreConfig{
+		SchemaConfig: SchemaConfig{
+			PeriodicTableConfig: PeriodicTableConfig{
+				UsePeriodicTables:    true,
+				TablePrefix:          tablePrefix,
+				TablePeriod:          day,
+				PeriodicTableStartAt: util.NewDayValue(0),
+			},
+			V7SchemaFrom: util.NewDayValue(0),
+		},
+	}, storage)
+	require.NoError(t, err)
+
+	compactor, err := NewCompactor(CompactorConfig{
+		GracePeriod: day,
+		MaxTableAge: 7 * day,
+		Concurrency: 2,
+	}, store)
+	require.NoError(t, err)
+	return compactor
+}
+
+func TestCompactorTablesToCompact(t *testing.T) {
+	compactor := newTestCompactor(t)
+	mtime.NowForce(time.Unix(0, 0).Add(3*day + time.Hour))
+	defer mtime.NowReset()
+
+	assert.Equal(t, []periodTable{
+		{name: tablePrefix + "0", periodic: true, from: 0, through: model.TimeFromUnix(int64(day / time.Second))},
+		{name: tablePrefix + "1", periodic: true, from: model.TimeFromUnix(int64(day / time.Second)), through: model.TimeFromUnix(int64(2 * day / time.Second))},
+	}, compactor.tablesToCompact())
+}
+
+func TestCompactor(t *testing.T) {
+	compactor := newTestCompactor(t)
+	ctx := user.Inject(context.Background(), userID)
+	mtime.NowForce(time.Unix(0, 0).Add(3*day + time.Hour))
+	defer mtime.NowReset()
+
+	// An hour of samples every 15s on day 1, flushed as one chunk by one
+	// replica and two by another.
+	series := model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}
+	start := model.TimeFromUnix(int64(day / time.Second))
+	samples := []model.SamplePair{}
+	for i := 0; i < 240; i++ {
+		samples = append(samples, model.SamplePair{Timestamp: start.Add(time.Duration(i) * 15 * time.Second), Value: model.SampleValue(i)})
+	}
+	replicaA, err := ChunksForSamples(userID, series, samples)
+	require.NoError(t, err)
+	replicaB1, err := ChunksForSamples(userID, series, samples[:100])
+	require.NoError(t, err)
+	replicaB2, err := ChunksForSamples(userID, series, samples[100:])
+	require.NoError(t, err)
+	original := append(append(append([]Chunk{}, replicaA...), replicaB1...), replicaB2...)
+	for i := range original {
+		// Sets the checksum, which is part of the chunk's key.
+		_, err := original[i].encode()
+		require.NoError(t, err)
+	}
+	require.NoError(t, compactor.store.Put(ctx, original))
+
+	tableName := tablePrefix + "1"
+	chunkIDs := func() []string {
+		tableSeries, err := compactor.scanTable(ctx, tableName)
+		require.NoError(t, err)
+		ids := []string{}
+		for _, s := range tableSeries {
+			for id := range s.refs {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	get := func(matchers ...*metric.LabelMatcher) model.Matrix {
+		chunks, err := compactor.store.Get(ctx, start, start.Add(time.Hour), append([]*metric.LabelMatcher{
+			mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"),
+		}, matchers...)...)
+		require.NoError(t, err)
+		matrix, err := ChunksToMatrix(chunks)
+		require.NoError(t, err)
+		return matrix
+	}
+
+	compactor.compactTables(context.Background())
+
+	// Tables 0 and 1 are marked compacted, which survives restarts.
+	compactor.store.compacted = map[string]bool{}
+	through, err := compactor.store.CompactedThrough(ctx, 0, model.TimeFromUnix(int64(3*day/time.Second)))
+	require.NoError(t, err)
+	assert.Equal(t, model.TimeFromUnix(int64(2*day/time.Second)), through)
+	through, err = compactor.store.CompactedThrough(ctx, model.TimeFromUnix(int64(2*day/time.Second)), model.TimeFromUnix(int64(3*day/time.Second)))
+	require.NoError(t, err)
+	assert.Equal(t, model.TimeFromUnix(int64(2*day/time.Second)), through)
+
+	// The raw series is one sequence of chunks with the same samples; those
+	// are the chunks of the replica which flushed one chunk, so the other's
+	// are no longer in the index.  The downsampled series aren't looked up.
+	chunks, err := compactor.store.Get(ctx, start, start.Add(time.Hour), mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	require.NoError(t, err)
+	require.Len(t, chunks, len(replicaA))
+	sort.Sort(byFrom(chunks))
+	for i, c := range chunks {
+		assert.Equal(t, original[i].externalKey(), c.externalKey())
+	}
+	for _, c := range original[len(replicaA):] {
+		assert.NotContains(t, chunkIDs(), c.externalKey())
+	}
+	assert.Equal(t, model.Matrix{{Metric: series, Values: samples}}, get())
+
+	// 12 five minute intervals of 20 samples each.
+	count := get(mustNewLabelMatcher(metric.Equal, ResolutionLabel, "5m"), mustNewLabelMatcher(metric.Equal, AggregateLabel, AggregateCount))
+	require.Len(t, count, 1)
+	assert.Equal(t, DownsampledMetric(series, 5*time.Minute, AggregateCount), count[0].Metric)
+	require.Len(t, count[0].Values, 12)
+	for i, v := range count[0].Values {
+		assert.Equal(t, samples[i*20+19].Timestamp, v.Timestamp)
+		assert.Equal(t, model.SampleValue(20), v.Value)
+	}
+
+	sum := get(mustNewLabelMatcher(metric.Equal, ResolutionLabel, "1h"), mustNewLabelMatcher(metric.Equal, AggregateLabel, AggregateSum))
+	require.Len(t, sum, 1)
+	assert.Equal(t, []model.SamplePair{{Timestamp: samples[239].Timestamp, Value: 239 * 240 / 2}}, sum[0].Values)
+
+	_, err = compactor.store.Get(ctx, start, start.Add(time.Hour), mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"), mustNewLabelMatcher(metric.RegexMatch, ResolutionLabel, ".+"))
+	assert.Equal(t, ErrDownsampledMatchers, err)
+
+	// Compacting again changes nothing.
+	before := chunkIDs()
+	require.NoError(t, compactor.compactTable(context.Background(), compactor.tablesToCompact()[1]))
+	assert.Equal(t, before, chunkIDs())
+}
@@ -0,0 +1,194 @@
+package chunk
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/prometheus/common/model"
+	prom_chunk "github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/prometheus/prometheus/storage/metric"
+
+	"github.com/weaveworks/common/errors"
+)
+
+// Downsampled series are written alongside the raw series they summarise,
+// with these two extra labels saying which resolution and aggregate they hold.
+const (
+	ResolutionLabel = model.LabelName("__resolution__")
+	AggregateLabel  = model.LabelName("__aggr__")
+)
+
+// Resolutions are the intervals the compactor downsamples series to.
+var Resolutions = []time.Duration{5 * time.Minute, time.Hour}
+
+// The aggregates written for each interval.
+const (
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+	AggregateSum   = "sum"
+	AggregateCount = "count"
+)
+
+// ErrDownsampledMatchers is returned for queries of downsampled series which
+// don't select one resolution and aggregate.
+const ErrDownsampledMatchers = errors.Error("downsampled series must be selected by equality on both " + string(ResolutionLabel) + " and " + string(AggregateLabel))
+
+// IsDownsampled says whether the metric is of a downsampled series.
+func IsDownsampled(m model.Metric) bool {
+	_, ok := m[ResolutionLabel]
+	return ok
+}
+
+// SelectsDownsampled says whether the matchers ask for downsampled series,
+// which are otherwise left out of query results.
+func SelectsDownsampled(matchers []*metric.LabelMatcher) bool {
+	for _, m := range matchers {
+		if m.Name == ResolutionLabel || m.Name == AggregateLabel {
+			return true
+		}
+	}
+	return false
+}
+
+// downsampledSelection returns the resolution and aggregate the matchers
+// select, if they ask for downsampled series.
+func downsampledSelection(matchers []*metric.LabelMatcher) (resolution, aggregate model.LabelValue, ok bool, err error) {
+	if !SelectsDownsampled(matchers) {
+		return "", "", false, nil
+	}
+	for _, m := range matchers {
+		if m.Type != metric.Equal {
+			continue
+		}
+		switch m.Name {
+		case ResolutionLabel:
+			resolution = m.Value
+		case AggregateLabel:
+			aggregate = m.Value
+		}
+	}
+	if resolution == "" || aggregate == "" {
+		return "", "", false, ErrDownsampledMatchers
+	}
+	return resolution, aggregate, true, nil
+}
+
+// indexUserID is the user ID the metric's series is indexed under.
+// Downsampled series share their raw series' metric name, so are indexed
+// under a user ID of their own, to keep them out of lookups of raw series.
+func indexUserID(userID string, m model.Metric) string {
+	if !IsDownsampled(m) {
+		return userID
+	}
+	return downsampledIndexUserID(userID, m[ResolutionLabel], m[AggregateLabel])
+}
+
+func downsampledIndexUserID(userID string, resolution, aggregate model.LabelValue) string {
+	return fmt.Sprintf("%s:%s:%s", userID, resolution, aggregate)
+}
+
+// DownsampledMetric returns the metric of the series holding the given
+// aggregate of m at the given resolution.
+func DownsampledMetric(m model.Metric, resolution time.Duration, aggregate string) model.Metric {
+	result := m.Clone()
+	result[ResolutionLabel] = model.LabelValue(model.Duration(resolution).String())
+	result[AggregateLabel] = model.LabelValue(aggregate)
+	return result
+}
+
+// RawMetric returns the metric of the raw series a downsampled one summarises.
+func RawMetric(m model.Metric) model.Metric {
+	if !IsDownsampled(m) {
+		return m
+	}
+	result := m.Clone()
+	delete(result, ResolutionLabel)
+	delete(result, AggregateLabel)
+	return result
+}
+
+// Downsample aggregates the samples, which must be sorted, over intervals of
+// the given resolution.  Each interval's aggregates are timestamped with its
+// last sample, so they never lie beyond the raw data.
+func Downsample(samples []model.SamplePair, resolution time.Duration) map[string][]model.SamplePair {
+	result := map[string][]model.SamplePair{}
+	res := int64(resolution / time.Millisecond)
+
+	var (
+		start                int64 = math.MinInt64
+		min, max, sum, count model.SampleValue
+		last                 model.Time
+	)
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		for aggregate, value := range map[string]model.SampleValue{
+			AggregateMin:   min,
+			AggregateMax:   max,
+			AggregateSum:   sum,
+			AggregateCount: count,
+		} {
+			result[aggregate] = append(result[aggregate], model.SamplePair{Timestamp: last, Value: value})
+		}
+	}
+
+	for _, s := range samples {
+		interval := int64(s.Timestamp) - mod(int64(s.Timestamp), res)
+		if interval != start {
+			flush()
+			start = interval
+			min, max, sum, count = s.Value, s.Value, 0, 0
+		}
+		if s.Value < min {
+			min = s.Value
+		}
+		if s.Value > max {
+			max = s.Value
+		}
+		sum += s.Value
+		count++
+		last = s.Timestamp
+	}
+	flush()
+	return result
+}
+
+// mod is the remainder of a / b, which is never negative.
+func mod(a, b int64) int64 {
+	m := a % b
+	if m < 0 {
+		m += b
+	}
+	return m
+}
+
+// ChunksForSamples encodes the samples, which must be sorted, into as many
+// chunks of the metric as they need.
+func ChunksForSamples(userID string, metric model.Metric, samples []model.SamplePair) ([]Chunk, error) {
+	if len(samples) == 0 {
+		return nil, nil
+	}
+
+	promChunks := []prom_chunk.Chunk{prom_chunk.New()}
+	for _, s := range samples {
+		head := promChunks[len(promChunks)-1]
+		added, err := head.Add(s)
+		if err != nil {
+			return nil, err
+		}
+		promChunks = append(promChunks[:len(promChunks)-1], added...)
+	}
+
+	fp := metric.Fingerprint()
+	result := make([]Chunk, 0, len(promChunks))
+	for _, c := range promChunks {
+		through, err := c.NewIterator().LastTimestamp()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, NewChunk(userID, fp, metric, c, c.FirstTime(), through))
+	}
+	return result, nil
+}
@@ -0,0 +1,67 @@
+package chunk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownsample(t *testing.T) {
+	samples := []model.SamplePair{
+		{Timestamp: 0, Value: 4},
+		{Timestamp: 60000, Value: 1},
+		{Timestamp: 299999, Value: 7},
+		{Timestamp: 300000, Value: 2},
+		{Timestamp: 900000, Value: 5},
+	}
+	assert.Equal(t, map[string][]model.SamplePair{
+		AggregateMin:   {{Timestamp: 299999, Value: 1}, {Timestamp: 300000, Value: 2}, {Timestamp: 900000, Value: 5}},
+		AggregateMax:   {{Timestamp: 299999, Value: 7}, {Timestamp: 300000, Value: 2}, {Timestamp: 900000, Value: 5}},
+		AggregateSum:   {{Timestamp: 299999, Value: 12}, {Timestamp: 300000, Value: 2}, {Timestamp: 900000, Value: 5}},
+		AggregateCount: {{Timestamp: 299999, Value: 3}, {Timestamp: 300000, Value: 1}, {Timestamp: 900000, Value: 1}},
+	}, Downsample(samples, 5*time.Minute))
+
+	assert.Equal(t, map[string][]model.SamplePair{
+		AggregateMin:   {{Timestamp: 900000, Value: 1}},
+		AggregateMax:   {{Timestamp: 900000, Value: 7}},
+		AggregateSum:   {{Timestamp: 900000, Value: 19}},
+		AggregateCount: {{Timestamp: 900000, Value: 5}},
+	}, Downsample(samples, time.Hour))
+
+	assert.Empty(t, Downsample(nil, time.Hour))
+}
+
+func TestDownsampledMetric(t *testing.T) {
+	raw := model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}
+	downsampled := DownsampledMetric(raw, time.Hour, AggregateSum)
+	assert.Equal(t, model.Metric{model.MetricNameLabel: "foo", "bar": "baz", ResolutionLabel: "1h", AggregateLabel: "sum"}, downsampled)
+	assert.True(t, IsDownsampled(downsampled))
+	assert.False(t, IsDownsampled(raw))
+	assert.Equal(t, raw, RawMetric(downsampled))
+}
+
+func TestChunksForSamples(t *testing.T) {
+	metric := model.Metric{model.MetricNameLabel: "foo"}
+	samples := []model.SamplePair{}
+	for i := 0; i < 2000; i++ {
+		samples = append(samples, model.SamplePair{Timestamp: model.Time(i * 15000), Value: model.SampleValue(i * i)})
+	}
+
+	chunks, err := ChunksForSamples(userID, metric, samples)
+	require.NoError(t, err)
+	require.True(t, len(chunks) > 1)
+	for i, c := range chunks {
+		assert.Equal(t, metric.Fingerprint(), c.Fingerprint)
+		if i > 0 {
+			assert.True(t, c.From > chunks[i-1].Through)
+		}
+	}
+
+	matrix, err := ChunksToMatrix(chunks)
+	require.NoError(t, err)
+	require.Len(t, matrix, 1)
+	assert.Equal(t, samples, matrix[0].Values)
+}
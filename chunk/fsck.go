@@ -0,0 +1,388 @@
+package chunk
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+// FsckConfig configures a Checker.
+type FsckConfig struct {
+	UserID        string
+	From, Through util.DayValue
+	Parallelism   int
+	Orphans       bool
+	Repair        bool
+	QuarantineDir string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *FsckConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.UserID, "fsck.user", "", "The tenant whose chunks to check.")
+	f.Var(&cfg.From, "fsck.from", "The first day (in the format YYYY-MM-DD) to check the chunks of.")
+	f.Var(&cfg.Through, "fsck.through", "The day (in the format YYYY-MM-DD) to check chunks up to, exclusive; defaults to now.")
+	f.IntVar(&cfg.Parallelism, "fsck.parallelism", 10, "Number of chunks checked at once.")
+	f.BoolVar(&cfg.Orphans, "fsck.orphans", true, "List the tenant's chunks in the object store, to find those not in the index.  Chunks being flushed while the check runs may be reported too.")
+	f.BoolVar(&cfg.Repair, "fsck.repair", false, "Delete the index entries of missing chunks, and of corrupt chunks once quarantined.")
+	f.StringVar(&cfg.QuarantineDir, "fsck.quarantine-dir", "", "Directory corrupt chunks are copied to.  Only quarantined corrupt chunks are removed from the index.")
+}
+
+// FsckReport is the result of a check, for printing as JSON.
+type FsckReport struct {
+	UserID  string     `json:"user_id"`
+	From    model.Time `json:"from"`
+	Through model.Time `json:"through"`
+	Tables  []string   `json:"tables"`
+	Checked int        `json:"checked"`
+
+	Missing  []FsckProblem `json:"missing"`
+	Corrupt  []FsckProblem `json:"corrupt"`
+	Orphaned []string      `json:"orphaned"`
+
+	Quarantined         []string `json:"quarantined"`
+	DeletedIndexEntries int      `json:"deleted_index_entries"`
+}
+
+// FsckProblem is a chunk which is missing or corrupt, and the index entries
+// referring to it.
+type FsckProblem struct {
+	Key          string   `json:"key"`
+	Error        string   `json:"error"`
+	IndexEntries []string `json:"index_entries"`
+}
+
+// Checker checks the chunks of a tenant listed in the index exist and decode
+// to the chunks their keys name, and that the tenant's chunks in the object
+// store are in the index.
+//
+// Index tables are scanned one at a time; each chunk is fetched once, however
+// many tables list it.  Only the keys of the chunks are kept between tables.
+type Checker struct {
+	cfg     FsckConfig
+	store   *Store
+	periods SchemaPeriods
+}
+
+// NewChecker makes a new Checker.
+func NewChecker(cfg FsckConfig, store *Store) (*Checker, error) {
+	if cfg.UserID == "" {
+		return nil, fmt.Errorf("no tenant to check")
+	}
+	if !cfg.From.IsSet() {
+		return nil, fmt.Errorf("no day to check from")
+	}
+	periods, err := store.cfg.SchemaConfig.EffectivePeriods()
+	if err != nil {
+		return nil, err
+	}
+	return &Checker{
+		cfg:     cfg,
+		store:   store,
+		periods: periods,
+	}, nil
+}
+
+// fsckChunk is a chunk listed in an index table, with the table's entries for it.
+type fsckChunk struct {
+	chunk   Chunk
+	entries []IndexEntry
+}
+
+// Run checks the chunks, repairing the index if configured to.
+func (c *Checker) Run(ctx context.Context) (*FsckReport, error) {
+	ctx = user.Inject(ctx, c.cfg.UserID)
+	report := &FsckReport{
+		UserID:      c.cfg.UserID,
+		From:        c.cfg.From.Time,
+		Through:     model.Now(),
+		Tables:      []string{},
+		Missing:     []FsckProblem{},
+		Corrupt:     []FsckProblem{},
+		Orphaned:    []string{},
+		Quarantined: []string{},
+	}
+	if c.cfg.Through.IsSet() {
+		report.Through = c.cfg.Through.Time
+	}
+
+	var (
+		// The problem with each chunk checked, or nil if it is fine.
+		checked = map[string]error{}
+		found   = map[string]*FsckProblem{}
+	)
+	for _, table := range c.periods.tables(report.From, report.Through) {
+		log.Infof("Checking table %s", table.name)
+		chunks, err := c.scanTable(ctx, table)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning table %s: %v", table.name, err)
+		}
+		report.Tables = append(report.Tables, table.name)
+
+		toCheck := []Chunk{}
+		for key, fc := range chunks {
+			if _, ok := checked[key]; ok {
+				continue
+			}
+			if fc.chunk.Through < report.From || report.Through <= fc.chunk.From {
+				continue
+			}
+			toCheck = append(toCheck, fc.chunk)
+		}
+		problems, err := c.checkChunks(ctx, toCheck)
+		if err != nil {
+			return nil, fmt.Errorf("error checking table %s: %v", table.name, err)
+		}
+		for i, chunk := range toCheck {
+			checked[chunk.externalKey()] = problems[i]
+		}
+		report.Checked += len(toCheck)
+
+		if err := c.handleProblems(ctx, report, chunks, checked, found); err != nil {
+			return nil, fmt.Errorf("error repairing table %s: %v", table.name, err)
+		}
+	}
+
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if checked[key] == ErrStorageObjectNotFound {
+			report.Missing = append(report.Missing, *found[key])
+		} else {
+			report.Corrupt = append(report.Corrupt, *found[key])
+		}
+	}
+
+	if c.cfg.Orphans {
+		if err := c.findOrphans(ctx, report, checked); err != nil {
+			return nil, fmt.Errorf("error listing chunks: %v", err)
+		}
+	}
+	return report, nil
+}
+
+// scanTable returns the tenant's chunks listed in the table, by key, with the
+// table's entries for each.
+func (c *Checker) scanTable(ctx context.Context, table periodTable) (map[string]*fsckChunk, error) {
+	var (
+		prefix = c.cfg.UserID + ":"
+		chunks = map[string]*fsckChunk{}
+	)
+	err := c.store.storage.ScanTable(ctx, table.name, "", func(entry IndexEntry) bool {
+		if !strings.HasPrefix(entry.HashValue, prefix) {
+			return true
+		}
+		chunkID, _, kind, err := parseRangeValue(entry.RangeValue, entry.Value)
+		if err != nil {
+			log.Warnf("Skipping index entry %s/%x in %s: %v", entry.HashValue, entry.RangeValue, table.name, err)
+			return true
+		}
+		if kind != chunkEntry && kind != chunkEntryMetadataInIndex {
+			return true
+		}
+
+		chunk, err := parseExternalKey(c.cfg.UserID, chunkID)
+		if err != nil {
+			log.Warnf("Skipping index entry %s/%x in %s: %v", entry.HashValue, entry.RangeValue, table.name, err)
+			return true
+		}
+		if kind == chunkEntryMetadataInIndex && entry.Value != nil {
+			if err := json.Unmarshal(entry.Value, &chunk); err != nil {
+				log.Warnf("Skipping index entry %s/%x in %s: %v", entry.HashValue, entry.RangeValue, table.name, err)
+				return true
+			}
+			chunk.metadataInIndex = true
+		}
+
+		key := chunk.externalKey()
+		fc, ok := chunks[key]
+		if !ok {
+			fc = &fsckChunk{chunk: chunk}
+			chunks[key] = fc
+		}
+		fc.entries = append(fc.entries, entry)
+		return true
+	})
+	return chunks, err
+}
+
+// checkChunks fetches and decodes the chunks, returning the problem with each.
+// Errors other than a missing or corrupt chunk stop the check, as they say
+// nothing about the chunk.
+func (c *Checker) checkChunks(ctx context.Context, chunks []Chunk) ([]error, error) {
+	workers := c.cfg.Parallelism
+	if workers <= 0 {
+		workers = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		mtx      sync.Mutex
+		firstErr error
+		problems = make([]error, len(chunks))
+		toDo     = make(chan int)
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range toDo {
+				problem, err := c.checkChunk(ctx, chunks[i])
+				if err != nil {
+					mtx.Lock()
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+					mtx.Unlock()
+					continue
+				}
+				problems[i] = problem
+			}
+		}()
+	}
+	for i := range chunks {
+		toDo <- i
+	}
+	close(toDo)
+	wg.Wait()
+	return problems, firstErr
+}
+
+// checkChunk returns the problem with the chunk, if it is missing or doesn't
+// decode to the chunk its key names.
+func (c *Checker) checkChunk(ctx context.Context, chunk Chunk) (problem, err error) {
+	key := chunk.externalKey()
+	buf, err := c.store.storage.GetChunk(ctx, key)
+	if err == ErrStorageObjectNotFound {
+		return err, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading chunk %s: %v", key, err)
+	}
+
+	decoded := chunk
+	if err := decoded.decode(buf); err != nil {
+		return err, nil
+	}
+	// Chunks with checksums have their metadata checked by decode.
+	if !chunk.ChecksumSet && !chunk.metadataInIndex && (decoded.From != chunk.From || decoded.Through != chunk.Through) {
+		return ErrWrongMetadata, nil
+	}
+	return nil, nil
+}
+
+// handleProblems records the problems with the table's chunks, and removes
+// them from the table's index if configured to.
+func (c *Checker) handleProblems(ctx context.Context, report *FsckReport, chunks map[string]*fsckChunk, checked map[string]error, found map[string]*FsckProblem) error {
+	keys := make([]string, 0, len(chunks))
+	for key := range chunks {
+		if checked[key] != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	batch := c.store.storage.NewWriteBatch()
+	deletes := 0
+	for _, key := range keys {
+		fc, problem := chunks[key], checked[key]
+		p, ok := found[key]
+		if !ok {
+			p = &FsckProblem{Key: key, Error: problem.Error()}
+			found[key] = p
+		}
+		for _, entry := range fc.entries {
+			p.IndexEntries = append(p.IndexEntries, fmt.Sprintf("%s/%s/%x", entry.TableName, entry.HashValue, entry.RangeValue))
+		}
+
+		if problem != ErrStorageObjectNotFound {
+			if c.cfg.QuarantineDir == "" {
+				continue
+			}
+			quarantined, err := c.quarantine(ctx, key)
+			if err != nil {
+				return err
+			}
+			if quarantined {
+				report.Quarantined = append(report.Quarantined, key)
+			}
+		}
+		if !c.cfg.Repair {
+			continue
+		}
+		for _, entry := range fc.entries {
+			batch.Delete(entry.TableName, entry.HashValue, entry.RangeValue)
+		}
+		deletes += len(fc.entries)
+	}
+
+	if deletes == 0 {
+		return nil
+	}
+	if err := c.store.storage.BatchWrite(ctx, batch); err != nil {
+		return err
+	}
+	report.DeletedIndexEntries += deletes
+	return nil
+}
+
+// quarantine copies the chunk's object to the quarantine directory, unless
+// an earlier table's check already did.
+func (c *Checker) quarantine(ctx context.Context, key string) (bool, error) {
+	filename := filepath.Join(c.cfg.QuarantineDir, filepath.FromSlash(key))
+	if _, err := os.Stat(filename); err == nil {
+		return false, nil
+	}
+	buf, err := c.store.storage.GetChunk(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("error reading chunk %s: %v", key, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return false, err
+	}
+	return true, ioutil.WriteFile(filename, buf, 0644)
+}
+
+// findOrphans reports the tenant's chunks in the period which aren't in the
+// index.
+func (c *Checker) findOrphans(ctx context.Context, report *FsckReport, indexed map[string]error) error {
+	prefix := c.cfg.UserID + "/"
+	err := c.store.storage.ListChunks(ctx, prefix, func(key string) bool {
+		if _, ok := indexed[key]; ok {
+			return true
+		}
+		// Keys of chunks with metadata in the index are legacy chunk IDs
+		// with the tenant prepended.
+		chunk, err := parseExternalKey(c.cfg.UserID, key)
+		if err != nil {
+			chunk, err = parseLegacyChunkID(c.cfg.UserID, strings.TrimPrefix(key, prefix))
+		}
+		if err != nil {
+			log.Warnf("Skipping chunk %s: %v", key, err)
+			return true
+		}
+		if chunk.Through < report.From || report.Through <= chunk.From {
+			return true
+		}
+		report.Orphaned = append(report.Orphaned, key)
+		return true
+	})
+	sort.Strings(report.Orphaned)
+	return err
+}
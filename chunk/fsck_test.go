@@ -0,0 +1,100 @@
+package chunk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestChecker(t *testing.T) {
+	store := newMigrateTestStore(t, tablePrefix, SchemaConfig{V7SchemaFrom: util.NewDayValue(0)})
+	storage := store.storage.(*MockStorage)
+	ctx := user.Inject(context.Background(), userID)
+
+	// A chunk a day for 10 days.
+	series := model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}
+	chunks := []Chunk{}
+	for d := 1; d <= 10; d++ {
+		start := model.TimeFromUnix(0).Add(time.Duration(d) * day)
+		cs, err := ChunksForSamples(userID, series, []model.SamplePair{{Timestamp: start, Value: 1}, {Timestamp: start.Add(time.Hour), Value: 2}})
+		require.NoError(t, err)
+		chunks = append(chunks, cs...)
+	}
+	require.NoError(t, store.Put(ctx, chunks))
+
+	// Lose one chunk, overwrite another with a third's data, and write one
+	// without indexing it.
+	missing, corrupt, orphaned := chunks[2].externalKey(), chunks[5].externalKey(), chunks[9]
+	delete(storage.objects, missing)
+	storage.objects[corrupt] = storage.objects[chunks[6].externalKey()]
+	orphaned.From, orphaned.Through = orphaned.From.Add(2*time.Hour), orphaned.Through.Add(2*time.Hour)
+	buf, err := orphaned.encode()
+	require.NoError(t, err)
+	require.NoError(t, storage.PutChunk(ctx, orphaned.externalKey(), buf))
+
+	dir, err := ioutil.TempDir("", "fsck")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cfg := FsckConfig{
+		UserID:      userID,
+		From:        util.NewDayValue(0),
+		Through:     util.NewDayValue(model.TimeFromUnix(0).Add(14 * day)),
+		Parallelism: 2,
+		Orphans:     true,
+	}
+	checker, err := NewChecker(cfg, store)
+	require.NoError(t, err)
+	report, err := checker.Run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 10, report.Checked)
+	require.Len(t, report.Missing, 1)
+	assert.Equal(t, missing, report.Missing[0].Key)
+	assert.NotEmpty(t, report.Missing[0].IndexEntries)
+	require.Len(t, report.Corrupt, 1)
+	assert.Equal(t, corrupt, report.Corrupt[0].Key)
+	assert.Equal(t, ErrInvalidChecksum.Error(), report.Corrupt[0].Error)
+	assert.Equal(t, []string{orphaned.externalKey()}, report.Orphaned)
+	assert.Equal(t, 0, report.DeletedIndexEntries)
+
+	// Repairing removes the chunks from the index, once the corrupt one is
+	// quarantined, so queries no longer fail.
+	_, err = store.Get(ctx, 0, model.TimeFromUnix(0).Add(14*day), mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	require.Error(t, err)
+	cfg.Repair = true
+	cfg.QuarantineDir = dir
+	checker, err = NewChecker(cfg, store)
+	require.NoError(t, err)
+	report, err = checker.Run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{corrupt}, report.Quarantined)
+	assert.Equal(t, len(report.Missing[0].IndexEntries)+len(report.Corrupt[0].IndexEntries), report.DeletedIndexEntries)
+	quarantined, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(corrupt)))
+	require.NoError(t, err)
+	assert.Equal(t, storage.objects[corrupt], quarantined)
+
+	fetched, err := store.Get(ctx, 0, model.TimeFromUnix(0).Add(14*day), mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	require.NoError(t, err)
+	assert.Len(t, fetched, 8)
+
+	// The corrupt chunk is now an orphan.
+	report, err = checker.Run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 8, report.Checked)
+	assert.Empty(t, report.Missing)
+	assert.Empty(t, report.Corrupt)
+	expected := []string{corrupt, orphaned.externalKey()}
+	sort.Strings(expected)
+	assert.Equal(t, expected, report.Orphaned)
+}
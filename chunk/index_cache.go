@@ -0,0 +1,168 @@
+package chunk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+)
+
+var (
+	indexCacheRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "index_cache_requests_total",
+		Help:      "Total count of index queries looked up in the cache.",
+	})
+	indexCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "index_cache_hits_total",
+		Help:      "Total count of index queries found in the cache.",
+	})
+	indexCacheCorrupt = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "index_cache_corrupt_total",
+		Help:      "Total count of corrupt index query results found in the cache.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(indexCacheRequests)
+	prometheus.MustRegister(indexCacheHits)
+	prometheus.MustRegister(indexCacheCorrupt)
+}
+
+// readBatch is a ReadBatch held in memory, holding all the pages of a query.
+type readBatch []readBatchRow
+
+type readBatchRow struct {
+	rangeValue, value []byte
+}
+
+func (b readBatch) Len() int                { return len(b) }
+func (b readBatch) RangeValue(i int) []byte { return b[i].rangeValue }
+func (b readBatch) Value(i int) []byte      { return b[i].value }
+
+func (b *readBatch) addBatch(other ReadBatch) {
+	for i := 0; i < other.Len(); i++ {
+		*b = append(*b, readBatchRow{
+			rangeValue: append([]byte(nil), other.RangeValue(i)...),
+			value:      append([]byte(nil), other.Value(i)...),
+		})
+	}
+}
+
+// encode serialises the rows as length-prefixed range value and value pairs.
+func (b readBatch) encode() []byte {
+	var buf []byte
+	var lenBuf [binary.MaxVarintLen64]byte
+	for _, row := range b {
+		for _, field := range [][]byte{row.rangeValue, row.value} {
+			n := binary.PutUvarint(lenBuf[:], uint64(len(field)))
+			buf = append(buf, lenBuf[:n]...)
+			buf = append(buf, field...)
+		}
+	}
+	return buf
+}
+
+func decodeReadBatch(buf []byte) (readBatch, error) {
+	var b readBatch
+	var fields [2][]byte
+	for len(buf) > 0 {
+		for i := range fields {
+			l, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < l {
+				return nil, fmt.Errorf("corrupt index cache entry")
+			}
+			// Keep empty values nil, as processResponse distinguishes them.
+			fields[i] = nil
+			if l > 0 {
+				fields[i] = buf[n : n+int(l)]
+			}
+			buf = buf[n+int(l):]
+		}
+		b = append(b, readBatchRow{rangeValue: fields[0], value: fields[1]})
+	}
+	return b, nil
+}
+
+func indexQueryKey(entry IndexEntry) string {
+	return hashedMemcacheKey("index", []byte(entry.TableName), []byte(entry.HashValue), entry.RangeValuePrefix, entry.RangeValueStart)
+}
+
+// bucketEnd parses the end of the bucket an index row is for from its hash
+// value, which is <userid>:<hour bucket>:... or <userid>:d<day bucket>:...
+func bucketEnd(hashValue string) (time.Time, bool) {
+	parts := strings.SplitN(hashValue, ":", 3)
+	if len(parts) < 3 {
+		return time.Time{}, false
+	}
+
+	bucketSize := int64(secondsInHour)
+	bucket := parts[1]
+	if strings.HasPrefix(bucket, "d") {
+		bucketSize = secondsInDay
+		bucket = bucket[1:]
+	}
+	i, err := strconv.ParseInt(bucket, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix((i+1)*bucketSize, 0), true
+}
+
+// indexQueryExpiration returns how long the result of a query of entry may be
+// cached for: queries of buckets which may still be written to are only
+// cached for IndexCacheValidity.
+func (c *Cache) indexQueryExpiration(entry IndexEntry) time.Duration {
+	end, ok := bucketEnd(entry.HashValue)
+	if !ok || time.Now().Sub(end) < c.cfg.IndexBucketsWritable {
+		return c.cfg.IndexCacheValidity
+	}
+	return c.cfg.Expiration
+}
+
+// FetchIndexQuery gets the result of an index query from the cache.
+func (c *Cache) FetchIndexQuery(ctx context.Context, entry IndexEntry) (ReadBatch, bool) {
+	if c.cache == nil || !c.cfg.IndexCache {
+		return nil, false
+	}
+
+	indexCacheRequests.Inc()
+	key := indexQueryKey(entry)
+	bufs, err := c.cache.Fetch(ctx, []string{key})
+	if err != nil {
+		log.Warnf("Error fetching index query from cache: %v", err)
+		return nil, false
+	}
+
+	buf, ok := bufs[key]
+	if !ok {
+		return nil, false
+	}
+	batch, err := decodeReadBatch(buf)
+	if err != nil {
+		indexCacheCorrupt.Inc()
+		log.Errorf("Failed to decode index query from cache: %v", err)
+		return nil, false
+	}
+	indexCacheHits.Inc()
+	return batch, true
+}
+
+// StoreIndexQuery stores the result of an index query in the cache.
+func (c *Cache) StoreIndexQuery(ctx context.Context, entry IndexEntry, batch readBatch) {
+	if c.cache == nil || !c.cfg.IndexCache {
+		return
+	}
+
+	err := c.cache.Store(ctx, []string{indexQueryKey(entry)}, [][]byte{batch.encode()}, c.indexQueryExpiration(entry))
+	if err != nil {
+		log.Warnf("Error storing index query in cache: %v", err)
+	}
+}
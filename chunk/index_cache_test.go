@@ -0,0 +1,133 @@
+package chunk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/chunk/cache"
+)
+
+func TestReadBatchEncoding(t *testing.T) {
+	batch := readBatch{
+		{rangeValue: []byte("foo"), value: []byte("bar")},
+		{rangeValue: []byte("baz"), value: nil},
+		{rangeValue: make([]byte, 300), value: []byte{0, 1, 2}},
+	}
+	decoded, err := decodeReadBatch(batch.encode())
+	require.NoError(t, err)
+	assert.Equal(t, batch, decoded)
+
+	_, err = decodeReadBatch(batch.encode()[:10])
+	assert.Error(t, err)
+}
+
+func TestBucketEnd(t *testing.T) {
+	for _, tc := range []struct {
+		hashValue string
+		end       time.Time
+		ok        bool
+	}{
+		{"user:17000:foo", time.Unix(17001*secondsInHour, 0), true},
+		{"user:d17000:foo", time.Unix(17001*secondsInDay, 0), true},
+		{"user:d17000:foo:bar", time.Unix(17001*secondsInDay, 0), true},
+		{"user:dfoo:bar", time.Time{}, false},
+		{"user", time.Time{}, false},
+	} {
+		end, ok := bucketEnd(tc.hashValue)
+		assert.Equal(t, tc.ok, ok, tc.hashValue)
+		assert.Equal(t, tc.end, end, tc.hashValue)
+	}
+}
+
+type queryCountingStorage struct {
+	StorageClient
+	queries int
+}
+
+func (s *queryCountingStorage) QueryPages(ctx context.Context, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error {
+	s.queries++
+	return s.StorageClient.QueryPages(ctx, entry, callback)
+}
+
+func TestChunkStoreIndexCache(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	mockStorage := NewMockStorage()
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{}, mockStorage)
+	require.NoError(t, err)
+	require.NoError(t, tableManager.syncTables(context.Background()))
+
+	storage := &queryCountingStorage{StorageClient: mockStorage}
+	store, err := NewStore(StoreConfig{
+		CacheConfig:   CacheConfig{IndexCache: true},
+		schemaFactory: v6Schema,
+	}, storage)
+	require.NoError(t, err)
+	store.cache.cache = cache.NewMemcached(newMockMemcache())
+
+	chunk := dummyChunk()
+	require.NoError(t, store.Put(ctx, []Chunk{chunk}))
+
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	require.NoError(t, err)
+
+	chunks, err := store.Get(ctx, chunk.From, chunk.Through, matcher)
+	require.NoError(t, err)
+	assert.Len(t, chunks, 1)
+	queries := storage.queries
+	assert.True(t, queries > 0)
+
+	// The second time round, the index is read from the cache.
+	chunks, err = store.Get(ctx, chunk.From, chunk.Through, matcher)
+	require.NoError(t, err)
+	assert.Len(t, chunks, 1)
+	assert.Equal(t, queries, storage.queries)
+}
+
+// Index queries cut short by the query limits aren't cached.
+func TestChunkStoreIndexCacheLimits(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	mockStorage := NewMockStorage()
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{}, mockStorage)
+	require.NoError(t, err)
+	require.NoError(t, tableManager.syncTables(context.Background()))
+
+	storage := &queryCountingStorage{StorageClient: mockStorage}
+	store, err := NewStore(StoreConfig{
+		CacheConfig:       CacheConfig{IndexCache: true},
+		QueryLimitsConfig: QueryLimitsConfig{QueryLimits: QueryLimits{MaxIndexEntriesPerQuery: 1}},
+		schemaFactory:     v6Schema,
+	}, storage)
+	require.NoError(t, err)
+	store.cache.cache = cache.NewMemcached(newMockMemcache())
+
+	chunks := []Chunk{
+		dummyChunkFor(model.Metric{model.MetricNameLabel: "foo", "instance": "a"}),
+		dummyChunkFor(model.Metric{model.MetricNameLabel: "foo", "instance": "b"}),
+	}
+	require.NoError(t, store.Put(ctx, chunks))
+
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	require.NoError(t, err)
+	_, err = store.Get(ctx, chunks[0].From, chunks[0].Through, matcher)
+	assert.Equal(t, QueryLimitError{What: "index entries", Limit: 1}, err)
+
+	// Without the limit, the index is read from storage, and then cached.
+	store.cfg.MaxIndexEntriesPerQuery = 0
+	queries := storage.queries
+	result, err := store.Get(ctx, chunks[0].From, chunks[0].Through, matcher)
+	require.NoError(t, err)
+	assert.Len(t, result, 2)
+	assert.True(t, storage.queries > queries)
+
+	queries = storage.queries
+	_, err = store.Get(ctx, chunks[0].From, chunks[0].Through, matcher)
+	require.NoError(t, err)
+	assert.Equal(t, queries, storage.queries)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"sort"
+	"strings"
 	"sync"
 
 	"github.com/aws/aws-sdk-go/service/dynamodb"
@@ -11,6 +12,15 @@ import (
 	"golang.org/x/net/context"
 )
 
+func init() {
+	RegisterIndexClient("inmemory", func(_ StorageClientConfig) (IndexClient, error) {
+		return NewMockStorage(), nil
+	})
+	RegisterObjectClient("inmemory", func(_ StorageClientConfig) (ObjectClient, error) {
+		return NewMockStorage(), nil
+	})
+}
+
 // MockStorage is a fake in-memory StorageClient.
 type MockStorage struct {
 	mtx     sync.RWMutex
@@ -19,8 +29,8 @@ type MockStorage struct {
 }
 
 type mockTable struct {
-	items       map[string][]mockItem
-	write, read int64
+	items map[string][]mockItem
+	desc  tableDescription
 }
 
 type mockItem struct {
@@ -51,52 +61,73 @@ func (m *MockStorage) ListTables(_ context.Context) ([]string, error) {
 }
 
 // CreateTable implements StorageClient.
-func (m *MockStorage) CreateTable(_ context.Context, name string, read, write int64) error {
+func (m *MockStorage) CreateTable(_ context.Context, desc tableDescription) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	if _, ok := m.tables[name]; ok {
+	if _, ok := m.tables[desc.name]; ok {
 		return fmt.Errorf("table already exists")
 	}
 
-	m.tables[name] = &mockTable{
+	table := &mockTable{
 		items: map[string][]mockItem{},
-		write: write,
-		read:  read,
 	}
+	table.update(desc)
+	m.tables[desc.name] = table
 
 	return nil
 }
 
 // DescribeTable implements StorageClient.
-func (m *MockStorage) DescribeTable(_ context.Context, name string) (readCapacity, writeCapacity int64, status string, err error) {
+func (m *MockStorage) DescribeTable(_ context.Context, name string) (desc tableDescription, status string, err error) {
 	m.mtx.RLock()
 	defer m.mtx.RUnlock()
 
 	table, ok := m.tables[name]
 	if !ok {
-		return 0, 0, "", fmt.Errorf("not found")
+		return tableDescription{}, "", fmt.Errorf("not found")
 	}
 
-	return table.read, table.write, dynamodb.TableStatusActive, nil
+	desc = table.desc
+	desc.tags = Tags{}
+	for k, v := range table.desc.tags {
+		desc.tags[k] = v
+	}
+	return desc, dynamodb.TableStatusActive, nil
 }
 
 // UpdateTable implements StorageClient.
-func (m *MockStorage) UpdateTable(_ context.Context, name string, readCapacity, writeCapacity int64) error {
+func (m *MockStorage) UpdateTable(_ context.Context, current, expected tableDescription) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	table, ok := m.tables[name]
+	table, ok := m.tables[expected.name]
 	if !ok {
 		return fmt.Errorf("not found")
 	}
 
-	table.read = readCapacity
-	table.write = writeCapacity
+	table.update(expected)
 
 	return nil
 }
 
+// update changes the table to match desc, as DynamoDB would: tables billed on
+// demand have no provisioned throughput, and tags are only ever added.
+func (t *mockTable) update(desc tableDescription) {
+	tags := t.desc.tags
+	if tags == nil {
+		tags = Tags{}
+	}
+	for k, v := range desc.tags {
+		tags[k] = v
+	}
+	t.desc = desc
+	t.desc.tags = tags
+	if desc.onDemand {
+		t.desc.provisionedRead, t.desc.provisionedWrite = 0, 0
+	}
+}
+
 // NewWriteBatch implements StorageClient.
 func (m *MockStorage) NewWriteBatch() WriteBatch {
 	return &mockWriteBatch{}
@@ -107,7 +138,8 @@ func (m *MockStorage) BatchWrite(_ context.Context, batch WriteBatch) error {
 	m.mtx.Lock()
 	defer m.mtx.Unlock()
 
-	for _, req := range *batch.(*mockWriteBatch) {
+	b := batch.(*mockWriteBatch)
+	for _, req := range b.adds {
 		table, ok := m.tables[req.tableName]
 		if !ok {
 			return fmt.Errorf("table not found")
@@ -124,7 +156,9 @@ func (m *MockStorage) BatchWrite(_ context.Context, batch WriteBatch) error {
 		if i >= len(items) || !bytes.Equal(items[i].rangeValue, req.rangeValue) {
 			items = append(items, mockItem{})
 			copy(items[i+1:], items[i:])
-		} else {
+		} else if !bytes.Equal(items[i].value, req.value) {
+			// Rewriting an identical entry is fine, as v7 schema series
+			// entries are written once per chunk.
 			return fmt.Errorf("Dupe write")
 		}
 		items[i] = mockItem{
@@ -134,6 +168,29 @@ func (m *MockStorage) BatchWrite(_ context.Context, batch WriteBatch) error {
 
 		table.items[req.hashValue] = items
 	}
+
+	for _, req := range b.deletes {
+		table, ok := m.tables[req.tableName]
+		if !ok {
+			return fmt.Errorf("table not found")
+		}
+
+		log.Debugf("Delete %s/%x", req.hashValue, req.rangeValue)
+
+		items := table.items[req.hashValue]
+		i := sort.Search(len(items), func(i int) bool {
+			return bytes.Compare(items[i].rangeValue, req.rangeValue) >= 0
+		})
+		if i >= len(items) || !bytes.Equal(items[i].rangeValue, req.rangeValue) {
+			continue
+		}
+		items = append(items[:i], items[i+1:]...)
+		if len(items) == 0 {
+			delete(table.items, req.hashValue)
+		} else {
+			table.items[req.hashValue] = items
+		}
+	}
 	return nil
 }
 
@@ -202,6 +259,39 @@ func (m *MockStorage) QueryPages(_ context.Context, entry IndexEntry, callback f
 	return nil
 }
 
+// ScanTable implements StorageClient.
+func (m *MockStorage) ScanTable(_ context.Context, tableName, hashPrefix string, callback func(entry IndexEntry) (shouldContinue bool)) error {
+	m.mtx.RLock()
+	table, ok := m.tables[tableName]
+	if !ok {
+		m.mtx.RUnlock()
+		return fmt.Errorf("table not found")
+	}
+	var entries []IndexEntry
+	for hashValue, items := range table.items {
+		if !strings.HasPrefix(hashValue, hashPrefix) {
+			continue
+		}
+		for _, item := range items {
+			entries = append(entries, IndexEntry{
+				TableName:  tableName,
+				HashValue:  hashValue,
+				RangeValue: item.rangeValue,
+				Value:      item.value,
+			})
+		}
+	}
+	m.mtx.RUnlock()
+
+	// The callback may write to the table, so is called without the lock.
+	for _, entry := range entries {
+		if !callback(entry) {
+			return nil
+		}
+	}
+	return nil
+}
+
 // PutChunk implements S3Client.
 func (m *MockStorage) PutChunk(_ context.Context, key string, buf []byte) error {
 	m.mtx.Lock()
@@ -218,24 +308,56 @@ func (m *MockStorage) GetChunk(_ context.Context, key string) ([]byte, error) {
 
 	buf, ok := m.objects[key]
 	if !ok {
-		return nil, fmt.Errorf("%v not found", key)
+		return nil, ErrStorageObjectNotFound
 	}
 
 	return buf, nil
 }
 
-type mockWriteBatch []struct {
+// ListChunks implements StorageClient.
+func (m *MockStorage) ListChunks(_ context.Context, prefix string, callback func(key string) (shouldContinue bool)) error {
+	m.mtx.RLock()
+	var keys []string
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	m.mtx.RUnlock()
+
+	for _, key := range keys {
+		if !callback(key) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// DeleteChunk implements StorageClient.
+func (m *MockStorage) DeleteChunk(_ context.Context, key string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	delete(m.objects, key)
+	return nil
+}
+
+type mockWriteBatch struct {
+	adds, deletes []mockWriteRequest
+}
+
+type mockWriteRequest struct {
 	tableName, hashValue string
 	rangeValue           []byte
 	value                []byte
 }
 
 func (b *mockWriteBatch) Add(tableName, hashValue string, rangeValue []byte, value []byte) {
-	*b = append(*b, struct {
-		tableName, hashValue string
-		rangeValue           []byte
-		value                []byte
-	}{tableName, hashValue, rangeValue, value})
+	b.adds = append(b.adds, mockWriteRequest{tableName, hashValue, rangeValue, value})
+}
+
+func (b *mockWriteBatch) Delete(tableName, hashValue string, rangeValue []byte) {
+	b.deletes = append(b.deletes, mockWriteRequest{tableName, hashValue, rangeValue, nil})
 }
 
 type mockReadBatch []mockItem
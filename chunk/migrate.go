@@ -0,0 +1,327 @@
+package chunk
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+// MigrateConfig configures a Migrator.
+type MigrateConfig struct {
+	UserID         string
+	From, Through  util.DayValue
+	Parallelism    int
+	RateLimit      float64
+	CheckpointFile string
+	Verify         bool
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *MigrateConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.UserID, "migrate.user", "", "The tenant whose chunks to migrate.")
+	f.Var(&cfg.From, "migrate.from", "The first day (in the format YYYY-MM-DD) to migrate the chunks of.")
+	f.Var(&cfg.Through, "migrate.through", "The day (in the format YYYY-MM-DD) to migrate chunks up to, exclusive; defaults to now.")
+	f.IntVar(&cfg.Parallelism, "migrate.parallelism", 10, "Number of series migrated at once.")
+	f.Float64Var(&cfg.RateLimit, "migrate.rate-limit", 0, "Maximum number of chunks copied per second (0 = unlimited).")
+	f.StringVar(&cfg.CheckpointFile, "migrate.checkpoint-file", "", "File recording the tables migrated so far, from which an interrupted migration resumes.  If empty, there are no checkpoints.")
+	f.BoolVar(&cfg.Verify, "migrate.verify", true, "Read each chunk back from the destination and check its checksum.")
+}
+
+// Migrator copies a tenant's chunks from one store to another, writing them
+// to the destination's index with the destination's schema.
+//
+// The source's index tables are scanned for the tenant's chunk entries one
+// at a time.  A table is only recorded in the checkpoint once all its chunks
+// are copied; copying a chunk again is harmless, so a migration interrupted
+// part way through a table redoes the table.
+type Migrator struct {
+	cfg          MigrateConfig
+	source, dest *Store
+	periods      SchemaPeriods
+	limiter      *rate.Limiter
+
+	copied, verified int64
+}
+
+// NewMigrator makes a new Migrator.
+func NewMigrator(cfg MigrateConfig, source, dest *Store) (*Migrator, error) {
+	if cfg.UserID == "" {
+		return nil, fmt.Errorf("no tenant to migrate")
+	}
+	if !cfg.From.IsSet() {
+		return nil, fmt.Errorf("no day to migrate from")
+	}
+	periods, err := source.cfg.SchemaConfig.EffectivePeriods()
+	if err != nil {
+		return nil, err
+	}
+
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if cfg.RateLimit > 0 {
+		burst := int(cfg.RateLimit)
+		if burst < 1 {
+			burst = 1
+		}
+		limiter = rate.NewLimiter(rate.Limit(cfg.RateLimit), burst)
+	}
+	return &Migrator{
+		cfg:     cfg,
+		source:  source,
+		dest:    dest,
+		periods: periods,
+		limiter: limiter,
+	}, nil
+}
+
+// migrateCheckpoint is the contents of the checkpoint file.
+type migrateCheckpoint struct {
+	UserID  string     `json:"user_id"`
+	From    model.Time `json:"from"`
+	Through model.Time `json:"through"`
+	Tables  []string   `json:"tables"`
+}
+
+// Run migrates the chunks, resuming from the checkpoint file if there is one.
+func (m *Migrator) Run(ctx context.Context) error {
+	through := model.Now()
+	if m.cfg.Through.IsSet() {
+		through = m.cfg.Through.Time
+	}
+	checkpoint := migrateCheckpoint{
+		UserID:  m.cfg.UserID,
+		From:    m.cfg.From.Time,
+		Through: through,
+	}
+	if err := m.loadCheckpoint(&checkpoint); err != nil {
+		return err
+	}
+	done := map[string]bool{}
+	for _, name := range checkpoint.Tables {
+		done[name] = true
+	}
+
+	for _, table := range m.periods.tables(checkpoint.From, checkpoint.Through) {
+		if done[table.name] {
+			log.Infof("Skipping table %s, already migrated", table.name)
+			continue
+		}
+		log.Infof("Migrating table %s", table.name)
+		if err := m.migrateTable(ctx, table, checkpoint.From, checkpoint.Through); err != nil {
+			return fmt.Errorf("error migrating table %s: %v", table.name, err)
+		}
+		checkpoint.Tables = append(checkpoint.Tables, table.name)
+		if err := m.saveCheckpoint(checkpoint); err != nil {
+			return err
+		}
+		log.Infof("Migrated table %s: %d chunks copied, %d verified so far", table.name, atomic.LoadInt64(&m.copied), atomic.LoadInt64(&m.verified))
+	}
+	return nil
+}
+
+// loadCheckpoint reads the tables already migrated from the checkpoint file,
+// if there is one.  The file's checkpoint must be of the same migration.
+func (m *Migrator) loadCheckpoint(checkpoint *migrateCheckpoint) error {
+	if m.cfg.CheckpointFile == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(m.cfg.CheckpointFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var saved migrateCheckpoint
+	if err := json.Unmarshal(buf, &saved); err != nil {
+		return fmt.Errorf("error parsing checkpoint %s: %v", m.cfg.CheckpointFile, err)
+	}
+	// Without -migrate.through, the checkpoint's end is used.
+	if !m.cfg.Through.IsSet() {
+		checkpoint.Through = saved.Through
+	}
+	if saved.UserID != checkpoint.UserID || saved.From != checkpoint.From || saved.Through != checkpoint.Through {
+		return fmt.Errorf("checkpoint %s is of a different migration: tenant %q from %v through %v", m.cfg.CheckpointFile, saved.UserID, saved.From, saved.Through)
+	}
+	checkpoint.Tables = saved.Tables
+	return nil
+}
+
+// saveCheckpoint replaces the checkpoint file, so it is never left half written.
+func (m *Migrator) saveCheckpoint(checkpoint migrateCheckpoint) error {
+	if m.cfg.CheckpointFile == "" {
+		return nil
+	}
+	buf, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	tmp := m.cfg.CheckpointFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.cfg.CheckpointFile)
+}
+
+func (m *Migrator) migrateTable(ctx context.Context, table periodTable, from, through model.Time) error {
+	series, err := m.scanTable(ctx, table, from, through)
+	if err != nil {
+		return err
+	}
+
+	workers := m.cfg.Parallelism
+	if workers <= 0 {
+		workers = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		mtx      sync.Mutex
+		firstErr error
+		toDo     = make(chan []Chunk)
+	)
+	ctx, cancel := context.WithCancel(user.Inject(ctx, m.cfg.UserID))
+	defer cancel()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunks := range toDo {
+				if err := m.migrateChunks(ctx, chunks); err != nil {
+					mtx.Lock()
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+					mtx.Unlock()
+				}
+			}
+		}()
+	}
+	for _, chunks := range series {
+		toDo <- chunks
+	}
+	close(toDo)
+	wg.Wait()
+	return firstErr
+}
+
+// scanTable returns the tenant's chunks in [from, through) listed in the
+// table, by series.  Chunks which start before the table's period are left
+// out, unless the migration starts in the table, as they are listed in the
+// previous table too.
+func (m *Migrator) scanTable(ctx context.Context, table periodTable, from, through model.Time) (map[model.Fingerprint][]Chunk, error) {
+	var (
+		prefix = m.cfg.UserID + ":"
+		seen   = map[string]bool{}
+		series = map[model.Fingerprint][]Chunk{}
+	)
+	err := m.source.storage.ScanTable(ctx, table.name, "", func(entry IndexEntry) bool {
+		if !strings.HasPrefix(entry.HashValue, prefix) {
+			return true
+		}
+		chunkID, _, kind, err := parseRangeValue(entry.RangeValue, entry.Value)
+		if err != nil {
+			log.Warnf("Skipping index entry %s/%x in %s: %v", entry.HashValue, entry.RangeValue, table.name, err)
+			return true
+		}
+		if kind != chunkEntry && kind != chunkEntryMetadataInIndex {
+			return true
+		}
+		if seen[chunkID] {
+			return true
+		}
+		seen[chunkID] = true
+
+		chunk, err := parseExternalKey(m.cfg.UserID, chunkID)
+		if err != nil {
+			log.Warnf("Skipping index entry %s/%x in %s: %v", entry.HashValue, entry.RangeValue, table.name, err)
+			return true
+		}
+		if kind == chunkEntryMetadataInIndex && entry.Value != nil {
+			if err := json.Unmarshal(entry.Value, &chunk); err != nil {
+				log.Warnf("Skipping index entry %s/%x in %s: %v", entry.HashValue, entry.RangeValue, table.name, err)
+				return true
+			}
+			chunk.metadataInIndex = true
+		}
+
+		if chunk.Through < from || through <= chunk.From {
+			return true
+		}
+		if chunk.From < table.from && from < table.from {
+			return true
+		}
+		series[chunk.Fingerprint] = append(series[chunk.Fingerprint], chunk)
+		return true
+	})
+	return series, err
+}
+
+// migrateChunks copies the chunks of a series, and checks the copies.
+func (m *Migrator) migrateChunks(ctx context.Context, chunks []Chunk) error {
+	for range chunks {
+		if err := m.limiter.Wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	fetched, err := m.source.fetchChunkData(ctx, chunks)
+	if err != nil {
+		return err
+	}
+
+	// Put encodes the chunks in place, setting their checksums.
+	sources := append([]Chunk(nil), fetched...)
+	if err := m.dest.Put(ctx, fetched); err != nil {
+		return err
+	}
+	atomic.AddInt64(&m.copied, int64(len(fetched)))
+
+	if !m.cfg.Verify {
+		return nil
+	}
+	for i, chunk := range fetched {
+		if sources[i].ChecksumSet && sources[i].Checksum != chunk.Checksum {
+			return fmt.Errorf("chunk %s changed checksum from %x when copied", chunk.externalKey(), sources[i].Checksum)
+		}
+		if err := m.verifyChunk(ctx, chunk); err != nil {
+			return err
+		}
+		atomic.AddInt64(&m.verified, 1)
+	}
+	return nil
+}
+
+// verifyChunk reads the chunk back from the destination and checks its
+// checksum and metadata.
+func (m *Migrator) verifyChunk(ctx context.Context, chunk Chunk) error {
+	key := chunk.externalKey()
+	buf, err := m.dest.storage.GetChunk(ctx, key)
+	if err != nil {
+		return fmt.Errorf("error reading back chunk %s: %v", key, err)
+	}
+	copied := Chunk{
+		UserID:      chunk.UserID,
+		Fingerprint: chunk.Fingerprint,
+		From:        chunk.From,
+		Through:     chunk.Through,
+		ChecksumSet: true,
+		Checksum:    chunk.Checksum,
+	}
+	if err := copied.decode(buf); err != nil {
+		return fmt.Errorf("error verifying chunk %s: %v", key, err)
+	}
+	return nil
+}
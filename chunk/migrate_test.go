@@ -0,0 +1,111 @@
+package chunk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+func newMigrateTestStore(t *testing.T, prefix string, schemaCfg SchemaConfig) *Store {
+	storage := NewMockStorage()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, storage.CreateTable(context.Background(), tableDescription{name: prefix + strconv.Itoa(i)}))
+	}
+	schemaCfg.PeriodicTableConfig = PeriodicTableConfig{
+		UsePeriodicTables:    true,
+		TablePrefix:          prefix,
+		TablePeriod:          7 * day,
+		PeriodicTableStartAt: util.NewDayValue(0),
+	}
+	store, err := NewStore(StoreConfig{SchemaConfig: schemaCfg}, storage)
+	require.NoError(t, err)
+	return store
+}
+
+func TestMigrator(t *testing.T) {
+	source := newMigrateTestStore(t, "source_", SchemaConfig{V5SchemaFrom: util.NewDayValue(0)})
+	dest := newMigrateTestStore(t, "dest_", SchemaConfig{V7SchemaFrom: util.NewDayValue(0)})
+	ctx := user.Inject(context.Background(), userID)
+
+	// Two series with a chunk a day for 10 days, each starting an hour before
+	// midnight, so the first chunk of the second week starts in the first.
+	put := func(userID string, m model.Metric) {
+		chunks := []Chunk{}
+		for d := 1; d <= 10; d++ {
+			samples := []model.SamplePair{}
+			start := model.TimeFromUnix(0).Add(time.Duration(d)*day - time.Hour)
+			for i := 0; i < 10; i++ {
+				samples = append(samples, model.SamplePair{Timestamp: start.Add(time.Duration(i) * 15 * time.Minute), Value: model.SampleValue(d*10 + i)})
+			}
+			cs, err := ChunksForSamples(userID, m, samples)
+			require.NoError(t, err)
+			chunks = append(chunks, cs...)
+		}
+		require.NoError(t, source.Put(user.Inject(context.Background(), userID), chunks))
+	}
+	put(userID, model.Metric{model.MetricNameLabel: "foo", "bar": "baz"})
+	put(userID, model.Metric{model.MetricNameLabel: "foo", "bar": "beep"})
+	put("other", model.Metric{model.MetricNameLabel: "foo", "bar": "baz"})
+
+	dir, err := ioutil.TempDir("", "migrate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cfg := MigrateConfig{
+		UserID:         userID,
+		From:           util.NewDayValue(0),
+		Through:        util.NewDayValue(model.TimeFromUnix(0).Add(14 * day)),
+		Parallelism:    2,
+		RateLimit:      1000,
+		CheckpointFile: filepath.Join(dir, "checkpoint"),
+		Verify:         true,
+	}
+	migrator, err := NewMigrator(cfg, source, dest)
+	require.NoError(t, err)
+	require.NoError(t, migrator.Run(context.Background()))
+	assert.Equal(t, int64(20), migrator.copied)
+	assert.Equal(t, int64(20), migrator.verified)
+
+	query := func(ctx context.Context, store *Store) model.Matrix {
+		chunks, err := store.Get(ctx, 0, model.TimeFromUnix(0).Add(14*day), mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+		require.NoError(t, err)
+		matrix, err := ChunksToMatrix(chunks)
+		require.NoError(t, err)
+		sort.Sort(byMetric(matrix))
+		return matrix
+	}
+	expected := query(ctx, source)
+	require.Len(t, expected, 2)
+	assert.Equal(t, expected, query(ctx, dest))
+	assert.Empty(t, query(user.Inject(context.Background(), "other"), dest))
+
+	// Resuming a finished migration copies nothing.
+	migrator, err = NewMigrator(cfg, source, dest)
+	require.NoError(t, err)
+	require.NoError(t, migrator.Run(context.Background()))
+	assert.Equal(t, int64(0), migrator.copied)
+
+	// Nor can the checkpoint be used for another migration.
+	cfg.UserID = "other"
+	migrator, err = NewMigrator(cfg, source, dest)
+	require.NoError(t, err)
+	assert.Error(t, migrator.Run(context.Background()))
+}
+
+type byMetric model.Matrix
+
+func (m byMetric) Len() int           { return len(m) }
+func (m byMetric) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byMetric) Less(i, j int) bool { return m[i].Metric.Before(m[j].Metric) }
@@ -0,0 +1,249 @@
+package chunk
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+// periodStorageClient sends index writes and queries to the index client of
+// the period owning the table, and chunks to the object client of the period
+// they start in.
+type periodStorageClient struct {
+	indexClients []IndexClient
+	tables       []tableRoute
+	objects      []objectRoute
+
+	// Each object client once, for listing and deleting.
+	objectClients []ObjectClient
+}
+
+type tableRoute struct {
+	prefix   string
+	periodic bool
+	client   int
+}
+
+type objectRoute struct {
+	from   model.Time
+	client ObjectClient
+}
+
+func newPeriodStorageClient(cfg StorageClientConfig, periods SchemaPeriods) (StorageClient, error) {
+	c := &periodStorageClient{}
+	indexClientsByName := map[string]int{}
+	objectClientsByName := map[string]ObjectClient{}
+	for _, p := range periods.Configs {
+		indexName, objectName := p.Store, p.ObjectStore
+		if indexName == "" {
+			indexName = cfg.StorageClient
+		}
+		if objectName == "" {
+			objectName = p.Store
+		}
+		if objectName == "" {
+			objectName = cfg.ObjectClient
+		}
+
+		i, ok := indexClientsByName[indexName]
+		if !ok {
+			client, err := newIndexClient(cfg, indexName)
+			if err != nil {
+				return nil, err
+			}
+			i = len(c.indexClients)
+			c.indexClients = append(c.indexClients, client)
+			indexClientsByName[indexName] = i
+		}
+		c.tables = append(c.tables, tableRoute{
+			prefix:   p.IndexTables.Prefix,
+			periodic: p.IndexTables.Period > 0,
+			client:   i,
+		})
+
+		objectClient, ok := objectClientsByName[objectName]
+		if !ok {
+			client, err := NewObjectClient(cfg, objectName)
+			if err != nil {
+				return nil, err
+			}
+			objectClient = client
+			objectClientsByName[objectName] = client
+			c.objectClients = append(c.objectClients, client)
+		}
+		c.objects = append(c.objects, objectRoute{p.From.Time, objectClient})
+	}
+
+	// Don't bother routing if every period uses the same clients.
+	if len(c.indexClients) == 1 && len(objectClientsByName) == 1 {
+		return storageClient{c.indexClients[0], c.objects[0].client}, nil
+	}
+	return c, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// indexClientFor finds the period owning the table.  As one prefix may extend
+// another, the longest match wins.
+func (c *periodStorageClient) indexClientFor(tableName string) (int, error) {
+	client, matched := -1, -1
+	for _, r := range c.tables {
+		var ok bool
+		if r.periodic {
+			ok = strings.HasPrefix(tableName, r.prefix) && isDigits(strings.TrimPrefix(tableName, r.prefix))
+		} else {
+			ok = tableName == r.prefix
+		}
+		if ok && len(r.prefix) > matched {
+			client, matched = r.client, len(r.prefix)
+		}
+	}
+	if client < 0 {
+		return 0, fmt.Errorf("no schema period for table %s", tableName)
+	}
+	return client, nil
+}
+
+func (c *periodStorageClient) objectClientFor(ctx context.Context, key string) (ObjectClient, error) {
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parseExternalKey(userID, key)
+	if err != nil {
+		return nil, err
+	}
+	client := c.objects[0].client
+	for _, r := range c.objects {
+		if r.from <= chunk.From {
+			client = r.client
+		}
+	}
+	return client, nil
+}
+
+type periodWriteBatch struct {
+	c       *periodStorageClient
+	batches []WriteBatch
+	err     error
+}
+
+func (c *periodStorageClient) NewWriteBatch() WriteBatch {
+	return &periodWriteBatch{
+		c:       c,
+		batches: make([]WriteBatch, len(c.indexClients)),
+	}
+}
+
+func (b *periodWriteBatch) Add(tableName, hashValue string, rangeValue []byte, value []byte) {
+	if batch := b.batchFor(tableName); batch != nil {
+		batch.Add(tableName, hashValue, rangeValue, value)
+	}
+}
+
+func (b *periodWriteBatch) Delete(tableName, hashValue string, rangeValue []byte) {
+	if batch := b.batchFor(tableName); batch != nil {
+		batch.Delete(tableName, hashValue, rangeValue)
+	}
+}
+
+// batchFor returns the batch for the index client owning the table, or nil
+// if there isn't one.
+func (b *periodWriteBatch) batchFor(tableName string) WriteBatch {
+	i, err := b.c.indexClientFor(tableName)
+	if err != nil {
+		if b.err == nil {
+			b.err = err
+		}
+		return nil
+	}
+	if b.batches[i] == nil {
+		b.batches[i] = b.c.indexClients[i].NewWriteBatch()
+	}
+	return b.batches[i]
+}
+
+func (c *periodStorageClient) BatchWrite(ctx context.Context, input WriteBatch) error {
+	batch := input.(*periodWriteBatch)
+	if batch.err != nil {
+		return batch.err
+	}
+	for i, b := range batch.batches {
+		if b == nil {
+			continue
+		}
+		if err := c.indexClients[i].BatchWrite(ctx, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *periodStorageClient) QueryPages(ctx context.Context, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error {
+	i, err := c.indexClientFor(entry.TableName)
+	if err != nil {
+		return err
+	}
+	return c.indexClients[i].QueryPages(ctx, entry, callback)
+}
+
+func (c *periodStorageClient) ScanTable(ctx context.Context, tableName, hashPrefix string, callback func(entry IndexEntry) (shouldContinue bool)) error {
+	i, err := c.indexClientFor(tableName)
+	if err != nil {
+		return err
+	}
+	return c.indexClients[i].ScanTable(ctx, tableName, hashPrefix, callback)
+}
+
+func (c *periodStorageClient) PutChunk(ctx context.Context, key string, data []byte) error {
+	client, err := c.objectClientFor(ctx, key)
+	if err != nil {
+		return err
+	}
+	return client.PutChunk(ctx, key, data)
+}
+
+func (c *periodStorageClient) GetChunk(ctx context.Context, key string) ([]byte, error) {
+	client, err := c.objectClientFor(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return client.GetChunk(ctx, key)
+}
+
+// ListChunks lists the chunks of every period's object client in turn.
+func (c *periodStorageClient) ListChunks(ctx context.Context, prefix string, callback func(key string) (shouldContinue bool)) error {
+	stopped := false
+	for _, client := range c.objectClients {
+		err := client.ListChunks(ctx, prefix, func(key string) bool {
+			stopped = !callback(key)
+			return !stopped
+		})
+		if err != nil || stopped {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteChunk deletes the chunk from every period's object client, as keys
+// listed by ListChunks may come from any of them.
+func (c *periodStorageClient) DeleteChunk(ctx context.Context, key string) error {
+	for _, client := range c.objectClients {
+		if err := client.DeleteChunk(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
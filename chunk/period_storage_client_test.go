@@ -0,0 +1,97 @@
+package chunk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestPeriodStorageClient(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	legacy, current := NewMockStorage(), NewMockStorage()
+	for _, name := range []string{"legacy", "cortex_3"} {
+		require.NoError(t, legacy.CreateTable(ctx, tableDescription{name: name, provisionedRead: 1, provisionedWrite: 1}))
+		require.NoError(t, current.CreateTable(ctx, tableDescription{name: name, provisionedRead: 1, provisionedWrite: 1}))
+	}
+	RegisterIndexClient("test-legacy", func(_ StorageClientConfig) (IndexClient, error) { return legacy, nil })
+	RegisterIndexClient("test-current", func(_ StorageClientConfig) (IndexClient, error) { return current, nil })
+	RegisterObjectClient("test-legacy", func(_ StorageClientConfig) (ObjectClient, error) { return legacy, nil })
+	RegisterObjectClient("test-current", func(_ StorageClientConfig) (ObjectClient, error) { return current, nil })
+
+	day := func(d int64) model.Time {
+		return model.TimeFromUnix(d * secondsInDay)
+	}
+	periods := SchemaPeriods{Configs: []PeriodConfig{
+		{
+			From:        util.NewDayValue(day(0)),
+			Schema:      "v6",
+			Store:       "test-legacy",
+			IndexTables: PeriodicTableSpec{Prefix: "legacy"},
+		},
+		{
+			From:        util.NewDayValue(day(14)),
+			Schema:      "v6",
+			Store:       "test-current",
+			IndexTables: PeriodicTableSpec{Prefix: "cortex_", Period: 7 * 24 * time.Hour},
+		},
+	}}
+	require.NoError(t, periods.Validate())
+	client, err := newPeriodStorageClient(StorageClientConfig{}, periods)
+	require.NoError(t, err)
+
+	// Index writes and queries go to the client of the table's period.
+	batch := client.NewWriteBatch()
+	batch.Add("legacy", "hash", []byte("legacy"), nil)
+	batch.Add("cortex_3", "hash", []byte("current"), nil)
+	require.NoError(t, client.BatchWrite(ctx, batch))
+
+	rangeValues := func(c IndexClient, table string) []string {
+		var result []string
+		require.NoError(t, c.QueryPages(ctx, IndexEntry{TableName: table, HashValue: "hash"}, func(resp ReadBatch, lastPage bool) bool {
+			for i := 0; i < resp.Len(); i++ {
+				result = append(result, string(resp.RangeValue(i)))
+			}
+			return !lastPage
+		}))
+		return result
+	}
+	assert.Equal(t, []string{"legacy"}, rangeValues(legacy, "legacy"))
+	assert.Empty(t, rangeValues(legacy, "cortex_3"))
+	assert.Equal(t, []string{"current"}, rangeValues(current, "cortex_3"))
+	assert.Equal(t, []string{"current"}, rangeValues(client, "cortex_3"))
+
+	batch = client.NewWriteBatch()
+	batch.Add("unknown", "hash", []byte("unknown"), nil)
+	assert.Error(t, client.BatchWrite(ctx, batch))
+
+	// Chunks go to the client of the period they start in.
+	keyFrom := func(from model.Time) string {
+		metric := model.Metric{model.MetricNameLabel: "foo"}
+		cs, _ := chunk.New().Add(model.SamplePair{Timestamp: from, Value: 0})
+		c := NewChunk(userID, metric.Fingerprint(), metric, cs[0], from, from.Add(time.Hour))
+		_, err := c.encode()
+		require.NoError(t, err)
+		return c.externalKey()
+	}
+	oldKey, newKey := keyFrom(day(1)), keyFrom(day(20))
+	require.NoError(t, client.PutChunk(ctx, oldKey, []byte("old")))
+	require.NoError(t, client.PutChunk(ctx, newKey, []byte("new")))
+
+	buf, err := legacy.GetChunk(ctx, oldKey)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("old"), buf)
+	_, err = legacy.GetChunk(ctx, newKey)
+	assert.Error(t, err)
+
+	buf, err = client.GetChunk(ctx, newKey)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new"), buf)
+}
@@ -0,0 +1,122 @@
+package chunk
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+var deferredMatchers = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "chunk_store_deferred_matchers_total",
+	Help:      "Total number of matchers applied to chunks' metrics instead of looked up in the index.",
+})
+
+func init() {
+	prometheus.MustRegister(deferredMatchers)
+}
+
+// rowSizeCache remembers how many entries index rows held when last read, to
+// estimate the cost of reading them again.
+type rowSizeCache struct {
+	mtx   sync.Mutex
+	size  int
+	sizes map[string]int
+}
+
+func newRowSizeCache(size int) *rowSizeCache {
+	return &rowSizeCache{
+		size:  size,
+		sizes: make(map[string]int, size),
+	}
+}
+
+// The start of the range read is left out, as it depends on the query time.
+func rowSizeKey(entry IndexEntry) string {
+	return entry.TableName + "\x00" + entry.HashValue + "\x00" + string(entry.RangeValuePrefix)
+}
+
+func (c *rowSizeCache) observe(entry IndexEntry, entries int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	key := rowSizeKey(entry)
+	if _, ok := c.sizes[key]; !ok && len(c.sizes) >= c.size {
+		// Evict an arbitrary row; map iteration order is random.
+		for k := range c.sizes {
+			delete(c.sizes, k)
+			break
+		}
+	}
+	c.sizes[key] = entries
+}
+
+// estimate returns the total number of entries in the rows, or false if any
+// of them haven't been read yet.
+func (c *rowSizeCache) estimate(entries []IndexEntry) (int, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	total := 0
+	for _, entry := range entries {
+		size, ok := c.sizes[rowSizeKey(entry)]
+		if !ok {
+			return 0, false
+		}
+		total += size
+	}
+	return total, true
+}
+
+// matcherLookup is a matcher and the index entries to read for it.
+type matcherLookup struct {
+	matcher  *metric.LabelMatcher
+	entries  []IndexEntry
+	estimate int
+	known    bool
+}
+
+// byCost orders lookups by estimated rows read, with equality matchers first
+// on ties and lookups of unknown cost last.
+type byCost []matcherLookup
+
+func (a byCost) Len() int      { return len(a) }
+func (a byCost) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byCost) Less(i, j int) bool {
+	if a[i].known != a[j].known {
+		return a[i].known
+	}
+	if a[i].estimate != a[j].estimate {
+		return a[i].estimate < a[j].estimate
+	}
+	return a[i].matcher.Type == metric.Equal && a[j].matcher.Type != metric.Equal
+}
+
+// planLookups orders the lookups, and splits off the cheapest to run first if
+// its cost is known.  The rest are run once its candidates are known.
+func (c *rowSizeCache) planLookups(lookups []matcherLookup) (first *matcherLookup, rest []matcherLookup) {
+	for i := range lookups {
+		lookups[i].estimate, lookups[i].known = c.estimate(lookups[i].entries)
+	}
+	sort.Sort(byCost(lookups))
+	if len(lookups) < 2 || !lookups[0].known {
+		return nil, lookups
+	}
+	return &lookups[0], lookups[1:]
+}
+
+// deferLookups splits off the lookups expected to read more rows than there
+// are candidates; it's cheaper to filter the candidates' metrics instead.
+func deferLookups(lookups []matcherLookup, candidates int) (run []matcherLookup, deferred []*metric.LabelMatcher) {
+	for _, lookup := range lookups {
+		if lookup.known && lookup.estimate > candidates {
+			deferred = append(deferred, lookup.matcher)
+			continue
+		}
+		run = append(run, lookup)
+	}
+	deferredMatchers.Add(float64(len(deferred)))
+	return run, deferred
+}
@@ -0,0 +1,145 @@
+package chunk
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+func TestPlanLookups(t *testing.T) {
+	var (
+		cache    = newRowSizeCache(10)
+		small    = IndexEntry{TableName: "table", HashValue: "small"}
+		large    = IndexEntry{TableName: "table", HashValue: "large"}
+		unknown  = IndexEntry{TableName: "table", HashValue: "unknown"}
+		equal    = mustNewLabelMatcher(metric.Equal, "instance", "a")
+		regex    = mustNewLabelMatcher(metric.RegexMatch, "job", ".+")
+		notEqual = mustNewLabelMatcher(metric.NotEqual, "env", "dev")
+	)
+	cache.observe(small, 5)
+	cache.observe(large, 100)
+
+	first, rest := cache.planLookups([]matcherLookup{
+		{matcher: notEqual, entries: []IndexEntry{unknown}},
+		{matcher: regex, entries: []IndexEntry{large}},
+		{matcher: equal, entries: []IndexEntry{small}},
+	})
+	require.NotNil(t, first)
+	assert.Equal(t, equal, first.matcher)
+	require.Len(t, rest, 2)
+	assert.Equal(t, regex, rest[0].matcher)
+	assert.Equal(t, notEqual, rest[1].matcher)
+
+	// The large row is not worth reading to filter 3 candidates, but lookups
+	// of unknown cost are still run.
+	run, deferred := deferLookups(rest, 3)
+	require.Len(t, run, 1)
+	assert.Equal(t, notEqual, run[0].matcher)
+	assert.Equal(t, []*metric.LabelMatcher{regex}, deferred)
+
+	// Without any known costs, everything is run together.
+	first, rest = cache.planLookups([]matcherLookup{
+		{matcher: notEqual, entries: []IndexEntry{unknown}},
+		{matcher: equal, entries: []IndexEntry{unknown}},
+	})
+	assert.Nil(t, first)
+	assert.Len(t, rest, 2)
+}
+
+func TestRowSizeCacheEviction(t *testing.T) {
+	cache := newRowSizeCache(2)
+	for i := 0; i < 10; i++ {
+		cache.observe(IndexEntry{HashValue: fmt.Sprintf("row%d", i)}, i)
+	}
+	assert.Len(t, cache.sizes, 2)
+}
+
+// rowCountingStorage counts the index entries read.
+type rowCountingStorage struct {
+	StorageClient
+	mtx      sync.Mutex
+	rowsRead int
+}
+
+func (s *rowCountingStorage) QueryPages(ctx context.Context, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error {
+	return s.StorageClient.QueryPages(ctx, entry, func(result ReadBatch, lastPage bool) bool {
+		s.mtx.Lock()
+		s.rowsRead += result.Len()
+		s.mtx.Unlock()
+		return callback(result, lastPage)
+	})
+}
+
+func (s *rowCountingStorage) reset() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	rowsRead := s.rowsRead
+	s.rowsRead = 0
+	return rowsRead
+}
+
+func TestChunkStorePlanner(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	now := model.Now()
+
+	chunks := []Chunk{}
+	for i := 0; i < 20; i++ {
+		chunks = append(chunks, dummyChunkFor(model.Metric{
+			model.MetricNameLabel: "foo",
+			"job":                 "api",
+			"instance":            model.LabelValue(fmt.Sprintf("instance%d", i)),
+		}))
+	}
+
+	for _, schema := range []struct {
+		name string
+		fn   func(cfg SchemaConfig) Schema
+	}{
+		{"v4 schema", v4Schema},
+		{"v6 schema", v6Schema},
+		{"v7 schema", v7Schema},
+	} {
+		t.Run(schema.name, func(t *testing.T) {
+			mockStorage := NewMockStorage()
+			tableManager, err := NewDynamoTableManager(TableManagerConfig{}, mockStorage)
+			require.NoError(t, err)
+			require.NoError(t, tableManager.syncTables(context.Background()))
+
+			storage := &rowCountingStorage{StorageClient: mockStorage}
+			store, err := NewStore(StoreConfig{
+				PlannerRowSizeCacheSize: 100,
+				schemaFactory:           schema.fn,
+			}, storage)
+			require.NoError(t, err)
+			require.NoError(t, store.Put(ctx, chunks))
+
+			query := func() int {
+				storage.reset()
+				result, err := store.Get(ctx, now.Add(-time.Hour), now,
+					mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"),
+					mustNewLabelMatcher(metric.RegexMatch, "job", ".+"),
+					mustNewLabelMatcher(metric.Equal, "instance", "instance3"),
+				)
+				require.NoError(t, err)
+				require.Len(t, result, 1)
+				assert.Equal(t, model.LabelValue("instance3"), result[0].Metric["instance"])
+				return storage.reset()
+			}
+
+			// The first query learns the row sizes; the second only reads the
+			// instance row, and filters on the job.
+			cold := query()
+			warm := query()
+			assert.True(t, warm < cold, "warm query read %d rows, cold %d", warm, cold)
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// +build integration
+
+package chunk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+// This test needs a Postgres at chunk-db.cortex.local; see the
+// chunk-integration-test Makefile target.
+func TestPostgresStorageClient(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	cfg := PostgresConfig{
+		URI:           "postgres://postgres@chunk-db.cortex.local/chunks_test?sslmode=disable",
+		Schema:        "cortex_index",
+		MigrationsDir: "../cmd/ingester/migrations",
+		PageSize:      2,
+	}
+	client, err := NewPostgresStorageClient(cfg)
+	require.NoError(t, err)
+
+	batch := client.NewWriteBatch()
+	for _, rangeValue := range []string{"a1", "a2", "b1", "b2", "c1"} {
+		batch.Add("index", "hash", []byte(rangeValue), []byte("old"))
+		batch.Add("index", "hash", []byte(rangeValue), []byte("value-"+rangeValue))
+	}
+	batch.Add("index", "other", []byte("a1"), nil)
+	batch.Add("other_index", "hash", []byte("a1"), nil)
+	require.NoError(t, client.BatchWrite(ctx, batch))
+
+	// Rewriting entries updates them.
+	require.NoError(t, client.BatchWrite(ctx, batch))
+
+	for _, tc := range []struct {
+		name     string
+		entry    IndexEntry
+		expected []string
+	}{
+		{"whole row", IndexEntry{TableName: "index", HashValue: "hash"}, []string{"a1", "a2", "b1", "b2", "c1"}},
+		{"prefix", IndexEntry{TableName: "index", HashValue: "hash", RangeValuePrefix: []byte("b")}, []string{"b1", "b2"}},
+		{"start", IndexEntry{TableName: "index", HashValue: "hash", RangeValueStart: []byte("b2")}, []string{"b2", "c1"}},
+		{"other row", IndexEntry{TableName: "index", HashValue: "other"}, []string{"a1"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var rangeValues []string
+			require.NoError(t, client.QueryPages(ctx, tc.entry, func(resp ReadBatch, lastPage bool) bool {
+				for i := 0; i < resp.Len(); i++ {
+					rangeValues = append(rangeValues, string(resp.RangeValue(i)))
+					if tc.entry.HashValue == "hash" {
+						assert.Equal(t, "value-"+string(resp.RangeValue(i)), string(resp.Value(i)))
+					}
+				}
+				return !lastPage
+			}))
+			assert.Equal(t, tc.expected, rangeValues)
+		})
+	}
+
+	// Rows are read a page at a time, until the callback has seen enough.
+	pages := 0
+	require.NoError(t, client.QueryPages(ctx, IndexEntry{TableName: "index", HashValue: "hash"}, func(resp ReadBatch, lastPage bool) bool {
+		pages++
+		assert.Equal(t, 2, resp.Len())
+		assert.False(t, lastPage)
+		return false
+	}))
+	assert.Equal(t, 1, pages)
+
+	// Another schema in the same database runs its own migrations, and has
+	// its own tables.
+	cfg.Schema = "cortex_index_other"
+	otherClient, err := NewPostgresStorageClient(cfg)
+	require.NoError(t, err)
+	require.NoError(t, otherClient.QueryPages(ctx, IndexEntry{TableName: "index", HashValue: "hash"}, func(resp ReadBatch, lastPage bool) bool {
+		assert.Equal(t, 0, resp.Len())
+		return !lastPage
+	}))
+
+	require.NoError(t, client.PutChunk(ctx, "key", []byte("chunk")))
+	require.NoError(t, client.PutChunk(ctx, "key", []byte("chunk")))
+	buf, err := client.GetChunk(ctx, "key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("chunk"), buf)
+	_, err = client.GetChunk(ctx, "missing")
+	assert.Equal(t, ErrStorageObjectNotFound, err)
+
+	require.NoError(t, client.PutChunk(ctx, "other/key", []byte("chunk")))
+	keys := []string{}
+	require.NoError(t, client.ListChunks(ctx, "ke", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	assert.Equal(t, []string{"key"}, keys)
+
+	require.NoError(t, client.DeleteChunk(ctx, "key"))
+	require.NoError(t, client.DeleteChunk(ctx, "key"))
+	_, err = client.GetChunk(ctx, "key")
+	assert.Equal(t, ErrStorageObjectNotFound, err)
+}
@@ -0,0 +1,418 @@
+package chunk
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+	_ "github.com/mattes/migrate/driver/postgres" // Import the postgres migrations driver
+	"github.com/mattes/migrate/migrate"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/instrument"
+)
+
+// Rows per INSERT statement; Postgres allows at most 65535 parameters.
+const postgresMaxBatchSize = 1000
+
+var postgresRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "cortex",
+	Name:      "postgres_request_duration_seconds",
+	Help:      "Time spent doing Postgres requests.",
+	Buckets:   prometheus.ExponentialBuckets(0.001, 4, 6),
+}, []string{"operation", "status_code"})
+
+func init() {
+	prometheus.MustRegister(postgresRequestDuration)
+
+	RegisterIndexClient("postgres", func(cfg StorageClientConfig) (IndexClient, error) {
+		return NewPostgresStorageClient(cfg.PostgresConfig)
+	})
+	RegisterObjectClient("postgres", func(cfg StorageClientConfig) (ObjectClient, error) {
+		return NewPostgresStorageClient(cfg.PostgresConfig)
+	})
+}
+
+// PostgresConfig specifies config for a Postgres database.
+type PostgresConfig struct {
+	URI           string
+	Schema        string
+	MigrationsDir string
+	PageSize      int
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *PostgresConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.URI, "postgres.uri", "", "URI of the Postgres database storing the index and, optionally, chunks.")
+	f.StringVar(&cfg.Schema, "postgres.schema", "cortex_index", "Postgres schema holding the index tables and their migration versions, created if need be, so the database can be shared with the configs service.")
+	f.StringVar(&cfg.MigrationsDir, "postgres.migrations", "", "Path where the index database migration files can be found; migrations are only run if set.")
+	f.IntVar(&cfg.PageSize, "postgres.page-size", 1000, "Number of index entries read from Postgres per query.")
+}
+
+// schemaURI returns the URI with the search path set to the schema, so the
+// migrations' schema_migrations table and our tables are created in it,
+// rather than alongside the configs service's in a shared database.
+func (cfg *PostgresConfig) schemaURI() (string, error) {
+	if cfg.Schema == "" {
+		return cfg.URI, nil
+	}
+	u, err := url.Parse(cfg.URI)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("search_path", cfg.Schema)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// createSchema creates the schema, if there is one.
+func (cfg *PostgresConfig) createSchema() error {
+	if cfg.Schema == "" {
+		return nil
+	}
+	db, err := sql.Open("postgres", cfg.URI)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec("CREATE SCHEMA IF NOT EXISTS " + pq.QuoteIdentifier(cfg.Schema))
+	return err
+}
+
+// postgresStorageClient stores every index table in one table, keyed by
+// (table_name, hash_value, range_value), and chunks in another.
+type postgresStorageClient struct {
+	db       *sql.DB
+	pageSize int
+	squirrel.StatementBuilderType
+}
+
+// NewPostgresStorageClient makes a new Postgres-backed StorageClient.
+func NewPostgresStorageClient(cfg PostgresConfig) (StorageClient, error) {
+	if cfg.URI == "" {
+		return nil, fmt.Errorf("no URI specified for Postgres")
+	}
+	uri, err := cfg.schemaURI()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.createSchema(); err != nil {
+		return nil, err
+	}
+	if cfg.MigrationsDir != "" {
+		log.Infof("Running index database migrations...")
+		if errs, ok := migrate.UpSync(uri, cfg.MigrationsDir); !ok {
+			for _, err := range errs {
+				log.Error(err)
+			}
+			return nil, errors.New("index database migrations failed")
+		}
+	}
+
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		return nil, err
+	}
+	pageSize := cfg.PageSize
+	if pageSize <= 0 {
+		pageSize = 1000
+	}
+	return &postgresStorageClient{
+		db:                   db,
+		pageSize:             pageSize,
+		StatementBuilderType: squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar),
+	}, nil
+}
+
+type postgresWriteBatch struct {
+	entries, deletes []IndexEntry
+}
+
+func (b *postgresWriteBatch) Add(tableName, hashValue string, rangeValue []byte, value []byte) {
+	b.entries = append(b.entries, IndexEntry{
+		TableName:  tableName,
+		HashValue:  hashValue,
+		RangeValue: rangeValue,
+		Value:      value,
+	})
+}
+
+func (b *postgresWriteBatch) Delete(tableName, hashValue string, rangeValue []byte) {
+	b.deletes = append(b.deletes, IndexEntry{
+		TableName:  tableName,
+		HashValue:  hashValue,
+		RangeValue: rangeValue,
+	})
+}
+
+func (p *postgresStorageClient) NewWriteBatch() WriteBatch {
+	return &postgresWriteBatch{}
+}
+
+// BatchWrite upserts the entries, then deletes those to be deleted,
+// postgresMaxBatchSize at a time.
+func (p *postgresStorageClient) BatchWrite(ctx context.Context, batch WriteBatch) error {
+	b := batch.(*postgresWriteBatch)
+	entries := dedupeIndexEntries(b.entries)
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > postgresMaxBatchSize {
+			n = postgresMaxBatchSize
+		}
+
+		insert := p.Insert("index_entries").Columns("table_name", "hash_value", "range_value", "value")
+		for _, entry := range entries[:n] {
+			insert = insert.Values(entry.TableName, entry.HashValue, entry.RangeValue, entry.Value)
+		}
+		query, args, err := insert.
+			Suffix("ON CONFLICT (table_name, hash_value, range_value) DO UPDATE SET value = EXCLUDED.value").
+			ToSql()
+		if err != nil {
+			return err
+		}
+
+		if err := instrument.TimeRequestHistogram(ctx, "Postgres.BatchWrite", postgresRequestDuration, func(ctx context.Context) error {
+			_, err := p.db.ExecContext(ctx, query, args...)
+			return err
+		}); err != nil {
+			return err
+		}
+		entries = entries[n:]
+	}
+
+	deletes := b.deletes
+	for len(deletes) > 0 {
+		n := len(deletes)
+		if n > postgresMaxBatchSize {
+			n = postgresMaxBatchSize
+		}
+
+		keys := squirrel.Or{}
+		for _, entry := range deletes[:n] {
+			keys = append(keys, squirrel.Eq{"table_name": entry.TableName, "hash_value": entry.HashValue, "range_value": entry.RangeValue})
+		}
+		query, args, err := p.Delete("index_entries").Where(keys).ToSql()
+		if err != nil {
+			return err
+		}
+
+		if err := instrument.TimeRequestHistogram(ctx, "Postgres.BatchDelete", postgresRequestDuration, func(ctx context.Context) error {
+			_, err := p.db.ExecContext(ctx, query, args...)
+			return err
+		}); err != nil {
+			return err
+		}
+		deletes = deletes[n:]
+	}
+	return nil
+}
+
+// dedupeIndexEntries keeps the last of entries with the same key, as one
+// INSERT ... ON CONFLICT can't update a row twice.
+func dedupeIndexEntries(entries []IndexEntry) []IndexEntry {
+	type key struct{ tableName, hashValue, rangeValue string }
+	seen := make(map[key]int, len(entries))
+	result := make([]IndexEntry, 0, len(entries))
+	for _, entry := range entries {
+		k := key{entry.TableName, entry.HashValue, string(entry.RangeValue)}
+		if i, ok := seen[k]; ok {
+			result[i] = entry
+			continue
+		}
+		seen[k] = len(result)
+		result = append(result, entry)
+	}
+	return result
+}
+
+// QueryPages reads pageSize rows at a time, each page starting after the
+// last range value of the one before.
+func (p *postgresStorageClient) QueryPages(ctx context.Context, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error {
+	var after []byte
+	for {
+		sel := p.Select("range_value", "value").
+			From("index_entries").
+			Where(squirrel.Eq{"table_name": entry.TableName, "hash_value": entry.HashValue}).
+			OrderBy("range_value").
+			Limit(uint64(p.pageSize))
+		if entry.RangeValuePrefix != nil {
+			sel = sel.Where("range_value >= ?", entry.RangeValuePrefix)
+			if bound := prefixUpperBound(entry.RangeValuePrefix); bound != nil {
+				sel = sel.Where("range_value < ?", bound)
+			}
+		} else if entry.RangeValueStart != nil {
+			sel = sel.Where("range_value >= ?", entry.RangeValueStart)
+		}
+		if after != nil {
+			sel = sel.Where("range_value > ?", after)
+		}
+		query, args, err := sel.ToSql()
+		if err != nil {
+			return err
+		}
+
+		var batch postgresReadBatch
+		if err := instrument.TimeRequestHistogram(ctx, "Postgres.QueryPages", postgresRequestDuration, func(ctx context.Context) error {
+			rows, err := p.db.QueryContext(ctx, query, args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var row postgresRow
+				if err := rows.Scan(&row.rangeValue, &row.value); err != nil {
+					return err
+				}
+				batch = append(batch, row)
+			}
+			return rows.Err()
+		}); err != nil {
+			return err
+		}
+
+		lastPage := len(batch) < p.pageSize
+		if !callback(batch, lastPage) || lastPage {
+			return nil
+		}
+		after = batch[len(batch)-1].rangeValue
+	}
+}
+
+// ScanTable reads the rows of the table with the hash prefix, calling back as
+// they arrive.
+func (p *postgresStorageClient) ScanTable(ctx context.Context, tableName, hashPrefix string, callback func(entry IndexEntry) (shouldContinue bool)) error {
+	builder := p.Select("hash_value", "range_value", "value").
+		From("index_entries").
+		Where(squirrel.Eq{"table_name": tableName})
+	if hashPrefix != "" {
+		builder = builder.Where("hash_value LIKE ?", likePrefixEscaper.Replace(hashPrefix)+"%")
+	}
+	query, args, err := builder.ToSql()
+	if err != nil {
+		return err
+	}
+
+	return instrument.TimeRequestHistogram(ctx, "Postgres.ScanTable", postgresRequestDuration, func(ctx context.Context) error {
+		rows, err := p.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			entry := IndexEntry{TableName: tableName}
+			if err := rows.Scan(&entry.HashValue, &entry.RangeValue, &entry.Value); err != nil {
+				return err
+			}
+			if !callback(entry) {
+				return nil
+			}
+		}
+		return rows.Err()
+	})
+}
+
+// likePrefixEscaper escapes the wildcards of a LIKE pattern, with Postgres'
+// default escape character.
+var likePrefixEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+type postgresRow struct {
+	rangeValue, value []byte
+}
+
+type postgresReadBatch []postgresRow
+
+func (b postgresReadBatch) Len() int {
+	return len(b)
+}
+
+func (b postgresReadBatch) RangeValue(i int) []byte {
+	return b[i].rangeValue
+}
+
+func (b postgresReadBatch) Value(i int) []byte {
+	return b[i].value
+}
+
+func (p *postgresStorageClient) PutChunk(ctx context.Context, key string, buf []byte) error {
+	query, args, err := p.Insert("chunks").
+		Columns("key", "value").
+		Values(key, buf).
+		Suffix("ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value").
+		ToSql()
+	if err != nil {
+		return err
+	}
+	return instrument.TimeRequestHistogram(ctx, "Postgres.PutChunk", postgresRequestDuration, func(ctx context.Context) error {
+		_, err := p.db.ExecContext(ctx, query, args...)
+		return err
+	})
+}
+
+func (p *postgresStorageClient) GetChunk(ctx context.Context, key string) ([]byte, error) {
+	query, args, err := p.Select("value").
+		From("chunks").
+		Where(squirrel.Eq{"key": key}).
+		ToSql()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	err = instrument.TimeRequestHistogram(ctx, "Postgres.GetChunk", postgresRequestDuration, func(ctx context.Context) error {
+		return p.db.QueryRowContext(ctx, query, args...).Scan(&buf)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrStorageObjectNotFound
+	}
+	return buf, err
+}
+
+// ListChunks reads the keys of the chunks starting with prefix.
+func (p *postgresStorageClient) ListChunks(ctx context.Context, prefix string, callback func(key string) (shouldContinue bool)) error {
+	query, args, err := p.Select("key").
+		From("chunks").
+		Where("substr(key, 1, ?) = ?", len(prefix), prefix).
+		ToSql()
+	if err != nil {
+		return err
+	}
+
+	return instrument.TimeRequestHistogram(ctx, "Postgres.ListChunks", postgresRequestDuration, func(ctx context.Context) error {
+		rows, err := p.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				return err
+			}
+			if !callback(key) {
+				return nil
+			}
+		}
+		return rows.Err()
+	})
+}
+
+func (p *postgresStorageClient) DeleteChunk(ctx context.Context, key string) error {
+	query, args, err := p.Delete("chunks").
+		Where(squirrel.Eq{"key": key}).
+		ToSql()
+	if err != nil {
+		return err
+	}
+	return instrument.TimeRequestHistogram(ctx, "Postgres.DeleteChunk", postgresRequestDuration, func(ctx context.Context) error {
+		_, err := p.db.ExecContext(ctx, query, args...)
+		return err
+	})
+}
@@ -0,0 +1,23 @@
+package chunk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupeIndexEntries(t *testing.T) {
+	entry := func(hashValue, rangeValue, value string) IndexEntry {
+		return IndexEntry{TableName: "table", HashValue: hashValue, RangeValue: []byte(rangeValue), Value: []byte(value)}
+	}
+	assert.Equal(t, []IndexEntry{
+		entry("a", "1", "new"),
+		entry("a", "2", "x"),
+		entry("b", "1", "y"),
+	}, dedupeIndexEntries([]IndexEntry{
+		entry("a", "1", "old"),
+		entry("a", "2", "x"),
+		entry("b", "1", "y"),
+		entry("a", "1", "new"),
+	}))
+}
@@ -0,0 +1,237 @@
+package chunk
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/common/user"
+)
+
+var purged = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "purged_total",
+	Help:      "Total count of index entries, and chunks, deleted by purges of deleted tenants.",
+}, []string{"type"})
+
+func init() {
+	prometheus.MustRegister(purged)
+}
+
+// PurgerConfig configures a Purger.
+type PurgerConfig struct {
+	Parallelism  int
+	BatchSize    int
+	RecheckDelay time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *PurgerConfig) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.Parallelism, "purger.parallelism", 10, "Number of chunks deleted at once.")
+	f.IntVar(&cfg.BatchSize, "purger.batch-size", 1000, "Number of index entries deleted in one write, and of chunks deleted between progress reports.")
+	f.DurationVar(&cfg.RecheckDelay, "purger.recheck-delay", 13*time.Hour, "How long after purging a tenant to purge it again, deleting chunks flushed meanwhile, before the purge is done.  Must exceed the ingesters' -ingester.max-chunk-age.")
+}
+
+// PurgeProgress is how far the purge of a tenant has got.  In each pass, the
+// tenant's entries are deleted from each index table in turn, then its chunks.
+type PurgeProgress struct {
+	Tables              int        `json:"tables"`
+	TablesDone          int        `json:"tables_done"`
+	IndexEntriesDeleted int        `json:"index_entries_deleted"`
+	ChunksDeleted       int        `json:"chunks_deleted"`
+	Passes              int        `json:"passes"`
+	LastPassAt          *time.Time `json:"last_pass_at,omitempty"`
+	Done                bool       `json:"done"`
+}
+
+// purgePasses is how many times a tenant's data is purged.
+const purgePasses = 2
+
+// Purger deletes all the index entries and chunks of a tenant.  Purges can
+// be resumed from their last progress report; tables are purged in order, and
+// new tables only come after existing ones.
+//
+// Ingesters which haven't yet noticed a tenant's deletion may still flush its
+// chunks, until they are older than -ingester.max-chunk-age.  So the purge is
+// only done after a second pass, RecheckDelay after the first.
+type Purger struct {
+	cfg     PurgerConfig
+	store   *Store
+	periods SchemaPeriods
+}
+
+// NewPurger makes a new Purger.
+func NewPurger(cfg PurgerConfig, store *Store) (*Purger, error) {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 1000
+	}
+	periods, err := store.cfg.SchemaConfig.EffectivePeriods()
+	if err != nil {
+		return nil, err
+	}
+	return &Purger{
+		cfg:     cfg,
+		store:   store,
+		periods: periods,
+	}, nil
+}
+
+// Due says whether there is any purging to do, given the progress so far.
+func (p *Purger) Due(progress PurgeProgress) bool {
+	return !progress.Done && (progress.LastPassAt == nil || mtime.Now().Sub(*progress.LastPassAt) >= p.cfg.RecheckDelay)
+}
+
+// Purge deletes the tenant's index entries, then its chunks, carrying on
+// from progress, if a pass is due.  The progress is passed to report after
+// each table and each batch of chunks, and at the end of the pass, with Done
+// set after the last one.
+func (p *Purger) Purge(ctx context.Context, userID string, progress PurgeProgress, report func(PurgeProgress) error) error {
+	if !p.Due(progress) {
+		return nil
+	}
+	ctx = user.Inject(ctx, userID)
+
+	tables := []string{}
+	seen := map[string]struct{}{}
+	for _, table := range p.periods.tables(0, model.Now()) {
+		if _, ok := seen[table.name]; ok {
+			continue
+		}
+		seen[table.name] = struct{}{}
+		tables = append(tables, table.name)
+	}
+	progress.Tables = len(tables)
+
+	for progress.TablesDone < len(tables) {
+		table := tables[progress.TablesDone]
+		log.Infof("Purging tenant %s from table %s", userID, table)
+		deleted, err := p.purgeTable(ctx, userID, table)
+		if err != nil {
+			return fmt.Errorf("error purging table %s: %v", table, err)
+		}
+		progress.TablesDone++
+		progress.IndexEntriesDeleted += deleted
+		if err := report(progress); err != nil {
+			return err
+		}
+	}
+
+	keys := []string{}
+	if err := p.store.storage.ListChunks(ctx, userID+"/", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		return fmt.Errorf("error listing chunks: %v", err)
+	}
+	log.Infof("Purging %d chunks of tenant %s", len(keys), userID)
+	for len(keys) > 0 {
+		n := p.cfg.BatchSize
+		if n > len(keys) {
+			n = len(keys)
+		}
+		if err := p.deleteChunks(ctx, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+		progress.ChunksDeleted += n
+		if err := report(progress); err != nil {
+			return err
+		}
+	}
+
+	now := mtime.Now()
+	progress.Passes++
+	progress.LastPassAt = &now
+	if progress.Passes < purgePasses {
+		progress.TablesDone = 0
+	} else {
+		progress.Done = true
+	}
+	return report(progress)
+}
+
+// purgeTable deletes the tenant's entries from the table, returning how many
+// there were.  Only the tenant's rows are scanned, where the storage client
+// can, and they are deleted a batch at a time as they are found.
+func (p *Purger) purgeTable(ctx context.Context, userID, table string) (int, error) {
+	var (
+		deleted  int
+		batch    = p.store.storage.NewWriteBatch()
+		batched  int
+		writeErr error
+	)
+	flush := func() error {
+		if batched == 0 {
+			return nil
+		}
+		if err := p.store.storage.BatchWrite(ctx, batch); err != nil {
+			return err
+		}
+		purged.WithLabelValues("index_entries").Add(float64(batched))
+		deleted += batched
+		batch, batched = p.store.storage.NewWriteBatch(), 0
+		return nil
+	}
+
+	if err := p.store.storage.ScanTable(ctx, table, userID+":", func(entry IndexEntry) bool {
+		batch.Delete(table, entry.HashValue, entry.RangeValue)
+		batched++
+		if batched >= p.cfg.BatchSize {
+			writeErr = flush()
+		}
+		return writeErr == nil
+	}); err != nil {
+		return deleted, err
+	} else if writeErr != nil {
+		return deleted, writeErr
+	}
+	err := flush()
+	return deleted, err
+}
+
+// deleteChunks deletes the chunks, stopping at the first error.
+func (p *Purger) deleteChunks(ctx context.Context, keys []string) error {
+	workers := p.cfg.Parallelism
+	if workers <= 0 {
+		workers = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		mtx      sync.Mutex
+		firstErr error
+		toDo     = make(chan string)
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range toDo {
+				if err := p.store.storage.DeleteChunk(ctx, key); err != nil {
+					mtx.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("error deleting chunk %s: %v", key, err)
+						cancel()
+					}
+					mtx.Unlock()
+					continue
+				}
+				purged.WithLabelValues("chunks").Inc()
+			}
+		}()
+	}
+	for _, key := range keys {
+		toDo <- key
+	}
+	close(toDo)
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,116 @@
+package chunk
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/util"
+)
+
+func TestPurger(t *testing.T) {
+	now := model.Now()
+	storage := NewMockStorage()
+	store, err := NewStore(StoreConfig{SchemaConfig: SchemaConfig{
+		V7SchemaFrom: util.NewDayValue(0),
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables:    true,
+			TablePrefix:          tablePrefix,
+			TablePeriod:          7 * day,
+			PeriodicTableStartAt: util.NewDayValue(now.Add(-21 * day)),
+		},
+	}}, storage)
+	require.NoError(t, err)
+	purger, err := NewPurger(PurgerConfig{Parallelism: 2, BatchSize: 3, RecheckDelay: 12 * time.Hour}, store)
+	require.NoError(t, err)
+	tables := purger.periods.tables(0, now)
+	for _, table := range tables {
+		require.NoError(t, storage.CreateTable(context.Background(), tableDescription{name: table.name}))
+	}
+
+	// A chunk a day for 10 days, for two tenants.
+	series := model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}
+	for _, userID := range []string{userID, "other"} {
+		chunks := []Chunk{}
+		for d := 1; d <= 10; d++ {
+			start := now.Add(-time.Duration(d) * day)
+			cs, err := ChunksForSamples(userID, series, []model.SamplePair{{Timestamp: start, Value: 1}, {Timestamp: start.Add(time.Hour), Value: 2}})
+			require.NoError(t, err)
+			chunks = append(chunks, cs...)
+		}
+		require.NoError(t, store.Put(user.Inject(context.Background(), userID), chunks))
+	}
+
+	// Stop after the first table, then carry on from there.
+	errStop := fmt.Errorf("stop")
+	var progress PurgeProgress
+	err = purger.Purge(context.Background(), userID, PurgeProgress{}, func(p PurgeProgress) error {
+		progress = p
+		return errStop
+	})
+	require.Equal(t, errStop, err)
+	assert.Equal(t, PurgeProgress{Tables: len(tables), TablesDone: 1}, progress)
+
+	reports := 0
+	purge := func() {
+		require.NoError(t, purger.Purge(context.Background(), userID, progress, func(p PurgeProgress) error {
+			progress = p
+			reports++
+			return nil
+		}))
+	}
+	purge()
+	assert.False(t, progress.Done)
+	assert.Equal(t, 1, progress.Passes)
+	assert.Equal(t, 0, progress.TablesDone)
+	assert.NotZero(t, progress.IndexEntriesDeleted)
+	assert.Equal(t, 10, progress.ChunksDeleted)
+	// The remaining tables, four batches of chunks, and the end of the pass.
+	assert.Equal(t, len(tables)-1+4+1, reports)
+
+	// The second pass waits for the recheck delay, and deletes a chunk an
+	// ingester flushed meanwhile.
+	late, err := ChunksForSamples(userID, series, []model.SamplePair{{Timestamp: now.Add(-time.Hour), Value: 3}})
+	require.NoError(t, err)
+	require.NoError(t, store.Put(user.Inject(context.Background(), userID), late))
+	reports = 0
+	purge()
+	assert.Equal(t, 0, reports)
+
+	mtime.NowForce(progress.LastPassAt.Add(12 * time.Hour))
+	defer mtime.NowReset()
+	purge()
+	assert.True(t, progress.Done)
+	assert.Equal(t, 2, progress.Passes)
+	assert.Equal(t, len(tables), progress.TablesDone)
+	assert.Equal(t, 11, progress.ChunksDeleted)
+	assert.Equal(t, len(tables)+1+1, reports)
+	assert.False(t, purger.Due(progress))
+
+	for key := range storage.objects {
+		assert.False(t, strings.HasPrefix(key, userID+"/"), key)
+	}
+	for _, table := range tables {
+		require.NoError(t, storage.ScanTable(context.Background(), table.name, "", func(entry IndexEntry) bool {
+			assert.False(t, strings.HasPrefix(entry.HashValue, userID+":"), entry.HashValue)
+			return true
+		}))
+	}
+
+	matcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	fetched, err := store.Get(user.Inject(context.Background(), userID), now.Add(-11*day), now, matcher)
+	require.NoError(t, err)
+	assert.Empty(t, fetched)
+	fetched, err = store.Get(user.Inject(context.Background(), "other"), now.Add(-11*day), now, matcher)
+	require.NoError(t, err)
+	assert.Len(t, fetched, 10)
+}
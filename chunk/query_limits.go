@@ -0,0 +1,207 @@
+package chunk
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+)
+
+var queryLimitsExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "cortex",
+	Name:      "chunk_store_query_limits_exceeded_total",
+	Help:      "Total number of queries which exceeded a limit.",
+}, []string{"limit"})
+
+func init() {
+	prometheus.MustRegister(queryLimitsExceeded)
+}
+
+// QueryLimits bound the resources a single query may use.  Zero means
+// unlimited.
+type QueryLimits struct {
+	MaxIndexEntriesPerQuery int `yaml:"max_index_entries_per_query"`
+	MaxChunksPerQuery       int `yaml:"max_chunks_per_query"`
+	MaxChunkBytesPerQuery   int `yaml:"max_chunk_bytes_per_query"`
+	MaxSeriesPerQuery       int `yaml:"max_series_per_query"`
+	MaxSamplesPerQuery      int `yaml:"max_samples_per_query"`
+}
+
+// QueryLimitsConfig holds the query limits set by flags, which apply to every
+// tenant without an entry in the overrides file.
+type QueryLimitsConfig struct {
+	QueryLimits
+	OverridesFile string
+
+	// Number of chunks a query fetches from storage at once.
+	ChunkFetchParallelism int
+
+	overrides map[string]QueryLimits
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *QueryLimitsConfig) RegisterFlags(f *flag.FlagSet) {
+	f.IntVar(&cfg.MaxIndexEntriesPerQuery, "chunk.max-index-entries-per-query", 0, "Maximum number of index entries a query may read (0 = unlimited).")
+	f.IntVar(&cfg.MaxChunksPerQuery, "chunk.max-chunks-per-query", 0, "Maximum number of chunks a query may fetch (0 = unlimited).")
+	f.IntVar(&cfg.MaxChunkBytesPerQuery, "chunk.max-chunk-bytes-per-query", 0, "Maximum number of bytes of chunks a query may fetch from storage (0 = unlimited).")
+	f.IntVar(&cfg.MaxSeriesPerQuery, "chunk.max-series-per-query", 0, "Maximum number of series a query may return (0 = unlimited).")
+	f.IntVar(&cfg.MaxSamplesPerQuery, "chunk.max-samples-per-query", 0, "Maximum number of samples a query may load (0 = unlimited).")
+	f.StringVar(&cfg.OverridesFile, "chunk.query-limits-overrides-file", "", "YAML file of per-tenant query limits, replacing all the limit flags for the tenants it lists.")
+	f.IntVar(&cfg.ChunkFetchParallelism, "chunk.fetch-parallelism", 64, "Maximum number of chunks a query fetches from storage concurrently.")
+}
+
+// queryLimitsOverrides is the contents of a query limits overrides file.
+type queryLimitsOverrides struct {
+	Overrides map[string]QueryLimits `yaml:"overrides"`
+}
+
+// loadOverrides reads the overrides file, if there is one.
+func (cfg *QueryLimitsConfig) loadOverrides() error {
+	if cfg.OverridesFile == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(cfg.OverridesFile)
+	if err != nil {
+		return err
+	}
+	var overrides queryLimitsOverrides
+	if err := yaml.Unmarshal(buf, &overrides); err != nil {
+		return fmt.Errorf("error parsing %s: %v", cfg.OverridesFile, err)
+	}
+	cfg.overrides = overrides.Overrides
+	return nil
+}
+
+// ForUser returns the query limits of the given tenant.
+func (cfg *QueryLimitsConfig) ForUser(userID string) QueryLimits {
+	if limits, ok := cfg.overrides[userID]; ok {
+		return limits
+	}
+	return cfg.QueryLimits
+}
+
+// QueryLimitError is returned when a query exceeds one of its limits.
+type QueryLimitError struct {
+	What  string
+	Limit int
+}
+
+func (e QueryLimitError) Error() string {
+	return fmt.Sprintf("query exceeded the limit of %d %s; narrow the selectors or shorten the time range", e.Limit, e.What)
+}
+
+// QueryUsage counts the resources used by one query.  Attach it to the
+// context of each of the query's selectors with WithQueryUsage, so the limits
+// apply to the query as a whole rather than to each selector.
+type QueryUsage struct {
+	limits       QueryLimits
+	indexEntries int64
+	chunks       int64
+	chunkBytes   int64
+
+	mtx     sync.Mutex
+	series  map[model.Fingerprint]struct{}
+	samples int
+}
+
+// NewQueryUsage makes a QueryUsage for a query with the given limits.
+func NewQueryUsage(limits QueryLimits) *QueryUsage {
+	return &QueryUsage{
+		limits: limits,
+		series: map[model.Fingerprint]struct{}{},
+	}
+}
+
+type queryUsageKey struct{}
+
+// WithQueryUsage returns a context whose selectors count towards usage.
+func WithQueryUsage(ctx context.Context, usage *QueryUsage) context.Context {
+	return context.WithValue(ctx, queryUsageKey{}, usage)
+}
+
+// queryLimiter counts one selector's resources against its query's usage.  A
+// nil queryLimiter doesn't limit anything.
+type queryLimiter struct {
+	*QueryUsage
+
+	// Chunks not matching the filters are dropped once fetched, so don't
+	// count towards the series and samples limits.
+	filters []*metric.LabelMatcher
+}
+
+type queryLimiterKey struct{}
+
+// withQueryLimiter adds a limiter for one selector, counting towards the
+// query's usage if there is one in ctx, or towards the selector's own.
+func withQueryLimiter(ctx context.Context, limits QueryLimits) context.Context {
+	usage, ok := ctx.Value(queryUsageKey{}).(*QueryUsage)
+	if !ok {
+		usage = NewQueryUsage(limits)
+	}
+	return context.WithValue(ctx, queryLimiterKey{}, &queryLimiter{QueryUsage: usage})
+}
+
+func queryLimiterFrom(ctx context.Context) *queryLimiter {
+	l, _ := ctx.Value(queryLimiterKey{}).(*queryLimiter)
+	return l
+}
+
+func checkLimit(name, what string, used int64, limit int) error {
+	if limit > 0 && used > int64(limit) {
+		queryLimitsExceeded.WithLabelValues(name).Inc()
+		return QueryLimitError{What: what, Limit: limit}
+	}
+	return nil
+}
+
+func (l *queryLimiter) addIndexEntries(n int) error {
+	if l == nil {
+		return nil
+	}
+	return checkLimit("index_entries", "index entries", atomic.AddInt64(&l.indexEntries, int64(n)), l.limits.MaxIndexEntriesPerQuery)
+}
+
+func (l *queryLimiter) addChunks(n int) error {
+	if l == nil {
+		return nil
+	}
+	return checkLimit("chunks", "chunks", atomic.AddInt64(&l.chunks, int64(n)), l.limits.MaxChunksPerQuery)
+}
+
+// Only bytes fetched from storage count; chunks found in the cache are free.
+func (l *queryLimiter) addChunkBytes(n int) error {
+	if l == nil {
+		return nil
+	}
+	return checkLimit("chunk_bytes", "chunk bytes", atomic.AddInt64(&l.chunkBytes, int64(n)), l.limits.MaxChunkBytesPerQuery)
+}
+
+// addChunk counts the series and samples of a fetched chunk, so a query is
+// stopped as soon as it has decoded too many, not once they are all merged.
+func (l *queryLimiter) addChunk(chunk Chunk) error {
+	if l == nil {
+		return nil
+	}
+	for _, filter := range l.filters {
+		if !filter.Match(chunk.Metric[filter.Name]) {
+			return nil
+		}
+	}
+
+	samples := chunk.Data.Len()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.series[chunk.Metric.Fingerprint()] = struct{}{}
+	l.samples += samples
+	if err := checkLimit("series", "series", int64(len(l.series)), l.limits.MaxSeriesPerQuery); err != nil {
+		return err
+	}
+	return checkLimit("samples", "samples", int64(l.samples), l.limits.MaxSamplesPerQuery)
+}
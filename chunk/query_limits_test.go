@@ -0,0 +1,222 @@
+package chunk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+)
+
+// concurrencyStorage records the most chunk fetches in flight at once.
+type concurrencyStorage struct {
+	StorageClient
+	mtx               sync.Mutex
+	inFlight, maxSeen int
+}
+
+func (s *concurrencyStorage) GetChunk(ctx context.Context, key string) ([]byte, error) {
+	s.mtx.Lock()
+	s.inFlight++
+	if s.inFlight > s.maxSeen {
+		s.maxSeen = s.inFlight
+	}
+	s.mtx.Unlock()
+
+	time.Sleep(time.Millisecond)
+	buf, err := s.StorageClient.GetChunk(ctx, key)
+
+	s.mtx.Lock()
+	s.inFlight--
+	s.mtx.Unlock()
+	return buf, err
+}
+
+func TestChunkStoreQueryLimits(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	now := model.Now()
+
+	chunks := []Chunk{}
+	for i := 0; i < 20; i++ {
+		chunks = append(chunks, dummyChunkFor(model.Metric{
+			model.MetricNameLabel: "foo",
+			"instance":            model.LabelValue(fmt.Sprintf("instance%d", i)),
+		}))
+	}
+	chunkBytes := 0
+	for i := range chunks {
+		encoded, err := chunks[i].encode()
+		require.NoError(t, err)
+		chunkBytes += len(encoded)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		limits QueryLimits
+		err    error
+	}{
+		{
+			name:   "unlimited",
+			limits: QueryLimits{},
+		},
+		{
+			name:   "within limits",
+			limits: QueryLimits{MaxIndexEntriesPerQuery: 20, MaxChunksPerQuery: 20, MaxChunkBytesPerQuery: chunkBytes, MaxSeriesPerQuery: 20, MaxSamplesPerQuery: 20},
+		},
+		{
+			name:   "too many index entries",
+			limits: QueryLimits{MaxIndexEntriesPerQuery: 19},
+			err:    QueryLimitError{What: "index entries", Limit: 19},
+		},
+		{
+			name:   "too many chunks",
+			limits: QueryLimits{MaxChunksPerQuery: 19},
+			err:    QueryLimitError{What: "chunks", Limit: 19},
+		},
+		{
+			name:   "too many chunk bytes",
+			limits: QueryLimits{MaxChunkBytesPerQuery: chunkBytes / 2},
+			err:    QueryLimitError{What: "chunk bytes", Limit: chunkBytes / 2},
+		},
+		{
+			name:   "too many series",
+			limits: QueryLimits{MaxSeriesPerQuery: 19},
+			err:    QueryLimitError{What: "series", Limit: 19},
+		},
+		{
+			name:   "too many samples",
+			limits: QueryLimits{MaxSamplesPerQuery: 10},
+			err:    QueryLimitError{What: "samples", Limit: 10},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mockStorage := NewMockStorage()
+			tableManager, err := NewDynamoTableManager(TableManagerConfig{}, mockStorage)
+			require.NoError(t, err)
+			require.NoError(t, tableManager.syncTables(context.Background()))
+
+			storage := &concurrencyStorage{StorageClient: mockStorage}
+			store, err := NewStore(StoreConfig{
+				QueryLimitsConfig: QueryLimitsConfig{
+					QueryLimits:           tc.limits,
+					ChunkFetchParallelism: 4,
+				},
+				schemaFactory: v6Schema,
+			}, storage)
+			require.NoError(t, err)
+			require.NoError(t, store.Put(ctx, chunks))
+
+			result, err := store.Get(ctx, now.Add(-time.Hour), now,
+				mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+			if tc.err != nil {
+				assert.Equal(t, tc.err, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, result, len(chunks))
+			assert.True(t, storage.maxSeen <= 4, "%d chunk fetches in flight", storage.maxSeen)
+		})
+	}
+}
+
+func TestChunkStoreQueryLimitsOverrides(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	now := model.Now()
+
+	chunks := []Chunk{}
+	for i := 0; i < 20; i++ {
+		chunks = append(chunks, dummyChunkFor(model.Metric{
+			model.MetricNameLabel: "foo",
+			"instance":            model.LabelValue(fmt.Sprintf("instance%d", i)),
+		}))
+	}
+
+	f, err := ioutil.TempFile("", "query-limits")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`
+overrides:
+  "` + userID + `":
+    max_series_per_query: 19
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	mockStorage := NewMockStorage()
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{}, mockStorage)
+	require.NoError(t, err)
+	require.NoError(t, tableManager.syncTables(context.Background()))
+	store, err := NewStore(StoreConfig{
+		QueryLimitsConfig: QueryLimitsConfig{
+			QueryLimits:   QueryLimits{MaxSeriesPerQuery: 1},
+			OverridesFile: f.Name(),
+		},
+		schemaFactory: v6Schema,
+	}, mockStorage)
+	require.NoError(t, err)
+	require.NoError(t, store.Put(ctx, chunks))
+
+	assert.Equal(t, QueryLimits{MaxSeriesPerQuery: 19}, store.QueryLimits(userID))
+	assert.Equal(t, QueryLimits{MaxSeriesPerQuery: 1}, store.QueryLimits("other"))
+
+	_, err = store.Get(ctx, now.Add(-time.Hour), now,
+		mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"))
+	assert.Equal(t, QueryLimitError{What: "series", Limit: 19}, err)
+
+	// Series dropped by filters after fetching don't count.
+	result, err := store.Get(ctx, now.Add(-time.Hour), now,
+		mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"),
+		mustNewLabelMatcher(metric.NotEqual, "instance", "instance0"))
+	require.NoError(t, err)
+	assert.Len(t, result, 19)
+}
+
+// Selectors sharing a QueryUsage are limited together.
+func TestChunkStoreQueryUsage(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	now := model.Now()
+
+	chunks := []Chunk{}
+	for i := 0; i < 20; i++ {
+		chunks = append(chunks, dummyChunkFor(model.Metric{
+			model.MetricNameLabel: "foo",
+			"instance":            model.LabelValue(fmt.Sprintf("instance%d", i)),
+		}))
+	}
+
+	mockStorage := NewMockStorage()
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{}, mockStorage)
+	require.NoError(t, err)
+	require.NoError(t, tableManager.syncTables(context.Background()))
+	limits := QueryLimits{MaxSeriesPerQuery: 15}
+	store, err := NewStore(StoreConfig{
+		QueryLimitsConfig: QueryLimitsConfig{QueryLimits: limits},
+		schemaFactory:     v6Schema,
+	}, mockStorage)
+	require.NoError(t, err)
+	require.NoError(t, store.Put(ctx, chunks))
+
+	get := func(ctx context.Context, instances model.LabelValue) error {
+		_, err := store.Get(ctx, now.Add(-time.Hour), now,
+			mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo"),
+			mustNewLabelMatcher(metric.RegexMatch, "instance", instances))
+		return err
+	}
+
+	// Without a shared usage, each selector is limited on its own.
+	require.NoError(t, get(ctx, "instance[0-9]"))
+	require.NoError(t, get(ctx, "instance1[0-9]"))
+
+	ctx = WithQueryUsage(ctx, NewQueryUsage(limits))
+	require.NoError(t, get(ctx, "instance[0-9]"))
+	assert.Equal(t, QueryLimitError{What: "series", Limit: 15}, get(ctx, "instance1[0-9]"))
+}
@@ -2,6 +2,7 @@ package chunk
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
@@ -14,9 +15,14 @@ import (
 
 	"github.com/prometheus/common/model"
 
+	"github.com/weaveworks/common/errors"
 	"github.com/weaveworks/cortex/util"
 )
 
+// ErrMetricNamesNotIndexed is returned when asked for the metric names of a
+// period whose schema predates v7, as they aren't listed in its index.
+const ErrMetricNamesNotIndexed = errors.Error("metric names are only listed in the index from schema v7 onwards")
+
 const (
 	secondsInHour      = int64(time.Hour / time.Second)
 	secondsInDay       = int64(24 * time.Hour / time.Second)
@@ -30,6 +36,10 @@ var (
 	rangeKeyV3 = []byte{'3'}
 	rangeKeyV4 = []byte{'4'}
 	rangeKeyV5 = []byte{'5'}
+	rangeKeyV6 = []byte{'6'}
+	rangeKeyV7 = []byte{'7'}
+	rangeKeyV8 = []byte{'8'}
+	rangeKeyV9 = []byte{'9'}
 )
 
 // Schema interface defines methods to calculate the hash and range keys needed
@@ -42,6 +52,14 @@ type Schema interface {
 	GetReadEntriesForMetric(from, through model.Time, userID string, metricName model.LabelValue) ([]IndexEntry, error)
 	GetReadEntriesForMetricLabel(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName) ([]IndexEntry, error)
 	GetReadEntriesForMetricLabelValue(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName, labelValue model.LabelValue) ([]IndexEntry, error)
+
+	// For schemas whose entries above lead to series IDs rather than chunk IDs,
+	// use this method to find the entries to query for the chunks of a series.
+	GetChunksForSeries(from, through model.Time, userID string, seriesID []byte) ([]IndexEntry, error)
+
+	// For schemas which list the metric names per user, use this method to find
+	// the entries to query for them.
+	GetReadEntriesForMetricNames(from, through model.Time, userID string) ([]IndexEntry, error)
 }
 
 // IndexEntry describes an entry in the chunk index
@@ -83,18 +101,27 @@ type SchemaConfig struct {
 
 	// After this time, we will read and write v6 schemas.
 	V6SchemaFrom util.DayValue
+
+	// After this time, we will read and write v7 schemas.
+	V7SchemaFrom util.DayValue
+
+	// If set, the schema periods are read from this file instead of the
+	// date flags above.
+	SchemaFileConfig
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *SchemaConfig) RegisterFlags(f *flag.FlagSet) {
 	cfg.PeriodicTableConfig.RegisterFlags(f)
+	cfg.SchemaFileConfig.RegisterFlags(f)
 
-	flag.StringVar(&cfg.OriginalTableName, "dynamodb.original-table-name", "", "The name of the DynamoDB table used before versioned schemas were introduced.")
+	f.StringVar(&cfg.OriginalTableName, "dynamodb.original-table-name", "", "The name of the DynamoDB table used before versioned schemas were introduced.")
 	f.Var(&cfg.DailyBucketsFrom, "dynamodb.daily-buckets-from", "The date (in the format YYYY-MM-DD) of the first day for which DynamoDB index buckets should be day-sized vs. hour-sized.")
 	f.Var(&cfg.Base64ValuesFrom, "dynamodb.base64-buckets-from", "The date (in the format YYYY-MM-DD) after which we will stop querying to non-base64 encoded values.")
 	f.Var(&cfg.V4SchemaFrom, "dynamodb.v4-schema-from", "The date (in the format YYYY-MM-DD) after which we enable v4 schema.")
 	f.Var(&cfg.V5SchemaFrom, "dynamodb.v5-schema-from", "The date (in the format YYYY-MM-DD) after which we enable v5 schema.")
 	f.Var(&cfg.V6SchemaFrom, "dynamodb.v6-schema-from", "The date (in the format YYYY-MM-DD) after which we enable v6 schema.")
+	f.Var(&cfg.V7SchemaFrom, "dynamodb.v7-schema-from", "The date (in the format YYYY-MM-DD) after which we enable v7 schema.")
 }
 
 func (cfg *SchemaConfig) tableForBucket(bucketStart int64) string {
@@ -173,6 +200,13 @@ func (a byStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a byStart) Less(i, j int) bool { return a[i].start < a[j].start }
 
 func newCompositeSchema(cfg SchemaConfig) (Schema, error) {
+	periods, ok, err := cfg.load()
+	if err != nil {
+		return nil, err
+	} else if ok {
+		return newPeriodsSchema(periods), nil
+	}
+
 	schemas := []compositeSchemaEntry{
 		{0, v1Schema(cfg)},
 	}
@@ -197,6 +231,10 @@ func newCompositeSchema(cfg SchemaConfig) (Schema, error) {
 		schemas = append(schemas, compositeSchemaEntry{cfg.V6SchemaFrom.Time, v6Schema(cfg)})
 	}
 
+	if cfg.V7SchemaFrom.IsSet() {
+		schemas = append(schemas, compositeSchemaEntry{cfg.V7SchemaFrom.Time, v7Schema(cfg)})
+	}
+
 	if !sort.IsSorted(byStart(schemas)) {
 		return nil, fmt.Errorf("schemas not in time-sorted order")
 	}
@@ -284,6 +322,18 @@ func (c compositeSchema) GetReadEntriesForMetricLabelValue(from, through model.T
 	})
 }
 
+func (c compositeSchema) GetChunksForSeries(from, through model.Time, userID string, seriesID []byte) ([]IndexEntry, error) {
+	return c.forSchemas(from, through, func(from, through model.Time, schema Schema) ([]IndexEntry, error) {
+		return schema.GetChunksForSeries(from, through, userID, seriesID)
+	})
+}
+
+func (c compositeSchema) GetReadEntriesForMetricNames(from, through model.Time, userID string) ([]IndexEntry, error) {
+	return c.forSchemas(from, through, func(from, through model.Time, schema Schema) ([]IndexEntry, error) {
+		return schema.GetReadEntriesForMetricNames(from, through, userID)
+	})
+}
+
 // v1Schema was:
 // - hash key: <userid>:<hour bucket>:<metric name>
 // - range key: <label name>\0<label value>\0<chunk name>
@@ -343,6 +393,183 @@ func v6Schema(cfg SchemaConfig) Schema {
 	}
 }
 
+// v7 schema indexes series rather than chunks, so the index grows with the
+// number of series rather than chunks.  Label entries map to series IDs; they
+// are still written with every chunk, but each chunk of a series in a day
+// bucket writes the same rows, so they overwrite rather than add to the index:
+// 1) - hash key: <userid>:d<day bucket>:<metric name>:<label name>
+//    - range key: \0\0<series id>\0<version 6>
+//    - value: <label value>
+// 2) - hash key: <userid>:d<day bucket>:<metric name>
+//    - range key: \0\0<series id>\0<version 7>
+// Then series IDs map to chunk IDs:
+// 3) - hash key: <userid>:d<day bucket>:<series id>
+//    - range key: <chunk end time>\0\0<chunk id>\0<version 8>
+// And the metric names are listed per user, for queries without one:
+// 4) - hash key: <userid>:d<day bucket>
+//    - range key: \0\0<metric name>\0<version 9>
+func v7Schema(cfg SchemaConfig) Schema {
+	return seriesSchema{cfg.dailyBuckets}
+}
+
+// seriesID returns a stable ID for the series with the given labels.  It is
+// base64 encoded, so can't contain null bytes or colons.
+func seriesID(labels model.Metric) []byte {
+	names := make(model.LabelNames, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Sort(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+		h.Write([]byte(labels[name]))
+		h.Write([]byte{0})
+	}
+	return encodeBase64Value(model.LabelValue(h.Sum(nil)))
+}
+
+// encodeLabelNames returns the sorted label names of a series, other than the
+// metric name, separated by commas, which can't appear in label names.
+func encodeLabelNames(labels model.Metric) []byte {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if name != model.MetricNameLabel {
+			names = append(names, string(name))
+		}
+	}
+	sort.Strings(names)
+	return []byte(strings.Join(names, ","))
+}
+
+func decodeLabelNames(bs []byte) model.LabelNames {
+	if len(bs) == 0 {
+		return nil
+	}
+	parts := strings.Split(string(bs), ",")
+	names := make(model.LabelNames, 0, len(parts))
+	for _, part := range parts {
+		names = append(names, model.LabelName(part))
+	}
+	return names
+}
+
+// seriesSchema implements Schema for v7.
+type seriesSchema struct {
+	buckets func(from, through model.Time, userID string, metricName model.LabelValue, callback bucketCallback) ([]IndexEntry, error)
+}
+
+func (s seriesSchema) GetWriteEntries(from, through model.Time, userID string, metricName model.LabelValue, labels model.Metric, chunkID string) ([]IndexEntry, error) {
+	seriesID := seriesID(labels)
+
+	entries, err := s.buckets(from, through, userID, metricName, func(_, _ uint32, tableName, hashKey string) ([]IndexEntry, error) {
+		entries := []IndexEntry{
+			{
+				TableName:  tableName,
+				HashValue:  hashKey,
+				RangeValue: buildRangeKey(nil, nil, seriesID, rangeKeyV7),
+				Value:      encodeLabelNames(labels),
+			},
+		}
+		for key, value := range labels {
+			if key == model.MetricNameLabel {
+				continue
+			}
+			entries = append(entries, IndexEntry{
+				TableName:  tableName,
+				HashValue:  hashKey + ":" + string(key),
+				RangeValue: buildRangeKey(nil, nil, seriesID, rangeKeyV6),
+				Value:      []byte(value),
+			})
+		}
+		return entries, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	chunkEntries, err := s.buckets(from, through, userID, model.LabelValue(seriesID), func(_, through uint32, tableName, hashKey string) ([]IndexEntry, error) {
+		return []IndexEntry{
+			{
+				TableName:  tableName,
+				HashValue:  hashKey,
+				RangeValue: buildRangeKey(encodeTime(through), nil, []byte(chunkID), rangeKeyV8),
+			},
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries = append(entries, chunkEntries...)
+
+	metricNameEntries, err := s.buckets(from, through, userID, "", func(_, _ uint32, tableName, hashKey string) ([]IndexEntry, error) {
+		return []IndexEntry{
+			{
+				TableName:  tableName,
+				HashValue:  strings.TrimSuffix(hashKey, ":"),
+				RangeValue: buildRangeKey(nil, nil, []byte(metricName), rangeKeyV9),
+			},
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(entries, metricNameEntries...), nil
+}
+
+func (s seriesSchema) GetReadEntriesForMetricNames(from, through model.Time, userID string) ([]IndexEntry, error) {
+	return s.buckets(from, through, userID, "", func(_, _ uint32, tableName, hashKey string) ([]IndexEntry, error) {
+		return []IndexEntry{
+			{
+				TableName: tableName,
+				HashValue: strings.TrimSuffix(hashKey, ":"),
+			},
+		}, nil
+	})
+}
+
+func (s seriesSchema) GetReadEntriesForMetric(from, through model.Time, userID string, metricName model.LabelValue) ([]IndexEntry, error) {
+	return s.buckets(from, through, userID, metricName, func(_, _ uint32, tableName, hashKey string) ([]IndexEntry, error) {
+		return []IndexEntry{
+			{
+				TableName: tableName,
+				HashValue: hashKey,
+			},
+		}, nil
+	})
+}
+
+func (s seriesSchema) GetReadEntriesForMetricLabel(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName) ([]IndexEntry, error) {
+	return s.buckets(from, through, userID, metricName, func(_, _ uint32, tableName, hashKey string) ([]IndexEntry, error) {
+		return []IndexEntry{
+			{
+				TableName: tableName,
+				HashValue: hashKey + ":" + string(labelName),
+			},
+		}, nil
+	})
+}
+
+func (s seriesSchema) GetReadEntriesForMetricLabelValue(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName, _ model.LabelValue) ([]IndexEntry, error) {
+	// The label value is not in the range key, so this has to read the whole
+	// row; the caller filters by value.
+	return s.GetReadEntriesForMetricLabel(from, through, userID, metricName, labelName)
+}
+
+func (s seriesSchema) GetChunksForSeries(from, through model.Time, userID string, seriesID []byte) ([]IndexEntry, error) {
+	return s.buckets(from, through, userID, model.LabelValue(seriesID), func(from, _ uint32, tableName, hashKey string) ([]IndexEntry, error) {
+		return []IndexEntry{
+			{
+				TableName:       tableName,
+				HashValue:       hashKey,
+				RangeValueStart: buildRangeKey(encodeTime(from)),
+			},
+		}, nil
+	})
+}
+
 // schema implements Schema given a bucketing function and and set of range key callbacks
 type schema struct {
 	buckets func(from, through model.Time, userID string, metricName model.LabelValue, callback bucketCallback) ([]IndexEntry, error)
@@ -373,6 +600,17 @@ func (s schema) GetReadEntriesForMetricLabelValue(from, through model.Time, user
 	})
 }
 
+// GetChunksForSeries returns nothing, as these schemas index chunks directly.
+func (s schema) GetChunksForSeries(from, through model.Time, userID string, seriesID []byte) ([]IndexEntry, error) {
+	return nil, nil
+}
+
+// GetReadEntriesForMetricNames returns ErrMetricNamesNotIndexed, as these
+// schemas don't list metric names.
+func (s schema) GetReadEntriesForMetricNames(from, through model.Time, userID string) ([]IndexEntry, error) {
+	return nil, ErrMetricNamesNotIndexed
+}
+
 type entries interface {
 	GetWriteEntries(from, through uint32, tableName, hashKey string, labels model.Metric, chunkID string) ([]IndexEntry, error)
 	GetReadMetricEntries(from, through uint32, tableName, hashKey string) ([]IndexEntry, error)
@@ -689,7 +927,24 @@ func decodeBase64Value(bs []byte) (model.LabelValue, error) {
 	return model.LabelValue(decoded), nil
 }
 
-func parseRangeValue(rangeValue []byte, value []byte) (string, model.LabelValue, bool, error) {
+// rangeValueKind says what the ID parsed from a range value refers to.
+type rangeValueKind int
+
+const (
+	// chunkEntry is a chunk ID; the chunk holds its own metadata.
+	chunkEntry rangeValueKind = iota
+	// chunkEntryMetadataInIndex is a chunk ID from the v1 & v2 schemas, where
+	// the chunk metadata was only written to the index.
+	chunkEntryMetadataInIndex
+	// seriesEntry is a series ID from the v7 schema; the chunk IDs for the
+	// series are found with Schema.GetChunksForSeries.
+	seriesEntry
+	// metricNameEntry has no ID, just a metric name in place of the label
+	// value.
+	metricNameEntry
+)
+
+func parseRangeValue(rangeValue []byte, value []byte) (string, model.LabelValue, rangeValueKind, error) {
 	components := make([][]byte, 0, 5)
 	i, j := 0, 0
 	for j < len(rangeValue) {
@@ -705,41 +960,59 @@ func parseRangeValue(rangeValue []byte, value []byte) (string, model.LabelValue,
 
 	switch {
 	case len(components) < 3:
-		return "", "", false, fmt.Errorf("invalid range value: %x", rangeValue)
+		return "", "", chunkEntry, fmt.Errorf("invalid range value: %x", rangeValue)
 
 	// v1 & v2 schema had three components - label name, label value and chunk ID.
 	// No version number.
 	case len(components) == 3:
-		return string(components[2]), model.LabelValue(components[1]), true, nil
+		return string(components[2]), model.LabelValue(components[1]), chunkEntryMetadataInIndex, nil
 
 	// v3 schema had four components - label name, label value, chunk ID and version.
 	// "version" is 1 and label value is base64 encoded.
 	case bytes.Equal(components[3], rangeKeyV1):
 		labelValue, err := decodeBase64Value(components[1])
-		return string(components[2]), labelValue, false, err
+		return string(components[2]), labelValue, chunkEntry, err
 
 	// v4 schema wrote v3 range keys and a new range key - version 2,
 	// with four components - <empty>, <empty>, chunk ID and version.
 	case bytes.Equal(components[3], rangeKeyV2):
-		return string(components[2]), model.LabelValue(""), false, nil
+		return string(components[2]), model.LabelValue(""), chunkEntry, nil
 
 	// v5 schema version 3 range key is chunk end time, <empty>, chunk ID, version
 	case bytes.Equal(components[3], rangeKeyV3):
-		return string(components[2]), model.LabelValue(""), false, nil
+		return string(components[2]), model.LabelValue(""), chunkEntry, nil
 
 	// v5 schema version 4 range key is chunk end time, label value, chunk ID, version
 	case bytes.Equal(components[3], rangeKeyV4):
 		labelValue, err := decodeBase64Value(components[1])
-		return string(components[2]), labelValue, false, err
+		return string(components[2]), labelValue, chunkEntry, err
 
 	// v6 schema added version 5 range keys, which have the label value written in
 	// to the value, not the range key. So they are [chunk end time, <empty>, chunk ID, version].
 	case bytes.Equal(components[3], rangeKeyV5):
 		labelValue := model.LabelValue(value)
-		return string(components[2]), labelValue, false, nil
+		return string(components[2]), labelValue, chunkEntry, nil
+
+	// v7 schema version 6 range key is <empty>, <empty>, series ID, version,
+	// with the label value written in to the value.
+	case bytes.Equal(components[3], rangeKeyV6):
+		return string(components[2]), model.LabelValue(value), seriesEntry, nil
+
+	// v7 schema version 7 range key is <empty>, <empty>, series ID, version,
+	// with the series' label names written in to the value.
+	case bytes.Equal(components[3], rangeKeyV7):
+		return string(components[2]), model.LabelValue(""), seriesEntry, nil
+
+	// v7 schema version 8 range key is chunk end time, <empty>, chunk ID, version.
+	case bytes.Equal(components[3], rangeKeyV8):
+		return string(components[2]), model.LabelValue(""), chunkEntry, nil
+
+	// v7 schema version 9 range key is <empty>, <empty>, metric name, version.
+	case bytes.Equal(components[3], rangeKeyV9):
+		return "", model.LabelValue(components[2]), metricNameEntry, nil
 
 	default:
-		return "", model.LabelValue(""), false, fmt.Errorf("unrecognised version: '%v'", string(components[3]))
+		return "", model.LabelValue(""), chunkEntry, fmt.Errorf("unrecognised version: '%v'", string(components[3]))
 	}
 
 }
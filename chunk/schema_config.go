@@ -0,0 +1,253 @@
+package chunk
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// schemaFactories are the schema versions which can be named in a schema
+// config file.
+var schemaFactories = map[string]func(cfg SchemaConfig) Schema{
+	"v1": v1Schema,
+	"v2": v2Schema,
+	"v3": v3Schema,
+	"v4": v4Schema,
+	"v5": v5Schema,
+	"v6": v6Schema,
+	"v7": v7Schema,
+}
+
+// SchemaFileConfig names the schema config file.  It is embedded in both the
+// chunk store's and the table manager's configs, so they share one flag.
+type SchemaFileConfig struct {
+	ConfigFile string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *SchemaFileConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.ConfigFile, "chunk.schema-config-file", "", "YAML file listing the schema periods, replacing the schema date and periodic table flags.")
+}
+
+// PeriodConfig configures the schema, tables and backends used for chunks
+// from a given day, until the start of the next period.  The object store
+// defaults to the index store.
+type PeriodConfig struct {
+	From        util.DayValue     `yaml:"from"`
+	Schema      string            `yaml:"schema"`
+	Store       string            `yaml:"store,omitempty"`
+	ObjectStore string            `yaml:"object_store,omitempty"`
+	IndexTables PeriodicTableSpec `yaml:"index"`
+}
+
+// PeriodicTableSpec describes the index tables of a period.  If Period is
+// zero, a single table called Prefix is used.
+type PeriodicTableSpec struct {
+	Prefix string        `yaml:"prefix"`
+	Period time.Duration `yaml:"period,omitempty"`
+}
+
+// SchemaPeriods is the contents of a schema config file.
+type SchemaPeriods struct {
+	Configs []PeriodConfig `yaml:"configs"`
+}
+
+// LoadSchemaPeriods reads and validates a schema config file.
+func LoadSchemaPeriods(filename string) (SchemaPeriods, error) {
+	var periods SchemaPeriods
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return periods, err
+	}
+	if err := yaml.Unmarshal(buf, &periods); err != nil {
+		return periods, fmt.Errorf("error parsing %s: %v", filename, err)
+	}
+	if err := periods.Validate(); err != nil {
+		return periods, fmt.Errorf("invalid schema config %s: %v", filename, err)
+	}
+	return periods, nil
+}
+
+// Validate checks the periods are in order and only use known schemas and
+// stores.  Only a non-periodic period followed by another may leave out its
+// index table prefix, for deployments that had no table before periodic
+// tables.
+func (s SchemaPeriods) Validate() error {
+	if len(s.Configs) == 0 {
+		return fmt.Errorf("no periods configured")
+	}
+
+	for i, p := range s.Configs {
+		if !p.From.IsSet() {
+			return fmt.Errorf("period %d: missing from date", i)
+		}
+		if i > 0 && p.From.Time <= s.Configs[i-1].From.Time {
+			return fmt.Errorf("period %d: from date %s is not after previous period's", i, p.From)
+		}
+		if _, ok := schemaFactories[p.Schema]; !ok {
+			return fmt.Errorf("period %d: unknown schema %q", i, p.Schema)
+		}
+		if _, ok := indexClientFactories[p.Store]; p.Store != "" && !ok {
+			return fmt.Errorf("period %d: unknown store %q", i, p.Store)
+		}
+		if _, ok := objectClientFactories[p.ObjectStore]; p.ObjectStore != "" && !ok {
+			return fmt.Errorf("period %d: unknown object store %q", i, p.ObjectStore)
+		}
+		if p.IndexTables.Prefix == "" && (p.IndexTables.Period != 0 || i == len(s.Configs)-1) {
+			return fmt.Errorf("period %d: missing index table prefix", i)
+		}
+		if p.IndexTables.Period < 0 || p.IndexTables.Period%(24*time.Hour) != 0 {
+			return fmt.Errorf("period %d: index table period %v is not a whole number of days", i, p.IndexTables.Period)
+		}
+	}
+	return nil
+}
+
+// periodTable is an index table, and the time range it holds the index of.
+type periodTable struct {
+	name          string
+	periodic      bool
+	from, through model.Time // [from, through)
+}
+
+// tables returns the index tables holding the index of [from, through).
+func (s SchemaPeriods) tables(from, through model.Time) []periodTable {
+	msPerSec := int64(time.Second / time.Millisecond)
+	result := []periodTable{}
+	for i, period := range s.Configs {
+		var (
+			start = period.From.Time
+			end   = model.Time(math.MaxInt64)
+		)
+		if i+1 < len(s.Configs) {
+			end = s.Configs[i+1].From.Time
+		}
+		if end <= from || through <= start {
+			continue
+		}
+
+		if period.IndexTables.Period == 0 {
+			// Before periodic tables, there mightn't have been a table.
+			if period.IndexTables.Prefix != "" {
+				result = append(result, periodTable{name: period.IndexTables.Prefix, from: start, through: end})
+			}
+			continue
+		}
+		tablePeriodSecs := int64(period.IndexTables.Period / time.Second)
+		for t := util.Max64(int64(start), int64(from)) / msPerSec / tablePeriodSecs; t*tablePeriodSecs*msPerSec < util.Min64(int64(end), int64(through)); t++ {
+			result = append(result, periodTable{
+				name:     period.IndexTables.Prefix + strconv.Itoa(int(t)),
+				periodic: true,
+				from:     model.Time(util.Max64(int64(start), t*tablePeriodSecs*msPerSec)),
+				through:  model.Time(util.Min64(int64(end), (t+1)*tablePeriodSecs*msPerSec)),
+			})
+		}
+	}
+	return result
+}
+
+// schemaConfig returns the config for this period's schema.
+func (p PeriodConfig) schemaConfig() SchemaConfig {
+	cfg := SchemaConfig{
+		OriginalTableName: p.IndexTables.Prefix,
+	}
+	if p.IndexTables.Period > 0 {
+		cfg.UsePeriodicTables = true
+		cfg.TablePrefix = p.IndexTables.Prefix
+		cfg.TablePeriod = p.IndexTables.Period
+		cfg.PeriodicTableStartAt = p.From
+	}
+	return cfg
+}
+
+func newPeriodsSchema(periods SchemaPeriods) Schema {
+	schemas := make([]compositeSchemaEntry, 0, len(periods.Configs))
+	for _, p := range periods.Configs {
+		schemas = append(schemas, compositeSchemaEntry{p.From.Time, schemaFactories[p.Schema](p.schemaConfig())})
+	}
+	return compositeSchema{schemas}
+}
+
+// load reads the schema config file, if there is one.  The date flags cannot
+// be used alongside it.
+func (cfg *SchemaConfig) load() (SchemaPeriods, bool, error) {
+	if cfg.ConfigFile == "" {
+		return SchemaPeriods{}, false, nil
+	}
+	for _, d := range []util.DayValue{cfg.DailyBucketsFrom, cfg.Base64ValuesFrom, cfg.V4SchemaFrom, cfg.V5SchemaFrom, cfg.V6SchemaFrom, cfg.V7SchemaFrom, cfg.PeriodicTableStartAt} {
+		if d.IsSet() {
+			return SchemaPeriods{}, false, fmt.Errorf("schema date flags cannot be used with a schema config file")
+		}
+	}
+	periods, err := LoadSchemaPeriods(cfg.ConfigFile)
+	return periods, err == nil, err
+}
+
+// EffectivePeriods returns the periods from the schema config file, or the
+// equivalent of the date flags if there isn't one.
+func (cfg SchemaConfig) EffectivePeriods() (SchemaPeriods, error) {
+	periods, ok, err := cfg.load()
+	if err != nil || ok {
+		return periods, err
+	}
+
+	type schemaStart struct {
+		from   model.Time
+		schema string
+	}
+	starts := []schemaStart{{0, "v1"}}
+	for _, s := range []struct {
+		from   util.DayValue
+		schema string
+	}{
+		{cfg.DailyBucketsFrom, "v2"},
+		{cfg.Base64ValuesFrom, "v3"},
+		{cfg.V4SchemaFrom, "v4"},
+		{cfg.V5SchemaFrom, "v5"},
+		{cfg.V6SchemaFrom, "v6"},
+		{cfg.V7SchemaFrom, "v7"},
+	} {
+		if s.from.IsSet() {
+			starts = append(starts, schemaStart{s.from.Time, s.schema})
+		}
+	}
+
+	boundaries := []model.Time{}
+	for _, s := range starts {
+		boundaries = append(boundaries, s.from)
+	}
+	if cfg.UsePeriodicTables {
+		boundaries = append(boundaries, cfg.PeriodicTableStartAt.Time)
+	}
+	sort.Slice(boundaries, func(i, j int) bool { return boundaries[i] < boundaries[j] })
+
+	for i, from := range boundaries {
+		if i > 0 && from == boundaries[i-1] {
+			continue
+		}
+
+		// As in newCompositeSchema, the last schema starting by then wins.
+		p := PeriodConfig{From: util.NewDayValue(from)}
+		for _, s := range starts {
+			if s.from <= from {
+				p.Schema = s.schema
+			}
+		}
+		if cfg.UsePeriodicTables && from >= cfg.PeriodicTableStartAt.Time {
+			p.IndexTables = PeriodicTableSpec{Prefix: cfg.TablePrefix, Period: cfg.TablePeriod}
+		} else {
+			p.IndexTables = PeriodicTableSpec{Prefix: cfg.OriginalTableName}
+		}
+		periods.Configs = append(periods.Configs, p)
+	}
+	return periods, nil
+}
@@ -0,0 +1,411 @@
+package chunk
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/mtime"
+	"github.com/weaveworks/common/test"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+func writeSchemaConfigFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "schema-config")
+	require.NoError(t, err)
+	_, err = f.WriteString(contents)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	return f.Name()
+}
+
+func TestLoadSchemaPeriods(t *testing.T) {
+	for _, tc := range []struct {
+		name, contents string
+		err            bool
+	}{
+		{
+			name: "valid",
+			contents: `
+configs:
+- from: 2017-01-01
+  schema: v6
+  store: aws
+  index: {prefix: cortex_, period: 168h}
+- from: 2017-06-01
+  schema: v7
+  store: aws
+  object_store: aws
+  index: {prefix: cortex_v7_, period: 168h}
+`,
+		},
+		{
+			name:     "no periods",
+			contents: `configs: []`,
+			err:      true,
+		},
+		{
+			name: "bad date",
+			contents: `
+configs:
+- from: 2017-01-01T00:00:00Z
+  schema: v6
+  index: {prefix: cortex_}
+`,
+			err: true,
+		},
+		{
+			name: "out of order",
+			contents: `
+configs:
+- from: 2017-06-01
+  schema: v6
+  index: {prefix: cortex_}
+- from: 2017-01-01
+  schema: v7
+  index: {prefix: cortex_}
+`,
+			err: true,
+		},
+		{
+			name: "unknown schema",
+			contents: `
+configs:
+- from: 2017-01-01
+  schema: v9
+  index: {prefix: cortex_}
+`,
+			err: true,
+		},
+		{
+			name: "unknown store",
+			contents: `
+configs:
+- from: 2017-01-01
+  schema: v6
+  store: floppy
+  index: {prefix: cortex_}
+`,
+			err: true,
+		},
+		{
+			name: "unknown object store",
+			contents: `
+configs:
+- from: 2017-01-01
+  schema: v6
+  store: aws
+  object_store: floppy
+  index: {prefix: cortex_}
+`,
+			err: true,
+		},
+		{
+			name: "mixed stores",
+			contents: `
+configs:
+- from: 2017-01-01
+  schema: v6
+  store: aws
+  index: {prefix: cortex_}
+- from: 2017-06-01
+  schema: v7
+  store: inmemory
+  object_store: aws
+  index: {prefix: cortex_v7_}
+`,
+		},
+		{
+			name: "missing prefix",
+			contents: `
+configs:
+- from: 2017-01-01
+  schema: v6
+  index: {period: 168h}
+`,
+			err: true,
+		},
+		{
+			name: "no legacy table",
+			contents: `
+configs:
+- from: 1970-01-01
+  schema: v1
+  index: {prefix: ""}
+- from: 2017-01-01
+  schema: v6
+  index: {prefix: cortex_, period: 168h}
+`,
+		},
+		{
+			name: "missing last prefix",
+			contents: `
+configs:
+- from: 2017-01-01
+  schema: v6
+  index: {prefix: ""}
+`,
+			err: true,
+		},
+		{
+			name: "partial day period",
+			contents: `
+configs:
+- from: 2017-01-01
+  schema: v6
+  index: {prefix: cortex_, period: 36h}
+`,
+			err: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := writeSchemaConfigFile(t, tc.contents)
+			defer os.Remove(filename)
+
+			_, err := LoadSchemaPeriods(filename)
+			if tc.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestSchemaConfigFileRejectsDateFlags(t *testing.T) {
+	filename := writeSchemaConfigFile(t, `
+configs:
+- from: 2017-01-01
+  schema: v6
+  index: {prefix: cortex_}
+`)
+	defer os.Remove(filename)
+
+	cfg := SchemaConfig{SchemaFileConfig: SchemaFileConfig{ConfigFile: filename}}
+	_, err := newCompositeSchema(cfg)
+	require.NoError(t, err)
+
+	cfg.V6SchemaFrom = util.NewDayValue(model.TimeFromUnix(0))
+	_, err = newCompositeSchema(cfg)
+	require.Error(t, err)
+}
+
+// The periods printed for the date flags must give the same index entries as
+// the flags themselves.
+func TestEffectivePeriodsMatchFlags(t *testing.T) {
+	day := func(d int64) util.DayValue {
+		return util.NewDayValue(model.TimeFromUnix(d * secondsInDay))
+	}
+	cfg := SchemaConfig{
+		OriginalTableName: "table",
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables:    true,
+			TablePrefix:          "cortex_",
+			TablePeriod:          7 * 24 * time.Hour,
+			PeriodicTableStartAt: day(20),
+		},
+		DailyBucketsFrom: day(5),
+		Base64ValuesFrom: day(10),
+		V4SchemaFrom:     day(10),
+		V5SchemaFrom:     day(30),
+		V6SchemaFrom:     day(40),
+		V7SchemaFrom:     day(50),
+	}
+
+	periods, err := cfg.EffectivePeriods()
+	require.NoError(t, err)
+	schemas := []string{}
+	for _, p := range periods.Configs {
+		schemas = append(schemas, p.Schema)
+	}
+	assert.Equal(t, []string{"v1", "v2", "v4", "v4", "v5", "v6", "v7"}, schemas)
+
+	// Round trip the periods through a file.
+	out, err := yaml.Marshal(periods)
+	require.NoError(t, err)
+	filename := writeSchemaConfigFile(t, string(out))
+	defer os.Remove(filename)
+
+	fromFlags, err := newCompositeSchema(cfg)
+	require.NoError(t, err)
+	fromFile, err := newCompositeSchema(SchemaConfig{SchemaFileConfig: SchemaFileConfig{ConfigFile: filename}})
+	require.NoError(t, err)
+
+	metric := model.Metric{
+		model.MetricNameLabel: "foo",
+		"bar":                 "baz",
+	}
+	for d := int64(0); d < 60; d++ {
+		from := model.TimeFromUnix(d*secondsInDay + 3600)
+		through := from.Add(2 * time.Hour)
+
+		want, err := fromFlags.GetWriteEntries(from, through, "userid", "foo", metric, "chunkID")
+		require.NoError(t, err)
+		have, err := fromFile.GetWriteEntries(from, through, "userid", "foo", metric, "chunkID")
+		require.NoError(t, err)
+
+		sort.Sort(ByHashRangeKey(want))
+		sort.Sort(ByHashRangeKey(have))
+		if !assert.Equal(t, want, have, "day %d", d) {
+			t.Log(test.Diff(want, have))
+		}
+	}
+}
+
+// The periods printed for the flags must load as a valid schema config file,
+// with or without a legacy table.
+func TestEffectivePeriodsLoad(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  SchemaConfig
+		err  bool
+	}{
+		{
+			name: "legacy table",
+			cfg:  SchemaConfig{OriginalTableName: "table", V6SchemaFrom: util.NewDayValue(model.TimeFromUnix(10 * secondsInDay))},
+		},
+		{
+			name: "no legacy table",
+			cfg: SchemaConfig{
+				PeriodicTableConfig: PeriodicTableConfig{
+					UsePeriodicTables:    true,
+					TablePrefix:          "cortex_",
+					TablePeriod:          7 * 24 * time.Hour,
+					PeriodicTableStartAt: util.NewDayValue(model.TimeFromUnix(7 * secondsInDay)),
+				},
+			},
+		},
+		{
+			name: "no table",
+			cfg:  SchemaConfig{},
+			err:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			periods, err := tc.cfg.EffectivePeriods()
+			require.NoError(t, err)
+			out, err := yaml.Marshal(periods)
+			require.NoError(t, err)
+			filename := writeSchemaConfigFile(t, string(out))
+			defer os.Remove(filename)
+
+			loaded, err := LoadSchemaPeriods(filename)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, periods, loaded)
+		})
+	}
+}
+
+func TestDynamoTableManagerPeriods(t *testing.T) {
+	filename := writeSchemaConfigFile(t, `
+configs:
+- from: 1970-01-01
+  schema: v2
+  index: {prefix: legacy}
+- from: 1970-01-15
+  schema: v6
+  index: {prefix: cortex_, period: 168h}
+- from: 1970-01-29
+  schema: v7
+  index: {prefix: cortex_v7_, period: 168h}
+`)
+	defer os.Remove(filename)
+
+	dynamoDB := NewMockStorage()
+	tableManager, err := NewDynamoTableManager(TableManagerConfig{
+		SchemaFileConfig:           SchemaFileConfig{ConfigFile: filename},
+		CreationGracePeriod:        gracePeriod,
+		MaxChunkAge:                maxChunkAge,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		InactiveWriteThroughput:    inactiveWrite,
+		InactiveReadThroughput:     inactiveRead,
+	}, dynamoDB)
+	require.NoError(t, err)
+
+	test := func(name string, tm time.Time, expected []tableDescription) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			mtime.NowForce(tm)
+			defer mtime.NowReset()
+			require.NoError(t, tableManager.syncTables(ctx))
+			expectTables(ctx, t, dynamoDB, expected)
+		})
+	}
+
+	// Before the periodic tables are needed, there is just the legacy table.
+	test(
+		"Initial test",
+		time.Unix(0, 0),
+		[]tableDescription{
+			{name: "legacy", provisionedRead: read, provisionedWrite: write},
+		},
+	)
+
+	// The first weekly table is created a grace period before it is needed.
+	test(
+		"Grace period before periodic tables",
+		time.Unix(14*secondsInDay, 0).Add(-gracePeriod),
+		[]tableDescription{
+			{name: "legacy", provisionedRead: read, provisionedWrite: write},
+			{name: "cortex_2", provisionedRead: read, provisionedWrite: write},
+		},
+	)
+
+	// The legacy table keeps write throughput for max chunk age after it is replaced.
+	test(
+		"Max chunk age + grace period after periodic tables",
+		time.Unix(14*secondsInDay, 0).Add(maxChunkAge).Add(gracePeriod),
+		[]tableDescription{
+			{name: "legacy", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: "cortex_2", provisionedRead: read, provisionedWrite: write},
+		},
+	)
+
+	// Tables with the old prefix stop at the next period.
+	test(
+		"After the v7 period starts",
+		time.Unix(35*secondsInDay, 0),
+		[]tableDescription{
+			{name: "legacy", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: "cortex_2", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: "cortex_3", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: "cortex_v7_4", provisionedRead: read, provisionedWrite: write},
+			{name: "cortex_v7_5", provisionedRead: read, provisionedWrite: write},
+		},
+	)
+}
+
+func TestSchemaPeriodsTables(t *testing.T) {
+	at := func(d int64) model.Time {
+		return model.TimeFromUnix(d * secondsInDay)
+	}
+	periods := SchemaPeriods{Configs: []PeriodConfig{
+		{From: util.NewDayValue(at(0)), IndexTables: PeriodicTableSpec{Prefix: "table"}},
+		{From: util.NewDayValue(at(10)), IndexTables: PeriodicTableSpec{Prefix: "weekly_", Period: 7 * 24 * time.Hour}},
+		{From: util.NewDayValue(at(20)), IndexTables: PeriodicTableSpec{Prefix: "daily_", Period: 24 * time.Hour}},
+	}}
+
+	assert.Equal(t, []periodTable{
+		{name: "table", from: at(0), through: at(10)},
+		{name: "weekly_1", periodic: true, from: at(10), through: at(14)},
+		{name: "weekly_2", periodic: true, from: at(14), through: at(20)},
+		{name: "daily_20", periodic: true, from: at(20), through: at(21)},
+	}, periods.tables(at(5), at(21)))
+
+	assert.Equal(t, []periodTable{
+		{name: "weekly_2", periodic: true, from: at(14), through: at(20)},
+	}, periods.tables(at(15), at(16)))
+}
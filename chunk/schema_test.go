@@ -32,6 +32,12 @@ func (mockSchema) GetReadEntriesForMetricLabel(from, through model.Time, userID
 func (mockSchema) GetReadEntriesForMetricLabelValue(from, through model.Time, userID string, metricName model.LabelValue, labelName model.LabelName, labelValue model.LabelValue) ([]IndexEntry, error) {
 	return nil, nil
 }
+func (mockSchema) GetChunksForSeries(from, through model.Time, userID string, seriesID []byte) ([]IndexEntry, error) {
+	return nil, nil
+}
+func (mockSchema) GetReadEntriesForMetricNames(from, through model.Time, userID string) ([]IndexEntry, error) {
+	return nil, nil
+}
 
 func TestSchemaComposite(t *testing.T) {
 	type result struct {
@@ -393,11 +399,13 @@ func TestSchemaRangeKey(t *testing.T) {
 		labelBuckets  = v4Schema(cfg)
 		tsRangeKeys   = v5Schema(cfg)
 		v6RangeKeys   = v6Schema(cfg)
+		v7SeriesKeys  = v7Schema(cfg)
 		metric        = model.Metric{
 			model.MetricNameLabel: metricName,
 			"bar": "bary",
 			"baz": "bazy",
 		}
+		series = string(seriesID(metric))
 	)
 
 	mkEntries := func(hashKey string, callback func(labelName model.LabelName, labelValue model.LabelValue) ([]byte, []byte)) []IndexEntry {
@@ -503,6 +511,39 @@ func TestSchemaRangeKey(t *testing.T) {
 				},
 			},
 		},
+		{
+			v7SeriesKeys,
+			[]IndexEntry{
+				{
+					TableName:  table,
+					HashValue:  "userid:d0:foo",
+					RangeValue: []byte("\x00\x00" + series + "\x007\x00"),
+					Value:      []byte("bar,baz"),
+				},
+				{
+					TableName:  table,
+					HashValue:  "userid:d0:foo:bar",
+					RangeValue: []byte("\x00\x00" + series + "\x006\x00"),
+					Value:      []byte("bary"),
+				},
+				{
+					TableName:  table,
+					HashValue:  "userid:d0:foo:baz",
+					RangeValue: []byte("\x00\x00" + series + "\x006\x00"),
+					Value:      []byte("bazy"),
+				},
+				{
+					TableName:  table,
+					HashValue:  "userid:d0:" + series,
+					RangeValue: []byte("0036ee7f\x00\x00chunkID\x008\x00"),
+				},
+				{
+					TableName:  table,
+					HashValue:  "userid:d0",
+					RangeValue: []byte("\x00\x00foo\x009\x00"),
+				},
+			},
+		},
 	} {
 		t.Run(fmt.Sprintf("TestSchameRangeKey[%d]", i), func(t *testing.T) {
 			have, err := tc.Schema.GetWriteEntries(
@@ -562,6 +603,25 @@ func TestParseRangeValue(t *testing.T) {
 		assert.Equal(t, model.LabelValue(c.value), labelValue)
 		assert.Equal(t, c.chunkID, chunkID)
 	}
+
+	// version 6, 7, 8 & 9 range keys (v7 schema) lead to series and chunk IDs,
+	// and metric names.
+	for _, c := range []struct {
+		encoded, value []byte
+		labelValue, id string
+		kind           rangeValueKind
+	}{
+		{[]byte("\x00\x00c2VyaWVz\x006\x00"), []byte("code"), "code", "c2VyaWVz", seriesEntry},
+		{[]byte("\x00\x00c2VyaWVz\x007\x00"), nil, "", "c2VyaWVz", seriesEntry},
+		{[]byte("a1b2c3d4\x00\x002:1484661279394:1484664879394\x008\x00"), nil, "", "2:1484661279394:1484664879394", chunkEntry},
+		{[]byte("\x00\x00http_requests_total\x009\x00"), nil, "http_requests_total", "", metricNameEntry},
+	} {
+		id, labelValue, kind, err := parseRangeValue(c.encoded, c.value)
+		require.NoError(t, err)
+		assert.Equal(t, model.LabelValue(c.labelValue), labelValue)
+		assert.Equal(t, c.id, id)
+		assert.Equal(t, c.kind, kind)
+	}
 }
 
 func TestSchemaTimeEncoding(t *testing.T) {
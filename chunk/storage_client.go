@@ -3,14 +3,20 @@ package chunk
 import (
 	"flag"
 	"fmt"
+	"sort"
 	"strings"
 
-	"github.com/prometheus/common/log"
 	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/errors"
 )
 
-// StorageClient is a client for the persistent storage for Cortex. (e.g. DynamoDB + S3).
-type StorageClient interface {
+// ErrStorageObjectNotFound is returned by ObjectClient.GetChunk when there is
+// no chunk with the key.
+const ErrStorageObjectNotFound = errors.Error("object not found in storage")
+
+// IndexClient is a client for the index of the chunk store (e.g. DynamoDB).
+type IndexClient interface {
 	// For the write path.
 	NewWriteBatch() WriteBatch
 	BatchWrite(context.Context, WriteBatch) error
@@ -18,14 +24,37 @@ type StorageClient interface {
 	// For the read path.
 	QueryPages(ctx context.Context, entry IndexEntry, callback func(result ReadBatch, lastPage bool) (shouldContinue bool)) error
 
-	// For storing and retrieving chunks.
+	// For tools which walk the whole index, e.g. the compactor.  Entries come
+	// in no particular order.  Only entries whose hash values start with
+	// hashPrefix are passed to the callback, which may write to the table.
+	ScanTable(ctx context.Context, tableName, hashPrefix string, callback func(entry IndexEntry) (shouldContinue bool)) error
+}
+
+// ObjectClient is a client for storing and retrieving chunks (e.g. S3).
+type ObjectClient interface {
 	PutChunk(ctx context.Context, key string, data []byte) error
 	GetChunk(ctx context.Context, key string) ([]byte, error)
+
+	// For tools which walk the whole store, e.g. fsck.  Keys come in no
+	// particular order.
+	ListChunks(ctx context.Context, prefix string, callback func(key string) (shouldContinue bool)) error
+
+	// For purging deleted tenants.  Deleting a chunk which doesn't exist is
+	// not an error.
+	DeleteChunk(ctx context.Context, key string) error
 }
 
-// WriteBatch represents a batch of writes.
+// StorageClient is a client for the persistent storage for Cortex. (e.g. DynamoDB + S3).
+type StorageClient interface {
+	IndexClient
+	ObjectClient
+}
+
+// WriteBatch represents a batch of writes.  Writes within a batch may be
+// done in any order, so a batch shouldn't add and delete the same entry.
 type WriteBatch interface {
 	Add(tableName, hashValue string, rangeValue []byte, value []byte)
+	Delete(tableName, hashValue string, rangeValue []byte)
 }
 
 // ReadBatch represents the results of a QueryPages.
@@ -35,30 +64,108 @@ type ReadBatch interface {
 	Value(index int) []byte
 }
 
-// StorageClientConfig chooses which storage client to use.
+// StorageClientConfig chooses which storage clients to use.
 type StorageClientConfig struct {
 	StorageClient string
+	ObjectClient  string
 	AWSStorageConfig
+	CassandraConfig
+	PostgresConfig
 }
 
 // RegisterFlags adds the flags required to configure this flag set.
 func (cfg *StorageClientConfig) RegisterFlags(f *flag.FlagSet) {
-	flag.StringVar(&cfg.StorageClient, "chunk.storage-client", "aws", "Which storage client to use (aws, inmemory).")
+	f.StringVar(&cfg.StorageClient, "chunk.storage-client", "aws", "Which storage client to use for the index (aws, cassandra, inmemory, postgres).")
+	f.StringVar(&cfg.ObjectClient, "chunk.object-client", "", "Which storage client to use for chunks (aws, cassandra, inmemory, postgres); defaults to -chunk.storage-client.")
 	cfg.AWSStorageConfig.RegisterFlags(f)
+	cfg.CassandraConfig.RegisterFlags(f)
+	cfg.PostgresConfig.RegisterFlags(f)
 }
 
-// NewStorageClient makes a storage client based on the configuration.
-func NewStorageClient(cfg StorageClientConfig) (StorageClient, error) {
-	switch cfg.StorageClient {
-	case "inmemory":
-		return NewMockStorage(), nil
-	case "aws":
-		path := strings.TrimPrefix(cfg.DynamoDB.URL.Path, "/")
-		if len(path) > 0 {
-			log.Warnf("Ignoring DynamoDB URL path: %v.", path)
+// IndexClientFactory makes an IndexClient from the storage config.
+type IndexClientFactory func(cfg StorageClientConfig) (IndexClient, error)
+
+// ObjectClientFactory makes an ObjectClient from the storage config.
+type ObjectClientFactory func(cfg StorageClientConfig) (ObjectClient, error)
+
+var (
+	indexClientFactories  = map[string]IndexClientFactory{}
+	objectClientFactories = map[string]ObjectClientFactory{}
+)
+
+// RegisterIndexClient makes an index backend available under the given name.
+func RegisterIndexClient(name string, factory IndexClientFactory) {
+	indexClientFactories[name] = factory
+}
+
+// RegisterObjectClient makes an object backend available under the given name.
+func RegisterObjectClient(name string, factory ObjectClientFactory) {
+	objectClientFactories[name] = factory
+}
+
+func registeredNames(names []string) string {
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func newIndexClient(cfg StorageClientConfig, name string) (IndexClient, error) {
+	factory, ok := indexClientFactories[name]
+	if !ok {
+		names := []string{}
+		for name := range indexClientFactories {
+			names = append(names, name)
+		}
+		return nil, fmt.Errorf("Unrecognized storage client %v, choose one of: %s", name, registeredNames(names))
+	}
+	return factory(cfg)
+}
+
+// NewObjectClient makes the named object client, e.g. for tools storing
+// objects other than chunks.
+func NewObjectClient(cfg StorageClientConfig, name string) (ObjectClient, error) {
+	factory, ok := objectClientFactories[name]
+	if !ok {
+		names := []string{}
+		for name := range objectClientFactories {
+			names = append(names, name)
+		}
+		return nil, fmt.Errorf("Unrecognized object client %v, choose one of: %s", name, registeredNames(names))
+	}
+	return factory(cfg)
+}
+
+// prefixUpperBound returns the smallest value greater than every value with
+// the given prefix, or nil if there isn't one.
+func prefixUpperBound(prefix []byte) []byte {
+	bound := append([]byte{}, prefix...)
+	for i := len(bound) - 1; i >= 0; i-- {
+		if bound[i] < 0xff {
+			bound[i]++
+			return bound[:i+1]
 		}
-		return NewAWSStorageClient(cfg.AWSStorageConfig)
-	default:
-		return nil, fmt.Errorf("Unrecognized storage client %v, choose one of: aws, inmemory", cfg.StorageClient)
 	}
+	return nil
+}
+
+// storageClient pairs an index client with an object client.
+type storageClient struct {
+	IndexClient
+	ObjectClient
+}
+
+// NewStorageClient makes a storage client based on the configuration.  Each
+// period in the schema config file may choose its own index and object
+// clients; those it doesn't name come from the flags.
+func NewStorageClient(cfg StorageClientConfig, schemaCfg SchemaConfig) (StorageClient, error) {
+	if cfg.ObjectClient == "" {
+		cfg.ObjectClient = cfg.StorageClient
+	}
+
+	periods, ok, err := schemaCfg.load()
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		periods = SchemaPeriods{Configs: []PeriodConfig{{}}}
+	}
+	return newPeriodStorageClient(cfg, periods)
 }
@@ -0,0 +1,20 @@
+package chunk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefixUpperBound(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, bound []byte
+	}{
+		{[]byte("abc"), []byte("abd")},
+		{[]byte("ab\xff"), []byte("ac")},
+		{[]byte("a\x00"), []byte("a\x01")},
+		{[]byte("\xff\xff"), nil},
+	} {
+		assert.Equal(t, tc.bound, prefixUpperBound(tc.prefix), "prefix %q", tc.prefix)
+	}
+}
@@ -0,0 +1,159 @@
+package chunk
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+
+	"github.com/weaveworks/common/mtime"
+)
+
+// AutoScalingConfig configures scaling the write throughput of active tables
+// to their observed usage, instead of provisioning them all the same.
+type AutoScalingConfig struct {
+	MetricsURL        string
+	Window            time.Duration
+	TargetUtilisation float64
+	MinWriteCapacity  int64
+	MaxWriteCapacity  int64
+	ScaleUpCooldown   time.Duration
+	ScaleDownCooldown time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *AutoScalingConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.MetricsURL, "dynamodb.autoscale.metrics-url", "", "URL of the Prometheus-compatible API to query for the tables' write usage. If empty, write throughput isn't scaled.")
+	f.DurationVar(&cfg.Window, "dynamodb.autoscale.window", 5*time.Minute, "Period over which to average the tables' write usage.")
+	f.Float64Var(&cfg.TargetUtilisation, "dynamodb.autoscale.target-utilisation", 0.8, "Fraction of provisioned write throughput active tables should consume.")
+	f.Int64Var(&cfg.MinWriteCapacity, "dynamodb.autoscale.min-write-capacity", 100, "Minimum write throughput of active tables.")
+	f.Int64Var(&cfg.MaxWriteCapacity, "dynamodb.autoscale.max-write-capacity", 10000, "Maximum write throughput of active tables.")
+	f.DurationVar(&cfg.ScaleUpCooldown, "dynamodb.autoscale.scale-up-cooldown", 5*time.Minute, "Minimum time between changing a table's write throughput and scaling it up.")
+	f.DurationVar(&cfg.ScaleDownCooldown, "dynamodb.autoscale.scale-down-cooldown", 6*time.Hour, "Minimum time between changing a table's write throughput and scaling it down; DynamoDB limits the number of decreases per day.")
+}
+
+// tableUsage is a table's recent write usage, in capacity units per second.
+type tableUsage struct {
+	consumed  float64
+	throttled float64
+}
+
+// writeUsageSource reports the recent write usage of tables, by name.
+type writeUsageSource interface {
+	writeUsage(ctx context.Context) (map[string]tableUsage, error)
+}
+
+// prometheusUsageSource reads the table write usage recorded by the
+// ingesters' storage clients from a Prometheus-compatible query API.
+type prometheusUsageSource struct {
+	url    string
+	window time.Duration
+	client *http.Client
+}
+
+func newPrometheusUsageSource(cfg AutoScalingConfig) *prometheusUsageSource {
+	return &prometheusUsageSource{
+		url:    strings.TrimSuffix(cfg.MetricsURL, "/"),
+		window: cfg.Window,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (p *prometheusUsageSource) writeUsage(ctx context.Context) (map[string]tableUsage, error) {
+	window := model.Duration(p.window).String()
+	consumed, err := p.query(ctx, fmt.Sprintf(`sum by (%s) (rate(cortex_dynamo_consumed_capacity_total{operation="DynamoDB.BatchWriteItem"}[%s]))`,
+		tableNameLabel, window))
+	if err != nil {
+		return nil, err
+	}
+	// Throttled reads are counted too, but reads are rare next to writes.
+	throttled, err := p.query(ctx, fmt.Sprintf(`sum by (%s) (rate(cortex_dynamo_failures_total{%s="%s"}[%s]))`,
+		tableNameLabel, errorReasonLabel, provisionedThroughputExceededException, window))
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]tableUsage{}
+	for _, sample := range consumed {
+		table := string(sample.Metric[tableNameLabel])
+		usage := result[table]
+		usage.consumed = float64(sample.Value)
+		result[table] = usage
+	}
+	for _, sample := range throttled {
+		table := string(sample.Metric[tableNameLabel])
+		usage := result[table]
+		usage.throttled = float64(sample.Value)
+		result[table] = usage
+	}
+	return result, nil
+}
+
+func (p *prometheusUsageSource) query(ctx context.Context, query string) (model.Vector, error) {
+	resp, err := ctxhttp.Get(ctx, p.client, p.url+"/api/v1/query?query="+url.QueryEscape(query))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Data   struct {
+			ResultType string       `json:"resultType"`
+			Result     model.Vector `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decoding response to %q (status %d): %v", query, resp.StatusCode, err)
+	}
+	if result.Status != "success" {
+		return nil, fmt.Errorf("error querying %q: %s", query, result.Error)
+	}
+	if result.Data.ResultType != "vector" {
+		return nil, fmt.Errorf("unexpected result type %q for %q", result.Data.ResultType, query)
+	}
+	return result.Data.Result, nil
+}
+
+// scaledWriteCapacity returns the write throughput an active table should
+// have so it consumes TargetUtilisation of it, within the configured bounds.
+// Tables without usage keep their current throughput, brought within bounds.
+func (m *DynamoTableManager) scaledWriteCapacity(name string, current int64, usage map[string]tableUsage) int64 {
+	cfg := m.cfg.AutoScaling
+
+	desired := current
+	if u, ok := usage[name]; ok {
+		desired = int64(math.Ceil(u.consumed / cfg.TargetUtilisation))
+		// Throttled writes consume nothing, so consumption understates demand.
+		if u.throttled > 0 && desired <= current {
+			desired = int64(math.Ceil(float64(current) / cfg.TargetUtilisation))
+		}
+	}
+	if desired < cfg.MinWriteCapacity {
+		desired = cfg.MinWriteCapacity
+	}
+	if cfg.MaxWriteCapacity > 0 && desired > cfg.MaxWriteCapacity {
+		desired = cfg.MaxWriteCapacity
+	}
+
+	sinceScaled := mtime.Now().Sub(m.lastScaled[name])
+	switch {
+	case desired > current && sinceScaled < cfg.ScaleUpCooldown:
+		log.Infof("  Not scaling table %s up to %d, scaled %v ago", name, desired, sinceScaled)
+		return current
+	case desired < current && sinceScaled < cfg.ScaleDownCooldown:
+		log.Infof("  Not scaling table %s down to %d, scaled %v ago", name, desired, sinceScaled)
+		return current
+	}
+	return desired
+}
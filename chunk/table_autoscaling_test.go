@@ -0,0 +1,203 @@
+package chunk
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/weaveworks/common/mtime"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+type fakeUsageSource struct {
+	usage map[string]tableUsage
+	err   error
+}
+
+func (f *fakeUsageSource) writeUsage(ctx context.Context) (map[string]tableUsage, error) {
+	return f.usage, f.err
+}
+
+func TestDynamoTableManagerAutoScaling(t *testing.T) {
+	dynamoDB := NewMockStorage()
+
+	cfg := TableManagerConfig{
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables: true,
+			TablePrefix:       tablePrefix,
+			TablePeriod:       tablePeriod,
+			PeriodicTableStartAt: util.DayValue{
+				Time: model.TimeFromUnix(0),
+			},
+		},
+
+		CreationGracePeriod:        gracePeriod,
+		MaxChunkAge:                maxChunkAge,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		InactiveWriteThroughput:    inactiveWrite,
+		InactiveReadThroughput:     inactiveRead,
+
+		AutoScaling: AutoScalingConfig{
+			TargetUtilisation: 0.5,
+			MinWriteCapacity:  50,
+			MaxWriteCapacity:  1000,
+			ScaleUpCooldown:   time.Minute,
+			ScaleDownCooldown: time.Hour,
+		},
+	}
+	tableManager, err := NewDynamoTableManager(cfg, dynamoDB)
+	require.NoError(t, err)
+	usage := &fakeUsageSource{usage: map[string]tableUsage{}}
+	tableManager.usage = usage
+
+	// Long after the legacy table stopped being written to.
+	start := time.Unix(0, 0).Add(tablePeriod / 2)
+	test := func(name string, tm time.Time, tableUsage map[string]tableUsage, expected []tableDescription) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			mtime.NowForce(tm)
+			defer mtime.NowReset()
+			usage.usage = tableUsage
+			require.NoError(t, tableManager.syncTables(ctx))
+			expectTables(ctx, t, dynamoDB, expected)
+		})
+	}
+
+	test(
+		"Tables are created with the provisioned throughput",
+		start,
+		nil,
+		[]tableDescription{
+			{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write},
+		},
+	)
+
+	test(
+		"Busy active tables scale up; inactive tables don't",
+		start.Add(time.Second),
+		map[string]tableUsage{
+			"":                {consumed: 1000},
+			tablePrefix + "0": {consumed: 150},
+		},
+		[]tableDescription{
+			{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: 300},
+		},
+	)
+
+	test(
+		"Not scaled again within the scale up cooldown",
+		start.Add(30*time.Second),
+		map[string]tableUsage{tablePrefix + "0": {consumed: 300}},
+		[]tableDescription{
+			{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: 300},
+		},
+	)
+
+	test(
+		"Throttling scales up, even though consumption is within target",
+		start.Add(2*time.Minute),
+		map[string]tableUsage{tablePrefix + "0": {consumed: 100, throttled: 10}},
+		[]tableDescription{
+			{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: 600},
+		},
+	)
+
+	test(
+		"Scale up is bounded by the maximum",
+		start.Add(4*time.Minute),
+		map[string]tableUsage{tablePrefix + "0": {consumed: 600, throttled: 10}},
+		[]tableDescription{
+			{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: 1000},
+		},
+	)
+
+	test(
+		"Not scaled down within the scale down cooldown",
+		start.Add(30*time.Minute),
+		map[string]tableUsage{tablePrefix + "0": {consumed: 10}},
+		[]tableDescription{
+			{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: 1000},
+		},
+	)
+
+	test(
+		"Idle tables scale down to the minimum",
+		start.Add(2*time.Hour),
+		map[string]tableUsage{tablePrefix + "0": {consumed: 10}},
+		[]tableDescription{
+			{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: 50},
+		},
+	)
+
+	usage.err = fmt.Errorf("metrics unavailable")
+	test(
+		"Without usage, tables keep their throughput",
+		start.Add(4*time.Hour),
+		nil,
+		[]tableDescription{
+			{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: 50},
+		},
+	)
+	usage.err = nil
+
+	test(
+		"Tables which become inactive get the inactive throughput",
+		time.Unix(0, 0).Add(tablePeriod).Add(gracePeriod).Add(maxChunkAge).Add(time.Second),
+		map[string]tableUsage{tablePrefix + "0": {consumed: 100}, tablePrefix + "1": {consumed: 100}},
+		[]tableDescription{
+			{name: "", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: tablePrefix + "0", provisionedRead: inactiveRead, provisionedWrite: inactiveWrite},
+			{name: tablePrefix + "1", provisionedRead: read, provisionedWrite: 200},
+		},
+	)
+}
+
+func TestPrometheusUsageSource(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/prometheus/api/v1/query", r.URL.Path)
+		query := r.URL.Query().Get("query")
+		queries = append(queries, query)
+		if strings.Contains(query, "consumed") {
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[
+				{"metric":{"table":"cortex_0"},"value":[1,"100"]},
+				{"metric":{"table":"cortex_1"},"value":[1,"50"]}]}}`)
+		} else {
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[
+				{"metric":{"table":"cortex_1"},"value":[1,"2.5"]}]}}`)
+		}
+	}))
+	defer server.Close()
+
+	source := newPrometheusUsageSource(AutoScalingConfig{
+		MetricsURL: server.URL + "/prometheus/",
+		Window:     2 * time.Minute,
+	})
+	usage, err := source.writeUsage(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]tableUsage{
+		"cortex_0": {consumed: 100},
+		"cortex_1": {consumed: 50, throttled: 2.5},
+	}, usage)
+	assert.Equal(t, []string{
+		`sum by (table) (rate(cortex_dynamo_consumed_capacity_total{operation="DynamoDB.BatchWriteItem"}[2m]))`,
+		`sum by (table) (rate(cortex_dynamo_failures_total{error="ProvisionedThroughputExceededException"}[2m]))`,
+	}, queries)
+}
@@ -3,6 +3,7 @@ package chunk
 import (
 	"flag"
 	"fmt"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
@@ -45,21 +46,25 @@ func init() {
 // DynamoTableClient is a client for telling Dynamo what to do with tables.
 type DynamoTableClient interface {
 	ListTables(ctx context.Context) ([]string, error)
-	CreateTable(ctx context.Context, name string, readCapacity, writeCapacity int64) error
-	DescribeTable(ctx context.Context, name string) (readCapacity, writeCapacity int64, status string, err error)
-	UpdateTable(ctx context.Context, name string, readCapacity, writeCapacity int64) error
+	CreateTable(ctx context.Context, desc tableDescription) error
+	DescribeTable(ctx context.Context, name string) (desc tableDescription, status string, err error)
+	// UpdateTable changes the table from current to expected.  Tags on the
+	// table but not in expected are left alone.
+	UpdateTable(ctx context.Context, current, expected tableDescription) error
 }
 
 // DynamoTableClientConfig configures the DynamoDB table client.
 type DynamoTableClientConfig struct {
 	DynamoClient string
 	DynamoDBConfig
+	CassandraConfig
 }
 
 // RegisterFlags adds the flags required to configure this flag set.
 func (cfg *DynamoTableClientConfig) RegisterFlags(f *flag.FlagSet) {
-	flag.StringVar(&cfg.DynamoClient, "table-manager.dynamo-client", "aws", "Which DynamoDB table client to use (aws, inmemory).")
+	flag.StringVar(&cfg.DynamoClient, "table-manager.dynamo-client", "aws", "Which DynamoDB table client to use (aws, cassandra, inmemory).")
 	cfg.DynamoDBConfig.RegisterFlags(f)
+	cfg.CassandraConfig.RegisterFlags(f)
 }
 
 // NewDynamoTableClient creates a new DynamoTableClient.
@@ -73,8 +78,10 @@ func NewDynamoTableClient(cfg DynamoTableClientConfig) (DynamoTableClient, error
 			log.Warnf("Ignoring DynamoDB URL path: %v.", path)
 		}
 		return newDynamoTableClient(cfg.DynamoDBConfig)
+	case "cassandra":
+		return NewCassandraTableClient(cfg.CassandraConfig)
 	default:
-		return nil, fmt.Errorf("Unrecognized storage client %v, choose one of: aws, inmemory", cfg.DynamoClient)
+		return nil, fmt.Errorf("Unrecognized storage client %v, choose one of: aws, cassandra, inmemory", cfg.DynamoClient)
 	}
 }
 
@@ -85,6 +92,10 @@ type TableManagerConfig struct {
 	PeriodicTableConfig
 	OriginalTableName string
 
+	// If set, the tables are read from this schema config file instead of
+	// the flags above.
+	SchemaFileConfig
+
 	// duration a table will be created before it is needed.
 	CreationGracePeriod        time.Duration
 	MaxChunkAge                time.Duration
@@ -92,6 +103,15 @@ type TableManagerConfig struct {
 	ProvisionedReadThroughput  int64
 	InactiveWriteThroughput    int64
 	InactiveReadThroughput     int64
+	InactiveOnDemand           bool
+
+	Tags      Tags
+	Encrypted bool
+
+	// Only log the changes which would be made to tables.
+	DryRun bool
+
+	AutoScaling AutoScalingConfig
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -103,10 +123,16 @@ func (cfg *TableManagerConfig) RegisterFlags(f *flag.FlagSet) {
 	f.Int64Var(&cfg.ProvisionedReadThroughput, "dynamodb.periodic-table.read-throughput", 300, "DynamoDB periodic tables read throughput")
 	f.Int64Var(&cfg.InactiveWriteThroughput, "dynamodb.periodic-table.inactive-write-throughput", 1, "DynamoDB periodic tables write throughput for inactive tables.")
 	f.Int64Var(&cfg.InactiveReadThroughput, "dynamodb.periodic-table.inactive-read-throughput", 300, "DynamoDB periodic tables read throughput for inactive tables")
+	f.BoolVar(&cfg.InactiveOnDemand, "dynamodb.periodic-table.inactive-on-demand", false, "Bill inactive tables per request, instead of provisioning them throughput.")
+	f.Var(&cfg.Tags, "dynamodb.table.tags", "Tags to set on tables, as comma-separated key=value pairs.")
+	f.BoolVar(&cfg.Encrypted, "dynamodb.table.encryption", false, "Enable server-side encryption of tables with an AWS managed key.")
+	f.BoolVar(&cfg.DryRun, "table-manager.dry-run", false, "Log the tables which would be created or changed, without changing anything.")
 
 	cfg.PeriodicTableConfig.RegisterFlags(f)
 	// XXX: Should this be in PeriodicTableConfig?
 	flag.StringVar(&cfg.OriginalTableName, "dynamodb.original-table-name", "", "The name of the DynamoDB table used before versioned schemas were introduced.")
+	cfg.SchemaFileConfig.RegisterFlags(f)
+	cfg.AutoScaling.RegisterFlags(f)
 }
 
 // PeriodicTableConfig for the use of periodic tables (ie, weekly tables).  Can
@@ -131,16 +157,38 @@ func (cfg *PeriodicTableConfig) RegisterFlags(f *flag.FlagSet) {
 type DynamoTableManager struct {
 	dynamoDB DynamoTableClient
 	cfg      TableManagerConfig
+	periods  []PeriodConfig
 	done     chan struct{}
 	wait     sync.WaitGroup
+
+	// Only used by the loop goroutine.
+	usage      writeUsageSource
+	lastScaled map[string]time.Time
 }
 
 // NewDynamoTableManager makes a new DynamoTableManager
 func NewDynamoTableManager(cfg TableManagerConfig, dynamoDBClient DynamoTableClient) (*DynamoTableManager, error) {
+	var periods SchemaPeriods
+	if cfg.ConfigFile != "" {
+		var err error
+		periods, err = LoadSchemaPeriods(cfg.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var usage writeUsageSource
+	if cfg.AutoScaling.MetricsURL != "" {
+		usage = newPrometheusUsageSource(cfg.AutoScaling)
+	}
+
 	return &DynamoTableManager{
-		cfg:      cfg,
-		dynamoDB: dynamoDBClient,
-		done:     make(chan struct{}),
+		cfg:        cfg,
+		dynamoDB:   dynamoDBClient,
+		periods:    periods.Configs,
+		done:       make(chan struct{}),
+		usage:      usage,
+		lastScaled: map[string]time.Time{},
 	}, nil
 }
 
@@ -195,13 +243,32 @@ func (m *DynamoTableManager) syncTables(ctx context.Context) error {
 		return err
 	}
 
-	return m.updateTables(ctx, toCheckThroughput)
+	var usage map[string]tableUsage
+	if m.usage != nil {
+		usage, err = m.usage.writeUsage(ctx)
+		if err != nil {
+			// Keep the tables' current write throughput until we know better.
+			log.Warnf("Error getting table write usage: %v", err)
+		}
+	}
+
+	return m.updateTables(ctx, toCheckThroughput, usage)
 }
 
 type tableDescription struct {
 	name             string
 	provisionedRead  int64
 	provisionedWrite int64
+
+	// On demand tables are billed per request; their provisioned throughput
+	// is ignored.
+	onDemand  bool
+	encrypted bool
+	tags      Tags
+
+	// Active tables are written to, so have their write throughput scaled
+	// when autoscaling is enabled.
+	active bool
 }
 
 type byName []tableDescription
@@ -211,12 +278,31 @@ func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a byName) Less(i, j int) bool { return a[i].name < a[j].name }
 
 func (m *DynamoTableManager) calculateExpectedTables() []tableDescription {
+	var result []tableDescription
+	if len(m.periods) > 0 {
+		result = m.calculateExpectedPeriodTables()
+	} else {
+		result = m.calculateExpectedFlagTables()
+	}
+
+	for i := range result {
+		result[i].tags = m.cfg.Tags
+		result[i].encrypted = m.cfg.Encrypted
+		result[i].onDemand = m.cfg.InactiveOnDemand && !result[i].active
+	}
+	return result
+}
+
+// calculateExpectedFlagTables is calculateExpectedTables for the periodic
+// table flags.
+func (m *DynamoTableManager) calculateExpectedFlagTables() []tableDescription {
 	if !m.cfg.UsePeriodicTables {
 		return []tableDescription{
 			{
 				name:             m.cfg.OriginalTableName,
 				provisionedRead:  m.cfg.ProvisionedReadThroughput,
 				provisionedWrite: m.cfg.ProvisionedWriteThroughput,
+				active:           true,
 			},
 		}
 	}
@@ -244,6 +330,7 @@ func (m *DynamoTableManager) calculateExpectedTables() []tableDescription {
 		if now < (firstTable*tablePeriodSecs)+gracePeriodSecs+maxChunkAgeSecs {
 			legacyTable.provisionedRead = m.cfg.ProvisionedReadThroughput
 			legacyTable.provisionedWrite = m.cfg.ProvisionedWriteThroughput
+			legacyTable.active = true
 		}
 		result = append(result, legacyTable)
 	}
@@ -260,6 +347,7 @@ func (m *DynamoTableManager) calculateExpectedTables() []tableDescription {
 		if (i*tablePeriodSecs)-gracePeriodSecs <= now && now < (i*tablePeriodSecs)+tablePeriodSecs+gracePeriodSecs+maxChunkAgeSecs {
 			table.provisionedRead = m.cfg.ProvisionedReadThroughput
 			table.provisionedWrite = m.cfg.ProvisionedWriteThroughput
+			table.active = true
 		}
 		result = append(result, table)
 	}
@@ -268,6 +356,78 @@ func (m *DynamoTableManager) calculateExpectedTables() []tableDescription {
 	return result
 }
 
+// calculateExpectedPeriodTables is calculateExpectedTables for the periods of
+// a schema config file.  Tables used by more than one period get the
+// throughput of their most active period.
+func (m *DynamoTableManager) calculateExpectedPeriodTables() []tableDescription {
+	var (
+		gracePeriodSecs = int64(m.cfg.CreationGracePeriod / time.Second)
+		maxChunkAgeSecs = int64(m.cfg.MaxChunkAge / time.Second)
+		now             = mtime.Now().Unix()
+		tables          = map[string]tableDescription{}
+	)
+
+	add := func(name string, active bool) {
+		table := tableDescription{
+			name:             name,
+			provisionedRead:  m.cfg.InactiveReadThroughput,
+			provisionedWrite: m.cfg.InactiveWriteThroughput,
+		}
+		if active {
+			table.provisionedRead = m.cfg.ProvisionedReadThroughput
+			table.provisionedWrite = m.cfg.ProvisionedWriteThroughput
+			table.active = true
+		}
+		if existing, ok := tables[name]; ok && existing.provisionedWrite >= table.provisionedWrite {
+			return
+		}
+		tables[name] = table
+	}
+
+	for i, period := range m.periods {
+		var (
+			from = period.From.Unix()
+			end  = int64(math.MaxInt64)
+		)
+		if i+1 < len(m.periods) {
+			end = m.periods[i+1].From.Unix()
+		}
+		if from > now+gracePeriodSecs {
+			break
+		}
+
+		if period.IndexTables.Period == 0 {
+			// the table needs write throughput until the next period is in use
+			active := end == math.MaxInt64 || now < end+gracePeriodSecs+maxChunkAgeSecs
+			if period.IndexTables.Prefix != "" {
+				add(period.IndexTables.Prefix, active)
+			}
+			continue
+		}
+
+		var (
+			tablePeriodSecs = int64(period.IndexTables.Period / time.Second)
+			firstTable      = from / tablePeriodSecs
+			lastTable       = (now + gracePeriodSecs) / tablePeriodSecs
+		)
+		if end != math.MaxInt64 && (end-1)/tablePeriodSecs < lastTable {
+			lastTable = (end - 1) / tablePeriodSecs
+		}
+		for t := firstTable; t <= lastTable; t++ {
+			// if now is within table [start - grace, end + grace), then we need some write throughput
+			active := (t*tablePeriodSecs)-gracePeriodSecs <= now && now < (t*tablePeriodSecs)+tablePeriodSecs+gracePeriodSecs+maxChunkAgeSecs
+			add(period.IndexTables.Prefix+strconv.Itoa(int(t)), active)
+		}
+	}
+
+	result := make([]tableDescription, 0, len(tables))
+	for _, table := range tables {
+		result = append(result, table)
+	}
+	sort.Sort(byName(result))
+	return result
+}
+
 // partitionTables works out tables that need to be created vs tables that need to be updated
 func (m *DynamoTableManager) partitionTables(ctx context.Context, descriptions []tableDescription) ([]tableDescription, []tableDescription, error) {
 	existingTables, err := m.dynamoDB.ListTables(ctx)
@@ -302,8 +462,12 @@ func (m *DynamoTableManager) partitionTables(ctx context.Context, descriptions [
 
 func (m *DynamoTableManager) createTables(ctx context.Context, descriptions []tableDescription) error {
 	for _, desc := range descriptions {
-		log.Infof("Creating table %s", desc.name)
-		err := m.dynamoDB.CreateTable(ctx, desc.name, desc.provisionedRead, desc.provisionedWrite)
+		if m.cfg.DryRun {
+			log.Infof("Dry run: would create table %s: %s", desc.name, desc)
+			continue
+		}
+		log.Infof("Creating table %s: %s", desc.name, desc)
+		err := m.dynamoDB.CreateTable(ctx, desc)
 		if err != nil {
 			return err
 		}
@@ -311,10 +475,10 @@ func (m *DynamoTableManager) createTables(ctx context.Context, descriptions []ta
 	return nil
 }
 
-func (m *DynamoTableManager) updateTables(ctx context.Context, descriptions []tableDescription) error {
+func (m *DynamoTableManager) updateTables(ctx context.Context, descriptions []tableDescription, usage map[string]tableUsage) error {
 	for _, desc := range descriptions {
-		log.Infof("Checking provisioned throughput on table %s", desc.name)
-		readCapacity, writeCapacity, status, err := m.dynamoDB.DescribeTable(ctx, desc.name)
+		log.Infof("Checking table %s", desc.name)
+		current, status, err := m.dynamoDB.DescribeTable(ctx, desc.name)
 		if err != nil {
 			return err
 		}
@@ -324,19 +488,121 @@ func (m *DynamoTableManager) updateTables(ctx context.Context, descriptions []ta
 			continue
 		}
 
-		tableCapacity.WithLabelValues(readLabel, desc.name).Set(float64(readCapacity))
-		tableCapacity.WithLabelValues(writeLabel, desc.name).Set(float64(writeCapacity))
+		tableCapacity.WithLabelValues(readLabel, desc.name).Set(float64(current.provisionedRead))
+		tableCapacity.WithLabelValues(writeLabel, desc.name).Set(float64(current.provisionedWrite))
 
-		if readCapacity == desc.provisionedRead && writeCapacity == desc.provisionedWrite {
-			log.Infof("  Provisioned throughput: read = %d, write = %d, skipping.", readCapacity, writeCapacity)
+		if desc.active && m.usage != nil {
+			desc.provisionedWrite = m.scaledWriteCapacity(desc.name, current.provisionedWrite, usage)
+		}
+
+		changes := tableChanges(current, desc)
+		if len(changes) == 0 {
+			log.Infof("  %s, skipping.", current)
 			continue
 		}
 
-		log.Infof("  Updating provisioned throughput on table %s to read = %d, write = %d", desc.name, desc.provisionedRead, desc.provisionedWrite)
-		err = m.dynamoDB.UpdateTable(ctx, desc.name, desc.provisionedRead, desc.provisionedWrite)
+		if m.cfg.DryRun {
+			log.Infof("  Dry run: would update table %s: %s", desc.name, strings.Join(changes, ", "))
+			continue
+		}
+		log.Infof("  Updating table %s: %s", desc.name, strings.Join(changes, ", "))
+		err = m.dynamoDB.UpdateTable(ctx, current, desc)
 		if err != nil {
 			return err
 		}
+		if current.provisionedWrite != desc.provisionedWrite {
+			m.lastScaled[desc.name] = mtime.Now()
+		}
 	}
 	return nil
 }
+
+func (desc tableDescription) String() string {
+	var result string
+	if desc.onDemand {
+		result = "billed on demand"
+	} else {
+		result = fmt.Sprintf("read = %d, write = %d", desc.provisionedRead, desc.provisionedWrite)
+	}
+	if desc.encrypted {
+		result += ", encrypted"
+	}
+	if len(desc.tags) > 0 {
+		result += ", tags = " + desc.tags.String()
+	}
+	return result
+}
+
+// tableChanges describes the changes needed to make current match expected,
+// if any.
+func tableChanges(current, expected tableDescription) []string {
+	var changes []string
+	if current.onDemand != expected.onDemand {
+		changes = append(changes, fmt.Sprintf("on demand %v -> %v", current.onDemand, expected.onDemand))
+	}
+	if !expected.onDemand {
+		if current.onDemand || current.provisionedRead != expected.provisionedRead {
+			changes = append(changes, fmt.Sprintf("read %d -> %d", current.provisionedRead, expected.provisionedRead))
+		}
+		if current.onDemand || current.provisionedWrite != expected.provisionedWrite {
+			changes = append(changes, fmt.Sprintf("write %d -> %d", current.provisionedWrite, expected.provisionedWrite))
+		}
+	}
+	if current.encrypted != expected.encrypted {
+		changes = append(changes, fmt.Sprintf("encrypted %v -> %v", current.encrypted, expected.encrypted))
+	}
+	if missing := current.tags.missing(expected.tags); len(missing) > 0 {
+		changes = append(changes, "tags += "+missing.String())
+	}
+	return changes
+}
+
+// Tags are key-value pairs to set on tables, for cost allocation.
+type Tags map[string]string
+
+// String implements flag.Value
+func (t Tags) String() string {
+	pairs := make([]string, 0, len(t))
+	for k, v := range t {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set implements flag.Value
+func (t *Tags) Set(s string) error {
+	tags := Tags{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("tag %q should be key=value", pair)
+		}
+		tags[parts[0]] = parts[1]
+	}
+	*t = tags
+	return nil
+}
+
+// missing returns the tags in expected which t lacks or has different values
+// for.
+func (t Tags) missing(expected Tags) Tags {
+	result := Tags{}
+	for k, v := range expected {
+		if current, ok := t[k]; !ok || current != v {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+func (t Tags) copy() Tags {
+	result := make(Tags, len(t))
+	for k, v := range t {
+		result[k] = v
+	}
+	return result
+}
@@ -144,6 +144,112 @@ func TestDynamoTableManager(t *testing.T) {
 	)
 }
 
+func TestDynamoTableManagerTagsAndBilling(t *testing.T) {
+	dynamoDB := NewMockStorage()
+	tags := Tags{"team": "cortex"}
+
+	cfg := TableManagerConfig{
+		PeriodicTableConfig: PeriodicTableConfig{
+			UsePeriodicTables: true,
+			TablePrefix:       tablePrefix,
+			TablePeriod:       tablePeriod,
+			PeriodicTableStartAt: util.DayValue{
+				Time: model.TimeFromUnix(0),
+			},
+		},
+
+		CreationGracePeriod:        gracePeriod,
+		MaxChunkAge:                maxChunkAge,
+		ProvisionedWriteThroughput: write,
+		ProvisionedReadThroughput:  read,
+		InactiveWriteThroughput:    inactiveWrite,
+		InactiveReadThroughput:     inactiveRead,
+		InactiveOnDemand:           true,
+		Tags:                       tags,
+		Encrypted:                  true,
+		DryRun:                     true,
+	}
+	tableManager, err := NewDynamoTableManager(cfg, dynamoDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test := func(name string, tm time.Time, expected []tableDescription) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			mtime.NowForce(tm)
+			defer mtime.NowReset()
+			if err := tableManager.syncTables(ctx); err != nil {
+				t.Fatal(err)
+			}
+			expectTables(ctx, t, dynamoDB, expected)
+		})
+	}
+
+	test("Dry run creates nothing", time.Unix(0, 0), nil)
+
+	tableManager.cfg.DryRun = false
+	test(
+		"Tables are created tagged and encrypted",
+		time.Unix(0, 0),
+		[]tableDescription{
+			{name: "", provisionedRead: read, provisionedWrite: write, encrypted: true, tags: tags},
+			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write, encrypted: true, tags: tags},
+		},
+	)
+
+	// Someone changes a table by hand, and tags it.
+	ctx := context.Background()
+	if err := dynamoDB.UpdateTable(ctx, tableDescription{}, tableDescription{
+		name:             tablePrefix + "0",
+		provisionedRead:  1,
+		provisionedWrite: 1,
+		tags:             Tags{"team": "other", "owner": "someone"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	test(
+		"Divergent tables are reconciled, keeping unknown tags",
+		time.Unix(0, 0),
+		[]tableDescription{
+			{name: "", provisionedRead: read, provisionedWrite: write, encrypted: true, tags: tags},
+			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write, encrypted: true, tags: Tags{"team": "cortex", "owner": "someone"}},
+		},
+	)
+
+	test(
+		"Inactive tables are billed on demand",
+		time.Unix(0, 0).Add(maxChunkAge).Add(gracePeriod),
+		[]tableDescription{
+			{name: "", onDemand: true, encrypted: true, tags: tags},
+			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write, encrypted: true, tags: Tags{"team": "cortex", "owner": "someone"}},
+		},
+	)
+
+	tableManager.cfg.DryRun = true
+	test(
+		"Dry run changes nothing",
+		time.Unix(0, 0).Add(tablePeriod).Add(maxChunkAge).Add(gracePeriod),
+		[]tableDescription{
+			{name: "", onDemand: true, encrypted: true, tags: tags},
+			{name: tablePrefix + "0", provisionedRead: read, provisionedWrite: write, encrypted: true, tags: Tags{"team": "cortex", "owner": "someone"}},
+		},
+	)
+}
+
+func TestTags(t *testing.T) {
+	var tags Tags
+	if err := tags.Set("team=cortex,env=prod"); err != nil {
+		t.Fatal(err)
+	}
+	if tags.String() != "env=prod,team=cortex" {
+		t.Fatalf("Unexpected tags %q", tags.String())
+	}
+	if err := tags.Set("team"); err == nil {
+		t.Fatal("Expected an error for a tag without a value")
+	}
+}
+
 func expectTables(ctx context.Context, t *testing.T, dynamo DynamoTableClient, expected []tableDescription) {
 	tables, err := dynamo.ListTables(ctx)
 	if err != nil {
@@ -162,17 +268,25 @@ func expectTables(ctx context.Context, t *testing.T, dynamo DynamoTableClient, e
 			t.Fatalf("Expected '%s', found '%s'", desc.name, tables[i])
 		}
 
-		read, write, _, err := dynamo.DescribeTable(ctx, desc.name)
+		current, _, err := dynamo.DescribeTable(ctx, desc.name)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		if read != desc.provisionedRead {
-			t.Fatalf("Expected '%d', found '%d' for table '%s'", desc.provisionedRead, read, desc.name)
+		if current.provisionedRead != desc.provisionedRead {
+			t.Fatalf("Expected '%d', found '%d' for table '%s'", desc.provisionedRead, current.provisionedRead, desc.name)
+		}
+
+		if current.provisionedWrite != desc.provisionedWrite {
+			t.Fatalf("Expected '%d', found '%d' for table '%s'", desc.provisionedWrite, current.provisionedWrite, desc.name)
+		}
+
+		if current.onDemand != desc.onDemand || current.encrypted != desc.encrypted {
+			t.Fatalf("Expected %s, found %s for table '%s'", desc, current, desc.name)
 		}
 
-		if write != desc.provisionedWrite {
-			t.Fatalf("Expected '%d', found '%d' for table '%s'", desc.provisionedWrite, write, desc.name)
+		if len(current.tags.missing(desc.tags)) > 0 || len(desc.tags.missing(current.tags)) > 0 {
+			t.Fatalf("Expected tags '%s', found '%s' for table '%s'", desc.tags, current.tags, desc.name)
 		}
 	}
 }
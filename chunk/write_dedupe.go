@@ -0,0 +1,82 @@
+package chunk
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+)
+
+var (
+	dedupedChunks = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_deduped_chunks_total",
+		Help:      "Total count of chunks not written as a replica already wrote them.",
+	})
+	dedupedIndexEntries = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "cortex",
+		Name:      "chunk_store_deduped_index_entries_total",
+		Help:      "Total count of index entries not written as they were already written.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(dedupedChunks)
+	prometheus.MustRegister(dedupedIndexEntries)
+}
+
+// writtenMarker is the value stored against write dedupe keys; only the
+// presence of the key matters.
+var writtenMarker = []byte{1}
+
+// chunkDedupeKey identifies a chunk by its series and time range, not its
+// checksum, as replicas' chunks for the same range needn't be byte for byte
+// the same.
+func chunkDedupeKey(userID string, chunk Chunk) string {
+	return hashedMemcacheKey("written", []byte(userID),
+		[]byte(strconv.FormatUint(uint64(chunk.Fingerprint), 16)),
+		[]byte(strconv.FormatInt(int64(chunk.From), 16)),
+		[]byte(strconv.FormatInt(int64(chunk.Through), 16)))
+}
+
+func indexEntryDedupeKey(entry IndexEntry) string {
+	return hashedMemcacheKey("written", []byte(entry.TableName), []byte(entry.HashValue), entry.RangeValue, entry.Value)
+}
+
+// Written returns which of the keys have recently been marked as written,
+// by any process sharing this cache.  Errors are logged, and treated as if
+// nothing had been written.
+func (c *Cache) Written(ctx context.Context, keys []string) map[string]bool {
+	if c.cache == nil || !c.cfg.WriteDedupe || len(keys) == 0 {
+		return nil
+	}
+
+	found, err := c.cache.Fetch(ctx, keys)
+	if err != nil {
+		log.Warnf("Error checking for written keys in cache: %v", err)
+		return nil
+	}
+
+	written := make(map[string]bool, len(found))
+	for key := range found {
+		written[key] = true
+	}
+	return written
+}
+
+// MarkWritten records that the keys have been written, for
+// WriteDedupeExpiration.
+func (c *Cache) MarkWritten(ctx context.Context, keys []string) {
+	if c.cache == nil || !c.cfg.WriteDedupe || len(keys) == 0 {
+		return
+	}
+
+	bufs := make([][]byte, len(keys))
+	for i := range bufs {
+		bufs[i] = writtenMarker
+	}
+	if err := c.cache.Store(ctx, keys, bufs, c.cfg.WriteDedupeExpiration); err != nil {
+		log.Warnf("Error marking keys as written in cache: %v", err)
+	}
+}
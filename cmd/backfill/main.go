@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/backfill"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/distributor"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util"
+)
+
+func main() {
+	var (
+		serverConfig = server.Config{
+			MetricsNamespace: "cortex",
+			GRPCMiddleware: []grpc.UnaryServerInterceptor{
+				middleware.ServerUserHeaderInterceptor,
+			},
+		}
+		ringConfig        ring.Config
+		distributorConfig distributor.Config
+		chunkStoreConfig  chunk.StoreConfig
+		storageConfig     chunk.StorageClientConfig
+		backfillConfig    backfill.Config
+	)
+	util.RegisterFlags(&serverConfig, &ringConfig, &distributorConfig, &chunkStoreConfig, &storageConfig, &backfillConfig)
+	flag.Parse()
+
+	r, err := ring.New(ringConfig)
+	if err != nil {
+		log.Fatalf("Error initializing ring: %v", err)
+	}
+	defer r.Stop()
+
+	// The distributor is only used to query the ingesters.
+	dist, err := distributor.New(distributorConfig, r, nil)
+	if err != nil {
+		log.Fatalf("Error initializing distributor: %v", err)
+	}
+	defer dist.Stop()
+	prometheus.MustRegister(dist)
+
+	storageClient, err := chunk.NewStorageClient(storageConfig, chunkStoreConfig.SchemaConfig)
+	if err != nil {
+		log.Fatalf("Error initializing storage client: %v", err)
+	}
+	chunkStore, err := chunk.NewStore(chunkStoreConfig, storageClient)
+	if err != nil {
+		log.Fatalf("Error initializing chunk store: %v", err)
+	}
+	defer chunkStore.Stop()
+
+	backfiller, err := backfill.New(backfillConfig, dist, chunkStore)
+	if err != nil {
+		log.Fatalf("Error initializing backfiller: %v", err)
+	}
+
+	server, err := server.New(serverConfig)
+	if err != nil {
+		log.Fatalf("Error initializing server: %v", err)
+	}
+	defer server.Shutdown()
+
+	server.HTTP.Handle("/ring", r)
+	server.HTTP.Handle("/api/prom/backfill", middleware.AuthenticateUser.Wrap(http.HandlerFunc(backfiller.Handler)))
+	server.Run()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/common/log"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+func main() {
+	var (
+		serverConfig = server.Config{
+			MetricsNamespace: "cortex",
+			GRPCMiddleware: []grpc.UnaryServerInterceptor{
+				middleware.ServerUserHeaderInterceptor,
+			},
+		}
+		chunkStoreConfig chunk.StoreConfig
+		storageConfig    chunk.StorageClientConfig
+		compactorConfig  chunk.CompactorConfig
+	)
+	util.RegisterFlags(&serverConfig, &chunkStoreConfig, &storageConfig, &compactorConfig)
+	flag.Parse()
+
+	storageClient, err := chunk.NewStorageClient(storageConfig, chunkStoreConfig.SchemaConfig)
+	if err != nil {
+		log.Fatalf("Error initializing storage client: %v", err)
+	}
+
+	chunkStore, err := chunk.NewStore(chunkStoreConfig, storageClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer chunkStore.Stop()
+
+	compactor, err := chunk.NewCompactor(compactorConfig, chunkStore)
+	if err != nil {
+		log.Fatalf("Error initializing compactor: %v", err)
+	}
+	compactor.Start()
+	defer compactor.Stop()
+
+	server, err := server.New(serverConfig)
+	if err != nil {
+		log.Fatalf("Error initializing server: %v", err)
+	}
+	defer server.Shutdown()
+
+	server.Run()
+}
@@ -0,0 +1,8 @@
+-- Tenants deleted through the configs API.  Their configs are marked deleted
+-- straight away; their index entries and chunks are purged in the background,
+-- and the purge's progress recorded here.
+CREATE TABLE IF NOT EXISTS deleted_tenants (
+  owner_id text PRIMARY KEY,
+  deleted_at timestamp with time zone not null default now(),
+  purge jsonb not null default '{}'
+);
@@ -10,6 +10,7 @@ import (
 
 	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/server"
+	configs "github.com/weaveworks/cortex/configs/client"
 	"github.com/weaveworks/cortex/distributor"
 	"github.com/weaveworks/cortex/ring"
 	"github.com/weaveworks/cortex/util"
@@ -40,10 +41,12 @@ func main() {
 				middleware.ServerUserHeaderInterceptor,
 			},
 		}
-		ringConfig        ring.Config
-		distributorConfig distributor.Config
+		ringConfig           ring.Config
+		distributorConfig    distributor.Config
+		deletedTenantsConfig configs.DeletedTenantsConfig
 	)
 	util.RegisterFlags(&serverConfig, &ringConfig, &distributorConfig)
+	util.RegisterFlagsWithPrefix("distributor.", &deletedTenantsConfig)
 	flag.Parse()
 
 	r, err := ring.New(ringConfig)
@@ -52,7 +55,14 @@ func main() {
 	}
 	defer r.Stop()
 
-	dist, err := distributor.New(distributorConfig, r)
+	var deletedTenants distributor.DeletedTenants
+	if deletedTenantsConfig.ConfigsAPIURL.URL != nil {
+		dt := configs.NewDeletedTenants(deletedTenantsConfig, nil, nil)
+		defer dt.Stop()
+		deletedTenants = dt
+	}
+
+	dist, err := distributor.New(distributorConfig, r, deletedTenants)
 	if err != nil {
 		log.Fatalf("Error initializing distributor: %v", err)
 	}
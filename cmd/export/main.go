@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/distributor"
+	"github.com/weaveworks/cortex/export"
+	"github.com/weaveworks/cortex/querier"
+	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util"
+)
+
+// export writes a tenant's series, from the ingesters and the chunk store, as
+// OpenMetrics text.  Without -export.output-dir, the files go to the object
+// store configured with the usual storage flags prefixed with -output., e.g.
+// -output.s3.url.
+func main() {
+	var (
+		ringConfig          ring.Config
+		distributorConfig   distributor.Config
+		chunkStoreConfig    chunk.StoreConfig
+		storageConfig       chunk.StorageClientConfig
+		outputStorageConfig chunk.StorageClientConfig
+		exportConfig        export.Config
+	)
+	util.RegisterFlags(&ringConfig, &distributorConfig, &chunkStoreConfig, &storageConfig, &exportConfig)
+	util.RegisterFlagsWithPrefix("output.", &outputStorageConfig)
+	flag.Parse()
+
+	r, err := ring.New(ringConfig)
+	if err != nil {
+		log.Fatalf("Error initializing ring: %v", err)
+	}
+	defer r.Stop()
+
+	dist, err := distributor.New(distributorConfig, r, nil)
+	if err != nil {
+		log.Fatalf("Error initializing distributor: %v", err)
+	}
+	defer dist.Stop()
+
+	// Exports read whole windows of a metric at once, so the query limits,
+	// which are meant for interactive queries, are turned off.
+	chunkStoreConfig.QueryLimits = chunk.QueryLimits{}
+	chunkStoreConfig.OverridesFile = ""
+
+	storageClient, err := chunk.NewStorageClient(storageConfig, chunkStoreConfig.SchemaConfig)
+	if err != nil {
+		log.Fatalf("Error initializing storage client: %v", err)
+	}
+	chunkStore, err := chunk.NewStore(chunkStoreConfig, storageClient)
+	if err != nil {
+		log.Fatalf("Error initializing chunk store: %v", err)
+	}
+	defer chunkStore.Stop()
+
+	var objects chunk.ObjectClient
+	if exportConfig.OutputDir == "" {
+		name := outputStorageConfig.ObjectClient
+		if name == "" {
+			name = outputStorageConfig.StorageClient
+		}
+		objects, err = chunk.NewObjectClient(outputStorageConfig, name)
+		if err != nil {
+			log.Fatalf("Error initializing output object client: %v", err)
+		}
+	}
+
+	// No downsampled data, as there's no query step.
+	queryable := querier.NewQueryable(querier.Config{}, dist, chunkStore)
+	exporter, err := export.New(exportConfig, queryable.Q, chunkStore, objects)
+	if err != nil {
+		log.Fatalf("Error initializing exporter: %v", err)
+	}
+	if err := exporter.Run(context.Background()); err != nil {
+		log.Fatalf("Error exporting: %v", err)
+	}
+}
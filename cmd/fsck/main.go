@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+// fsck checks a tenant's chunks against the index, printing a JSON report to
+// stdout.  It exits with status 1 if there are missing, corrupt or orphaned
+// chunks.
+func main() {
+	var (
+		storeConfig   chunk.StoreConfig
+		storageConfig chunk.StorageClientConfig
+		fsckConfig    chunk.FsckConfig
+	)
+	util.RegisterFlags(&storeConfig, &storageConfig, &fsckConfig)
+	flag.Parse()
+
+	storageClient, err := chunk.NewStorageClient(storageConfig, storeConfig.SchemaConfig)
+	if err != nil {
+		log.Fatalf("Error initializing storage client: %v", err)
+	}
+	store, err := chunk.NewStore(storeConfig, storageClient)
+	if err != nil {
+		log.Fatalf("Error initializing chunk store: %v", err)
+	}
+	defer store.Stop()
+
+	checker, err := chunk.NewChecker(fsckConfig, store)
+	if err != nil {
+		log.Fatalf("Error initializing checker: %v", err)
+	}
+	report, err := checker.Run(context.Background())
+	if err != nil {
+		log.Fatalf("Error checking chunks: %v", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Fatalf("Error writing report: %v", err)
+	}
+	if len(report.Missing) > 0 || len(report.Corrupt) > 0 || len(report.Orphaned) > 0 {
+		store.Stop()
+		os.Exit(1)
+	}
+}
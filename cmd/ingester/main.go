@@ -12,6 +12,7 @@ import (
 	"github.com/weaveworks/common/server"
 	"github.com/weaveworks/cortex"
 	"github.com/weaveworks/cortex/chunk"
+	configs "github.com/weaveworks/cortex/configs/client"
 	"github.com/weaveworks/cortex/ingester"
 	"github.com/weaveworks/cortex/util"
 )
@@ -27,10 +28,13 @@ func main() {
 		chunkStoreConfig chunk.StoreConfig
 		storageConfig    chunk.StorageClientConfig
 		ingesterConfig   ingester.Config
+
+		deletedTenantsConfig configs.DeletedTenantsConfig
 	)
 	// Ingester needs to know our gRPC listen port.
 	ingesterConfig.ListenPort = &serverConfig.GRPCListenPort
 	util.RegisterFlags(&serverConfig, &chunkStoreConfig, &storageConfig, &ingesterConfig)
+	util.RegisterFlagsWithPrefix("ingester.", &deletedTenantsConfig)
 	flag.Parse()
 
 	server, err := server.New(serverConfig)
@@ -39,7 +43,7 @@ func main() {
 	}
 	defer server.Shutdown()
 
-	storageClient, err := chunk.NewStorageClient(storageConfig)
+	storageClient, err := chunk.NewStorageClient(storageConfig, chunkStoreConfig.SchemaConfig)
 	if err != nil {
 		log.Fatalf("Error initializing storage client: %v", err)
 	}
@@ -57,6 +61,11 @@ func main() {
 	prometheus.MustRegister(ingester)
 	defer ingester.Shutdown()
 
+	if deletedTenantsConfig.ConfigsAPIURL.URL != nil {
+		deletedTenants := configs.NewDeletedTenants(deletedTenantsConfig, ingester.DeleteUser, ingester.ForgetDeletedUser)
+		defer deletedTenants.Stop()
+	}
+
 	cortex.RegisterIngesterServer(server.GRPC, ingester)
 	server.HTTP.Path("/ready").Handler(http.HandlerFunc(ingester.ReadinessHandler))
 	server.Run()
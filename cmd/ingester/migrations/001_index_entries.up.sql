@@ -0,0 +1,18 @@
+-- Index entries for the postgres storage client.  table_name is the name of
+-- the index table the entry would have been written to in DynamoDB.
+--
+-- These migrations are run in the schema given by -postgres.schema, which
+-- has its own schema_migrations table, so their versions don't clash with
+-- the configs service's migrations if the two share a database.
+CREATE TABLE IF NOT EXISTS index_entries (
+  table_name text NOT NULL,
+  hash_value text NOT NULL,
+  range_value bytea NOT NULL,
+  value bytea,
+  PRIMARY KEY (table_name, hash_value, range_value)
+);
+
+CREATE TABLE IF NOT EXISTS chunks (
+  key text NOT NULL PRIMARY KEY,
+  value bytea NOT NULL
+);
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+// migrate copies a tenant's chunks from one chunk store to another, e.g. to
+// move them to a newer schema or another storage backend.  The stores are
+// configured with the usual chunk store and storage flags, prefixed with
+// -source. and -dest., e.g. -source.dynamodb.url and -dest.dynamodb.url.
+func main() {
+	var (
+		sourceStoreConfig, destStoreConfig     chunk.StoreConfig
+		sourceStorageConfig, destStorageConfig chunk.StorageClientConfig
+		migrateConfig                          chunk.MigrateConfig
+	)
+	util.RegisterFlagsWithPrefix("source.", &sourceStoreConfig, &sourceStorageConfig)
+	util.RegisterFlagsWithPrefix("dest.", &destStoreConfig, &destStorageConfig)
+	util.RegisterFlags(&migrateConfig)
+	flag.Parse()
+
+	source, err := newStore(sourceStoreConfig, sourceStorageConfig)
+	if err != nil {
+		log.Fatalf("Error initializing source store: %v", err)
+	}
+	defer source.Stop()
+
+	dest, err := newStore(destStoreConfig, destStorageConfig)
+	if err != nil {
+		log.Fatalf("Error initializing destination store: %v", err)
+	}
+	defer dest.Stop()
+
+	migrator, err := chunk.NewMigrator(migrateConfig, source, dest)
+	if err != nil {
+		log.Fatalf("Error initializing migrator: %v", err)
+	}
+	if err := migrator.Run(context.Background()); err != nil {
+		log.Fatalf("Error migrating chunks: %v", err)
+	}
+}
+
+func newStore(storeConfig chunk.StoreConfig, storageConfig chunk.StorageClientConfig) (*chunk.Store, error) {
+	storageClient, err := chunk.NewStorageClient(storageConfig, storeConfig.SchemaConfig)
+	if err != nil {
+		return nil, err
+	}
+	return chunk.NewStore(storeConfig, storageClient)
+}
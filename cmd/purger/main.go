@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/server"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/configs"
+	"github.com/weaveworks/cortex/configs/client"
+	"github.com/weaveworks/cortex/util"
+)
+
+// purger deletes the index entries and chunks of deleted tenants, recording
+// its progress with the configs API server so that purges survive restarts.
+func main() {
+	var (
+		serverConfig = server.Config{
+			MetricsNamespace: "cortex",
+			GRPCMiddleware: []grpc.UnaryServerInterceptor{
+				middleware.ServerUserHeaderInterceptor,
+			},
+		}
+		chunkStoreConfig chunk.StoreConfig
+		storageConfig    chunk.StorageClientConfig
+		purgerConfig     chunk.PurgerConfig
+		tenantsConfig    client.DeletedTenantsConfig
+		delay            time.Duration
+	)
+	util.RegisterFlags(&serverConfig, &chunkStoreConfig, &storageConfig, &purgerConfig)
+	util.RegisterFlagsWithPrefix("purger.", &tenantsConfig)
+	flag.DurationVar(&delay, "purger.delay", time.Hour, "How long after a tenant is deleted to purge its data; it must be longer than the ingesters take to notice the deletion, and flush.")
+	flag.Parse()
+
+	if tenantsConfig.ConfigsAPIURL.URL == nil {
+		log.Fatalf("Must set -purger.configs.url")
+	}
+	api := &client.TenantsAPI{
+		URL:     tenantsConfig.ConfigsAPIURL.URL,
+		Timeout: tenantsConfig.ClientTimeout,
+	}
+
+	storageClient, err := chunk.NewStorageClient(storageConfig, chunkStoreConfig.SchemaConfig)
+	if err != nil {
+		log.Fatalf("Error initializing storage client: %v", err)
+	}
+
+	chunkStore, err := chunk.NewStore(chunkStoreConfig, storageClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer chunkStore.Stop()
+
+	purger, err := chunk.NewPurger(purgerConfig, chunkStore)
+	if err != nil {
+		log.Fatalf("Error initializing purger: %v", err)
+	}
+
+	server, err := server.New(serverConfig)
+	if err != nil {
+		log.Fatalf("Error initializing server: %v", err)
+	}
+	defer server.Shutdown()
+
+	go func() {
+		for range time.Tick(tenantsConfig.PollInterval) {
+			if err := purgeDeletedTenants(api, purger, delay); err != nil {
+				log.Errorf("Error purging deleted tenants: %v", err)
+			}
+		}
+	}()
+
+	server.Run()
+}
+
+// purgeDeletedTenants purges each tenant deleted more than delay ago, and
+// not yet purged, carrying on from where any earlier purge got to.
+func purgeDeletedTenants(api *client.TenantsAPI, purger *chunk.Purger, delay time.Duration) error {
+	deletions, err := api.GetTenantDeletions()
+	if err != nil {
+		return err
+	}
+	for userID, deletion := range deletions {
+		if time.Since(deletion.DeletedAt) < delay || !purger.Due(chunk.PurgeProgress(deletion.Purge)) {
+			continue
+		}
+		log.Infof("Purging tenant %s, deleted at %v", userID, deletion.DeletedAt)
+		if err := purger.Purge(context.Background(), userID, chunk.PurgeProgress(deletion.Purge), func(progress chunk.PurgeProgress) error {
+			return api.SetPurgeProgress(userID, configs.PurgeProgress(progress))
+		}); err != nil {
+			return fmt.Errorf("error purging tenant %s: %v", userID, err)
+		}
+		log.Infof("Finished a purge pass of tenant %s", userID)
+	}
+	return nil
+}
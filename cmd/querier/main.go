@@ -43,9 +43,11 @@ func main() {
 		distributorConfig distributor.Config
 		chunkStoreConfig  chunk.StoreConfig
 		storageConfig     chunk.StorageClientConfig
+		querierConfig     querier.Config
 	)
-	util.RegisterFlags(&serverConfig, &ringConfig, &distributorConfig, &chunkStoreConfig, &storageConfig)
+	util.RegisterFlags(&serverConfig, &ringConfig, &distributorConfig, &chunkStoreConfig, &storageConfig, &querierConfig)
 	flag.Parse()
+	distributorConfig.MaxMetricNamesPerQuery = chunkStoreConfig.MaxMetricNamesPerQuery
 
 	r, err := ring.New(ringConfig)
 	if err != nil {
@@ -53,7 +55,7 @@ func main() {
 	}
 	defer r.Stop()
 
-	dist, err := distributor.New(distributorConfig, r)
+	dist, err := distributor.New(distributorConfig, r, nil)
 	if err != nil {
 		log.Fatalf("Error initializing distributor: %v", err)
 	}
@@ -67,7 +69,7 @@ func main() {
 	defer server.Shutdown()
 	server.HTTP.Handle("/ring", r)
 
-	storageClient, err := chunk.NewStorageClient(storageConfig)
+	storageClient, err := chunk.NewStorageClient(storageConfig, chunkStoreConfig.SchemaConfig)
 	if err != nil {
 		log.Fatalf("Error initializing storage client: %v", err)
 	}
@@ -78,19 +80,21 @@ func main() {
 	}
 	defer chunkStore.Stop()
 
-	queryable := querier.NewQueryable(dist, chunkStore)
+	queryable := querier.NewQueryable(querierConfig, dist, chunkStore)
 	engine := promql.NewEngine(queryable, nil)
 	api := v1.NewAPI(engine, querier.DummyStorage{Queryable: queryable}, dummyTargetRetriever{}, dummyAlertmanagerRetriever{})
 	promRouter := route.New(func(r *http.Request) (context.Context, error) {
-		return r.Context(), nil
+		return querier.DownsamplingFromRequest(r), nil
 	}).WithPrefix("/api/prom/api/v1")
 	api.Register(promRouter)
 
 	subrouter := server.HTTP.PathPrefix("/api/prom").Subrouter()
+	subrouter.Path("/api/v1/labels").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(queryable.Q.LabelNamesHandler)))
 	subrouter.PathPrefix("/api/v1").Handler(middleware.AuthenticateUser.Wrap(promRouter))
 	subrouter.Path("/read").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(queryable.Q.RemoteReadHandler)))
 	subrouter.Path("/validate_expr").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.ValidateExprHandler)))
 	subrouter.Path("/user_stats").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.UserStatsHandler)))
+	subrouter.Path("/cardinality").Handler(middleware.AuthenticateUser.Wrap(http.HandlerFunc(dist.CardinalityHandler)))
 
 	server.Run()
 }
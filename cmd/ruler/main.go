@@ -32,8 +32,9 @@ func main() {
 	)
 	util.RegisterFlags(&serverConfig, &ringConfig, &distributorConfig, &rulerConfig, &chunkStoreConfig, &storageConfig)
 	flag.Parse()
+	distributorConfig.MaxMetricNamesPerQuery = chunkStoreConfig.MaxMetricNamesPerQuery
 
-	storageClient, err := chunk.NewStorageClient(storageConfig)
+	storageClient, err := chunk.NewStorageClient(storageConfig, chunkStoreConfig.SchemaConfig)
 	if err != nil {
 		log.Fatalf("Error initializing storage client: %v", err)
 	}
@@ -50,7 +51,7 @@ func main() {
 	}
 	defer r.Stop()
 
-	dist, err := distributor.New(distributorConfig, r)
+	dist, err := distributor.New(distributorConfig, r, nil)
 	if err != nil {
 		log.Fatalf("Error initializing distributor: %v", err)
 	}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/prometheus/common/log"
+	"gopkg.in/yaml.v2"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+// schema-config prints the schema periods in effect for the given flags, in
+// the format of a schema config file.  Run it with the same schema flags as
+// the other components to migrate them to a schema config file, or with
+// -chunk.schema-config-file to check a file.
+func main() {
+	var schemaConfig chunk.SchemaConfig
+	util.RegisterFlags(&schemaConfig)
+	flag.Parse()
+
+	periods, err := schemaConfig.EffectivePeriods()
+	if err != nil {
+		log.Fatalf("Error loading schema config: %v", err)
+	}
+	if err := periods.Validate(); err != nil {
+		log.Fatalf("Invalid schema config, check -dynamodb.original-table-name and the periodic table flags: %v", err)
+	}
+
+	out, err := yaml.Marshal(periods)
+	if err != nil {
+		log.Fatalf("Error encoding schema config: %v", err)
+	}
+	fmt.Print(string(out))
+}
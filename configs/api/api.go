@@ -63,6 +63,10 @@ func (a *API) RegisterRoutes(r *mux.Router) {
 		// Internal APIs.
 		{"private_get_rules", "GET", "/private/api/prom/configs/rules", a.getConfigs},
 		{"private_get_alertmanager_config", "GET", "/private/api/prom/configs/alertmanager", a.getConfigs},
+		// Admin APIs for deleting tenants, and purging their data.
+		{"private_delete_tenant", "DELETE", "/private/api/prom/tenants/{userID}", a.deleteTenant},
+		{"private_get_tenant_deletions", "GET", "/private/api/prom/tenants/deletions", a.getTenantDeletions},
+		{"private_set_purge_progress", "PUT", "/private/api/prom/tenants/{userID}/purge", a.setPurgeProgress},
 	} {
 		r.Handle(route.path, route.handler).Methods(route.method).Name(route.name)
 	}
@@ -110,7 +114,11 @@ func (a *API) setConfig(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if err := a.db.SetConfig(userID, cfg); err != nil {
+	err = a.db.SetConfig(userID, cfg)
+	if err == configs.ErrTenantDeleted {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
 		// XXX: Untested
 		log.Errorf("Error storing config: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -197,3 +205,54 @@ func (a *API) getConfigs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// deleteTenant marks the tenant deleted.  Its configs are gone straight away;
+// its data is purged in the background.
+func (a *API) deleteTenant(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+	if err := a.db.DeleteTenant(userID); err != nil {
+		// XXX: Untested
+		log.Errorf("Error deleting tenant: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Deleted tenant %s", userID)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// TenantDeletionsView renders the deleted tenants, mapping userID to
+// TenantDeletion.
+type TenantDeletionsView struct {
+	Deletions map[string]configs.TenantDeletion `json:"deletions"`
+}
+
+func (a *API) getTenantDeletions(w http.ResponseWriter, r *http.Request) {
+	deletions, err := a.db.GetTenantDeletions()
+	if err != nil {
+		// XXX: Untested
+		log.Errorf("Error getting tenant deletions: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	util.WriteJSONResponse(w, TenantDeletionsView{Deletions: deletions})
+}
+
+func (a *API) setPurgeProgress(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["userID"]
+	var progress configs.PurgeProgress
+	if err := json.NewDecoder(r.Body).Decode(&progress); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err := a.db.SetPurgeProgress(userID, progress)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No such deleted tenant", http.StatusNotFound)
+		return
+	} else if err != nil {
+		// XXX: Untested
+		log.Errorf("Error setting purge progress: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -223,6 +223,66 @@ func Test_GetConfigs_IncludesNewerConfigsAndExcludesOlder(t *testing.T) {
 	}
 }
 
+// Deleting a tenant removes its configs, except from the configs changed
+// since, where they are marked deleted, and records the deletion for purging.
+func Test_DeleteTenant(t *testing.T) {
+	setup(t)
+	defer cleanup(t)
+
+	for _, c := range allClients {
+		userID := makeUserID()
+		config := c.post(t, userID, makeConfig())
+		otherUserID := makeUserID()
+		otherConfig := c.post(t, otherUserID, makeConfig())
+
+		w := request(t, "DELETE", "/private/api/prom/tenants/"+userID, nil)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		// Deleting twice is fine.
+		w = request(t, "DELETE", "/private/api/prom/tenants/"+userID, nil)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+
+		w = requestAsUser(t, userID, "GET", c.Endpoint, nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		w = requestAsUser(t, userID, "POST", c.Endpoint, jsonObject(makeConfig()).Reader(t))
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		w = request(t, "GET", c.PrivateEndpoint, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var found api.ConfigsView
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &found))
+		assert.Equal(t, otherConfig, found.Configs[otherUserID])
+		assert.NotContains(t, found.Configs, userID)
+		// Configs of tenants which aren't deleted look as they always did.
+		assert.NotContains(t, w.Body.String(), "deleted_at")
+
+		w = request(t, "GET", fmt.Sprintf("%s?since=%d", c.PrivateEndpoint, config.ID), nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		found = api.ConfigsView{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &found))
+		require.Contains(t, found.Configs, userID)
+		assert.True(t, found.Configs[userID].ID > otherConfig.ID)
+		assert.NotNil(t, found.Configs[userID].DeletedAt)
+		assert.Nil(t, found.Configs[otherUserID].DeletedAt)
+
+		progress := configs.PurgeProgress{Tables: 3, TablesDone: 1, IndexEntriesDeleted: 10}
+		w = request(t, "PUT", "/private/api/prom/tenants/"+userID+"/purge", jsonObject{
+			"tables": 3, "tables_done": 1, "index_entries_deleted": 10,
+		}.Reader(t))
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		w = request(t, "PUT", "/private/api/prom/tenants/"+otherUserID+"/purge", jsonObject{}.Reader(t))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		w = request(t, "GET", "/private/api/prom/tenants/deletions", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var deletions api.TenantDeletionsView
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &deletions))
+		require.Contains(t, deletions.Deletions, userID)
+		assert.NotContains(t, deletions.Deletions, otherUserID)
+		assert.False(t, deletions.Deletions[userID].DeletedAt.IsZero())
+		assert.Equal(t, progress, deletions.Deletions[userID].Purge)
+	}
+}
+
 func Test_ValidateAlertmanagerConfig(t *testing.T) {
 	tests := []struct {
 		config      string
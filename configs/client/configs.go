@@ -35,6 +35,9 @@ type CortexConfig struct {
 type CortexConfigView struct {
 	ConfigID ConfigID     `json:"id"`
 	Config   CortexConfig `json:"config"`
+
+	// Set if the user has been deleted, in which case the config is empty.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 // CortexConfigsResponse is a response from server for GetConfigs.
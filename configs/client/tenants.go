@@ -0,0 +1,172 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+
+	"github.com/weaveworks/cortex/configs"
+	"github.com/weaveworks/cortex/util"
+)
+
+// TenantsAPI allows retrieving deleted tenants, and recording the purge of
+// their data.
+type TenantsAPI struct {
+	URL     *url.URL
+	Timeout time.Duration
+}
+
+// GetTenantDeletions returns all the deleted tenants, by user ID.
+func (c *TenantsAPI) GetTenantDeletions() (map[string]configs.TenantDeletion, error) {
+	endpoint := fmt.Sprintf("%s/private/api/prom/tenants/deletions", c.URL.String())
+	client := &http.Client{Timeout: c.Timeout}
+	res, err := client.Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Invalid response from configs server: %v", res.StatusCode)
+	}
+	var deletions struct {
+		Deletions map[string]configs.TenantDeletion `json:"deletions"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&deletions); err != nil {
+		return nil, err
+	}
+	return deletions.Deletions, nil
+}
+
+// SetPurgeProgress records how far the purge of a deleted tenant has got.
+func (c *TenantsAPI) SetPurgeProgress(userID string, progress configs.PurgeProgress) error {
+	buf, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("%s/private/api/prom/tenants/%s/purge", c.URL.String(), url.PathEscape(userID))
+	req, err := http.NewRequest("PUT", endpoint, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: c.Timeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("Invalid response from configs server: %v", res.StatusCode)
+	}
+	return nil
+}
+
+// DeletedTenantsConfig configures DeletedTenants.  Its flags are meant to be
+// registered with the prefix of the component using it.
+type DeletedTenantsConfig struct {
+	ConfigsAPIURL util.URLValue
+	PollInterval  time.Duration
+	ClientTimeout time.Duration
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *DeletedTenantsConfig) RegisterFlags(f *flag.FlagSet) {
+	f.Var(&cfg.ConfigsAPIURL, "configs.url", "URL of configs API server, to poll for deleted tenants.  Tenants are never deleted if unset.")
+	f.DurationVar(&cfg.PollInterval, "configs.poll-interval", 15*time.Second, "How frequently to poll for deleted tenants.")
+	f.DurationVar(&cfg.ClientTimeout, "configs.client-timeout", 5*time.Second, "Timeout for requests to the configs API server.")
+}
+
+// DeletedTenants keeps track of the deleted tenants, by polling the configs
+// API server.
+type DeletedTenants struct {
+	api      TenantsAPI
+	interval time.Duration
+	onDelete func(userID string)
+	onPurged func(userID string)
+
+	// Whether each deleted tenant's purge is done.
+	mtx     sync.RWMutex
+	deleted map[string]bool
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewDeletedTenants makes a new DeletedTenants, which calls onDelete, if not
+// nil, once for each deleted tenant whose purge isn't done, including those
+// deleted before it started.  It calls onPurged, if not nil, once for each
+// deleted tenant whose purge is done.
+func NewDeletedTenants(cfg DeletedTenantsConfig, onDelete, onPurged func(userID string)) *DeletedTenants {
+	d := &DeletedTenants{
+		api: TenantsAPI{
+			URL:     cfg.ConfigsAPIURL.URL,
+			Timeout: cfg.ClientTimeout,
+		},
+		interval: cfg.PollInterval,
+		onDelete: onDelete,
+		onPurged: onPurged,
+		deleted:  map[string]bool{},
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go d.loop()
+	return d
+}
+
+func (d *DeletedTenants) loop() {
+	defer close(d.done)
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		if err := d.poll(); err != nil {
+			log.Warnf("Error polling for deleted tenants: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+func (d *DeletedTenants) poll() error {
+	deletions, err := d.api.GetTenantDeletions()
+	if err != nil {
+		return err
+	}
+	for userID, deletion := range deletions {
+		d.mtx.Lock()
+		purged, ok := d.deleted[userID]
+		d.deleted[userID] = deletion.Purge.Done
+		d.mtx.Unlock()
+		if !ok && !deletion.Purge.Done && d.onDelete != nil {
+			log.Infof("Tenant %s has been deleted", userID)
+			d.onDelete(userID)
+		}
+		if !purged && deletion.Purge.Done && d.onPurged != nil {
+			log.Infof("Tenant %s has been purged", userID)
+			d.onPurged(userID)
+		}
+	}
+	return nil
+}
+
+// IsDeleted returns whether the tenant has been deleted.
+func (d *DeletedTenants) IsDeleted(userID string) bool {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	_, ok := d.deleted[userID]
+	return ok
+}
+
+// Stop stops polling.
+func (d *DeletedTenants) Stop() {
+	close(d.quit)
+	<-d.done
+}
@@ -1,5 +1,13 @@
 package configs
 
+import (
+	"errors"
+	"time"
+)
+
+// ErrTenantDeleted is returned when setting the config of a deleted tenant.
+var ErrTenantDeleted = errors.New("tenant has been deleted")
+
 // ID is the unique ID given to each configuration. When a configuration
 // changes, it gets a new ID.
 type ID int
@@ -12,4 +20,26 @@ type Config map[string]interface{}
 type ConfigView struct {
 	ID     ID     `json:"id"`
 	Config Config `json:"config"`
+
+	// Set if the tenant owning the config has been deleted; only ever when
+	// getting the configs which changed since some ID.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// TenantDeletion records the deletion of a tenant, and the purge of its data.
+type TenantDeletion struct {
+	DeletedAt time.Time     `json:"deleted_at"`
+	Purge     PurgeProgress `json:"purge"`
+}
+
+// PurgeProgress is how far the purge of a deleted tenant's index entries and
+// chunks has got.  It matches chunk.PurgeProgress.
+type PurgeProgress struct {
+	Tables              int        `json:"tables"`
+	TablesDone          int        `json:"tables_done"`
+	IndexEntriesDeleted int        `json:"index_entries_deleted"`
+	ChunksDeleted       int        `json:"chunks_deleted"`
+	Passes              int        `json:"passes"`
+	LastPassAt          *time.Time `json:"last_pass_at,omitempty"`
+	Done                bool       `json:"done"`
 }
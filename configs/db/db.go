@@ -30,6 +30,13 @@ type DB interface {
 	GetAllConfigs() (map[string]configs.ConfigView, error)
 	GetConfigs(since configs.ID) (map[string]configs.ConfigView, error)
 
+	// DeleteTenant marks the tenant's configs deleted, and records the
+	// deletion so its data can be purged.  Deleting a tenant twice does
+	// nothing.
+	DeleteTenant(userID string) error
+	GetTenantDeletions() (map[string]configs.TenantDeletion, error)
+	SetPurgeProgress(userID string, progress configs.PurgeProgress) error
+
 	Close() error
 }
 
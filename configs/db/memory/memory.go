@@ -2,40 +2,48 @@ package memory
 
 import (
 	"database/sql"
+	"time"
 
 	"github.com/weaveworks/cortex/configs"
 )
 
 type config struct {
-	cfg configs.Config
-	id  configs.ID
+	cfg       configs.Config
+	id        configs.ID
+	deletedAt time.Time
 }
 
 func (c config) toView() configs.ConfigView {
-	return configs.ConfigView{
+	view := configs.ConfigView{
 		ID:     c.id,
 		Config: c.cfg,
 	}
+	if !c.deletedAt.IsZero() {
+		view.DeletedAt = &c.deletedAt
+	}
+	return view
 }
 
 // DB is an in-memory database for testing, and local development
 type DB struct {
-	cfgs map[string]config
-	id   uint
+	cfgs      map[string]config
+	deletions map[string]configs.TenantDeletion
+	id        uint
 }
 
 // New creates a new in-memory database
 func New(_, _ string) (*DB, error) {
 	return &DB{
-		cfgs: map[string]config{},
-		id:   0,
+		cfgs:      map[string]config{},
+		deletions: map[string]configs.TenantDeletion{},
+		id:        0,
 	}, nil
 }
 
 // GetConfig gets the user's configuration.
 func (d *DB) GetConfig(userID string) (configs.ConfigView, error) {
 	c, ok := d.cfgs[userID]
-	if !ok {
+	if !ok || !c.deletedAt.IsZero() {
 		return configs.ConfigView{}, sql.ErrNoRows
 	}
 	return c.toView(), nil
@@ -43,6 +51,9 @@ func (d *DB) GetConfig(userID string) (configs.ConfigView, error) {
 
 // SetConfig sets configuration for a user.
 func (d *DB) SetConfig(userID string, cfg configs.Config) error {
+	if _, ok := d.deletions[userID]; ok {
+		return configs.ErrTenantDeleted
+	}
 	d.cfgs[userID] = config{cfg: cfg, id: configs.ID(d.id)}
 	d.id++
 	return nil
@@ -52,12 +63,15 @@ func (d *DB) SetConfig(userID string, cfg configs.Config) error {
 func (d *DB) GetAllConfigs() (map[string]configs.ConfigView, error) {
 	cfgs := map[string]configs.ConfigView{}
 	for user, c := range d.cfgs {
-		cfgs[user] = c.toView()
+		if c.deletedAt.IsZero() {
+			cfgs[user] = c.toView()
+		}
 	}
 	return cfgs, nil
 }
 
-// GetConfigs gets all of the configs that have changed recently.
+// GetConfigs gets all of the configs that have changed recently, including
+// those of deleted tenants.
 func (d *DB) GetConfigs(since configs.ID) (map[string]configs.ConfigView, error) {
 	cfgs := map[string]configs.ConfigView{}
 	for user, c := range d.cfgs {
@@ -68,6 +82,39 @@ func (d *DB) GetConfigs(since configs.ID) (map[string]configs.ConfigView, error)
 	return cfgs, nil
 }
 
+// DeleteTenant marks the tenant's configs deleted, replacing them with an
+// empty deleted config so the deletion shows up in GetConfigs.
+func (d *DB) DeleteTenant(userID string) error {
+	if _, ok := d.deletions[userID]; ok {
+		return nil
+	}
+	now := time.Now()
+	d.cfgs[userID] = config{cfg: configs.Config{}, id: configs.ID(d.id), deletedAt: now}
+	d.id++
+	d.deletions[userID] = configs.TenantDeletion{DeletedAt: now}
+	return nil
+}
+
+// GetTenantDeletions gets all of the deleted tenants.
+func (d *DB) GetTenantDeletions() (map[string]configs.TenantDeletion, error) {
+	deletions := make(map[string]configs.TenantDeletion, len(d.deletions))
+	for user, deletion := range d.deletions {
+		deletions[user] = deletion
+	}
+	return deletions, nil
+}
+
+// SetPurgeProgress records how far the purge of a deleted tenant has got.
+func (d *DB) SetPurgeProgress(userID string, progress configs.PurgeProgress) error {
+	deletion, ok := d.deletions[userID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	deletion.Purge = progress
+	d.deletions[userID] = deletion
+	return nil
+}
+
 // Close finishes using the db. Noop.
 func (d *DB) Close() error {
 	return nil
@@ -7,7 +7,7 @@ import (
 
 	"github.com/Masterminds/squirrel"
 	"github.com/Sirupsen/logrus"
-	_ "github.com/lib/pq"                         // Import the postgres sql driver
+	"github.com/lib/pq"
 	_ "github.com/mattes/migrate/driver/postgres" // Import the postgres migrations driver
 	"github.com/mattes/migrate/migrate"
 	"github.com/weaveworks/cortex/configs"
@@ -26,6 +26,10 @@ var (
 		"owner_type": entityType,
 		"subsystem":  subsystem,
 	}
+	allConfigs = squirrel.Eq{
+		"owner_type": entityType,
+		"subsystem":  subsystem,
+	}
 )
 
 // DB is a postgres db, for dev and production
@@ -62,7 +66,7 @@ func New(uri, migrationsDir string) (DB, error) {
 var statementBuilder = squirrel.StatementBuilder.PlaceholderFormat(squirrel.Dollar).RunWith
 
 func (d DB) findConfigs(filter squirrel.Sqlizer) (map[string]configs.ConfigView, error) {
-	rows, err := d.Select("id", "owner_id", "config").
+	rows, err := d.Select("id", "owner_id", "config", "deleted_at").
 		Options("DISTINCT ON (owner_id)").
 		From("configs").
 		Where(filter).
@@ -77,7 +81,8 @@ func (d DB) findConfigs(filter squirrel.Sqlizer) (map[string]configs.ConfigView,
 		var cfg configs.ConfigView
 		var cfgBytes []byte
 		var userID string
-		err = rows.Scan(&cfg.ID, &userID, &cfgBytes)
+		var deletedAt pq.NullTime
+		err = rows.Scan(&cfg.ID, &userID, &cfgBytes, &deletedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -85,6 +90,9 @@ func (d DB) findConfigs(filter squirrel.Sqlizer) (map[string]configs.ConfigView,
 		if err != nil {
 			return nil, err
 		}
+		if deletedAt.Valid {
+			cfg.DeletedAt = &deletedAt.Time
+		}
 		cfgs[userID] = cfg
 	}
 	return cfgs, nil
@@ -109,6 +117,13 @@ func (d DB) GetConfig(userID string) (configs.ConfigView, error) {
 
 // SetConfig sets a configuration.
 func (d DB) SetConfig(userID string, cfg configs.Config) error {
+	deleted, err := d.isDeleted(userID)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		return configs.ErrTenantDeleted
+	}
 	cfgBytes, err := json.Marshal(cfg)
 	if err != nil {
 		return err
@@ -125,14 +140,104 @@ func (d DB) GetAllConfigs() (map[string]configs.ConfigView, error) {
 	return d.findConfigs(activeConfig)
 }
 
-// GetConfigs gets all of the configs that have changed recently.
+// GetConfigs gets all of the configs that have changed recently, including
+// those of deleted tenants.
 func (d DB) GetConfigs(since configs.ID) (map[string]configs.ConfigView, error) {
 	return d.findConfigs(squirrel.And{
-		activeConfig,
+		allConfigs,
 		squirrel.Gt{"id": since},
 	})
 }
 
+func (d DB) isDeleted(userID string) (bool, error) {
+	var count int
+	err := d.Select("count(*)").
+		From("deleted_tenants").
+		Where(squirrel.Eq{"owner_id": userID}).
+		QueryRow().Scan(&count)
+	return count > 0, err
+}
+
+// DeleteTenant marks the tenant's configs deleted, and adds an empty deleted
+// config after them, so the deletion shows up in GetConfigs.
+func (d DB) DeleteTenant(userID string) error {
+	return d.Transaction(func(tx DB) error {
+		deleted, err := tx.isDeleted(userID)
+		if err != nil || deleted {
+			return err
+		}
+		_, err = tx.Update("configs").
+			Set("deleted_at", squirrel.Expr("now()")).
+			Where(squirrel.And{activeConfig, squirrel.Eq{"owner_id": userID}}).
+			Exec()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Insert("configs").
+			Columns("owner_id", "owner_type", "subsystem", "config", "deleted_at").
+			Values(userID, entityType, subsystem, []byte("{}"), squirrel.Expr("now()")).
+			Exec()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Insert("deleted_tenants").
+			Columns("owner_id").
+			Values(userID).
+			Exec()
+		return err
+	})
+}
+
+// GetTenantDeletions gets all of the deleted tenants.
+func (d DB) GetTenantDeletions() (map[string]configs.TenantDeletion, error) {
+	rows, err := d.Select("owner_id", "deleted_at", "purge").
+		From("deleted_tenants").
+		Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deletions := map[string]configs.TenantDeletion{}
+	for rows.Next() {
+		var deletion configs.TenantDeletion
+		var purgeBytes []byte
+		var userID string
+		err = rows.Scan(&userID, &deletion.DeletedAt, &purgeBytes)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(purgeBytes, &deletion.Purge)
+		if err != nil {
+			return nil, err
+		}
+		deletions[userID] = deletion
+	}
+	return deletions, rows.Err()
+}
+
+// SetPurgeProgress records how far the purge of a deleted tenant has got.
+func (d DB) SetPurgeProgress(userID string, progress configs.PurgeProgress) error {
+	purgeBytes, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	result, err := d.Update("deleted_tenants").
+		Set("purge", purgeBytes).
+		Where(squirrel.Eq{"owner_id": userID}).
+		Exec()
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
 // Transaction runs the given function in a postgres transaction. If fn returns
 // an error the txn will be rolled back.
 func (d DB) Transaction(f func(DB) error) error {
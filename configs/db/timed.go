@@ -68,6 +68,26 @@ func (t timed) GetConfigs(since configs.ID) (cfgs map[string]configs.ConfigView,
 	return
 }
 
+func (t timed) DeleteTenant(userID string) error {
+	return t.timeRequest("DeleteTenant", func(_ context.Context) error {
+		return t.d.DeleteTenant(userID)
+	})
+}
+
+func (t timed) GetTenantDeletions() (deletions map[string]configs.TenantDeletion, err error) {
+	t.timeRequest("GetTenantDeletions", func(_ context.Context) error {
+		deletions, err = t.d.GetTenantDeletions()
+		return err
+	})
+	return
+}
+
+func (t timed) SetPurgeProgress(userID string, progress configs.PurgeProgress) error {
+	return t.timeRequest("SetPurgeProgress", func(_ context.Context) error {
+		return t.d.SetPurgeProgress(userID, progress)
+	})
+}
+
 func (t timed) Close() error {
 	return t.timeRequest("Close", func(_ context.Context) error {
 		return t.d.Close()
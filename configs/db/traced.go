@@ -34,6 +34,21 @@ func (t traced) GetConfigs(since configs.ID) (cfgs map[string]configs.ConfigView
 	return t.d.GetConfigs(since)
 }
 
+func (t traced) DeleteTenant(userID string) (err error) {
+	defer func() { t.trace("DeleteTenant", userID, err) }()
+	return t.d.DeleteTenant(userID)
+}
+
+func (t traced) GetTenantDeletions() (deletions map[string]configs.TenantDeletion, err error) {
+	defer func() { t.trace("GetTenantDeletions", deletions, err) }()
+	return t.d.GetTenantDeletions()
+}
+
+func (t traced) SetPurgeProgress(userID string, progress configs.PurgeProgress) (err error) {
+	defer func() { t.trace("SetPurgeProgress", userID, progress, err) }()
+	return t.d.SetPurgeProgress(userID, progress)
+}
+
 func (t traced) Close() (err error) {
 	defer func() { t.trace("Close", err) }()
 	return t.d.Close()
@@ -0,0 +1,179 @@
+package distributor
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex"
+	"github.com/weaveworks/cortex/util"
+)
+
+const defaultCardinalityLimit = 20
+
+// CardinalityStat is the count for one metric or label name.
+type CardinalityStat struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+// CardinalityStats explains where a user's series come from.
+type CardinalityStats struct {
+	NumSeries     uint64            `json:"numSeries"`
+	MatchedSeries uint64            `json:"matchedSeries"`
+	MetricNames   []CardinalityStat `json:"metricNames"`
+	LabelNames    []CardinalityStat `json:"labelNames"`
+}
+
+// Cardinality returns the limit metric names with the most series, the limit
+// label names with the most distinct values, and how many series match
+// matchers, if given.
+//
+// Series counts are summed across ingesters and divided by the replication
+// factor, like UserStats.  Distinct values can't be summed, as ingesters share
+// values, so the highest count from any one ingester is used; it is a lower
+// bound.
+//
+// Ingesters return all their names, and the limit is applied to the merged
+// counts, as a metric name outside every ingester's own top limit can still
+// have the most series overall.
+func (d *Distributor) Cardinality(ctx context.Context, limit int, matchers []*metric.LabelMatcher) (*CardinalityStats, error) {
+	req, err := util.ToCardinalityRequest(0, matchers)
+	if err != nil {
+		return nil, err
+	}
+	resps, err := d.forAllIngesters(func(client cortex.IngesterClient) (interface{}, error) {
+		return client.Cardinality(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &CardinalityStats{}
+	seriesPerMetric := map[string]uint64{}
+	valuesPerLabel := map[string]uint64{}
+	for _, resp := range resps {
+		r := resp.(*cortex.CardinalityResponse)
+		stats.NumSeries += r.NumSeries
+		stats.MatchedSeries += r.MatchedSeries
+		for _, s := range r.MetricNames {
+			seriesPerMetric[s.Name] += s.Count
+		}
+		for _, s := range r.LabelNames {
+			if s.Count > valuesPerLabel[s.Name] {
+				valuesPerLabel[s.Name] = s.Count
+			}
+		}
+	}
+
+	replicationFactor := uint64(d.cfg.ReplicationFactor)
+	stats.NumSeries /= replicationFactor
+	stats.MatchedSeries /= replicationFactor
+	for name := range seriesPerMetric {
+		seriesPerMetric[name] /= replicationFactor
+	}
+	stats.MetricNames = fromCardinalityStats(util.TopCardinalityStats(seriesPerMetric, limit))
+	stats.LabelNames = fromCardinalityStats(util.TopCardinalityStats(valuesPerLabel, limit))
+	return stats, nil
+}
+
+func fromCardinalityStats(stats []cortex.CardinalityStat) []CardinalityStat {
+	result := make([]CardinalityStat, 0, len(stats))
+	for _, s := range stats {
+		result = append(result, CardinalityStat{Name: s.Name, Count: s.Count})
+	}
+	return result
+}
+
+const cardinalityTpl = `
+<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>Cortex Cardinality</title>
+	</head>
+	<body>
+		<h1>Cortex Cardinality</h1>
+		<form action="" method="GET">
+			<input type="text" name="selector" size="60" placeholder='{job="example"}' value="{{ .Selector }}">
+			<input type="number" name="limit" value="{{ .Limit }}">
+			<button type="submit">Update</button>
+		</form>
+		<p>Total series: {{ .Stats.NumSeries }}</p>
+		{{ if .Selector }}<p>Series matching <code>{{ .Selector }}</code>: {{ .Stats.MatchedSeries }}</p>{{ end }}
+		<h2>Metric names by series</h2>
+		<table border="1">
+			<thead><tr><th>Metric name</th><th>Series</th></tr></thead>
+			<tbody>
+				{{ range .Stats.MetricNames }}
+				<tr><td>{{ .Name }}</td><td>{{ .Count }}</td></tr>
+				{{ end }}
+			</tbody>
+		</table>
+		<h2>Label names by distinct values</h2>
+		<table border="1">
+			<thead><tr><th>Label name</th><th>Values</th></tr></thead>
+			<tbody>
+				{{ range .Stats.LabelNames }}
+				<tr><td>{{ .Name }}</td><td>{{ .Count }}</td></tr>
+				{{ end }}
+			</tbody>
+		</table>
+	</body>
+</html>`
+
+var cardinalityTmpl = template.Must(template.New("cardinality").Parse(cardinalityTpl))
+
+// CardinalityHandler serves the current user's cardinality stats, as HTML for
+// browsers and as JSON otherwise.  It takes an optional series `selector`, and
+// a `limit` on the number of metric and label names listed.
+func (d *Distributor) CardinalityHandler(w http.ResponseWriter, r *http.Request) {
+	limit := defaultCardinalityLimit
+	if l := r.FormValue("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	selector := r.FormValue("selector")
+	var matchers []*metric.LabelMatcher
+	if selector != "" {
+		var err error
+		if matchers, err = promql.ParseMetricSelector(selector); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	stats, err := d.Cardinality(r.Context(), limit, matchers)
+	if err != nil {
+		log.Errorf("Error getting cardinality: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		util.WriteJSONResponse(w, stats)
+		return
+	}
+
+	if err := cardinalityTmpl.Execute(w, struct {
+		Selector string
+		Limit    int
+		Stats    *CardinalityStats
+	}{
+		Selector: selector,
+		Limit:    limit,
+		Stats:    stats,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
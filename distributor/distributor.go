@@ -4,7 +4,6 @@ import (
 	"errors"
 	"flag"
 	"fmt"
-	"hash/fnv"
 	"io"
 	"sync"
 	"sync/atomic"
@@ -42,12 +41,13 @@ var (
 // Distributor is a storage.SampleAppender and a cortex.Querier which
 // forwards appends and queries to individual ingesters.
 type Distributor struct {
-	cfg        Config
-	ring       ReadRing
-	clientsMtx sync.RWMutex
-	clients    map[string]cortex.IngesterClient
-	quit       chan struct{}
-	done       chan struct{}
+	cfg            Config
+	ring           ReadRing
+	deletedTenants DeletedTenants
+	clientsMtx     sync.RWMutex
+	clients        map[string]cortex.IngesterClient
+	quit           chan struct{}
+	done           chan struct{}
 
 	billingClient *billing.Client
 
@@ -73,6 +73,12 @@ type ReadRing interface {
 	GetAll() []*ring.IngesterDesc
 }
 
+// DeletedTenants tells whether a tenant has been deleted, as
+// configs/client.DeletedTenants does.
+type DeletedTenants interface {
+	IsDeleted(userID string) bool
+}
+
 // Config contains the configuration require to
 // create a Distributor
 type Config struct {
@@ -86,6 +92,11 @@ type Config struct {
 	IngestionRateLimit  float64
 	IngestionBurstSize  int
 
+	// Queries without a metric name may match at most this many metric
+	// names; the queriers set it from -chunk.max-metric-names-per-query, so
+	// the ingesters and the chunk store are limited alike.
+	MaxMetricNamesPerQuery int
+
 	// for testing
 	ingesterClientFactory func(addr string, timeout time.Duration) (cortex.IngesterClient, error)
 }
@@ -103,8 +114,9 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	flag.IntVar(&cfg.IngestionBurstSize, "distributor.ingestion-burst-size", 50000, "Per-user allowed ingestion burst size (in number of samples).")
 }
 
-// New constructs a new Distributor
-func New(cfg Config, ring ReadRing) (*Distributor, error) {
+// New constructs a new Distributor.  Writes from tenants deletedTenants says
+// are deleted are refused; deletedTenants may be nil.
+func New(cfg Config, ring ReadRing, deletedTenants DeletedTenants) (*Distributor, error) {
 	if 0 > cfg.ReplicationFactor {
 		return nil, fmt.Errorf("ReplicationFactor must be greater than zero: %d", cfg.ReplicationFactor)
 	}
@@ -124,6 +136,7 @@ func New(cfg Config, ring ReadRing) (*Distributor, error) {
 	d := &Distributor{
 		cfg:            cfg,
 		ring:           ring,
+		deletedTenants: deletedTenants,
 		clients:        map[string]cortex.IngesterClient{},
 		quit:           make(chan struct{}),
 		done:           make(chan struct{}),
@@ -243,19 +256,12 @@ func (d *Distributor) getClientFor(ingester *ring.IngesterDesc) (cortex.Ingester
 func tokenForLabels(userID string, labels []cortex.LabelPair) (uint32, error) {
 	for _, label := range labels {
 		if label.Name.Equal(labelNameBytes) {
-			return tokenFor(userID, label.Value), nil
+			return ring.TokenFor(userID, label.Value), nil
 		}
 	}
 	return 0, fmt.Errorf("No metric name label")
 }
 
-func tokenFor(userID string, name []byte) uint32 {
-	h := fnv.New32()
-	h.Write([]byte(userID))
-	h.Write(name)
-	return h.Sum32()
-}
-
 type sampleTracker struct {
 	labels      []cortex.LabelPair
 	sample      cortex.Sample
@@ -278,6 +284,9 @@ func (d *Distributor) Push(ctx context.Context, req *cortex.WriteRequest) (*cort
 	if err != nil {
 		return nil, err
 	}
+	if d.deletedTenants != nil && d.deletedTenants.IsDeleted(userID) {
+		return nil, util.ErrTenantDeleted
+	}
 
 	// First we flatten out the request into a list of samples.
 	// We use the heuristic of 1 sample per TS to size the array.
@@ -448,27 +457,71 @@ func (d *Distributor) Query(ctx context.Context, from, to model.Time, matchers .
 			return err
 		}
 
-		metricName, _, err := util.ExtractMetricNameFromMatchers(matchers)
-		if err != nil {
-			return err
+		nameMatchers, otherMatchers := util.SplitMetricNameMatchers(matchers)
+		if metricName, ok := util.EqualMetricName(nameMatchers); ok {
+			result, err = d.queryMetric(ctx, userID, from, to, metricName, matchers)
+			return promql.ErrStorage(err)
 		}
 
-		req, err := util.ToQueryRequest(from, to, matchers)
+		// Series are sharded by metric name, so without one the query is run
+		// for every matching metric name the ingesters know about.
+		metricNames, err := d.LabelValuesForLabelName(ctx, from, to, model.MetricNameLabel)
+		if err != nil {
+			return promql.ErrStorage(err)
+		}
+		metricNames, err = util.MatchingMetricNames(metricNames, nameMatchers, d.cfg.MaxMetricNamesPerQuery)
 		if err != nil {
 			return err
 		}
 
-		ingesters, err := d.ring.Get(tokenFor(userID, []byte(metricName)), d.cfg.ReplicationFactor, ring.Read)
-		if err != nil {
-			return promql.ErrStorage(err)
+		results := make(chan model.Matrix)
+		errs := make(chan error)
+		for _, metricName := range metricNames {
+			go func(metricName model.LabelValue) {
+				nameMatcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, metricName)
+				if err != nil {
+					errs <- err
+					return
+				}
+				matrix, err := d.queryMetric(ctx, userID, from, to, metricName, append([]*metric.LabelMatcher{nameMatcher}, otherMatchers...))
+				if err != nil {
+					errs <- err
+				} else {
+					results <- matrix
+				}
+			}(metricName)
 		}
 
-		result, err = d.queryIngesters(ctx, ingesters, req)
-		return promql.ErrStorage(err)
+		var lastErr error
+		result = model.Matrix{}
+		for range metricNames {
+			select {
+			case matrix := <-results:
+				result = append(result, matrix...)
+			case err := <-errs:
+				lastErr = err
+			}
+		}
+		return promql.ErrStorage(lastErr)
 	})
 	return result, err
 }
 
+// queryMetric queries the ingesters holding the given metric name.
+func (d *Distributor) queryMetric(ctx context.Context, userID string, from, to model.Time, metricName model.LabelValue, matchers []*metric.LabelMatcher) (model.Matrix, error) {
+	req, err := util.ToQueryRequest(from, to, matchers)
+	if err != nil {
+		return nil, err
+	}
+
+	ingesters, err := d.ring.Get(ring.TokenFor(userID, []byte(metricName)), d.cfg.ReplicationFactor, ring.Read)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.queryIngesters(ctx, ingesters, req)
+}
+
 // Query implements Querier.
 func (d *Distributor) queryIngesters(ctx context.Context, ingesters []*ring.IngesterDesc, req *cortex.QueryRequest) (model.Matrix, error) {
 	// We need a response from a quorum of ingesters, which is n/2 + 1.
@@ -579,10 +632,13 @@ func (d *Distributor) forAllIngesters(f func(cortex.IngesterClient) (interface{}
 	return result, nil
 }
 
-// LabelValuesForLabelName returns all of the label values that are associated with a given label name.
-func (d *Distributor) LabelValuesForLabelName(ctx context.Context, labelName model.LabelName) (model.LabelValues, error) {
+// LabelValuesForLabelName returns all of the label values that are associated with a given label name,
+// for series with samples between from and through.
+func (d *Distributor) LabelValuesForLabelName(ctx context.Context, from, through model.Time, labelName model.LabelName) (model.LabelValues, error) {
 	req := &cortex.LabelValuesRequest{
-		LabelName: string(labelName),
+		LabelName:        string(labelName),
+		StartTimestampMs: int64(from),
+		EndTimestampMs:   int64(through),
 	}
 	resps, err := d.forAllIngesters(func(client cortex.IngesterClient) (interface{}, error) {
 		return client.LabelValues(ctx, req)
@@ -605,6 +661,33 @@ func (d *Distributor) LabelValuesForLabelName(ctx context.Context, labelName mod
 	return values, nil
 }
 
+// LabelNames returns all of the label names of series with samples between from and through.
+func (d *Distributor) LabelNames(ctx context.Context, from, through model.Time) (model.LabelNames, error) {
+	req := &cortex.LabelNamesRequest{
+		StartTimestampMs: int64(from),
+		EndTimestampMs:   int64(through),
+	}
+	resps, err := d.forAllIngesters(func(client cortex.IngesterClient) (interface{}, error) {
+		return client.LabelNames(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	nameSet := map[model.LabelName]struct{}{}
+	for _, resp := range resps {
+		for _, n := range resp.(*cortex.LabelNamesResponse).LabelNames {
+			nameSet[model.LabelName(n)] = struct{}{}
+		}
+	}
+
+	names := make(model.LabelNames, 0, len(nameSet))
+	for n := range nameSet {
+		names = append(names, n)
+	}
+	return names, nil
+}
+
 // MetricsForLabelMatchers gets the metrics that match said matchers
 func (d *Distributor) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matchers ...metric.LabelMatchers) ([]metric.Metric, error) {
 	req, err := util.ToMetricsForLabelMatchersRequest(from, through, matchers)
@@ -650,10 +733,12 @@ func (d *Distributor) UserStats(ctx context.Context) (*UserStats, error) {
 	for _, resp := range resps {
 		totalStats.IngestionRate += resp.(*cortex.UserStatsResponse).IngestionRate
 		totalStats.NumSeries += resp.(*cortex.UserStatsResponse).NumSeries
+		totalStats.MemoryBytes += resp.(*cortex.UserStatsResponse).MemoryBytes
 	}
 
 	totalStats.IngestionRate /= float64(d.cfg.ReplicationFactor)
 	totalStats.NumSeries /= uint64(d.cfg.ReplicationFactor)
+	totalStats.MemoryBytes /= uint64(d.cfg.ReplicationFactor)
 
 	return totalStats, nil
 }
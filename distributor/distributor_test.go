@@ -1,7 +1,11 @@
 package distributor
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
@@ -9,12 +13,14 @@ import (
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/metric"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 
 	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex"
 	"github.com/weaveworks/cortex/ring"
+	"github.com/weaveworks/cortex/util"
 )
 
 // mockRing doesn't do any consistent hashing, just returns same ingesters for every query.
@@ -42,6 +48,9 @@ func (r mockRing) GetAll() []*ring.IngesterDesc {
 type mockIngester struct {
 	cortex.IngesterClient
 	happy bool
+
+	// seriesPerMetric overrides the metric names Cardinality reports.
+	seriesPerMetric map[string]uint64
 }
 
 func (i mockIngester) Push(ctx context.Context, in *cortex.WriteRequest, opts ...grpc.CallOption) (*cortex.WriteResponse, error) {
@@ -51,6 +60,15 @@ func (i mockIngester) Push(ctx context.Context, in *cortex.WriteRequest, opts ..
 	return &cortex.WriteResponse{}, nil
 }
 
+func (i mockIngester) LabelValues(ctx context.Context, in *cortex.LabelValuesRequest, opts ...grpc.CallOption) (*cortex.LabelValuesResponse, error) {
+	if !i.happy {
+		return nil, fmt.Errorf("Fail")
+	}
+	return &cortex.LabelValuesResponse{
+		LabelValues: []string{"foo"},
+	}, nil
+}
+
 func (i mockIngester) Query(ctx context.Context, in *cortex.QueryRequest, opts ...grpc.CallOption) (*cortex.QueryResponse, error) {
 	if !i.happy {
 		return nil, fmt.Errorf("Fail")
@@ -79,6 +97,27 @@ func (i mockIngester) Query(ctx context.Context, in *cortex.QueryRequest, opts .
 	}, nil
 }
 
+// Cardinality reports the same two metrics and label names from every
+// ingester, unless told otherwise, limited as asked.
+func (i mockIngester) Cardinality(ctx context.Context, in *cortex.CardinalityRequest, opts ...grpc.CallOption) (*cortex.CardinalityResponse, error) {
+	if !i.happy {
+		return nil, fmt.Errorf("Fail")
+	}
+	seriesPerMetric := i.seriesPerMetric
+	if seriesPerMetric == nil {
+		seriesPerMetric = map[string]uint64{"foo": 20, "bar": 10}
+	}
+	resp := &cortex.CardinalityResponse{
+		NumSeries:   30,
+		MetricNames: util.TopCardinalityStats(seriesPerMetric, int(in.Limit)),
+		LabelNames:  util.TopCardinalityStats(map[string]uint64{"instance": 20, "job": 2}, int(in.Limit)),
+	}
+	if len(in.Matchers) > 0 {
+		resp.MatchedSeries = 20
+	}
+	return resp, nil
+}
+
 func TestDistributorPush(t *testing.T) {
 	ctx := user.Inject(context.Background(), "user")
 	for i, tc := range []struct {
@@ -163,7 +202,7 @@ func TestDistributorPush(t *testing.T) {
 				ingesterClientFactory: func(addr string, _ time.Duration) (cortex.IngesterClient, error) {
 					return ingesters[addr], nil
 				},
-			}, ring)
+			}, ring, nil)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -193,6 +232,55 @@ func TestDistributorPush(t *testing.T) {
 	}
 }
 
+type mockDeletedTenants map[string]struct{}
+
+func (m mockDeletedTenants) IsDeleted(userID string) bool {
+	_, ok := m[userID]
+	return ok
+}
+
+func TestDistributorPushDeletedTenant(t *testing.T) {
+	ingesterDescs := []*ring.IngesterDesc{}
+	for i := 0; i < 3; i++ {
+		ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+			Addr:      fmt.Sprintf("%d", i),
+			Timestamp: time.Now().Unix(),
+		})
+	}
+	ring := mockRing{
+		Counter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "foo",
+		}),
+		ingesters: ingesterDescs,
+	}
+
+	d, err := New(Config{
+		ReplicationFactor:   3,
+		HeartbeatTimeout:    1 * time.Minute,
+		RemoteTimeout:       1 * time.Minute,
+		ClientCleanupPeriod: 1 * time.Minute,
+		IngestionRateLimit:  10000,
+		IngestionBurstSize:  10000,
+
+		ingesterClientFactory: func(addr string, _ time.Duration) (cortex.IngesterClient, error) {
+			return mockIngester{happy: true}, nil
+		},
+	}, ring, mockDeletedTenants{"deleted": {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	request := &cortex.WriteRequest{Timeseries: []cortex.TimeSeries{{
+		Labels:  []cortex.LabelPair{{Name: []byte("__name__"), Value: []byte("foo")}},
+		Samples: []cortex.Sample{{Value: 1, TimestampMs: 1}},
+	}}}
+	_, err = d.Push(user.Inject(context.Background(), "deleted"), request)
+	assert.Equal(t, util.ErrTenantDeleted, err)
+	_, err = d.Push(user.Inject(context.Background(), "user"), request)
+	assert.NoError(t, err)
+}
+
 func TestDistributorQuery(t *testing.T) {
 	ctx := user.Inject(context.Background(), "user")
 
@@ -288,19 +376,138 @@ func TestDistributorQuery(t *testing.T) {
 				ingesterClientFactory: func(addr string, _ time.Duration) (cortex.IngesterClient, error) {
 					return ingesters[addr], nil
 				},
-			}, ring)
+			}, ring, nil)
 			if err != nil {
 				t.Fatal(err)
 			}
 			defer d.Stop()
 
-			matcher, err := metric.NewLabelMatcher(metric.Equal, model.LabelName("__name__"), model.LabelValue("foo"))
-			if err != nil {
-				t.Fatal(err)
+			// Queries without a metric name are expanded to the names the
+			// ingesters know about.
+			for _, matchType := range []metric.MatchType{metric.Equal, metric.RegexMatch} {
+				matcher, err := metric.NewLabelMatcher(matchType, model.LabelName("__name__"), model.LabelValue("foo"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				response, err := d.Query(ctx, 0, 10, matcher)
+				assert.Equal(t, tc.expectedResponse, response, "Wrong response")
+				assert.Equal(t, tc.expectedError, err, "Wrong error")
 			}
-			response, err := d.Query(ctx, 0, 10, matcher)
-			assert.Equal(t, tc.expectedResponse, response, "Wrong response")
-			assert.Equal(t, tc.expectedError, err, "Wrong error")
 		})
 	}
 }
+
+func TestDistributorCardinalityHandler(t *testing.T) {
+	ingesterDescs := []*ring.IngesterDesc{}
+	for i := 0; i < 3; i++ {
+		ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+			Addr:      fmt.Sprintf("%d", i),
+			Timestamp: time.Now().Unix(),
+		})
+	}
+	ring := mockRing{
+		Counter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "foo",
+		}),
+		ingesters: ingesterDescs,
+	}
+
+	d, err := New(Config{
+		ReplicationFactor:   3,
+		HeartbeatTimeout:    1 * time.Minute,
+		RemoteTimeout:       1 * time.Minute,
+		ClientCleanupPeriod: 1 * time.Minute,
+		IngestionRateLimit:  10000,
+		IngestionBurstSize:  10000,
+
+		ingesterClientFactory: func(addr string, _ time.Duration) (cortex.IngesterClient, error) {
+			return mockIngester{happy: true}, nil
+		},
+	}, ring, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+
+	for _, tc := range []struct {
+		query    string
+		code     int
+		expected CardinalityStats
+	}{
+		{
+			query: "",
+			code:  http.StatusOK,
+			expected: CardinalityStats{
+				NumSeries:   30,
+				MetricNames: []CardinalityStat{{"foo", 20}, {"bar", 10}},
+				LabelNames:  []CardinalityStat{{"instance", 20}, {"job", 2}},
+			},
+		},
+		{
+			query: "?limit=1&selector=" + url.QueryEscape(`{__name__="foo"}`),
+			code:  http.StatusOK,
+			expected: CardinalityStats{
+				NumSeries:     30,
+				MatchedSeries: 20,
+				MetricNames:   []CardinalityStat{{"foo", 20}},
+				LabelNames:    []CardinalityStat{{"instance", 20}},
+			},
+		},
+		{query: "?limit=-1", code: http.StatusBadRequest},
+		{query: "?selector=" + url.QueryEscape("{"), code: http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest("GET", "/api/prom/cardinality"+tc.query, nil)
+		req = req.WithContext(user.Inject(req.Context(), "user"))
+		w := httptest.NewRecorder()
+		d.CardinalityHandler(w, req)
+		require.Equal(t, tc.code, w.Code, tc.query)
+		if tc.code != http.StatusOK {
+			continue
+		}
+		var stats CardinalityStats
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+		assert.Equal(t, tc.expected, stats, tc.query)
+	}
+}
+
+// A metric name in no ingester's own top limit can still have the most series
+// once they are summed.
+func TestDistributorCardinalityLimit(t *testing.T) {
+	ingesters := map[string]mockIngester{
+		"0": {happy: true, seriesPerMetric: map[string]uint64{"foo": 30, "bar": 27}},
+		"1": {happy: true, seriesPerMetric: map[string]uint64{"baz": 30, "bar": 27}},
+		"2": {happy: true, seriesPerMetric: map[string]uint64{"qux": 30, "bar": 27}},
+	}
+	ingesterDescs := []*ring.IngesterDesc{}
+	for addr := range ingesters {
+		ingesterDescs = append(ingesterDescs, &ring.IngesterDesc{
+			Addr:      addr,
+			Timestamp: time.Now().Unix(),
+		})
+	}
+	ring := mockRing{
+		Counter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "foo",
+		}),
+		ingesters: ingesterDescs,
+	}
+
+	d, err := New(Config{
+		ReplicationFactor:   3,
+		HeartbeatTimeout:    1 * time.Minute,
+		RemoteTimeout:       1 * time.Minute,
+		ClientCleanupPeriod: 1 * time.Minute,
+		IngestionRateLimit:  10000,
+		IngestionBurstSize:  10000,
+
+		ingesterClientFactory: func(addr string, _ time.Duration) (cortex.IngesterClient, error) {
+			return ingesters[addr], nil
+		},
+	}, ring, nil)
+	require.NoError(t, err)
+	defer d.Stop()
+
+	stats, err := d.Cardinality(user.Inject(context.Background(), "user"), 1, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []CardinalityStat{{"bar", 27}}, stats.MetricNames)
+}
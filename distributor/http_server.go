@@ -31,13 +31,23 @@ func (d *Distributor) PushHandler(w http.ResponseWriter, r *http.Request) {
 				err = util.ErrUserSeriesLimitExceeded
 			case util.ErrMetricSeriesLimitExceeded.Error():
 				err = util.ErrMetricSeriesLimitExceeded
+			case util.ErrUserMemoryLimitExceeded.Error():
+				err = util.ErrUserMemoryLimitExceeded
+			case util.ErrMemoryLimitExceeded.Error():
+				err = util.ErrMemoryLimitExceeded
 			}
+		} else if grpc.Code(err) == codes.PermissionDenied && grpc.ErrorDesc(err) == util.ErrTenantDeleted.Error() {
+			// The ingesters heard of the deletion first.
+			err = util.ErrTenantDeleted
 		}
 
 		var code int
 		switch err {
-		case errIngestionRateLimitExceeded, util.ErrUserSeriesLimitExceeded, util.ErrMetricSeriesLimitExceeded:
+		case errIngestionRateLimitExceeded, util.ErrUserSeriesLimitExceeded, util.ErrMetricSeriesLimitExceeded,
+			util.ErrUserMemoryLimitExceeded, util.ErrMemoryLimitExceeded:
 			code = http.StatusTooManyRequests
+		case util.ErrTenantDeleted:
+			code = http.StatusForbidden
 		default:
 			code = http.StatusInternalServerError
 		}
@@ -61,6 +71,7 @@ func (d *Distributor) PushHandler(w http.ResponseWriter, r *http.Request) {
 type UserStats struct {
 	IngestionRate float64 `json:"ingestionRate"`
 	NumSeries     uint64  `json:"numSeries"`
+	MemoryBytes   uint64  `json:"memoryBytes"`
 }
 
 // UserStatsHandler handles user stats to the Distributor.
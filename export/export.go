@@ -0,0 +1,421 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+// Config configures the Exporter.
+type Config struct {
+	UserID         string
+	Selectors      selectors
+	From, Through  util.DayValue
+	Window         time.Duration
+	FetchWindows   int
+	OutputDir      string
+	OutputPrefix   string
+	CheckpointFile string
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.UserID, "export.user", "", "The tenant whose data to export.")
+	f.Var(&cfg.Selectors, "export.selector", "Series selector, e.g. '{job=\"foo\"}', of the series to export; may be given more than once.  Defaults to every series.")
+	f.Var(&cfg.From, "export.from", "The first day (in the format YYYY-MM-DD) to export.")
+	f.Var(&cfg.Through, "export.through", "The day (in the format YYYY-MM-DD) to export up to, exclusive; defaults to now.")
+	f.DurationVar(&cfg.Window, "export.window", time.Hour, "Time range of each file.")
+	f.IntVar(&cfg.FetchWindows, "export.fetch-windows", 24, "Number of windows of a metric read at once; their samples are held in memory together.")
+	f.StringVar(&cfg.OutputDir, "export.output-dir", "", "Directory to write files to, if not writing to an object store.")
+	f.StringVar(&cfg.OutputPrefix, "export.output-prefix", "export/", "Prefix of the keys of files written to an object store.")
+	f.StringVar(&cfg.CheckpointFile, "export.checkpoint-file", "", "File recording the metrics exported so far, from which an interrupted export resumes.  If empty, there are no checkpoints.")
+}
+
+// selectors is a flag which may be given more than once.
+type selectors []string
+
+// String implements flag.Value
+func (s selectors) String() string {
+	return strings.Join(s, " ")
+}
+
+// Set implements flag.Value
+func (s *selectors) Set(v string) error {
+	if _, err := promql.ParseMetricSelector(v); err != nil {
+		return err
+	}
+	*s = append(*s, v)
+	return nil
+}
+
+// Querier reads the samples to export, e.g. a querier.MergeQuerier over the
+// ingesters and the chunk store.
+type Querier interface {
+	Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error)
+	LabelValuesInRange(ctx context.Context, from, through model.Time, name model.LabelName) (model.LabelValues, error)
+}
+
+// Index says whether the chunk index lists metric names, e.g. a chunk.Store.
+type Index interface {
+	MetricNamesIndexed(from, through model.Time) bool
+}
+
+// Exporter writes a tenant's series as OpenMetrics text, a file per metric
+// per window: <metric name>/<window start in Unix seconds>.om.  Each file is
+// a complete exposition, ending in "# EOF".
+//
+// Metrics are exported in name order, FetchWindows windows at a time, so only
+// those windows of a metric are in memory at once.  A metric is only recorded
+// in the checkpoint once all its windows are written; a metric interrupted
+// part way through is exported again.
+//
+// Metric names are those the ingesters and the chunk index list.  Chunk
+// tables with schemas before v7 don't list them, so exports of their ranges
+// must select series by metric name.  Prometheus TSDB blocks aren't written.
+type Exporter struct {
+	cfg     Config
+	querier Querier
+	index   Index
+	objects chunk.ObjectClient
+
+	series, samples, files int
+}
+
+// New makes a new Exporter.  Files are written to objects if it isn't nil,
+// and otherwise to the output directory.
+func New(cfg Config, querier Querier, index Index, objects chunk.ObjectClient) (*Exporter, error) {
+	if cfg.UserID == "" {
+		return nil, fmt.Errorf("no tenant to export")
+	}
+	if !cfg.From.IsSet() {
+		return nil, fmt.Errorf("no day to export from")
+	}
+	if cfg.Window <= 0 {
+		return nil, fmt.Errorf("export window must be positive")
+	}
+	if cfg.FetchWindows <= 0 {
+		return nil, fmt.Errorf("number of windows fetched at once must be positive")
+	}
+	if objects == nil && cfg.OutputDir == "" {
+		return nil, fmt.Errorf("no output directory")
+	}
+	return &Exporter{
+		cfg:     cfg,
+		querier: querier,
+		index:   index,
+		objects: objects,
+	}, nil
+}
+
+// exportCheckpoint is the contents of the checkpoint file.
+type exportCheckpoint struct {
+	UserID      string     `json:"user_id"`
+	Selectors   []string   `json:"selectors"`
+	From        model.Time `json:"from"`
+	Through     model.Time `json:"through"`
+	MetricNames []string   `json:"metric_names"`
+}
+
+// Run exports the series, resuming from the checkpoint file if there is one.
+func (e *Exporter) Run(ctx context.Context) error {
+	ctx = user.Inject(ctx, e.cfg.UserID)
+	through := model.Now()
+	if e.cfg.Through.IsSet() {
+		through = e.cfg.Through.Time
+	}
+	checkpoint := exportCheckpoint{
+		UserID:    e.cfg.UserID,
+		Selectors: []string(e.cfg.Selectors),
+		From:      e.cfg.From.Time,
+		Through:   through,
+	}
+	if err := e.loadCheckpoint(&checkpoint); err != nil {
+		return err
+	}
+	done := map[string]bool{}
+	for _, name := range checkpoint.MetricNames {
+		done[name] = true
+	}
+
+	matchersByName, err := e.metricNames(ctx, checkpoint.From, checkpoint.Through)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(matchersByName))
+	for name := range matchersByName {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if done[name] {
+			log.Infof("Skipping metric %s, already exported", name)
+			continue
+		}
+		if err := e.exportMetric(ctx, model.LabelValue(name), matchersByName[model.LabelValue(name)], checkpoint.From, checkpoint.Through); err != nil {
+			return fmt.Errorf("error exporting metric %s: %v", name, err)
+		}
+		checkpoint.MetricNames = append(checkpoint.MetricNames, name)
+		if err := e.saveCheckpoint(checkpoint); err != nil {
+			return err
+		}
+		log.Infof("Exported metric %s: %d series, %d samples in %d files so far", name, e.series, e.samples, e.files)
+	}
+	return nil
+}
+
+// metricNames returns the names of the metrics to export, with the matchers
+// of each selector choosing some of the metric's series.
+func (e *Exporter) metricNames(ctx context.Context, from, through model.Time) (map[model.LabelValue][][]*metric.LabelMatcher, error) {
+	selectors := e.cfg.Selectors
+	if len(selectors) == 0 {
+		selectors = []string{`{__name__=~".+"}`}
+	}
+
+	var allNames model.LabelValues
+	result := map[model.LabelValue][][]*metric.LabelMatcher{}
+	for _, selector := range selectors {
+		matchers, err := promql.ParseMetricSelector(selector)
+		if err != nil {
+			return nil, err
+		}
+		nameMatchers, matchers := util.SplitMetricNameMatchers(matchers)
+
+		var names model.LabelValues
+		if name, ok := util.EqualMetricName(nameMatchers); ok {
+			names, err = util.MatchingMetricNames(model.LabelValues{name}, nameMatchers, 0)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			if allNames == nil {
+				// The querier falls back to the names the ingesters know where
+				// the index doesn't list them, which would silently leave out
+				// the older series.
+				if !e.index.MetricNamesIndexed(from, through) {
+					return nil, fmt.Errorf("selector %s has no metric name, but the export's range uses a schema before v7 which doesn't list them", selector)
+				}
+				allNames, err = e.querier.LabelValuesInRange(ctx, from, through, model.MetricNameLabel)
+				if err != nil {
+					return nil, err
+				}
+			}
+			names, err = util.MatchingMetricNames(allNames, nameMatchers, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, name := range names {
+			result[name] = append(result[name], matchers)
+		}
+	}
+	return result, nil
+}
+
+// exportMetric writes a file for each window of the metric with samples.
+// The samples of FetchWindows windows are read at once, and split between
+// them.
+func (e *Exporter) exportMetric(ctx context.Context, name model.LabelValue, matcherSets [][]*metric.LabelMatcher, from, through model.Time) error {
+	fetchRange := e.cfg.Window * time.Duration(e.cfg.FetchWindows)
+	for fetchStart := from; fetchStart < through; fetchStart = fetchStart.Add(fetchRange) {
+		fetchEnd := fetchStart.Add(fetchRange)
+		if fetchEnd > through {
+			fetchEnd = through
+		}
+
+		// Series matched by several selectors are only written once.
+		series := map[model.Fingerprint]*model.SampleStream{}
+		for _, matchers := range matcherSets {
+			matrix, err := e.querier.Query(ctx, fetchStart, fetchEnd-1, append([]*metric.LabelMatcher{
+				{Type: metric.Equal, Name: model.MetricNameLabel, Value: name},
+			}, matchers...)...)
+			if err != nil {
+				return err
+			}
+			for _, ss := range matrix {
+				values := util.SamplesBetween(ss.Values, fetchStart, fetchEnd)
+				if len(values) == 0 {
+					continue
+				}
+				fp := ss.Metric.Fingerprint()
+				if existing, ok := series[fp]; ok {
+					existing.Values = util.MergeSamples(existing.Values, values)
+				} else {
+					series[fp] = &model.SampleStream{Metric: ss.Metric, Values: values}
+				}
+			}
+		}
+		if len(series) == 0 {
+			continue
+		}
+
+		matrix := make(model.Matrix, 0, len(series))
+		for _, ss := range series {
+			matrix = append(matrix, ss)
+		}
+		sort.Sort(byMetric(matrix))
+		for start := fetchStart; start < fetchEnd; start = start.Add(e.cfg.Window) {
+			if err := e.exportWindow(ctx, name, matrix, start, start.Add(e.cfg.Window)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exportWindow writes a file of the samples of the sorted series in
+// [start, end), if there are any.
+func (e *Exporter) exportWindow(ctx context.Context, name model.LabelValue, matrix model.Matrix, start, end model.Time) error {
+	window := make(model.Matrix, 0, len(matrix))
+	for _, ss := range matrix {
+		if values := util.SamplesBetween(ss.Values, start, end); len(values) > 0 {
+			window = append(window, &model.SampleStream{Metric: ss.Metric, Values: values})
+		}
+	}
+	if len(window) == 0 {
+		return nil
+	}
+
+	if err := e.write(ctx, fmt.Sprintf("%s/%d.om", name, start.Unix()), openMetrics(name, window)); err != nil {
+		return err
+	}
+	e.series += len(window)
+	for _, ss := range window {
+		e.samples += len(ss.Values)
+	}
+	e.files++
+	return nil
+}
+
+// write writes the file to the object store, or the output directory.
+func (e *Exporter) write(ctx context.Context, name string, buf []byte) error {
+	if e.objects != nil {
+		return e.objects.PutChunk(ctx, e.cfg.OutputPrefix+e.cfg.UserID+"/"+name, buf)
+	}
+	filename := filepath.Join(e.cfg.OutputDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// loadCheckpoint reads the metrics already exported from the checkpoint
+// file, if there is one.  The file's checkpoint must be of the same export.
+func (e *Exporter) loadCheckpoint(checkpoint *exportCheckpoint) error {
+	if e.cfg.CheckpointFile == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(e.cfg.CheckpointFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var saved exportCheckpoint
+	if err := json.Unmarshal(buf, &saved); err != nil {
+		return fmt.Errorf("error parsing checkpoint %s: %v", e.cfg.CheckpointFile, err)
+	}
+	// Without -export.through, the checkpoint's end is used.
+	if !e.cfg.Through.IsSet() {
+		checkpoint.Through = saved.Through
+	}
+	if saved.UserID != checkpoint.UserID || strings.Join(saved.Selectors, " ") != strings.Join(checkpoint.Selectors, " ") ||
+		saved.From != checkpoint.From || saved.Through != checkpoint.Through {
+		return fmt.Errorf("checkpoint %s is of a different export: tenant %q, selectors %v, from %v through %v", e.cfg.CheckpointFile, saved.UserID, saved.Selectors, saved.From, saved.Through)
+	}
+	checkpoint.MetricNames = saved.MetricNames
+	return nil
+}
+
+// saveCheckpoint replaces the checkpoint file, so it is never left half written.
+func (e *Exporter) saveCheckpoint(checkpoint exportCheckpoint) error {
+	if e.cfg.CheckpointFile == "" {
+		return nil
+	}
+	buf, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	tmp := e.cfg.CheckpointFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.cfg.CheckpointFile)
+}
+
+// openMetrics formats the series of a metric as an OpenMetrics exposition.
+// Cortex doesn't know the metric's type, so it is unknown.
+func openMetrics(name model.LabelValue, matrix model.Matrix) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# TYPE %s unknown\n", name)
+	for _, ss := range matrix {
+		labels := openMetricsLabels(ss.Metric)
+		for _, s := range ss.Values {
+			fmt.Fprintf(&buf, "%s%s %s %s\n", name, labels, openMetricsValue(float64(s.Value)), s.Timestamp)
+		}
+	}
+	buf.WriteString("# EOF\n")
+	return buf.Bytes()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func openMetricsLabels(m model.Metric) string {
+	names := make(model.LabelNames, 0, len(m))
+	for name := range m {
+		if name != model.MetricNameLabel {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Sort(names)
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(string(m[name]))))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func openMetricsValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type byMetric model.Matrix
+
+func (m byMetric) Len() int           { return len(m) }
+func (m byMetric) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byMetric) Less(i, j int) bool { return m[i].Metric.Before(m[j].Metric) }
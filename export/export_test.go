@@ -0,0 +1,173 @@
+package export
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// mockQuerier is both the Querier and the Index.  If unindexed, the index
+// behaves like one whose schema doesn't list metric names.
+type mockQuerier struct {
+	matrix    model.Matrix
+	queries   int
+	unindexed bool
+}
+
+func (m *mockQuerier) Query(_ context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	m.queries++
+	result := model.Matrix{}
+outer:
+	for _, ss := range m.matrix {
+		for _, matcher := range matchers {
+			if !matcher.Match(ss.Metric[matcher.Name]) {
+				continue outer
+			}
+		}
+		values := []model.SamplePair{}
+		for _, s := range ss.Values {
+			if from <= s.Timestamp && s.Timestamp <= to {
+				values = append(values, s)
+			}
+		}
+		result = append(result, &model.SampleStream{Metric: ss.Metric, Values: values})
+	}
+	return result, nil
+}
+
+func (m *mockQuerier) LabelValuesInRange(_ context.Context, _, _ model.Time, name model.LabelName) (model.LabelValues, error) {
+	set := map[model.LabelValue]struct{}{}
+	for _, ss := range m.matrix {
+		set[ss.Metric[name]] = struct{}{}
+	}
+	result := model.LabelValues{}
+	for v := range set {
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+func (m *mockQuerier) MetricNamesIndexed(from, through model.Time) bool {
+	return !m.unindexed
+}
+
+func TestExporter(t *testing.T) {
+	hour := model.TimeFromUnix(3600)
+	querier := &mockQuerier{matrix: model.Matrix{
+		{
+			Metric: model.Metric{model.MetricNameLabel: "foo", "job": "a", "path": "/\"x\"\n"},
+			Values: []model.SamplePair{{Timestamp: 0, Value: 1}, {Timestamp: 1500, Value: 2.5}, {Timestamp: hour, Value: model.SampleValue(math.Inf(1))}},
+		},
+		{
+			Metric: model.Metric{model.MetricNameLabel: "foo", "job": "b"},
+			Values: []model.SamplePair{{Timestamp: 1000, Value: 3}},
+		},
+		{
+			Metric: model.Metric{model.MetricNameLabel: "bar"},
+			Values: []model.SamplePair{{Timestamp: 2000, Value: 4}},
+		},
+		{
+			Metric: model.Metric{model.MetricNameLabel: "baz"},
+			Values: []model.SamplePair{{Timestamp: 3000, Value: 5}},
+		},
+	}}
+
+	dir, err := ioutil.TempDir("", "export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cfg := Config{
+		UserID:         "1",
+		From:           util.NewDayValue(0),
+		Through:        util.NewDayValue(model.TimeFromUnix(24 * 3600)),
+		Window:         time.Hour,
+		FetchWindows:   24,
+		OutputDir:      filepath.Join(dir, "out"),
+		CheckpointFile: filepath.Join(dir, "checkpoint"),
+	}
+	// Overlapping selectors export each series once.
+	require.NoError(t, cfg.Selectors.Set(`{__name__=~"fo.*"}`))
+	require.NoError(t, cfg.Selectors.Set(`foo{job="a"}`))
+	require.NoError(t, cfg.Selectors.Set(`bar`))
+	exporter, err := New(cfg, querier, querier, nil)
+	require.NoError(t, err)
+	require.NoError(t, exporter.Run(context.Background()))
+	// The day is read at once, for each metric and selector.
+	assert.Equal(t, 3, querier.queries)
+
+	read := func(name string) string {
+		buf, err := ioutil.ReadFile(filepath.Join(dir, "out", name))
+		require.NoError(t, err)
+		return string(buf)
+	}
+	assert.Equal(t, `# TYPE foo unknown
+foo{job="b"} 3 1
+foo{job="a",path="/\"x\"\n"} 1 0
+foo{job="a",path="/\"x\"\n"} 2.5 1.5
+# EOF
+`, read("foo/0.om"))
+	assert.Equal(t, `# TYPE foo unknown
+foo{job="a",path="/\"x\"\n"} +Inf 3600
+# EOF
+`, read("foo/3600.om"))
+	assert.Equal(t, "# TYPE bar unknown\nbar 4 2\n# EOF\n", read("bar/0.om"))
+	_, err = os.Stat(filepath.Join(dir, "out", "baz"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Resuming a finished export reads nothing.
+	querier.queries = 0
+	exporter, err = New(cfg, querier, querier, nil)
+	require.NoError(t, err)
+	require.NoError(t, exporter.Run(context.Background()))
+	assert.Equal(t, 0, querier.queries)
+
+	// Nor can the checkpoint be used for another export.
+	cfg.Selectors = nil
+	exporter, err = New(cfg, querier, querier, nil)
+	require.NoError(t, err)
+	assert.Error(t, exporter.Run(context.Background()))
+}
+
+func TestExporterUnindexedMetricNames(t *testing.T) {
+	querier := &mockQuerier{
+		matrix: model.Matrix{{
+			Metric: model.Metric{model.MetricNameLabel: "foo"},
+			Values: []model.SamplePair{{Timestamp: 0, Value: 1}},
+		}},
+		unindexed: true,
+	}
+	dir, err := ioutil.TempDir("", "export")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cfg := Config{
+		UserID:       "1",
+		From:         util.NewDayValue(0),
+		Through:      util.NewDayValue(model.TimeFromUnix(24 * 3600)),
+		Window:       time.Hour,
+		FetchWindows: 24,
+		OutputDir:    dir,
+	}
+
+	// Without a metric name, the export fails rather than leaving out series.
+	exporter, err := New(cfg, querier, querier, nil)
+	require.NoError(t, err)
+	assert.Error(t, exporter.Run(context.Background()))
+	assert.Equal(t, 0, querier.queries)
+
+	require.NoError(t, cfg.Selectors.Set(`foo`))
+	exporter, err = New(cfg, querier, querier, nil)
+	require.NoError(t, err)
+	require.NoError(t, exporter.Run(context.Background()))
+	_, err = os.Stat(filepath.Join(dir, "foo", "0.om"))
+	assert.NoError(t, err)
+}
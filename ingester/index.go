@@ -8,59 +8,153 @@ import (
 	"github.com/prometheus/prometheus/storage/metric"
 )
 
+// indexShards is the number of independently locked shards each user's
+// inverted index is split into.  Series are assigned to shards by fingerprint.
+const indexShards = 32
+
+// invertedIndex maps interned label names and values to the sorted
+// fingerprints of the series that have them.
 type invertedIndex struct {
+	shards  [indexShards]indexShard
+	symbols *symbolTable
+}
+
+type indexShard struct {
 	mtx sync.RWMutex
-	idx map[model.LabelName]map[model.LabelValue][]model.Fingerprint // entries are sorted in fp order?
+	idx map[uint32]map[uint32][]model.Fingerprint // entries are sorted in fp order
+	pad [cacheLineSize]byte
 }
 
-func newInvertedIndex() *invertedIndex {
-	return &invertedIndex{
-		idx: map[model.LabelName]map[model.LabelValue][]model.Fingerprint{},
+func newInvertedIndex(symbols *symbolTable) *invertedIndex {
+	i := &invertedIndex{
+		symbols: symbols,
 	}
+	for j := range i.shards {
+		i.shards[j].idx = map[uint32]map[uint32][]model.Fingerprint{}
+	}
+	return i
+}
+
+func (i *invertedIndex) shardFor(fp model.Fingerprint) *indexShard {
+	return &i.shards[uint64(fp)%indexShards]
 }
 
-func (i *invertedIndex) add(metric model.Metric, fp model.Fingerprint) {
-	i.mtx.Lock()
-	defer i.mtx.Unlock()
+func (i *invertedIndex) add(ls labelSet, fp model.Fingerprint) {
+	shard := i.shardFor(fp)
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
 
-	for name, value := range metric {
-		values, ok := i.idx[name]
+	for _, l := range ls {
+		values, ok := shard.idx[l.name]
 		if !ok {
-			values = map[model.LabelValue][]model.Fingerprint{}
+			values = map[uint32][]model.Fingerprint{}
 		}
-		fingerprints := values[value]
+		fingerprints := values[l.value]
 		j := sort.Search(len(fingerprints), func(i int) bool {
 			return fingerprints[i] >= fp
 		})
 		fingerprints = append(fingerprints, 0)
 		copy(fingerprints[j+1:], fingerprints[j:])
 		fingerprints[j] = fp
-		values[value] = fingerprints
-		i.idx[name] = values
+		values[l.value] = fingerprints
+		shard.idx[l.name] = values
 	}
 }
 
+// lookup returns the sorted fingerprints of all series matching all of the
+// matchers.  Matchers which don't match the empty string select the series
+// with a matching value; the others are applied by removing the series with
+// a non-matching value, starting from all series if there are no matchers of
+// the first kind.
 func (i *invertedIndex) lookup(matchers []*metric.LabelMatcher) []model.Fingerprint {
 	if len(matchers) == 0 {
 		return nil
 	}
-	i.mtx.RLock()
-	defer i.mtx.RUnlock()
 
-	// intersection is initially nil, which is a special case.
-	var intersection []model.Fingerprint
+	var positive, negative []*metric.LabelMatcher
+	for _, matcher := range matchers {
+		if matcher.Match("") {
+			negative = append(negative, matcher)
+		} else {
+			positive = append(positive, matcher)
+		}
+	}
+
+	var (
+		nameIDs = map[model.LabelName]uint32{}
+		vms     = make(map[*metric.LabelMatcher]*valueMatcher, len(matchers))
+	)
 	for _, matcher := range matchers {
-		values, ok := i.idx[matcher.Name]
+		id, ok := i.symbols.lookup(string(matcher.Name))
+		if !ok {
+			if !matcher.Match("") {
+				// No series has this label, so no series can match.
+				return nil
+			}
+			// No series has this label, so every series matches.
+			continue
+		}
+		nameIDs[matcher.Name] = id
+		vms[matcher] = newValueMatcher(matcher)
+	}
+	if len(positive) == 0 {
+		// Every series has a metric name, so this selects all of them.
+		id, ok := i.symbols.lookup(string(model.MetricNameLabel))
 		if !ok {
 			return nil
 		}
-		var toIntersect []model.Fingerprint
-		for value, fps := range values {
-			if matcher.Match(value) {
-				toIntersect = merge(toIntersect, fps)
+		nameIDs[model.MetricNameLabel] = id
+	}
+
+	var result []model.Fingerprint
+	for j := range i.shards {
+		result = merge(result, i.shards[j].lookup(i.symbols, positive, negative, nameIDs, vms))
+	}
+	return result
+}
+
+func (s *indexShard) lookup(symbols *symbolTable, positive, negative []*metric.LabelMatcher, nameIDs map[model.LabelName]uint32, vms map[*metric.LabelMatcher]*valueMatcher) []model.Fingerprint {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	// intersection is initially nil, which is a special case.
+	var intersection []model.Fingerprint
+	for _, matcher := range positive {
+		postings := s.postings(symbols, nameIDs[matcher.Name], vms[matcher])
+		if matcher.Type == metric.NotEqual || matcher.Type == metric.RegexNoMatch {
+			// A negated matcher which doesn't match the empty string, e.g.
+			// `foo!=""`, selects the series with the label which fail its
+			// positive form.
+			postings = subtract(s.allPostings(nameIDs[matcher.Name]), postings)
+		}
+		intersection = intersect(intersection, postings)
+		if len(intersection) == 0 {
+			return nil
+		}
+	}
+
+	if len(positive) == 0 {
+		intersection = s.allPostings(nameIDs[model.MetricNameLabel])
+	}
+
+	for _, matcher := range negative {
+		vm, ok := vms[matcher]
+		if !ok {
+			continue
+		}
+		var toSubtract []model.Fingerprint
+		if matcher.Type == metric.NotEqual || matcher.Type == metric.RegexNoMatch {
+			// The series failing a negative matcher are those matching its
+			// positive form.
+			toSubtract = s.postings(symbols, nameIDs[matcher.Name], vm)
+		} else {
+			for value, fps := range s.idx[nameIDs[matcher.Name]] {
+				if !matcher.Match(model.LabelValue(symbols.get(value))) {
+					toSubtract = merge(toSubtract, fps)
+				}
 			}
 		}
-		intersection = intersect(intersection, toIntersect)
+		intersection = subtract(intersection, toSubtract)
 		if len(intersection) == 0 {
 			return nil
 		}
@@ -69,31 +163,148 @@ func (i *invertedIndex) lookup(matchers []*metric.LabelMatcher) []model.Fingerpr
 	return intersection
 }
 
-func (i *invertedIndex) lookupLabelValues(name model.LabelName) model.LabelValues {
-	i.mtx.RLock()
-	defer i.mtx.RUnlock()
+// allPostings returns all the series in this shard with the named label.
+// The caller must hold s.mtx.
+func (s *indexShard) allPostings(name uint32) []model.Fingerprint {
+	var result []model.Fingerprint
+	for _, fps := range s.idx[name] {
+		result = merge(result, fps)
+	}
+	return result
+}
+
+// postings returns the sorted fingerprints of the series with a value for
+// the label name which is selected by vm.  Literal values are looked up
+// directly; everything else requires a scan of the label's values.
+func (s *indexShard) postings(symbols *symbolTable, name uint32, vm *valueMatcher) []model.Fingerprint {
+	values, ok := s.idx[name]
+	if !ok {
+		return nil
+	}
+
+	var result []model.Fingerprint
+	if vm.literals != nil {
+		for _, literal := range vm.literals {
+			id, ok := symbols.lookup(literal)
+			if !ok {
+				continue
+			}
+			result = merge(result, values[id])
+		}
+		return result
+	}
+
+	for value, fps := range values {
+		if vm.matches(symbols.get(value)) {
+			result = merge(result, fps)
+		}
+	}
+	return result
+}
+
+// seriesPerValue returns the number of series with each value of the named
+// label.
+func (i *invertedIndex) seriesPerValue(name model.LabelName) map[string]uint64 {
+	nameID, ok := i.symbols.lookup(string(name))
+	if !ok {
+		return nil
+	}
+
+	counts := map[uint32]uint64{}
+	for j := range i.shards {
+		shard := &i.shards[j]
+		shard.mtx.RLock()
+		for val, fps := range shard.idx[nameID] {
+			counts[val] += uint64(len(fps))
+		}
+		shard.mtx.RUnlock()
+	}
+
+	res := make(map[string]uint64, len(counts))
+	for val, count := range counts {
+		res[i.symbols.get(val)] = count
+	}
+	return res
+}
+
+// valuesPerName returns the number of distinct values of each label name.
+func (i *invertedIndex) valuesPerName() map[string]uint64 {
+	seen := map[uint32]map[uint32]struct{}{}
+	for j := range i.shards {
+		shard := &i.shards[j]
+		shard.mtx.RLock()
+		for name, values := range shard.idx {
+			nameSeen, ok := seen[name]
+			if !ok {
+				nameSeen = make(map[uint32]struct{}, len(values))
+				seen[name] = nameSeen
+			}
+			for val := range values {
+				nameSeen[val] = struct{}{}
+			}
+		}
+		shard.mtx.RUnlock()
+	}
 
-	values, ok := i.idx[name]
+	res := make(map[string]uint64, len(seen))
+	for name, values := range seen {
+		res[i.symbols.get(name)] = uint64(len(values))
+	}
+	return res
+}
+
+func (i *invertedIndex) lookupLabelValues(name model.LabelName) model.LabelValues {
+	nameID, ok := i.symbols.lookup(string(name))
 	if !ok {
 		return nil
 	}
-	res := make(model.LabelValues, 0, len(values))
-	for val := range values {
-		res = append(res, val)
+
+	seen := map[uint32]struct{}{}
+	for j := range i.shards {
+		shard := &i.shards[j]
+		shard.mtx.RLock()
+		for val := range shard.idx[nameID] {
+			seen[val] = struct{}{}
+		}
+		shard.mtx.RUnlock()
+	}
+
+	res := make(model.LabelValues, 0, len(seen))
+	for val := range seen {
+		res = append(res, model.LabelValue(i.symbols.get(val)))
+	}
+	return res
+}
+
+func (i *invertedIndex) lookupLabelNames() model.LabelNames {
+	seen := map[uint32]struct{}{}
+	for j := range i.shards {
+		shard := &i.shards[j]
+		shard.mtx.RLock()
+		for name := range shard.idx {
+			seen[name] = struct{}{}
+		}
+		shard.mtx.RUnlock()
+	}
+
+	res := make(model.LabelNames, 0, len(seen))
+	for name := range seen {
+		res = append(res, model.LabelName(i.symbols.get(name)))
 	}
 	return res
 }
 
-func (i *invertedIndex) delete(metric model.Metric, fp model.Fingerprint) {
-	i.mtx.Lock()
-	defer i.mtx.Unlock()
+func (i *invertedIndex) delete(ls labelSet, fp model.Fingerprint) {
+	shard := i.shardFor(fp)
+	shard.mtx.Lock()
+	defer shard.mtx.Unlock()
 
-	for name, value := range metric {
-		values, ok := i.idx[name]
+	for _, l := range ls {
+		values, ok := shard.idx[l.name]
 		if !ok {
 			continue
 		}
-		fingerprints, ok := values[value]
+		fingerprints, ok := values[l.value]
 		if !ok {
 			continue
 		}
@@ -104,15 +315,15 @@ func (i *invertedIndex) delete(metric model.Metric, fp model.Fingerprint) {
 		fingerprints = fingerprints[:j+copy(fingerprints[j:], fingerprints[j+1:])]
 
 		if len(fingerprints) == 0 {
-			delete(values, value)
+			delete(values, l.value)
 		} else {
-			values[value] = fingerprints
+			values[l.value] = fingerprints
 		}
 
 		if len(values) == 0 {
-			delete(i.idx, name)
+			delete(shard.idx, l.name)
 		} else {
-			i.idx[name] = values
+			shard.idx[l.name] = values
 		}
 	}
 }
@@ -159,3 +370,19 @@ func merge(a, b []model.Fingerprint) []model.Fingerprint {
 	}
 	return result
 }
+
+// subtract removes the fingerprints in b from a.  Both lists must be sorted.
+func subtract(a, b []model.Fingerprint) []model.Fingerprint {
+	result := make([]model.Fingerprint, 0, len(a))
+	j := 0
+	for _, fp := range a {
+		for j < len(b) && b[j] < fp {
+			j++
+		}
+		if j < len(b) && b[j] == fp {
+			continue
+		}
+		result = append(result, fp)
+	}
+	return result
+}
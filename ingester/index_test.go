@@ -0,0 +1,108 @@
+package ingester
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexLookup(t *testing.T) {
+	symbols := newSymbolTable()
+	index := newInvertedIndex(symbols)
+
+	metrics := map[model.Fingerprint]model.Metric{}
+	for i, job := range []string{"a", "b", "c", "foo", "foobar", "bar"} {
+		for j := 0; j < 10; j++ {
+			m := model.Metric{
+				model.MetricNameLabel: "up",
+				"job":                 model.LabelValue(job),
+				"instance":            model.LabelValue(fmt.Sprintf("instance%d", j)),
+			}
+			if j%2 == 0 {
+				m["env"] = "prod"
+			}
+			fp := model.Fingerprint(i*100 + j)
+			ls, _ := symbols.internMetric(m)
+			index.add(ls, fp)
+			metrics[fp] = m
+		}
+	}
+
+	for _, tc := range []struct {
+		matchers []*metric.LabelMatcher
+		expected int
+	}{
+		{matchers(t, metric.Equal, "job", "a"), 10},
+		{matchers(t, metric.Equal, "job", "missing"), 0},
+		{matchers(t, metric.Equal, "missing", "a"), 0},
+		{matchers(t, metric.RegexMatch, "job", "a|b|c"), 30},
+		{matchers(t, metric.RegexMatch, "job", "foo|foobar"), 20},
+		{matchers(t, metric.RegexMatch, "job", "foo.*"), 20},
+		{matchers(t, metric.RegexMatch, "job", "fo+"), 10},
+		{matchers(t, metric.RegexMatch, "job", ".+"), 60},
+		{matchers(t, metric.NotEqual, "job", "a"), 50},
+		{matchers(t, metric.RegexNoMatch, "job", "a|b"), 40},
+		{matchers(t, metric.RegexNoMatch, "job", "f.*"), 40},
+		{matchers(t, metric.NotEqual, "env", "prod"), 30},
+		{matchers(t, metric.Equal, "env", ""), 30},
+		{matchers(t, metric.NotEqual, "missing", "x"), 60},
+		{matchers(t, metric.NotEqual, "env", ""), 30},
+		{matchers(t, metric.RegexNoMatch, "env", "|dev"), 30},
+		{matchers(t, metric.RegexNoMatch, "env", "prod|"), 0},
+		{matchers(t, metric.RegexNoMatch, "job", ".*"), 0},
+		{append(matchers(t, metric.RegexMatch, "job", "a|b"), matchers(t, metric.NotEqual, "env", "prod")...), 10},
+		{append(matchers(t, metric.Equal, "instance", "instance1"), matchers(t, metric.RegexNoMatch, "job", "foo.*")...), 4},
+	} {
+		var expected []model.Fingerprint
+		for fp, m := range metrics {
+			matches := true
+			for _, matcher := range tc.matchers {
+				matches = matches && matcher.Match(m[matcher.Name])
+			}
+			if matches {
+				expected = append(expected, fp)
+			}
+		}
+		sort.Sort(model.Fingerprints(expected))
+
+		actual := index.lookup(tc.matchers)
+		assert.Equal(t, tc.expected, len(actual), "%v", tc.matchers)
+		if len(expected) > 0 {
+			assert.Equal(t, expected, actual, "%v", tc.matchers)
+		}
+	}
+}
+
+func TestValueMatcher(t *testing.T) {
+	for _, tc := range []struct {
+		regex    string
+		literals []string
+		prefixes []string
+	}{
+		{"foo", []string{"foo"}, nil},
+		{"a|b|c", []string{"a", "b", "c"}, nil},
+		{"foo|foobar", []string{"foo", "foobar"}, nil},
+		{"(prod|dev)-api", []string{"prod-api", "dev-api"}, nil},
+		{"foo.*", nil, []string{"foo"}},
+		{"(foo|bar).*", nil, []string{"foo", "bar"}},
+		{"fo+", nil, nil},
+		{"(?i)foo", nil, nil},
+	} {
+		m, err := metric.NewLabelMatcher(metric.RegexMatch, "job", model.LabelValue(tc.regex))
+		require.NoError(t, err)
+		vm := newValueMatcher(m)
+		assert.Equal(t, tc.literals, vm.literals, tc.regex)
+		assert.Equal(t, tc.prefixes, vm.prefixes, tc.regex)
+	}
+}
+
+func matchers(t *testing.T, matchType metric.MatchType, name model.LabelName, value model.LabelValue) []*metric.LabelMatcher {
+	m, err := metric.NewLabelMatcher(matchType, name, value)
+	require.NoError(t, err)
+	return []*metric.LabelMatcher{m}
+}
@@ -52,6 +52,11 @@ var (
 		"The current number of users in memory.",
 		nil, nil,
 	)
+	memoryBytesDesc = prometheus.NewDesc(
+		"cortex_ingester_memory_bytes",
+		"The approximate number of bytes used by series, index and chunks in memory.",
+		nil, nil,
+	)
 	flushQueueLengthDesc = prometheus.NewDesc(
 		"cortex_ingester_flush_queue_length",
 		"The total number of series pending in the flush queue.",
@@ -88,6 +93,11 @@ type Config struct {
 	ConcurrentFlushes int
 	ChunkEncoding     string
 
+	// Only the replica owning the primary token for a series flushes it
+	// straight away; the others wait FlushLeaderTimeout for it to do so.
+	FlushLeader        bool
+	FlushLeaderTimeout time.Duration
+
 	// For testing, you can override the address and ID of this ingester
 	addr                  string
 	id                    string
@@ -111,6 +121,8 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	f.DurationVar(&cfg.MaxChunkAge, "ingester.max-chunk-age", 12*time.Hour, "Maximum chunk age time before flushing.")
 	f.IntVar(&cfg.ConcurrentFlushes, "ingester.concurrent-flushes", DefaultConcurrentFlush, "Number of concurrent goroutines flushing to dynamodb.")
 	f.StringVar(&cfg.ChunkEncoding, "ingester.chunk-encoding", "1", "Encoding version to use for chunks.")
+	f.BoolVar(&cfg.FlushLeader, "ingester.flush-leader", false, "Only flush series this ingester holds the primary replica of straight away; flush others after -ingester.flush-leader-timeout. Use with -memcache.write-dedupe.")
+	f.DurationVar(&cfg.FlushLeaderTimeout, "ingester.flush-leader-timeout", 10*time.Minute, "How long to wait for the primary replica to flush a series before flushing it ourselves.")
 
 	addr, err := util.GetFirstAddressOf(infName)
 	if err != nil {
@@ -135,6 +147,9 @@ type Ingester struct {
 
 	userStatesMtx sync.RWMutex
 	userStates    *userStates
+	// Users deleted since starting, whose samples are refused until their
+	// purge is done.  Guarded by userStatesMtx.
+	deletedUsers map[string]struct{}
 
 	// These values are initialised at startup, and never change
 	id   string
@@ -152,6 +167,10 @@ type Ingester struct {
 	state  ring.IngesterState
 	tokens []uint32
 
+	// The ring as of our last heartbeat, for picking flush leaders.
+	ringDescMtx sync.RWMutex
+	ringDesc    *ring.Desc
+
 	// Controls the ready-reporting
 	readyLock sync.Mutex
 	startTime time.Time
@@ -213,10 +232,11 @@ func New(cfg Config, chunkStore ChunkStore) (*Ingester, error) {
 	}
 
 	i := &Ingester{
-		cfg:        cfg,
-		consul:     consul,
-		chunkStore: chunkStore,
-		userStates: newUserStates(&cfg.userStatesConfig),
+		cfg:          cfg,
+		consul:       consul,
+		chunkStore:   chunkStore,
+		userStates:   newUserStates(&cfg.userStatesConfig),
+		deletedUsers: map[string]struct{}{},
 
 		addr: fmt.Sprintf("%s:%d", cfg.addr, *cfg.ListenPort),
 		id:   cfg.id,
@@ -279,9 +299,15 @@ func (i *Ingester) Push(ctx context.Context, req *cortex.WriteRequest) (*cortex.
 	samples := util.FromWriteRequest(req)
 	for j := range samples {
 		if err := i.append(ctx, &samples[j]); err != nil {
-			if err == util.ErrUserSeriesLimitExceeded || err == util.ErrMetricSeriesLimitExceeded {
-				lastPartialErr = grpc.Errorf(codes.ResourceExhausted, err.Error())
+			switch err {
+			case util.ErrUserSeriesLimitExceeded, util.ErrMetricSeriesLimitExceeded:
+				lastPartialErr = grpc.Errorf(codes.ResourceExhausted, "%s", err.Error())
 				continue
+			case util.ErrUserMemoryLimitExceeded, util.ErrMemoryLimitExceeded:
+				// Every further sample would be rejected too.
+				return nil, grpc.Errorf(codes.ResourceExhausted, "%s", err.Error())
+			case util.ErrTenantDeleted:
+				return nil, grpc.Errorf(codes.PermissionDenied, "%s", err.Error())
 			}
 			return nil, err
 		}
@@ -311,6 +337,11 @@ func (i *Ingester) append(ctx context.Context, sample *model.Sample) error {
 
 	i.userStatesMtx.RLock()
 	defer i.userStatesMtx.RUnlock()
+	if userID, err := user.Extract(ctx); err == nil {
+		if _, ok := i.deletedUsers[userID]; ok {
+			return util.ErrTenantDeleted
+		}
+	}
 	state, fp, series, err := i.userStates.getOrCreateSeries(ctx, sample.Metric)
 	if err != nil {
 		return err
@@ -328,12 +359,53 @@ func (i *Ingester) append(ctx context.Context, sample *model.Sample) error {
 	}
 
 	i.memoryChunks.Add(float64(len(series.chunkDescs) - prevNumChunks))
+	state.addMemory(int64(len(series.chunkDescs)-prevNumChunks) * chunkBytes)
 	i.ingestedSamples.Inc()
 	state.ingestedSamples.inc()
 
 	return err
 }
 
+func (i *Ingester) isDeleted(userID string) bool {
+	i.userStatesMtx.RLock()
+	defer i.userStatesMtx.RUnlock()
+	_, ok := i.deletedUsers[userID]
+	return ok
+}
+
+// DeleteUser drops the series of a deleted user, without flushing them, and
+// refuses its samples from then on.
+func (i *Ingester) DeleteUser(userID string) {
+	i.userStatesMtx.Lock()
+	i.deletedUsers[userID] = struct{}{}
+	state, ok := i.userStates.delete(userID)
+	i.userStatesMtx.Unlock()
+	if !ok {
+		return
+	}
+
+	// Flushes of the user's series that started before it was deleted finish
+	// while their series are locked; later ones find the user gone.
+	series, chunks := 0, 0
+	for pair := range state.fpToSeries.iter() {
+		state.fpLocker.Lock(pair.fp)
+		series++
+		chunks += len(pair.series.chunkDescs)
+		state.fpLocker.Unlock(pair.fp)
+	}
+	i.memoryChunks.Sub(float64(chunks))
+	state.addMemory(-state.memory.get())
+	log.Infof("Dropped %d series and %d chunks of deleted user %s", series, chunks, userID)
+}
+
+// ForgetDeletedUser stops refusing the samples of a deleted user, once its
+// purge is done; by then, the distributors refuse them.
+func (i *Ingester) ForgetDeletedUser(userID string) {
+	i.userStatesMtx.Lock()
+	delete(i.deletedUsers, userID)
+	i.userStatesMtx.Unlock()
+}
+
 // Query implements service.IngesterServer
 func (i *Ingester) Query(ctx context.Context, req *cortex.QueryRequest) (*cortex.QueryResponse, error) {
 	start, end, matchers, err := util.FromQueryRequest(req)
@@ -368,7 +440,7 @@ func (i *Ingester) query(ctx context.Context, from, through model.Time, matchers
 		}
 
 		result = append(result, &model.SampleStream{
-			Metric: series.metric,
+			Metric: state.symbols.toMetric(series.labels),
 			Values: values,
 		})
 		queriedSamples += len(values)
@@ -387,14 +459,48 @@ func (i *Ingester) LabelValues(ctx context.Context, req *cortex.LabelValuesReque
 		return nil, err
 	}
 
+	var values model.LabelValues
+	if req.StartTimestampMs == 0 && req.EndTimestampMs == 0 {
+		values = state.index.lookupLabelValues(model.LabelName(req.LabelName))
+	} else {
+		values, err = state.labelValuesInRange(model.LabelName(req.LabelName), model.Time(req.StartTimestampMs), model.Time(req.EndTimestampMs))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	resp := &cortex.LabelValuesResponse{}
-	for _, v := range state.index.lookupLabelValues(model.LabelName(req.LabelName)) {
+	for _, v := range values {
 		resp.LabelValues = append(resp.LabelValues, string(v))
 	}
 
 	return resp, nil
 }
 
+// LabelNames returns all the label names of series for the current user.
+func (i *Ingester) LabelNames(ctx context.Context, req *cortex.LabelNamesRequest) (*cortex.LabelNamesResponse, error) {
+	i.userStatesMtx.RLock()
+	defer i.userStatesMtx.RUnlock()
+	state, err := i.userStates.getOrCreate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var names model.LabelNames
+	if req.StartTimestampMs == 0 && req.EndTimestampMs == 0 {
+		names = state.index.lookupLabelNames()
+	} else {
+		names = state.labelNamesInRange(model.Time(req.StartTimestampMs), model.Time(req.EndTimestampMs))
+	}
+
+	resp := &cortex.LabelNamesResponse{}
+	for _, n := range names {
+		resp.LabelNames = append(resp.LabelNames, string(n))
+	}
+
+	return resp, nil
+}
+
 // MetricsForLabelMatchers returns all the metrics which match a set of matchers.
 func (i *Ingester) MetricsForLabelMatchers(ctx context.Context, req *cortex.MetricsForLabelMatchersRequest) (*cortex.MetricsForLabelMatchersResponse, error) {
 	i.userStatesMtx.RLock()
@@ -414,7 +520,7 @@ func (i *Ingester) MetricsForLabelMatchers(ctx context.Context, req *cortex.Metr
 	for _, matchers := range matchersSet {
 		if err := state.forSeriesMatching(matchers, func(fp model.Fingerprint, series *memorySeries) error {
 			if _, ok := metrics[fp]; !ok {
-				metrics[fp] = series.metric
+				metrics[fp] = state.symbols.toMetric(series.labels)
 			}
 			return nil
 		}); err != nil {
@@ -442,13 +548,42 @@ func (i *Ingester) UserStats(ctx context.Context, req *cortex.UserStatsRequest)
 	return &cortex.UserStatsResponse{
 		IngestionRate: state.ingestedSamples.rate(),
 		NumSeries:     uint64(state.fpToSeries.length()),
+		MemoryBytes:   uint64(state.memory.get()),
 	}, nil
 }
 
+// Cardinality returns the metric names with the most series and the label
+// names with the most values for the current user, and optionally how many
+// series match a selector.
+func (i *Ingester) Cardinality(ctx context.Context, req *cortex.CardinalityRequest) (*cortex.CardinalityResponse, error) {
+	limit, matchers, err := util.FromCardinalityRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	i.userStatesMtx.RLock()
+	defer i.userStatesMtx.RUnlock()
+	state, err := i.userStates.getOrCreate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &cortex.CardinalityResponse{
+		NumSeries:   uint64(state.fpToSeries.length()),
+		MetricNames: util.TopCardinalityStats(state.index.seriesPerValue(model.MetricNameLabel), limit),
+		LabelNames:  util.TopCardinalityStats(state.index.valuesPerName(), limit),
+	}
+	if len(matchers) > 0 {
+		resp.MatchedSeries = uint64(len(state.index.lookup(matchers)))
+	}
+	return resp, nil
+}
+
 // Describe implements prometheus.Collector.
 func (i *Ingester) Describe(ch chan<- *prometheus.Desc) {
 	ch <- memorySeriesDesc
 	ch <- memoryUsersDesc
+	ch <- memoryBytesDesc
 	ch <- flushQueueLengthDesc
 	ch <- i.ingestedSamples.Desc()
 	ch <- i.chunkUtilization.Desc()
@@ -476,6 +611,11 @@ func (i *Ingester) Collect(ch chan<- prometheus.Metric) {
 		prometheus.GaugeValue,
 		float64(numUsers),
 	)
+	ch <- prometheus.MustNewConstMetric(
+		memoryBytesDesc,
+		prometheus.GaugeValue,
+		float64(i.userStates.memory.get()),
+	)
 
 	flushQueueLength := 0
 	for _, flushQueue := range i.flushQueues {
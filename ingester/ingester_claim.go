@@ -53,6 +53,9 @@ func (i *Ingester) TransferChunks(stream cortex.Ingester_TransferChunksServer) e
 		// wireSeries.FromIngesterId and assume it is the same every time
 		// round this loop.
 		fromIngesterID = wireSeries.FromIngesterId
+		if i.isDeleted(wireSeries.UserId) {
+			continue
+		}
 		metric := util.FromLabelPairs(wireSeries.Labels)
 		userCtx := user.Inject(stream.Context(), wireSeries.UserId)
 		descs, err := fromWireChunks(wireSeries.Chunks)
@@ -73,6 +76,7 @@ func (i *Ingester) TransferChunks(stream cortex.Ingester_TransferChunksServer) e
 		}
 
 		i.memoryChunks.Add(float64(len(series.chunkDescs) - prevNumChunks))
+		state.addMemory(int64(len(series.chunkDescs)-prevNumChunks) * chunkBytes)
 		sentChunks.Add(float64(len(descs)))
 	}
 
@@ -2,6 +2,7 @@ package ingester
 
 import (
 	"fmt"
+	"math"
 	"time"
 
 	"golang.org/x/net/context"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/ring"
 )
 
 const (
@@ -24,13 +26,19 @@ type flushOp struct {
 	userID    string
 	fp        model.Fingerprint
 	immediate bool
+	pressure  bool // flushing to relieve memory pressure
 }
 
 func (o *flushOp) Key() string {
-	return fmt.Sprintf("%s-%d-%v", o.userID, o.fp, o.immediate)
+	return fmt.Sprintf("%s-%d-%v-%v", o.userID, o.fp, o.immediate, o.pressure)
 }
 
+// Priority orders flushes by age, with flushes to relieve memory pressure
+// ahead of all others.
 func (o *flushOp) Priority() int64 {
+	if o.pressure {
+		return math.MaxInt64 - int64(o.from)
+	}
 	return -int64(o.from)
 }
 
@@ -41,9 +49,10 @@ func (i *Ingester) sweepUsers(immediate bool) {
 	}
 
 	for id, state := range i.userStates.cp() {
+		pressure := i.userStates.underMemoryPressure(state)
 		for pair := range state.fpToSeries.iter() {
 			state.fpLocker.Lock(pair.fp)
-			i.sweepSeries(id, pair.fp, pair.series, immediate)
+			i.sweepSeries(id, pair.fp, pair.series, immediate, pressure)
 			state.fpLocker.Unlock(pair.fp)
 		}
 	}
@@ -53,17 +62,18 @@ func (i *Ingester) sweepUsers(immediate bool) {
 //
 // NB we don't close the head chunk here, as the series could wait in the queue
 // for some time, and we want to encourage chunks to be as full as possible.
-func (i *Ingester) sweepSeries(userID string, fp model.Fingerprint, series *memorySeries, immediate bool) {
+// Under memory pressure every series is flushed, head chunk included.
+func (i *Ingester) sweepSeries(userID string, fp model.Fingerprint, series *memorySeries, immediate, pressure bool) {
 	if len(series.chunkDescs) <= 0 {
 		return
 	}
 
 	firstTime := series.firstTime()
-	flush := i.shouldFlushSeries(series, immediate)
+	flush := i.shouldFlushSeries(series, immediate || pressure)
 
 	if flush {
 		flushQueueIndex := int(uint64(fp) % uint64(i.cfg.ConcurrentFlushes))
-		i.flushQueues[flushQueueIndex].Enqueue(&flushOp{firstTime, userID, fp, immediate})
+		i.flushQueues[flushQueueIndex].Enqueue(&flushOp{firstTime, userID, fp, immediate, pressure})
 	}
 }
 
@@ -108,7 +118,7 @@ func (i *Ingester) flushLoop(j int) {
 		}
 		op := o.(*flushOp)
 
-		err := i.flushUserSeries(op.userID, op.fp, op.immediate)
+		err := i.flushUserSeries(op.userID, op.fp, op.immediate || op.pressure)
 		if err != nil {
 			log.Errorf("Failed to flush user %v: %v", op.userID, err)
 		}
@@ -146,6 +156,9 @@ func (i *Ingester) flushUserSeries(userID string, fp model.Fingerprint, immediat
 	} else {
 		chunks = chunks[:len(chunks)-1]
 	}
+	if !immediate && !i.isFlushLeader(userID, userState.symbols.value(series.labels, model.MetricNameLabel)) {
+		chunks = chunksIdleFor(chunks, i.cfg.FlushLeaderTimeout)
+	}
 	userState.fpLocker.Unlock(fp)
 
 	if len(chunks) == 0 {
@@ -154,22 +167,57 @@ func (i *Ingester) flushUserSeries(userID string, fp model.Fingerprint, immediat
 
 	// flush the chunks without locking the series, as we don't want to hold the series lock for the duration of the dynamo/s3 rpcs.
 	ctx := user.Inject(context.Background(), userID)
-	err := i.flushChunks(ctx, fp, series.metric, chunks)
+	err := i.flushChunks(ctx, fp, userState.symbols.toMetric(series.labels), chunks)
 	if err != nil {
 		return err
 	}
 
-	// now remove the chunks
+	// now remove the chunks, unless the user was deleted meanwhile, taking its
+	// memory use with it
 	userState.fpLocker.Lock(fp)
+	if current, ok := i.userStates.get(userID); !ok || current != userState {
+		userState.fpLocker.Unlock(fp)
+		return nil
+	}
 	series.chunkDescs = series.chunkDescs[len(chunks):]
 	i.memoryChunks.Sub(float64(len(chunks)))
+	userState.addMemory(-int64(len(chunks)) * chunkBytes)
 	if len(series.chunkDescs) == 0 {
-		userState.removeSeries(fp, series.metric)
+		userState.removeSeries(fp, series.labels)
 	}
 	userState.fpLocker.Unlock(fp)
 	return nil
 }
 
+// isFlushLeader returns true if this ingester should flush series of the
+// given metric as soon as they need flushing, rather than give the replica
+// which owns them a chance to do so first.
+func (i *Ingester) isFlushLeader(userID string, metricName model.LabelValue) bool {
+	if !i.cfg.FlushLeader {
+		return true
+	}
+
+	i.ringDescMtx.RLock()
+	defer i.ringDescMtx.RUnlock()
+	if i.ringDesc == nil {
+		return true
+	}
+	leader, ok := i.ringDesc.PrimaryIngester(ring.TokenFor(userID, []byte(metricName)))
+	return !ok || leader == i.id
+}
+
+// chunksIdleFor returns the leading chunks which have had no samples appended
+// for at least d.  The head chunk is closed using the usual criteria, so with
+// write dedupe these are the same chunks the flush leader wrote.
+func chunksIdleFor(chunks []*desc, d time.Duration) []*desc {
+	for j, c := range chunks {
+		if model.Now().Sub(c.LastTime) < d {
+			return chunks[:j]
+		}
+	}
+	return chunks
+}
+
 func (i *Ingester) flushChunks(ctx context.Context, fp model.Fingerprint, metric model.Metric, chunkDescs []*desc) error {
 	userID, err := user.Extract(ctx)
 	if err != nil {
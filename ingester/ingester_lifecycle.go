@@ -297,6 +297,10 @@ func (i *Ingester) updateConsul() error {
 			ringDesc.Ingesters[i.id] = ingesterDesc
 		}
 
+		i.ringDescMtx.Lock()
+		i.ringDesc = ringDesc
+		i.ringDescMtx.Unlock()
+
 		return ringDesc, true, nil
 	})
 }
@@ -370,7 +374,7 @@ func (i *Ingester) transferChunks() error {
 			err = stream.Send(&cortex.TimeSeriesChunk{
 				FromIngesterId: i.id,
 				UserId:         userID,
-				Labels:         util.ToLabelPairs(pair.series.metric),
+				Labels:         util.ToLabelPairs(state.symbols.toMetric(pair.series.labels)),
 				Chunks:         chunks,
 			})
 			state.fpLocker.Unlock(pair.fp)
@@ -2,20 +2,25 @@ package ingester
 
 import (
 	"fmt"
+	"runtime"
 	"sort"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/metric"
 
 	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex"
 	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/ring"
 	"github.com/weaveworks/cortex/util"
 )
 
@@ -297,3 +302,296 @@ func TestIngesterMetricSeriesLimitExceeded(t *testing.T) {
 
 	assert.Equal(t, expected, res)
 }
+
+func TestIngesterUserMemoryLimitExceeded(t *testing.T) {
+	cfg := defaultIngesterTestConfig()
+	cfg.userStatesConfig = UserStatesConfig{
+		MaxMemoryPerUserHard: 1,
+	}
+
+	store := newTestStore()
+	ing, err := New(cfg, store)
+	require.NoError(t, err)
+	defer ing.Shutdown()
+
+	userID := "1"
+	sample1 := model.Sample{
+		Metric:    model.Metric{model.MetricNameLabel: "testmetric", "foo": "bar"},
+		Timestamp: 0,
+		Value:     1,
+	}
+	sample2 := model.Sample{
+		Metric:    model.Metric{model.MetricNameLabel: "testmetric", "foo": "bar"},
+		Timestamp: 1,
+		Value:     2,
+	}
+
+	// The first sample takes the user over its limit.
+	ctx := user.Inject(context.Background(), userID)
+	_, err = ing.Push(ctx, util.ToWriteRequest([]model.Sample{sample1}))
+	require.NoError(t, err)
+
+	stats, err := ing.UserStats(ctx, &cortex.UserStatsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.NumSeries)
+	ls, symbolBytes := newSymbolTable().internMetric(sample1.Metric)
+	assert.Equal(t, uint64(seriesBytes(ls)+symbolBytes+chunkBytes), stats.MemoryBytes)
+
+	// So the next one is rejected.
+	_, err = ing.Push(ctx, util.ToWriteRequest([]model.Sample{sample2}))
+	assert.Equal(t, codes.ResourceExhausted, grpc.Code(err))
+	assert.Equal(t, util.ErrUserMemoryLimitExceeded.Error(), grpc.ErrorDesc(err))
+
+	// Other users are unaffected.
+	ctx = user.Inject(context.Background(), "2")
+	_, err = ing.Push(ctx, util.ToWriteRequest([]model.Sample{sample1}))
+	require.NoError(t, err)
+}
+
+func TestIngesterMemoryPressureFlush(t *testing.T) {
+	cfg := defaultIngesterTestConfig()
+	cfg.userStatesConfig = UserStatesConfig{
+		MaxMemoryPerUserSoft: 1,
+	}
+
+	store := newTestStore()
+	ing, err := New(cfg, store)
+	require.NoError(t, err)
+	defer ing.Shutdown()
+
+	samples := matrixToSamples(buildTestMatrix(10, 10, 0))
+	ctx := user.Inject(context.Background(), userID)
+	_, err = ing.Push(ctx, util.ToWriteRequest(samples))
+	require.NoError(t, err)
+
+	// Nothing is old enough to be flushed, but the user is above its soft
+	// limit so all its chunks get flushed anyway.
+	ing.sweepUsers(false)
+	poll(t, 100*time.Millisecond, 10, func() interface{} {
+		store.mtx.Lock()
+		defer store.mtx.Unlock()
+		return len(store.chunks[userID])
+	})
+	poll(t, 100*time.Millisecond, int64(0), func() interface{} {
+		state, _ := ing.userStates.get(userID)
+		return state.memory.get()
+	})
+}
+
+func TestIngesterFlushLeader(t *testing.T) {
+	cfg := defaultIngesterTestConfig()
+	cfg.FlushLeader = true
+	cfg.FlushLeaderTimeout = time.Hour
+	cfg.MaxChunkIdle = 30 * time.Second
+	cfg.HeartbeatPeriod = 99999 * time.Hour
+
+	store := newTestStore()
+	ing, err := New(cfg, store)
+	require.NoError(t, err)
+	defer ing.Shutdown()
+
+	// Heartbeats are off, so the ring we set is the one used for flushing.
+	setRing := func(leader string) {
+		desc := ring.NewDesc()
+		desc.AddIngester(leader, "", []uint32{0}, ring.ACTIVE)
+		ing.ringDescMtx.Lock()
+		ing.ringDesc = desc
+		ing.ringDescMtx.Unlock()
+	}
+	flushed := func() interface{} {
+		store.mtx.Lock()
+		defer store.mtx.Unlock()
+		return len(store.chunks[userID])
+	}
+
+	ctx := user.Inject(context.Background(), userID)
+	_, err = ing.Push(ctx, util.ToWriteRequest([]model.Sample{
+		{Metric: model.Metric{model.MetricNameLabel: "recent"}, Timestamp: model.Now().Add(-time.Minute), Value: 1},
+		{Metric: model.Metric{model.MetricNameLabel: "stale"}, Timestamp: model.Now().Add(-2 * time.Hour), Value: 1},
+	}))
+	require.NoError(t, err)
+
+	// Another ingester is the leader, so we only flush the series it has
+	// had longer than the timeout to flush.
+	setRing("other")
+	ing.sweepUsers(false)
+	poll(t, 100*time.Millisecond, 1, flushed)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, flushed())
+
+	// As the leader we flush straight away.
+	setRing(cfg.id)
+	ing.sweepUsers(false)
+	poll(t, 100*time.Millisecond, 2, flushed)
+}
+
+func TestIngesterDeleteUser(t *testing.T) {
+	cfg := defaultIngesterTestConfig()
+	store := newTestStore()
+	ing, err := New(cfg, store)
+	require.NoError(t, err)
+
+	samples := matrixToSamples(buildTestMatrix(10, 10, 0))
+	for _, userID := range []string{"1", "2"} {
+		ctx := user.Inject(context.Background(), userID)
+		_, err = ing.Push(ctx, util.ToWriteRequest(samples))
+		require.NoError(t, err)
+	}
+	state, ok := ing.userStates.get("2")
+	require.True(t, ok)
+	otherMemory := state.memory.get()
+
+	// The deleted user's series are dropped, and its samples refused.
+	ing.DeleteUser("1")
+	_, ok = ing.userStates.get("1")
+	assert.False(t, ok)
+	assert.Equal(t, otherMemory, ing.userStates.memory.get())
+	ctx := user.Inject(context.Background(), "1")
+	_, err = ing.Push(ctx, util.ToWriteRequest(samples))
+	assert.Equal(t, codes.PermissionDenied, grpc.Code(err))
+	assert.Equal(t, util.ErrTenantDeleted.Error(), grpc.ErrorDesc(err))
+
+	// Only the other user's chunks are flushed.
+	ing.Shutdown()
+	assert.Empty(t, store.chunks["1"])
+	assert.Len(t, store.chunks["2"], 10)
+
+	// Once the user's purge is done, it is forgotten.
+	ing.ForgetDeletedUser("1")
+	assert.False(t, ing.isDeleted("1"))
+	assert.Empty(t, ing.deletedUsers)
+}
+
+func TestIngesterLabelNamesAndValues(t *testing.T) {
+	cfg := defaultIngesterTestConfig()
+	store := newTestStore()
+	ing, err := New(cfg, store)
+	require.NoError(t, err)
+
+	// Series i has samples from i to i+999; only series 0 has the extra label.
+	testData := buildTestMatrix(10, 1000, 0)
+	testData[0].Metric["extra"] = "value"
+
+	ctx := user.Inject(context.Background(), "1")
+	_, err = ing.Push(ctx, util.ToWriteRequest(matrixToSamples(testData)))
+	require.NoError(t, err)
+
+	names, err := ing.LabelNames(ctx, &cortex.LabelNamesRequest{})
+	require.NoError(t, err)
+	sort.Strings(names.LabelNames)
+	assert.Equal(t, []string{model.MetricNameLabel, "extra", model.JobLabel}, names.LabelNames)
+
+	names, err = ing.LabelNames(ctx, &cortex.LabelNamesRequest{StartTimestampMs: 1005, EndTimestampMs: 2000})
+	require.NoError(t, err)
+	sort.Strings(names.LabelNames)
+	assert.Equal(t, []string{model.MetricNameLabel, model.JobLabel}, names.LabelNames)
+
+	values, err := ing.LabelValues(ctx, &cortex.LabelValuesRequest{LabelName: model.MetricNameLabel})
+	require.NoError(t, err)
+	assert.Len(t, values.LabelValues, 10)
+
+	values, err = ing.LabelValues(ctx, &cortex.LabelValuesRequest{LabelName: model.MetricNameLabel, StartTimestampMs: 1005, EndTimestampMs: 2000})
+	require.NoError(t, err)
+	sort.Strings(values.LabelValues)
+	assert.Equal(t, []string{"testmetric_6", "testmetric_7", "testmetric_8", "testmetric_9"}, values.LabelValues)
+}
+
+func TestIngesterCardinality(t *testing.T) {
+	cfg := defaultIngesterTestConfig()
+	store := newTestStore()
+	ing, err := New(cfg, store)
+	require.NoError(t, err)
+
+	var samples []model.Sample
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 5; j++ {
+			samples = append(samples, model.Sample{
+				Metric: model.Metric{
+					model.MetricNameLabel: model.LabelValue(fmt.Sprintf("metric_%d", i)),
+					"instance":            model.LabelValue(fmt.Sprintf("instance%d", i*j)),
+				},
+				Timestamp: 1,
+			})
+		}
+	}
+	samples = append(samples, model.Sample{Metric: model.Metric{model.MetricNameLabel: "metric_2", "extra": "foo"}, Timestamp: 1})
+
+	ctx := user.Inject(context.Background(), "1")
+	_, err = ing.Push(ctx, util.ToWriteRequest(samples))
+	require.NoError(t, err)
+
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "metric_2")
+	require.NoError(t, err)
+	req, err := util.ToCardinalityRequest(2, []*metric.LabelMatcher{matcher})
+	require.NoError(t, err)
+
+	resp, err := ing.Cardinality(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, &cortex.CardinalityResponse{
+		NumSeries: 12,
+		MetricNames: []cortex.CardinalityStat{
+			{Name: "metric_2", Count: 6},
+			{Name: "metric_1", Count: 5},
+		},
+		LabelNames: []cortex.CardinalityStat{
+			{Name: "instance", Count: 7},
+			{Name: model.MetricNameLabel, Count: 3},
+		},
+		MatchedSeries: 6,
+	}, resp)
+}
+
+// BenchmarkIngesterSeries pushes a sample for each of 10,000 new series, with
+// labels shared as they would be between a cluster's targets.
+func BenchmarkIngesterSeries(b *testing.B) {
+	const numSeries = 10000
+	reqs := []*cortex.WriteRequest{}
+	for i := 0; i < numSeries; i += 1000 {
+		samples := make([]model.Sample, 0, 1000)
+		for j := i; j < i+1000; j++ {
+			samples = append(samples, model.Sample{
+				Metric: model.Metric{
+					model.MetricNameLabel: model.LabelValue(fmt.Sprintf("metric_%d", j%100)),
+					model.JobLabel:        model.LabelValue(fmt.Sprintf("job_%d", j%10)),
+					"instance":            model.LabelValue(fmt.Sprintf("instance_%d", j%500)),
+					"pod":                 model.LabelValue(fmt.Sprintf("pod_%d", j/100)),
+					"namespace":           "default",
+				},
+				Timestamp: 1,
+				Value:     1,
+			})
+		}
+		reqs = append(reqs, util.ToWriteRequest(samples))
+	}
+	ctx := user.Inject(context.Background(), "1")
+
+	var retained int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		before := heapAlloc()
+		ing, err := New(defaultIngesterTestConfig(), newTestStore())
+		require.NoError(b, err)
+		b.StartTimer()
+
+		for _, req := range reqs {
+			_, err := ing.Push(ctx, req)
+			require.NoError(b, err)
+		}
+
+		b.StopTimer()
+		retained += heapAlloc() - before
+		ing.Shutdown()
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(retained)/float64(b.N*numSeries), "retained-B/series")
+}
+
+// heapAlloc returns the bytes of heap in use after a garbage collection.
+func heapAlloc() int64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapAlloc)
+}
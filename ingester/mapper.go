@@ -3,7 +3,6 @@ package ingester
 import (
 	"fmt"
 	"sort"
-	"strings"
 	"sync"
 	"sync/atomic"
 
@@ -14,8 +13,6 @@ import (
 
 const maxMappedFP = 1 << 20 // About 1M fingerprints reserved for mapping.
 
-var separatorString = string([]byte{model.SeparatorByte})
-
 // fpMappings maps original fingerprints to a map of string representations of
 // metrics to the truly unique fingerprint.
 type fpMappings map[model.Fingerprint]map[string]model.Fingerprint
@@ -30,13 +27,15 @@ type fpMapper struct {
 	mappings fpMappings
 
 	fpToSeries *seriesMap
+	symbols    *symbolTable
 }
 
 // newFPMapper loads the collision map from the persistence and
 // returns an fpMapper ready to use.
-func newFPMapper(fpToSeries *seriesMap) *fpMapper {
+func newFPMapper(fpToSeries *seriesMap, symbols *symbolTable) *fpMapper {
 	return &fpMapper{
 		fpToSeries: fpToSeries,
+		symbols:    symbols,
 		mappings:   map[model.Fingerprint]map[string]model.Fingerprint{},
 	}
 }
@@ -59,7 +58,7 @@ func (m *fpMapper) mapFP(fp model.Fingerprint, metric model.Metric) model.Finger
 	s, ok := m.fpToSeries.get(fp)
 	if ok {
 		// FP exists in memory, but is it for the same metric?
-		if metric.Equal(s.metric) {
+		if m.symbols.equal(s.labels, metric) {
 			// Yupp. We are done.
 			return fp
 		}
@@ -139,11 +138,26 @@ func (m *fpMapper) nextMappedFP() model.Fingerprint {
 // FastFingerprint function, and its result is not suitable as a key for maps
 // and indexes as it might become really large, causing a lot of hashing effort
 // in maps and a lot of storage overhead in indexes.
+//
+// Labels are written in label name order, the same order in which they are
+// held in a labelSet.
 func metricToUniqueString(m model.Metric) string {
-	parts := make([]string, 0, len(m))
+	names := make(model.LabelNames, 0, len(m))
+	size := 0
 	for ln, lv := range m {
-		parts = append(parts, string(ln)+separatorString+string(lv))
+		names = append(names, ln)
+		size += len(ln) + len(lv) + 2
+	}
+	sort.Sort(names)
+
+	buf := make([]byte, 0, size)
+	for i, ln := range names {
+		if i > 0 {
+			buf = append(buf, model.SeparatorByte)
+		}
+		buf = append(buf, ln...)
+		buf = append(buf, model.SeparatorByte)
+		buf = append(buf, m[ln]...)
 	}
-	sort.Strings(parts)
-	return strings.Join(parts, separatorString)
+	return string(buf)
 }
@@ -45,8 +45,13 @@ var (
 
 func TestFPMapper(t *testing.T) {
 	sm := newSeriesMap()
+	symbols := newSymbolTable()
+	series := func(m model.Metric) *memorySeries {
+		ls, _ := symbols.internMetric(m)
+		return newMemorySeries(ls)
+	}
 
-	mapper := newFPMapper(sm)
+	mapper := newFPMapper(sm, symbols)
 
 	// Everything is empty, resolving a FP should do nothing.
 	gotFP := mapper.mapFP(fp1, cm11)
@@ -60,7 +65,7 @@ func TestFPMapper(t *testing.T) {
 
 	// cm11 is in sm. Adding cm11 should do nothing. Mapping cm12 should resolve
 	// the collision.
-	sm.put(fp1, &memorySeries{metric: cm11})
+	sm.put(fp1, series(cm11))
 	gotFP = mapper.mapFP(fp1, cm11)
 	if wantFP := fp1; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
@@ -71,7 +76,7 @@ func TestFPMapper(t *testing.T) {
 	}
 
 	// The mapped cm12 is added to sm, too. That should not change the outcome.
-	sm.put(model.Fingerprint(1), &memorySeries{metric: cm12})
+	sm.put(model.Fingerprint(1), series(cm12))
 	gotFP = mapper.mapFP(fp1, cm11)
 	if wantFP := fp1; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
@@ -92,7 +97,7 @@ func TestFPMapper(t *testing.T) {
 	}
 
 	// Add cm13 to sm. Should not change anything.
-	sm.put(model.Fingerprint(2), &memorySeries{metric: cm13})
+	sm.put(model.Fingerprint(2), series(cm13))
 	gotFP = mapper.mapFP(fp1, cm11)
 	if wantFP := fp1; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
@@ -111,7 +116,7 @@ func TestFPMapper(t *testing.T) {
 	if wantFP := fp2; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	sm.put(fp2, &memorySeries{metric: cm21})
+	sm.put(fp2, series(cm21))
 	gotFP = mapper.mapFP(fp2, cm21)
 	if wantFP := fp2; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
@@ -120,7 +125,7 @@ func TestFPMapper(t *testing.T) {
 	if wantFP := model.Fingerprint(3); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	sm.put(model.Fingerprint(3), &memorySeries{metric: cm22})
+	sm.put(model.Fingerprint(3), series(cm22))
 	gotFP = mapper.mapFP(fp2, cm21)
 	if wantFP := fp2; gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
@@ -135,14 +140,14 @@ func TestFPMapper(t *testing.T) {
 	if wantFP := model.Fingerprint(4); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	sm.put(model.Fingerprint(4), &memorySeries{metric: cm31})
+	sm.put(model.Fingerprint(4), series(cm31))
 
 	// Map cm32, which is now mapped for two reasons...
 	gotFP = mapper.mapFP(fp3, cm32)
 	if wantFP := model.Fingerprint(5); gotFP != wantFP {
 		t.Errorf("got fingerprint %v, want fingerprint %v", gotFP, wantFP)
 	}
-	sm.put(model.Fingerprint(5), &memorySeries{metric: cm32})
+	sm.put(model.Fingerprint(5), series(cm32))
 
 	// Now check ALL the mappings, just to be sure.
 	gotFP = mapper.mapFP(fp1, cm11)
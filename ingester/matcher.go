@@ -0,0 +1,170 @@
+package ingester
+
+import (
+	"regexp/syntax"
+	"strings"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// maxSetMatches bounds how many literal values a regex may be expanded to
+// before we give up and fall back to evaluating it against every value.
+const maxSetMatches = 256
+
+// valueMatcher finds the label values a matcher selects without running
+// the matcher against every value, where possible.
+type valueMatcher struct {
+	matcher *metric.LabelMatcher
+
+	// literals, if set, are the only values the matcher can select.
+	literals []string
+	// prefixes, if set, select any value which starts with one of them and
+	// whose remainder is matched by `.*`.
+	prefixes []string
+	// matchesNewline is true if the remainder after a prefix may contain a
+	// newline, i.e. the regex was `foo(?s:.*)`.
+	matchesNewline bool
+}
+
+// newValueMatcher analyses the positive form of a matcher: for `=` and `!=`
+// the value itself, for `=~` and `!~` the regex.  Negation is left to the
+// caller.
+func newValueMatcher(m *metric.LabelMatcher) *valueMatcher {
+	vm := &valueMatcher{matcher: m}
+	switch m.Type {
+	case metric.Equal, metric.NotEqual:
+		vm.literals = []string{string(m.Value)}
+	case metric.RegexMatch, metric.RegexNoMatch:
+		re, err := syntax.Parse(string(m.Value), syntax.Perl)
+		if err != nil {
+			return vm
+		}
+		re = re.Simplify()
+		if literals, ok := regexLiterals(re); ok {
+			vm.literals = literals
+		} else if prefixes, newline, ok := regexPrefixes(re); ok {
+			vm.prefixes, vm.matchesNewline = prefixes, newline
+		}
+	}
+	return vm
+}
+
+// matches returns true if value is selected by the positive form of the
+// matcher.
+func (vm *valueMatcher) matches(value string) bool {
+	switch {
+	case vm.literals != nil:
+		for _, l := range vm.literals {
+			if l == value {
+				return true
+			}
+		}
+		return false
+	case vm.prefixes != nil:
+		for _, p := range vm.prefixes {
+			if strings.HasPrefix(value, p) && (vm.matchesNewline || !strings.Contains(value[len(p):], "\n")) {
+				return true
+			}
+		}
+		return false
+	}
+	match := vm.matcher.Match(model.LabelValue(value))
+	if vm.matcher.Type == metric.RegexNoMatch {
+		return !match
+	}
+	return match
+}
+
+// regexLiterals returns the finite set of strings matched by re, if there is
+// one and it is small.
+func regexLiterals(re *syntax.Regexp) ([]string, bool) {
+	if re.Flags&syntax.FoldCase != 0 {
+		return nil, false
+	}
+
+	switch re.Op {
+	case syntax.OpEmptyMatch:
+		return []string{""}, true
+
+	case syntax.OpLiteral:
+		return []string{string(re.Rune)}, true
+
+	case syntax.OpCharClass:
+		var result []string
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			lo, hi := re.Rune[i], re.Rune[i+1]
+			if len(result)+int(hi-lo)+1 > maxSetMatches {
+				return nil, false
+			}
+			for r := lo; r <= hi; r++ {
+				result = append(result, string(r))
+			}
+		}
+		return result, true
+
+	case syntax.OpCapture:
+		return regexLiterals(re.Sub[0])
+
+	case syntax.OpQuest:
+		sub, ok := regexLiterals(re.Sub[0])
+		if !ok || len(sub)+1 > maxSetMatches {
+			return nil, false
+		}
+		return append([]string{""}, sub...), true
+
+	case syntax.OpAlternate:
+		var result []string
+		for _, sub := range re.Sub {
+			lits, ok := regexLiterals(sub)
+			if !ok || len(result)+len(lits) > maxSetMatches {
+				return nil, false
+			}
+			result = append(result, lits...)
+		}
+		return result, true
+
+	case syntax.OpConcat:
+		result := []string{""}
+		for _, sub := range re.Sub {
+			lits, ok := regexLiterals(sub)
+			if !ok || len(result)*len(lits) > maxSetMatches {
+				return nil, false
+			}
+			product := make([]string, 0, len(result)*len(lits))
+			for _, prefix := range result {
+				for _, suffix := range lits {
+					product = append(product, prefix+suffix)
+				}
+			}
+			result = product
+		}
+		return result, true
+	}
+	return nil, false
+}
+
+// regexPrefixes recognises regexes of the form `<literals>.*`, returning the
+// literal prefixes and whether the trailing `.*` matches newlines.
+func regexPrefixes(re *syntax.Regexp) ([]string, bool, bool) {
+	if re.Op == syntax.OpCapture {
+		return regexPrefixes(re.Sub[0])
+	}
+	if re.Op != syntax.OpConcat || len(re.Sub) < 2 {
+		return nil, false, false
+	}
+
+	last := re.Sub[len(re.Sub)-1]
+	if last.Op != syntax.OpStar || (last.Sub[0].Op != syntax.OpAnyChar && last.Sub[0].Op != syntax.OpAnyCharNotNL) {
+		return nil, false, false
+	}
+
+	prefixes, ok := regexLiterals(&syntax.Regexp{
+		Op:  syntax.OpConcat,
+		Sub: re.Sub[:len(re.Sub)-1],
+	})
+	if !ok {
+		return nil, false, false
+	}
+	return prefixes, last.Sub[0].Op == syntax.OpAnyChar, true
+}
@@ -0,0 +1,82 @@
+package ingester
+
+import (
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/local/chunk"
+
+	"github.com/weaveworks/cortex/util"
+)
+
+// Approximate sizes used for memory accounting.  These don't need to be
+// exact, they just need to scale with the things that actually use memory:
+// label strings, index entries and chunks.
+const (
+	// A memorySeries, its entry in the seriesMap and its fpMapper bookkeeping.
+	seriesOverheadBytes = int64(unsafe.Sizeof(memorySeries{})) + 64
+	// An interned label pair in the series' labelSet.
+	labelRefBytes = int64(unsafe.Sizeof(labelRef{}))
+	// A fingerprint in the inverted index, plus amortised map overhead.
+	indexEntryBytes = int64(unsafe.Sizeof(model.Fingerprint(0))) + 16
+	// A chunk and its desc.
+	chunkBytes = chunk.ChunkLen + int64(unsafe.Sizeof(desc{}))
+)
+
+// memoryUsage tracks the approximate number of bytes used.  It is safe for
+// concurrent use.
+type memoryUsage struct {
+	bytes int64
+}
+
+func (m *memoryUsage) add(n int64) {
+	atomic.AddInt64(&m.bytes, n)
+}
+
+func (m *memoryUsage) get() int64 {
+	return atomic.LoadInt64(&m.bytes)
+}
+
+// seriesBytes approximates the memory used by a series with the given labels,
+// excluding its chunks and the symbols it refers to, which are accounted for
+// by the symbolTable.
+func seriesBytes(ls labelSet) int64 {
+	return seriesOverheadBytes + int64(len(ls))*(labelRefBytes+indexEntryBytes)
+}
+
+// addMemory records a change in the memory used by this user.
+func (u *userState) addMemory(n int64) {
+	u.memory.add(n)
+	u.global.add(n)
+}
+
+// checkMemoryLimits returns an error if this user, or the ingester as a whole,
+// is above its hard memory limit.
+func (u *userState) checkMemoryLimits(cfg *UserStatesConfig) error {
+	if cfg.MaxMemoryPerUserHard > 0 && u.memory.get() >= cfg.MaxMemoryPerUserHard {
+		return util.ErrUserMemoryLimitExceeded
+	}
+	if cfg.MaxMemoryHard > 0 && u.global.get() >= cfg.MaxMemoryHard {
+		return util.ErrMemoryLimitExceeded
+	}
+	return nil
+}
+
+// underMemoryPressure returns true if this user's series should be flushed
+// ahead of the usual criteria to relieve memory pressure.  That is the case
+// if the user is above its own soft limit, or if the ingester is above its
+// global soft limit and this user uses more than its fair share of it.
+func (us *userStates) underMemoryPressure(u *userState) bool {
+	if us.cfg.MaxMemoryPerUserSoft > 0 && u.memory.get() >= us.cfg.MaxMemoryPerUserSoft {
+		return true
+	}
+	if us.cfg.MaxMemorySoft > 0 && us.memory.get() >= us.cfg.MaxMemorySoft {
+		numUsers := us.numUsers()
+		if numUsers == 0 {
+			return false
+		}
+		return u.memory.get() >= us.cfg.MaxMemorySoft/int64(numUsers)
+	}
+	return false
+}
@@ -23,7 +23,7 @@ func init() {
 }
 
 type memorySeries struct {
-	metric model.Metric
+	labels labelSet
 
 	// Sorted by start time, overlapping chunk ranges are forbidden.
 	chunkDescs []*desc
@@ -40,10 +40,10 @@ type memorySeries struct {
 }
 
 // newMemorySeries returns a pointer to a newly allocated memorySeries for the
-// given metric.
-func newMemorySeries(m model.Metric) *memorySeries {
+// given interned labels.
+func newMemorySeries(ls labelSet) *memorySeries {
 	return &memorySeries{
-		metric:   m,
+		labels:   ls,
 		lastTime: model.Earliest,
 	}
 }
@@ -123,6 +123,15 @@ func (s *memorySeries) head() *desc {
 	return s.chunkDescs[len(s.chunkDescs)-1]
 }
 
+// overlaps returns true if the series has chunks between from and through.
+// The caller must have locked the fingerprint of the memorySeries.
+func (s *memorySeries) overlaps(from, through model.Time) bool {
+	if len(s.chunkDescs) == 0 {
+		return false
+	}
+	return !s.firstTime().After(through) && !s.head().LastTime.Before(from)
+}
+
 func (s *memorySeries) samplesForRange(from, through model.Time) ([]model.SamplePair, error) {
 	// Find first chunk with start time after "from".
 	fromIdx := sort.Search(len(s.chunkDescs), func(i int) bool {
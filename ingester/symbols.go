@@ -0,0 +1,175 @@
+package ingester
+
+import (
+	"sort"
+	"sync"
+	"unsafe"
+
+	"github.com/prometheus/common/model"
+)
+
+// symbolOverheadBytes approximates the bookkeeping cost of one symbol: its
+// entry in the ids map, the string header in strings and its refcount.
+const symbolOverheadBytes = 2*int64(unsafe.Sizeof("")) + 4 + 4 + 16
+
+// labelRef is an interned label pair.
+type labelRef struct {
+	name, value uint32
+}
+
+// labelSet is a set of interned label pairs, sorted by label name.  It is
+// the compact equivalent of a model.Metric, only meaningful together with
+// the symbolTable it was interned in.
+type labelSet []labelRef
+
+// symbolTable interns the label names and values of one user's series, so
+// each distinct string is only held in memory once.  Symbols are reference
+// counted, and their ids recycled once no series refers to them.  All its
+// methods are goroutine-safe.
+type symbolTable struct {
+	mtx     sync.RWMutex
+	ids     map[string]uint32
+	strings []string
+	refs    []uint32
+	free    []uint32
+}
+
+func newSymbolTable() *symbolTable {
+	return &symbolTable{
+		ids: map[string]uint32{},
+	}
+}
+
+// internMetric interns all the label names and values of metric, returning
+// the resulting labelSet and the number of bytes used by newly created symbols.
+func (t *symbolTable) internMetric(metric model.Metric) (labelSet, int64) {
+	names := make(model.LabelNames, 0, len(metric))
+	for name := range metric {
+		names = append(names, name)
+	}
+	sort.Sort(names)
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	var added int64
+	ls := make(labelSet, 0, len(names))
+	for _, name := range names {
+		nameID, n := t.intern(string(name))
+		valueID, v := t.intern(string(metric[name]))
+		added += n + v
+		ls = append(ls, labelRef{name: nameID, value: valueID})
+	}
+	return ls, added
+}
+
+// intern takes a reference to s, returning its id and the number of bytes
+// used if a new symbol had to be created.  The caller must hold t.mtx.
+func (t *symbolTable) intern(s string) (uint32, int64) {
+	if id, ok := t.ids[s]; ok {
+		t.refs[id]++
+		return id, 0
+	}
+
+	var id uint32
+	if len(t.free) > 0 {
+		id = t.free[len(t.free)-1]
+		t.free = t.free[:len(t.free)-1]
+		t.strings[id] = s
+		t.refs[id] = 1
+	} else {
+		id = uint32(len(t.strings))
+		t.strings = append(t.strings, s)
+		t.refs = append(t.refs, 1)
+	}
+	t.ids[s] = id
+	return id, int64(len(s)) + symbolOverheadBytes
+}
+
+// release drops the references held by ls, returning the number of bytes
+// freed by symbols which are no longer referred to.
+func (t *symbolTable) release(ls labelSet) int64 {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	var freed int64
+	for _, l := range ls {
+		freed += t.unref(l.name) + t.unref(l.value)
+	}
+	return freed
+}
+
+func (t *symbolTable) unref(id uint32) int64 {
+	t.refs[id]--
+	if t.refs[id] > 0 {
+		return 0
+	}
+	s := t.strings[id]
+	delete(t.ids, s)
+	t.strings[id] = ""
+	t.free = append(t.free, id)
+	return int64(len(s)) + symbolOverheadBytes
+}
+
+// lookup returns the id of s, if it is interned.
+func (t *symbolTable) lookup(s string) (uint32, bool) {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	id, ok := t.ids[s]
+	return id, ok
+}
+
+// get returns the string for an id.  The id must be referenced.
+func (t *symbolTable) get(id uint32) string {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+	return t.strings[id]
+}
+
+// toMetric expands ls back into a model.Metric.
+func (t *symbolTable) toMetric(ls labelSet) model.Metric {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	metric := make(model.Metric, len(ls))
+	for _, l := range ls {
+		metric[model.LabelName(t.strings[l.name])] = model.LabelValue(t.strings[l.value])
+	}
+	return metric
+}
+
+// value returns the value of the label called name in ls, or the empty
+// string if there is no such label.
+func (t *symbolTable) value(ls labelSet, name model.LabelName) model.LabelValue {
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	nameID, ok := t.ids[string(name)]
+	if !ok {
+		return ""
+	}
+	for _, l := range ls {
+		if l.name == nameID {
+			return model.LabelValue(t.strings[l.value])
+		}
+	}
+	return ""
+}
+
+// equal returns true if ls holds exactly the labels of metric.
+func (t *symbolTable) equal(ls labelSet, metric model.Metric) bool {
+	if len(ls) != len(metric) {
+		return false
+	}
+
+	t.mtx.RLock()
+	defer t.mtx.RUnlock()
+
+	for _, l := range ls {
+		value, ok := metric[model.LabelName(t.strings[l.name])]
+		if !ok || string(value) != t.strings[l.value] {
+			return false
+		}
+	}
+	return true
+}
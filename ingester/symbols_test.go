@@ -0,0 +1,50 @@
+package ingester
+
+import (
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSymbolTable(t *testing.T) {
+	symbols := newSymbolTable()
+
+	m1 := model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}
+	m2 := model.Metric{model.MetricNameLabel: "foo", "bar": "bop"}
+
+	ls1, added1 := symbols.internMetric(m1)
+	assert.Equal(t, 4, len(symbols.ids))
+	ls2, added2 := symbols.internMetric(m2)
+	assert.Equal(t, 5, len(symbols.ids))
+	assert.Equal(t, int64(len("__name__foobarbaz"))+4*symbolOverheadBytes, added1)
+	assert.Equal(t, int64(len("bop"))+symbolOverheadBytes, added2)
+
+	// Labels are shared, and sorted by name.
+	assert.Equal(t, ls1[0].name, ls2[0].name)
+	assert.Equal(t, "__name__", symbols.get(ls1[0].name))
+	assert.Equal(t, "bar", symbols.get(ls1[1].name))
+
+	assert.Equal(t, m1, symbols.toMetric(ls1))
+	assert.Equal(t, m2, symbols.toMetric(ls2))
+	assert.Equal(t, model.LabelValue("bop"), symbols.value(ls2, "bar"))
+	assert.Equal(t, model.LabelValue(""), symbols.value(ls2, "missing"))
+	assert.True(t, symbols.equal(ls1, m1))
+	assert.False(t, symbols.equal(ls1, m2))
+	assert.False(t, symbols.equal(ls1, model.Metric{model.MetricNameLabel: "foo"}))
+
+	// Releasing ls1 only frees the symbols not used by ls2.
+	assert.Equal(t, int64(len("baz"))+symbolOverheadBytes, symbols.release(ls1))
+	assert.Equal(t, 4, len(symbols.ids))
+	_, ok := symbols.lookup("baz")
+	assert.False(t, ok)
+
+	// Freed ids are reused.
+	ls3, _ := symbols.internMetric(model.Metric{"new": "foo"})
+	assert.Equal(t, 5, len(symbols.strings))
+	assert.Equal(t, model.Metric{"new": "foo"}, symbols.toMetric(ls3))
+
+	symbols.release(ls2)
+	symbols.release(ls3)
+	assert.Equal(t, 0, len(symbols.ids))
+}
@@ -18,15 +18,19 @@ type userStates struct {
 	mtx    sync.RWMutex
 	states map[string]*userState
 	cfg    *UserStatesConfig
+	memory memoryUsage
 }
 
 type userState struct {
 	userID          string
 	fpLocker        *fingerprintLocker
 	fpToSeries      *seriesMap
+	symbols         *symbolTable
 	mapper          *fpMapper
 	index           *invertedIndex
 	ingestedSamples *ewmaRate
+	memory          memoryUsage
+	global          *memoryUsage
 
 	seriesInMetricMtx sync.Mutex
 	seriesInMetric    map[model.LabelValue]int
@@ -37,6 +41,12 @@ type UserStatesConfig struct {
 	RateUpdatePeriod   time.Duration
 	MaxSeriesPerUser   int
 	MaxSeriesPerMetric int
+
+	// Memory limits, in bytes.  Zero means no limit.
+	MaxMemoryPerUserSoft int64
+	MaxMemoryPerUserHard int64
+	MaxMemorySoft        int64
+	MaxMemoryHard        int64
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -44,6 +54,10 @@ func (cfg *UserStatesConfig) RegisterFlags(f *flag.FlagSet) {
 	f.DurationVar(&cfg.RateUpdatePeriod, "ingester.rate-update-period", 15*time.Second, "Period with which to update the per-user ingestion rates.")
 	f.IntVar(&cfg.MaxSeriesPerUser, "ingester.max-series-per-user", DefaultMaxSeriesPerUser, "Maximum number of active series per user.")
 	f.IntVar(&cfg.MaxSeriesPerMetric, "ingester.max-series-per-metric", DefaultMaxSeriesPerMetric, "Maximum number of active series per metric name.")
+	f.Int64Var(&cfg.MaxMemoryPerUserSoft, "ingester.max-memory-per-user-soft", 0, "Approximate memory use per user, in bytes, above which its series are flushed with priority. 0 to disable.")
+	f.Int64Var(&cfg.MaxMemoryPerUserHard, "ingester.max-memory-per-user-hard", 0, "Approximate memory use per user, in bytes, above which its samples are rejected. 0 to disable.")
+	f.Int64Var(&cfg.MaxMemorySoft, "ingester.max-memory-soft", 0, "Approximate memory use across all users, in bytes, above which the largest users' series are flushed with priority. 0 to disable.")
+	f.Int64Var(&cfg.MaxMemoryHard, "ingester.max-memory-hard", 0, "Approximate memory use across all users, in bytes, above which all samples are rejected. 0 to disable.")
 }
 
 func newUserStates(cfg *UserStatesConfig) *userStates {
@@ -74,6 +88,15 @@ func (us *userStates) gc() {
 	}
 }
 
+// delete removes the user's state.
+func (us *userStates) delete(userID string) (*userState, bool) {
+	us.mtx.Lock()
+	defer us.mtx.Unlock()
+	state, ok := us.states[userID]
+	delete(us.states, userID)
+	return state, ok
+}
+
 func (us *userStates) updateRates() {
 	us.mtx.RLock()
 	defer us.mtx.RUnlock()
@@ -163,21 +186,28 @@ func (us *userStates) getOrCreateSeries(ctx context.Context, metric model.Metric
 func (us *userStates) unlockedGetOrCreate(userID string) *userState {
 	state, ok := us.states[userID]
 	if !ok {
+		symbols := newSymbolTable()
 		state = &userState{
 			userID:          userID,
 			fpToSeries:      newSeriesMap(),
+			symbols:         symbols,
 			fpLocker:        newFingerprintLocker(16),
-			index:           newInvertedIndex(),
+			index:           newInvertedIndex(symbols),
 			ingestedSamples: newEWMARate(0.2, us.cfg.RateUpdatePeriod),
 			seriesInMetric:  map[model.LabelValue]int{},
+			global:          &us.memory,
 		}
-		state.mapper = newFPMapper(state.fpToSeries)
+		state.mapper = newFPMapper(state.fpToSeries, symbols)
 		us.states[userID] = state
 	}
 	return state
 }
 
 func (u *userState) unlockedGet(metric model.Metric, cfg *UserStatesConfig) (model.Fingerprint, *memorySeries, error) {
+	if err := u.checkMemoryLimits(cfg); err != nil {
+		return 0, nil, err
+	}
+
 	rawFP := metric.FastFingerprint()
 	u.fpLocker.Lock(rawFP)
 	fp := u.mapper.mapFP(rawFP, metric)
@@ -212,9 +242,11 @@ func (u *userState) unlockedGet(metric model.Metric, cfg *UserStatesConfig) (mod
 		return fp, nil, util.ErrMetricSeriesLimitExceeded
 	}
 
-	series = newMemorySeries(metric)
+	ls, symbolBytes := u.symbols.internMetric(metric)
+	series = newMemorySeries(ls)
 	u.fpToSeries.put(fp, series)
-	u.index.add(metric, fp)
+	u.index.add(ls, fp)
+	u.addMemory(seriesBytes(ls) + symbolBytes)
 	return fp, series, nil
 }
 
@@ -229,17 +261,18 @@ func (u *userState) canAddSeriesFor(metric model.LabelValue, cfg *UserStatesConf
 	return true
 }
 
-func (u *userState) removeSeries(fp model.Fingerprint, metric model.Metric) {
-	u.fpToSeries.del(fp)
-	u.index.delete(metric, fp)
-
-	metricName, err := util.ExtractMetricNameFromMetric(metric)
-	if err != nil {
+func (u *userState) removeSeries(fp model.Fingerprint, ls labelSet) {
+	metricName := u.symbols.value(ls, model.MetricNameLabel)
+	if metricName == "" {
 		// Series without a metric name should never be able to make it into
 		// the ingester's memory storage.
-		panic(err)
+		panic(util.ErrMissingMetricName)
 	}
 
+	u.fpToSeries.del(fp)
+	u.index.delete(ls, fp)
+	u.addMemory(-seriesBytes(ls) - u.symbols.release(ls))
+
 	u.seriesInMetricMtx.Lock()
 	defer u.seriesInMetricMtx.Unlock()
 
@@ -249,14 +282,56 @@ func (u *userState) removeSeries(fp model.Fingerprint, metric model.Metric) {
 	}
 }
 
+// labelNamesInRange returns the names of all labels of series with samples
+// between from and through.
+func (u *userState) labelNamesInRange(from, through model.Time) model.LabelNames {
+	seen := map[model.LabelName]struct{}{}
+	for pair := range u.fpToSeries.iter() {
+		u.fpLocker.Lock(pair.fp)
+		if pair.series.overlaps(from, through) {
+			for name := range u.symbols.toMetric(pair.series.labels) {
+				seen[name] = struct{}{}
+			}
+		}
+		u.fpLocker.Unlock(pair.fp)
+	}
+
+	res := make(model.LabelNames, 0, len(seen))
+	for name := range seen {
+		res = append(res, name)
+	}
+	return res
+}
+
+// labelValuesInRange returns the values of the named label of series with
+// samples between from and through.
+func (u *userState) labelValuesInRange(name model.LabelName, from, through model.Time) (model.LabelValues, error) {
+	matcher, err := metric.NewLabelMatcher(metric.NotEqual, name, "")
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[model.LabelValue]struct{}{}
+	err = u.forSeriesMatching([]*metric.LabelMatcher{matcher}, func(_ model.Fingerprint, series *memorySeries) error {
+		if series.overlaps(from, through) {
+			seen[u.symbols.value(series.labels, name)] = struct{}{}
+		}
+		return nil
+	})
+
+	res := make(model.LabelValues, 0, len(seen))
+	for value := range seen {
+		res = append(res, value)
+	}
+	return res, err
+}
+
 // forSeriesMatching passes all series matching the given matchers to the provided callback.
-// Deals with locking and the quirks of zero-length matcher values.
-func (u *userState) forSeriesMatching(allMatchers []*metric.LabelMatcher, callback func(model.Fingerprint, *memorySeries) error) error {
-	filters, matchers := util.SplitFiltersAndMatchers(allMatchers)
+// Deals with locking; the index deals with the quirks of zero-length matcher values.
+func (u *userState) forSeriesMatching(matchers []*metric.LabelMatcher, callback func(model.Fingerprint, *memorySeries) error) error {
 	fps := u.index.lookup(matchers)
 
 	// fps is sorted, lock them in order to prevent deadlocks
-outer:
 	for _, fp := range fps {
 		u.fpLocker.Lock(fp)
 		series, ok := u.fpToSeries.get(fp)
@@ -265,13 +340,6 @@ outer:
 			continue
 		}
 
-		for _, filter := range filters {
-			if !filter.Match(series.metric[filter.Name]) {
-				u.fpLocker.Unlock(fp)
-				continue outer
-			}
-		}
-
 		err := callback(fp, series)
 		u.fpLocker.Unlock(fp)
 		if err != nil {
@@ -0,0 +1,192 @@
+package querier
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+// overTimeAggregates are the functions over range vectors whose results can
+// be computed from one aggregate of the downsampled series, as the same
+// function of that aggregate.
+var overTimeAggregates = map[string]string{
+	"max_over_time": chunk.AggregateMax,
+	"min_over_time": chunk.AggregateMin,
+	"sum_over_time": chunk.AggregateSum,
+}
+
+type downsamplingKey struct{}
+
+// downsampling says which aggregate of the downsampled series at which
+// resolution a query can read in place of raw samples.
+type downsampling struct {
+	resolution time.Duration
+	aggregate  string
+}
+
+// WithDownsampling records which downsampled series the range query being
+// run can be answered from, if any, so the ChunkQuerier can read them.
+func WithDownsampling(ctx context.Context, query string, start model.Time, step time.Duration) context.Context {
+	resolution, aggregate := downsamplingFor(query, start, step)
+	if resolution == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, downsamplingKey{}, downsampling{resolution: resolution, aggregate: aggregate})
+}
+
+// DownsamplingFromRequest is WithDownsampling for the query, start and step
+// of a Prometheus API range query.  Other requests are left as they are.
+func DownsamplingFromRequest(r *http.Request) context.Context {
+	step := stepFromRequest(r)
+	start, err := util.ParseTime(r.FormValue("start"))
+	if step == 0 || err != nil {
+		return r.Context()
+	}
+	return WithDownsampling(r.Context(), r.FormValue("query"), start, step)
+}
+
+func downsamplingFrom(ctx context.Context) (downsampling, bool) {
+	d, ok := ctx.Value(downsamplingKey{}).(downsampling)
+	return d, ok
+}
+
+// stepFromRequest returns the `step` parameter of a Prometheus API query,
+// in the formats Prometheus accepts, or zero if there isn't a valid one.
+func stepFromRequest(r *http.Request) time.Duration {
+	s := r.FormValue("step")
+	if d, err := strconv.ParseFloat(s, 64); err == nil && d > 0 && d < math.MaxInt64/float64(time.Second) {
+		return time.Duration(d * float64(time.Second))
+	}
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d)
+	}
+	return 0
+}
+
+// downsamplingFor returns the resolution and aggregate of the downsampled
+// series a range query can be answered from, or zero if it needs raw
+// samples.  Every selector must be the range of the same one of
+// overTimeAggregates, as other functions, e.g. rate over counter resets,
+// can't be computed from the aggregates, and the ranges and evaluation times
+// must line up with the downsampled intervals.  A range's samples are then
+// those of whole intervals, except for samples exactly at its end, which
+// are read with the next interval.
+func downsamplingFor(query string, start model.Time, step time.Duration) (time.Duration, string) {
+	expr, err := promql.ParseExpr(query)
+	if err != nil {
+		return 0, ""
+	}
+	var (
+		aggregate string
+		durations = []time.Duration{time.Duration(start) * time.Millisecond, step}
+		ok        = true
+	)
+	promql.Inspect(expr, func(node promql.Node) bool {
+		switch n := node.(type) {
+		case *promql.Call:
+			a, known := overTimeAggregates[n.Func.Name]
+			if !known {
+				return true
+			}
+			selector, isMatrix := n.Args[0].(*promql.MatrixSelector)
+			if !isMatrix || (aggregate != "" && aggregate != a) {
+				ok = false
+				return false
+			}
+			aggregate = a
+			durations = append(durations, selector.Range, selector.Offset)
+			return false
+		case *promql.VectorSelector, *promql.MatrixSelector:
+			ok = false
+		}
+		return ok
+	})
+	if !ok || aggregate == "" {
+		return 0, ""
+	}
+
+	var result time.Duration
+outer:
+	for _, resolution := range chunk.Resolutions {
+		if resolution > step || resolution <= result {
+			continue
+		}
+		for _, d := range durations {
+			if d%resolution != 0 {
+				continue outer
+			}
+		}
+		result = resolution
+	}
+	if result == 0 {
+		return 0, ""
+	}
+	return result, aggregate
+}
+
+// queryDownsampled returns the given aggregate of the downsampled series
+// before boundary, up to which the tables have been compacted, in place of
+// the raw samples, and the raw samples from then on.
+func (q *ChunkQuerier) queryDownsampled(ctx context.Context, from, to, boundary model.Time, d downsampling, matchers []*metric.LabelMatcher) (model.Matrix, error) {
+	downsampledTo := to
+	if boundary <= to {
+		downsampledTo = boundary - 1
+	}
+	aggregated, err := q.aggregate(ctx, from, downsampledTo, d, matchers)
+	if err != nil {
+		return nil, err
+	}
+	if to < boundary {
+		return aggregated, nil
+	}
+
+	raw, err := q.query(ctx, boundary, to, matchers...)
+	if err != nil {
+		return nil, err
+	}
+	series := map[model.Fingerprint]*model.SampleStream{}
+	for _, ss := range aggregated {
+		series[ss.Metric.Fingerprint()] = ss
+	}
+	for _, ss := range raw {
+		values := util.SamplesBetween(ss.Values, boundary, model.Latest)
+		if existing, ok := series[ss.Metric.Fingerprint()]; ok {
+			existing.Values = append(existing.Values, values...)
+		} else {
+			series[ss.Metric.Fingerprint()] = &model.SampleStream{Metric: ss.Metric, Values: values}
+		}
+	}
+
+	result := make(model.Matrix, 0, len(series))
+	for _, ss := range series {
+		result = append(result, ss)
+	}
+	return result, nil
+}
+
+// aggregate reads the aggregate's series at the resolution, up to through,
+// as the raw series.
+func (q *ChunkQuerier) aggregate(ctx context.Context, from, through model.Time, d downsampling, matchers []*metric.LabelMatcher) (model.Matrix, error) {
+	matchers = append(matchers[:len(matchers):len(matchers)],
+		&metric.LabelMatcher{Type: metric.Equal, Name: chunk.ResolutionLabel, Value: model.LabelValue(model.Duration(d.resolution).String())},
+		&metric.LabelMatcher{Type: metric.Equal, Name: chunk.AggregateLabel, Value: model.LabelValue(d.aggregate)},
+	)
+	matrix, err := q.query(ctx, from, through, matchers...)
+	if err != nil {
+		return nil, err
+	}
+	for _, ss := range matrix {
+		ss.Metric = chunk.RawMetric(ss.Metric)
+		ss.Values = util.SamplesBetween(ss.Values, model.Earliest, through+1)
+	}
+	return matrix, nil
+}
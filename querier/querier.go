@@ -1,8 +1,11 @@
 package querier
 
 import (
+	"flag"
 	"fmt"
 	"net/http"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/prometheus/common/log"
@@ -12,30 +15,58 @@ import (
 	"github.com/prometheus/prometheus/storage/metric"
 	"golang.org/x/net/context"
 
+	"github.com/weaveworks/common/user"
 	"github.com/weaveworks/cortex"
 	"github.com/weaveworks/cortex/chunk"
 	"github.com/weaveworks/cortex/util"
 )
 
+// DefaultLabelLookback is how far back label names and values are looked up
+// when the caller doesn't give a time range.
+const DefaultLabelLookback = 12 * time.Hour
+
 // ChunkStore is the interface we need to get chunks
 type ChunkStore interface {
 	Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]chunk.Chunk, error)
+	LabelValuesForMetricName(ctx context.Context, from, through model.Time, metricName model.LabelValue, labelName model.LabelName) (model.LabelValues, error)
+	LabelNamesForMetricName(ctx context.Context, from, through model.Time, metricName model.LabelValue) (model.LabelNames, error)
+	MetricNames(ctx context.Context, from, through model.Time) (model.LabelValues, error)
+	QueryLimits(userID string) chunk.QueryLimits
+	CompactedThrough(ctx context.Context, from, through model.Time) (model.Time, error)
+}
+
+// Config configures the querier.  Limits on queries are set in the chunk
+// store's config, as it enforces them while fetching chunks.
+type Config struct {
+	// Range queries of max_over_time, min_over_time or sum_over_time with
+	// steps of at least 5m read those aggregates of the downsampled series
+	// written by the compactor, where it has compacted the tables.
+	ReadDownsampled bool
+}
+
+// RegisterFlags adds the flags required to config this to the given FlagSet
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.BoolVar(&cfg.ReadDownsampled, "querier.read-downsampled", false, "Read the downsampled series of compacted tables for range queries of max_over_time, min_over_time or sum_over_time with coarse steps.")
 }
 
 // NewEngine creates a new promql.Engine for cortex.
-func NewEngine(distributor Querier, chunkStore ChunkStore) *promql.Engine {
-	queryable := NewQueryable(distributor, chunkStore)
+func NewEngine(cfg Config, distributor Querier, chunkStore ChunkStore) *promql.Engine {
+	queryable := NewQueryable(cfg, distributor, chunkStore)
 	return promql.NewEngine(queryable, nil)
 }
 
 // NewQueryable creates a new Queryable for cortex.
-func NewQueryable(distributor Querier, chunkStore ChunkStore) Queryable {
+func NewQueryable(cfg Config, distributor Querier, chunkStore ChunkStore) Queryable {
 	return Queryable{
 		Q: MergeQuerier{
+			Config: cfg,
+			Limits: chunkStore.QueryLimits,
 			Queriers: []Querier{
 				distributor,
 				&ChunkQuerier{
-					Store: chunkStore,
+					Store:           chunkStore,
+					MetricNames:     distributor,
+					ReadDownsampled: cfg.ReadDownsampled,
 				},
 			},
 		},
@@ -46,18 +77,43 @@ func NewQueryable(distributor Querier, chunkStore ChunkStore) Queryable {
 // of label matchers.
 type Querier interface {
 	Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error)
-	LabelValuesForLabelName(context.Context, model.LabelName) (model.LabelValues, error)
+	LabelValuesForLabelName(ctx context.Context, from, through model.Time, name model.LabelName) (model.LabelValues, error)
+	LabelNames(ctx context.Context, from, through model.Time) (model.LabelNames, error)
 	MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error)
 }
 
 // A ChunkQuerier is a Querier that fetches samples from a ChunkStore.
 type ChunkQuerier struct {
 	Store ChunkStore
+
+	// The chunk index is keyed by metric name, so label lookups which aren't
+	// restricted to a metric are done once per metric name.  Only the newer
+	// schemas list metric names, so those known to MetricNames are used too.
+	MetricNames Querier
+
+	// Whether data in compacted tables is read from the downsampled series,
+	// for queries WithDownsampling finds can be.
+	ReadDownsampled bool
 }
 
 // Query implements Querier and transforms a list of chunks into sample
 // matrices.
 func (q *ChunkQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	d, ok := downsamplingFrom(ctx)
+	if !q.ReadDownsampled || !ok || chunk.SelectsDownsampled(matchers) {
+		return q.query(ctx, from, to, matchers...)
+	}
+	boundary, err := q.Store.CompactedThrough(ctx, from, to)
+	if err != nil {
+		return nil, promql.ErrStorage(err)
+	}
+	if boundary <= from {
+		return q.query(ctx, from, to, matchers...)
+	}
+	return q.queryDownsampled(ctx, from, to, boundary, d, matchers)
+}
+
+func (q *ChunkQuerier) query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
 	// Get chunks for all matching series from ChunkStore.
 	chunks, err := q.Store.Get(ctx, from, to, matchers...)
 	if err != nil {
@@ -67,15 +123,128 @@ func (q *ChunkQuerier) Query(ctx context.Context, from, to model.Time, matchers
 	return chunk.ChunksToMatrix(chunks)
 }
 
+// metricNames returns the metric names to look up in the chunk index.  Where
+// the index doesn't list them, ie. for ranges before the v7 schema, only the
+// names known to the ingesters are used, so metrics which are no longer being
+// written are missed.
+func (q *ChunkQuerier) metricNames(ctx context.Context, from, through model.Time) (model.LabelValues, error) {
+	names, err := q.indexedMetricNames(ctx, from, through)
+	if err != nil {
+		return nil, err
+	}
+	if q.MetricNames == nil {
+		return names, nil
+	}
+
+	// Ask for all the names the ingesters know about, not just those with
+	// samples in the queried range.
+	ingesterNames, err := q.MetricNames.LabelValuesForLabelName(ctx, 0, 0, model.MetricNameLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	nameSet := map[model.LabelValue]struct{}{}
+	for _, name := range append(names, ingesterNames...) {
+		nameSet[name] = struct{}{}
+	}
+	result := make(model.LabelValues, 0, len(nameSet))
+	for name := range nameSet {
+		result = append(result, name)
+	}
+	return result, nil
+}
+
+// indexedMetricNames returns the metric names listed in the chunk index, or
+// none if part of the range uses a schema which doesn't list them.
+func (q *ChunkQuerier) indexedMetricNames(ctx context.Context, from, through model.Time) (model.LabelValues, error) {
+	names, err := q.Store.MetricNames(ctx, from, through)
+	if err == chunk.ErrMetricNamesNotIndexed {
+		return nil, nil
+	} else if err != nil {
+		return nil, promql.ErrStorage(err)
+	}
+	return names, nil
+}
+
 // LabelValuesForLabelName returns all of the label values that are associated with a given label name.
-func (q *ChunkQuerier) LabelValuesForLabelName(ctx context.Context, ln model.LabelName) (model.LabelValues, error) {
-	// TODO: Support querying historical label values at some point?
-	return nil, nil
+// For ranges before the v7 schema, only metrics the ingesters know are looked
+// up; see metricNames.
+func (q *ChunkQuerier) LabelValuesForLabelName(ctx context.Context, from, through model.Time, ln model.LabelName) (model.LabelValues, error) {
+	if ln == model.MetricNameLabel {
+		// Only the metric names listed in the index; the caller gets the rest
+		// from MetricNames.
+		return q.indexedMetricNames(ctx, from, through)
+	}
+
+	metricNames, err := q.metricNames(ctx, from, through)
+	if err != nil {
+		return nil, err
+	}
+
+	valueSet := map[model.LabelValue]struct{}{}
+	for _, metricName := range metricNames {
+		vals, err := q.Store.LabelValuesForMetricName(ctx, from, through, metricName, ln)
+		if err != nil {
+			return nil, promql.ErrStorage(err)
+		}
+		for _, v := range vals {
+			valueSet[v] = struct{}{}
+		}
+	}
+
+	values := make(model.LabelValues, 0, len(valueSet))
+	for v := range valueSet {
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// LabelNames returns all of the label names of series with chunks in the given range.
+// For ranges before the v7 schema, only metrics the ingesters know are looked
+// up; see metricNames.
+func (q *ChunkQuerier) LabelNames(ctx context.Context, from, through model.Time) (model.LabelNames, error) {
+	metricNames, err := q.metricNames(ctx, from, through)
+	if err != nil {
+		return nil, err
+	}
+
+	nameSet := map[model.LabelName]struct{}{}
+	for _, metricName := range metricNames {
+		names, err := q.Store.LabelNamesForMetricName(ctx, from, through, metricName)
+		if err != nil {
+			return nil, promql.ErrStorage(err)
+		}
+		for _, n := range names {
+			nameSet[n] = struct{}{}
+		}
+	}
+
+	names := make(model.LabelNames, 0, len(nameSet))
+	for n := range nameSet {
+		names = append(names, n)
+	}
+	return names, nil
 }
 
-// MetricsForLabelMatchers is a noop for chunk querier.
+// MetricsForLabelMatchers returns the metrics of chunks matching any of the
+// matcher sets.
 func (q *ChunkQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
-	return nil, nil
+	metrics := map[model.Fingerprint]metric.Metric{}
+	for _, matchers := range matcherSets {
+		chunks, err := q.Store.Get(ctx, from, through, matchers...)
+		if err != nil {
+			return nil, promql.ErrStorage(err)
+		}
+		for _, c := range chunks {
+			metrics[c.Metric.Fingerprint()] = metric.Metric{Metric: c.Metric}
+		}
+	}
+
+	result := make([]metric.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		result = append(result, m)
+	}
+	return result, nil
 }
 
 // Queryable is an adapter between Prometheus' Queryable and Querier.
@@ -83,20 +252,58 @@ type Queryable struct {
 	Q MergeQuerier
 }
 
-// Querier implements Queryable
+// Querier implements Queryable.  The engine gets a querier for each query,
+// so the query's selectors share one chunk.QueryUsage.
 func (q Queryable) Querier() (local.Querier, error) {
-	return q.Q, nil
+	qm := q.Q
+	qm.usage = &queryUsage{}
+	return qm, nil
 }
 
 // A MergeQuerier is a promql.Querier that merges the results of multiple
 // cortex.Queriers for the same query.
 type MergeQuerier struct {
+	Config
 	Queriers []Querier
+
+	// The merged results, which include the ingesters' series, are checked
+	// against the tenant's series and samples limits.
+	Limits func(userID string) chunk.QueryLimits
+
+	usage *queryUsage
+}
+
+// queryUsage counts the chunk store resources used by all the selectors of
+// one query.  It is made for the first selector, as the tenant, and so their
+// limits, aren't known until then.
+type queryUsage struct {
+	once  sync.Once
+	usage *chunk.QueryUsage
+}
+
+// withQueryUsage attaches the query's usage to ctx, if it has one.
+func (qm MergeQuerier) withQueryUsage(ctx context.Context) (context.Context, error) {
+	if qm.usage == nil || qm.Limits == nil {
+		return ctx, nil
+	}
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return nil, err
+	}
+	qm.usage.once.Do(func() {
+		qm.usage.usage = chunk.NewQueryUsage(qm.Limits(userID))
+	})
+	return chunk.WithQueryUsage(ctx, qm.usage.usage), nil
 }
 
 // Query fetches series for a given time range and label matchers from multiple
 // promql.Queriers and returns the merged results as a model.Matrix.
 func (qm MergeQuerier) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	ctx, err := qm.withQueryUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	// Fetch samples from all queriers in parallel.
 	matrices := make(chan model.Matrix)
 	errors := make(chan error)
@@ -112,10 +319,39 @@ func (qm MergeQuerier) Query(ctx context.Context, from, to model.Time, matchers
 	}
 
 	matrix, err := mergeMatrices(matrices, errors, len(qm.Queriers))
+	if err == nil {
+		err = qm.checkLimits(ctx, matrix)
+	}
 	if err != nil {
 		log.Errorf("Error in MergeQuerier.Query: %v", err)
+		return nil, err
+	}
+	return matrix, nil
+}
+
+func (qm MergeQuerier) checkLimits(ctx context.Context, matrix model.Matrix) error {
+	if qm.Limits == nil {
+		return nil
+	}
+	userID, err := user.Extract(ctx)
+	if err != nil {
+		return err
+	}
+	limits := qm.Limits(userID)
+
+	if limits.MaxSeriesPerQuery > 0 && len(matrix) > limits.MaxSeriesPerQuery {
+		return chunk.QueryLimitError{What: "series", Limit: limits.MaxSeriesPerQuery}
 	}
-	return matrix, err
+	if limits.MaxSamplesPerQuery > 0 {
+		samples := 0
+		for _, ss := range matrix {
+			samples += len(ss.Values)
+		}
+		if samples > limits.MaxSamplesPerQuery {
+			return chunk.QueryLimitError{What: "samples", Limit: limits.MaxSamplesPerQuery}
+		}
+	}
+	return nil
 }
 
 // QueryRange fetches series for a given time range and label matchers from multiple
@@ -144,8 +380,7 @@ func (qm MergeQuerier) QueryInstant(ctx context.Context, ts model.Time, stalenes
 
 // MetricsForLabelMatchers Implements local.Querier.
 func (qm MergeQuerier) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
-	// NB we don't do this in parallel, as in practice we only have 2 queriers,
-	// one of which is the chunk store which doesn't implement this.
+	// NB we don't do this in parallel, as in practice we only have 2 queriers.
 
 	metrics := map[model.Fingerprint]metric.Metric{}
 	for _, q := range qm.Queriers {
@@ -171,11 +406,18 @@ func (qm MergeQuerier) LastSampleForLabelMatchers(ctx context.Context, cutoff mo
 	return nil, nil
 }
 
-// LabelValuesForLabelName implements local.Querier.
+// LabelValuesForLabelName implements local.Querier, looking back DefaultLabelLookback.
 func (qm MergeQuerier) LabelValuesForLabelName(ctx context.Context, name model.LabelName) (model.LabelValues, error) {
+	through := model.Now()
+	return qm.LabelValuesInRange(ctx, through.Add(-DefaultLabelLookback), through, name)
+}
+
+// LabelValuesInRange returns the values of the named label for series with
+// samples between from and through.
+func (qm MergeQuerier) LabelValuesInRange(ctx context.Context, from, through model.Time, name model.LabelName) (model.LabelValues, error) {
 	valueSet := map[model.LabelValue]struct{}{}
 	for _, q := range qm.Queriers {
-		vals, err := q.LabelValuesForLabelName(ctx, name)
+		vals, err := q.LabelValuesForLabelName(ctx, from, through, name)
 		if err != nil {
 			return nil, err
 		}
@@ -191,6 +433,26 @@ func (qm MergeQuerier) LabelValuesForLabelName(ctx context.Context, name model.L
 	return values, nil
 }
 
+// LabelNames returns the label names of series with samples between from and through.
+func (qm MergeQuerier) LabelNames(ctx context.Context, from, through model.Time) (model.LabelNames, error) {
+	nameSet := map[model.LabelName]struct{}{}
+	for _, q := range qm.Queriers {
+		names, err := q.LabelNames(ctx, from, through)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			nameSet[n] = struct{}{}
+		}
+	}
+
+	names := make(model.LabelNames, 0, len(nameSet))
+	for n := range nameSet {
+		names = append(names, n)
+	}
+	return names, nil
+}
+
 // Close is a noop
 func (qm MergeQuerier) Close() error {
 	return nil
@@ -243,6 +505,51 @@ func (qm MergeQuerier) RemoteReadHandler(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// LabelNamesHandler serves the label names of series with samples between the
+// optional `start` and `end` parameters, in the format of Prometheus's
+// /api/v1/labels.  Without them, it looks back DefaultLabelLookback.  Where
+// the range uses a schema before v7, the names of series of metrics no longer
+// in the ingesters are left out.
+func (qm MergeQuerier) LabelNamesHandler(w http.ResponseWriter, r *http.Request) {
+	through := model.Now()
+	from := through.Add(-DefaultLabelLookback)
+	var err error
+	if end := r.FormValue("end"); end != "" {
+		if through, err = util.ParseTime(end); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = through.Add(-DefaultLabelLookback)
+	}
+	if start := r.FormValue("start"); start != "" {
+		if from, err = util.ParseTime(start); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if through < from {
+		http.Error(w, "end timestamp must not be before start time", http.StatusBadRequest)
+		return
+	}
+
+	names, err := qm.LabelNames(r.Context(), from, through)
+	if err != nil {
+		log.Errorf("Error getting label names: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Sort(names)
+
+	// As for ValidateExprHandler, we mimic the response format of Prometheus's API.
+	util.WriteJSONResponse(w, struct {
+		Status string           `json:"status"`
+		Data   model.LabelNames `json:"data"`
+	}{
+		Status: "success",
+		Data:   names,
+	})
+}
+
 func mergeMatrices(matrices chan model.Matrix, errors chan error, n int) (model.Matrix, error) {
 	// Group samples from all matrices by fingerprint.
 	fpToSS := map[model.Fingerprint]*model.SampleStream{}
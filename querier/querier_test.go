@@ -0,0 +1,404 @@
+package querier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/common/user"
+	"github.com/weaveworks/cortex/chunk"
+	"github.com/weaveworks/cortex/util"
+)
+
+const userID = "1"
+
+// mockChunkStore is a ChunkStore holding the given chunks.  If unindexed, it
+// behaves like a store whose schema doesn't list metric names.  Like the
+// index, it only looks up downsampled series when they're asked for.
+type mockChunkStore struct {
+	chunks           []chunk.Chunk
+	unindexed        bool
+	limits           chunk.QueryLimits
+	compactedThrough model.Time
+}
+
+func (s *mockChunkStore) Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]chunk.Chunk, error) {
+	if !chunk.SelectsDownsampled(matchers) {
+		matchers = append(matchers, &metric.LabelMatcher{Type: metric.Equal, Name: chunk.ResolutionLabel})
+	}
+	var result []chunk.Chunk
+outer:
+	for _, c := range s.chunks {
+		if c.Through < from || through < c.From {
+			continue
+		}
+		for _, matcher := range matchers {
+			if !matcher.Match(c.Metric[matcher.Name]) {
+				continue outer
+			}
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+func (s *mockChunkStore) LabelValuesForMetricName(ctx context.Context, from, through model.Time, metricName model.LabelValue, labelName model.LabelName) (model.LabelValues, error) {
+	var result model.LabelValues
+	for _, c := range s.chunks {
+		if c.Metric[model.MetricNameLabel] == metricName && c.Through >= from && through >= c.From && !chunk.IsDownsampled(c.Metric) {
+			if value, ok := c.Metric[labelName]; ok {
+				result = append(result, value)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (s *mockChunkStore) LabelNamesForMetricName(ctx context.Context, from, through model.Time, metricName model.LabelValue) (model.LabelNames, error) {
+	var result model.LabelNames
+	for _, c := range s.chunks {
+		if c.Metric[model.MetricNameLabel] == metricName && c.Through >= from && through >= c.From && !chunk.IsDownsampled(c.Metric) {
+			for name := range c.Metric {
+				result = append(result, name)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (s *mockChunkStore) MetricNames(ctx context.Context, from, through model.Time) (model.LabelValues, error) {
+	if s.unindexed {
+		return nil, chunk.ErrMetricNamesNotIndexed
+	}
+	var result model.LabelValues
+	for _, c := range s.chunks {
+		if c.Through >= from && through >= c.From && !chunk.IsDownsampled(c.Metric) {
+			result = append(result, c.Metric[model.MetricNameLabel])
+		}
+	}
+	return result, nil
+}
+
+func (s *mockChunkStore) QueryLimits(userID string) chunk.QueryLimits {
+	return s.limits
+}
+
+func (s *mockChunkStore) CompactedThrough(ctx context.Context, from, through model.Time) (model.Time, error) {
+	if s.compactedThrough > from {
+		return s.compactedThrough, nil
+	}
+	return from, nil
+}
+
+// mockIngesters is a Querier for the series held by the ingesters.
+type mockIngesters struct {
+	matrix model.Matrix
+}
+
+func (q *mockIngesters) Query(ctx context.Context, from, to model.Time, matchers ...*metric.LabelMatcher) (model.Matrix, error) {
+	var result model.Matrix
+outer:
+	for _, ss := range q.matrix {
+		for _, matcher := range matchers {
+			if !matcher.Match(ss.Metric[matcher.Name]) {
+				continue outer
+			}
+		}
+		result = append(result, ss)
+	}
+	return result, nil
+}
+
+func (q *mockIngesters) LabelValuesForLabelName(ctx context.Context, from, through model.Time, name model.LabelName) (model.LabelValues, error) {
+	var result model.LabelValues
+	for _, ss := range q.matrix {
+		if value, ok := ss.Metric[name]; ok {
+			result = append(result, value)
+		}
+	}
+	return result, nil
+}
+
+func (q *mockIngesters) LabelNames(ctx context.Context, from, through model.Time) (model.LabelNames, error) {
+	var result model.LabelNames
+	for _, ss := range q.matrix {
+		for name := range ss.Metric {
+			result = append(result, name)
+		}
+	}
+	return result, nil
+}
+
+func (q *mockIngesters) MetricsForLabelMatchers(ctx context.Context, from, through model.Time, matcherSets ...metric.LabelMatchers) ([]metric.Metric, error) {
+	return nil, nil
+}
+
+func chunksFor(t *testing.T, m model.Metric, samples ...model.SamplePair) []chunk.Chunk {
+	chunks, err := chunk.ChunksForSamples(userID, m, samples)
+	require.NoError(t, err)
+	return chunks
+}
+
+func TestLabelNamesHandler(t *testing.T) {
+	now := model.Now()
+	store := &mockChunkStore{}
+	store.chunks = append(store.chunks, chunksFor(t, model.Metric{model.MetricNameLabel: "foo", "old": "a"},
+		model.SamplePair{Timestamp: now.Add(-DefaultLabelLookback * 2), Value: 1})...)
+	store.chunks = append(store.chunks, chunksFor(t, model.Metric{model.MetricNameLabel: "foo", "stored": "b"},
+		model.SamplePair{Timestamp: now.Add(-DefaultLabelLookback / 2), Value: 1})...)
+	downsampled := model.Metric{model.MetricNameLabel: "foo", "stored": "b", chunk.ResolutionLabel: "5m", chunk.AggregateLabel: "sum"}
+	store.chunks = append(store.chunks, chunksFor(t, downsampled,
+		model.SamplePair{Timestamp: now.Add(-DefaultLabelLookback / 2), Value: 1})...)
+	ingesters := &mockIngesters{matrix: model.Matrix{
+		{Metric: model.Metric{model.MetricNameLabel: "bar", "ingested": "c"}},
+	}}
+	qm := NewQueryable(Config{}, ingesters, store).Q
+
+	for _, tc := range []struct {
+		query string
+		code  int
+		names model.LabelNames
+	}{
+		{"", http.StatusOK, model.LabelNames{model.MetricNameLabel, "ingested", "stored"}},
+		{"?start=0", http.StatusOK, model.LabelNames{model.MetricNameLabel, "ingested", "old", "stored"}},
+		{"?start=foo", http.StatusBadRequest, nil},
+		{"?start=10&end=5", http.StatusBadRequest, nil},
+	} {
+		req := httptest.NewRequest("GET", "/api/prom/api/v1/labels"+tc.query, nil)
+		req = req.WithContext(user.Inject(req.Context(), userID))
+		w := httptest.NewRecorder()
+		qm.LabelNamesHandler(w, req)
+		require.Equal(t, tc.code, w.Code, tc.query)
+		if tc.code != http.StatusOK {
+			continue
+		}
+		var resp struct {
+			Status string           `json:"status"`
+			Data   model.LabelNames `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "success", resp.Status)
+		assert.Equal(t, tc.names, resp.Data, tc.query)
+	}
+}
+
+func TestLabelValuesWithoutIndexedMetricNames(t *testing.T) {
+	now := model.Now()
+	store := &mockChunkStore{
+		chunks: chunksFor(t, model.Metric{model.MetricNameLabel: "foo", "job": "stored"},
+			model.SamplePair{Timestamp: now.Add(-time.Hour), Value: 1}),
+		unindexed: true,
+	}
+	ingesters := &mockIngesters{matrix: model.Matrix{
+		{Metric: model.Metric{model.MetricNameLabel: "foo", "job": "ingested"}},
+	}}
+	qm := NewQueryable(Config{}, ingesters, store).Q
+	ctx := user.Inject(context.Background(), userID)
+
+	// Label values are still found for the metric names the ingesters know.
+	values, err := qm.LabelValuesInRange(ctx, now.Add(-2*time.Hour), now, "job")
+	require.NoError(t, err)
+	sort.Sort(values)
+	assert.Equal(t, model.LabelValues{"ingested", "stored"}, values)
+
+	names, err := qm.LabelValuesInRange(ctx, now.Add(-2*time.Hour), now, model.MetricNameLabel)
+	require.NoError(t, err)
+	assert.Equal(t, model.LabelValues{"foo"}, names)
+}
+
+// Before v7, the label names of metrics the ingesters no longer have are
+// missed.
+func TestLabelNamesWithoutIndexedMetricNames(t *testing.T) {
+	now := model.Now()
+	store := &mockChunkStore{
+		chunks: append(
+			chunksFor(t, model.Metric{model.MetricNameLabel: "foo", "job": "stored"},
+				model.SamplePair{Timestamp: now.Add(-time.Hour), Value: 1}),
+			chunksFor(t, model.Metric{model.MetricNameLabel: "bar", "instance": "stored"},
+				model.SamplePair{Timestamp: now.Add(-time.Hour), Value: 1})...),
+		unindexed: true,
+	}
+	ingesters := &mockIngesters{matrix: model.Matrix{
+		{Metric: model.Metric{model.MetricNameLabel: "foo", "env": "ingested"}},
+	}}
+	qm := NewQueryable(Config{}, ingesters, store).Q
+	ctx := user.Inject(context.Background(), userID)
+
+	names, err := qm.LabelNames(ctx, now.Add(-2*time.Hour), now)
+	require.NoError(t, err)
+	sort.Sort(names)
+	assert.Equal(t, model.LabelNames{model.MetricNameLabel, "env", "job"}, names)
+}
+
+func TestMergeQuerierLimits(t *testing.T) {
+	ingesters := &mockIngesters{}
+	for _, instance := range []model.LabelValue{"a", "b", "c"} {
+		ingesters.matrix = append(ingesters.matrix, &model.SampleStream{
+			Metric: model.Metric{model.MetricNameLabel: "foo", "instance": instance},
+			Values: []model.SamplePair{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}},
+		})
+	}
+	ctx := user.Inject(context.Background(), userID)
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		limits chunk.QueryLimits
+		err    error
+	}{
+		{chunk.QueryLimits{}, nil},
+		{chunk.QueryLimits{MaxSeriesPerQuery: 3, MaxSamplesPerQuery: 6}, nil},
+		{chunk.QueryLimits{MaxSeriesPerQuery: 2}, chunk.QueryLimitError{What: "series", Limit: 2}},
+		{chunk.QueryLimits{MaxSamplesPerQuery: 5}, chunk.QueryLimitError{What: "samples", Limit: 5}},
+	} {
+		store := &mockChunkStore{limits: tc.limits}
+		matrix, err := NewQueryable(Config{}, ingesters, store).Q.Query(ctx, 0, 10, matcher)
+		assert.Equal(t, tc.err, err)
+		if tc.err == nil {
+			assert.Len(t, matrix, 3)
+		}
+	}
+}
+
+// Each query's selectors share one chunk.QueryUsage.
+func TestQueryableQueryUsage(t *testing.T) {
+	ctx := user.Inject(context.Background(), userID)
+	matcher, err := metric.NewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	require.NoError(t, err)
+	queryable := NewQueryable(Config{}, &mockIngesters{}, &mockChunkStore{})
+
+	usage := func() *chunk.QueryUsage {
+		q, err := queryable.Querier()
+		require.NoError(t, err)
+		qm := q.(MergeQuerier)
+		for i := 0; i < 2; i++ {
+			_, err := qm.Query(ctx, 0, 10, matcher)
+			require.NoError(t, err)
+			require.NotNil(t, qm.usage.usage)
+		}
+		return qm.usage.usage
+	}
+	assert.True(t, usage() != usage(), "queries share a QueryUsage")
+}
+
+func TestDownsamplingFor(t *testing.T) {
+	for _, tc := range []struct {
+		query      string
+		start      model.Time
+		step       time.Duration
+		resolution time.Duration
+		aggregate  string
+	}{
+		{"max_over_time(foo[10m])", 0, 5 * time.Minute, 5 * time.Minute, chunk.AggregateMax},
+		{"sum(min_over_time(foo[2h] offset 1h))", 0, time.Hour, time.Hour, chunk.AggregateMin},
+		{"sum_over_time(foo[2h]) / 2", 0, 2 * time.Hour, time.Hour, chunk.AggregateSum},
+		{"max_over_time(foo[10m]) > max_over_time(bar[1h])", 0, time.Hour, 5 * time.Minute, chunk.AggregateMax},
+		// Fine steps, and ranges or times not lined up with the intervals.
+		{"max_over_time(foo[10m])", 0, time.Minute, 0, ""},
+		{"max_over_time(foo[7m])", 0, 5 * time.Minute, 0, ""},
+		{"max_over_time(foo[10m] offset 1m)", 0, 5 * time.Minute, 0, ""},
+		{"max_over_time(foo[10m])", 1000, 5 * time.Minute, 0, ""},
+		// Functions which can't be computed from the aggregates.
+		{"rate(foo[10m])", 0, 5 * time.Minute, 0, ""},
+		{"count_over_time(foo[10m])", 0, 5 * time.Minute, 0, ""},
+		{"avg_over_time(foo[10m])", 0, 5 * time.Minute, 0, ""},
+		{"foo", 0, 5 * time.Minute, 0, ""},
+		{"max_over_time(foo[10m]) - foo", 0, 5 * time.Minute, 0, ""},
+		{"max_over_time(foo[10m]) - min_over_time(foo[10m])", 0, 5 * time.Minute, 0, ""},
+		{"max_over_time(", 0, 5 * time.Minute, 0, ""},
+	} {
+		resolution, aggregate := downsamplingFor(tc.query, tc.start, tc.step)
+		assert.Equal(t, tc.resolution, resolution, tc.query)
+		assert.Equal(t, tc.aggregate, aggregate, tc.query)
+	}
+}
+
+// recordingChunkStore records the aggregates of downsampled series read.
+type recordingChunkStore struct {
+	*mockChunkStore
+	mtx        sync.Mutex
+	aggregates []model.LabelValue
+}
+
+func (s *recordingChunkStore) Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]chunk.Chunk, error) {
+	for _, m := range matchers {
+		if m.Name == chunk.AggregateLabel {
+			s.mtx.Lock()
+			s.aggregates = append(s.aggregates, m.Value)
+			s.mtx.Unlock()
+		}
+	}
+	return s.mockChunkStore.Get(ctx, from, through, matchers...)
+}
+
+func TestDownsampledQueries(t *testing.T) {
+	// Two hours of a gauge and a counter which resets, scraped every 15s,
+	// of which the compactor has downsampled the first hour.
+	var (
+		gauge    = model.Metric{model.MetricNameLabel: "gauge"}
+		counter  = model.Metric{model.MetricNameLabel: "counter"}
+		boundary = model.TimeFromUnix(int64(time.Hour / time.Second))
+		end      = model.TimeFromUnix(int64(2 * time.Hour / time.Second))
+		gauges   []model.SamplePair
+		counts   []model.SamplePair
+		chunks   []chunk.Chunk
+	)
+	for i, ts := 0, model.Time(7000); ts < end; i, ts = i+1, ts.Add(15*time.Second) {
+		gauges = append(gauges, model.SamplePair{Timestamp: ts, Value: model.SampleValue(i * 37 % 101)})
+		counts = append(counts, model.SamplePair{Timestamp: ts, Value: model.SampleValue(i % 150 * 3)})
+	}
+	for _, series := range []struct {
+		metric  model.Metric
+		samples []model.SamplePair
+	}{{gauge, gauges}, {counter, counts}} {
+		chunks = append(chunks, chunksFor(t, series.metric, series.samples...)...)
+		compacted := util.SamplesBetween(series.samples, 0, boundary)
+		for _, resolution := range chunk.Resolutions {
+			for aggregate, aggregated := range chunk.Downsample(compacted, resolution) {
+				chunks = append(chunks, chunksFor(t, chunk.DownsampledMetric(series.metric, resolution, aggregate), aggregated...)...)
+			}
+		}
+	}
+	ctx := user.Inject(context.Background(), userID)
+	start, step := model.TimeFromUnix(int64(15*time.Minute/time.Second)), 5*time.Minute
+
+	for _, tc := range []struct {
+		query      string
+		aggregates []model.LabelValue
+	}{
+		{"max_over_time(gauge[10m])", []model.LabelValue{chunk.AggregateMax}},
+		{"min_over_time(gauge[15m] offset 5m)", []model.LabelValue{chunk.AggregateMin}},
+		{"sum_over_time(counter[10m])", []model.LabelValue{chunk.AggregateSum}},
+		{"rate(counter[10m])", nil},
+		{"count_over_time(gauge[10m])", nil},
+		{"max_over_time(gauge[10m]) - gauge", nil},
+	} {
+		run := func(readDownsampled bool) (model.Matrix, []model.LabelValue) {
+			store := &recordingChunkStore{mockChunkStore: &mockChunkStore{chunks: chunks, compactedThrough: boundary}}
+			queryable := NewQueryable(Config{ReadDownsampled: readDownsampled}, &mockIngesters{}, store)
+			query, err := promql.NewEngine(queryable, nil).NewRangeQuery(tc.query, start, end, step)
+			require.NoError(t, err)
+			matrix, err := query.Exec(WithDownsampling(ctx, tc.query, start, step)).Matrix()
+			require.NoError(t, err, tc.query)
+			return matrix, store.aggregates
+		}
+
+		raw, _ := run(false)
+		downsampled, aggregates := run(true)
+		require.Len(t, raw, 1, tc.query)
+		require.Len(t, raw[0].Values, 22, tc.query)
+		assert.Equal(t, raw, downsampled, tc.query)
+		assert.Equal(t, tc.aggregates, aggregates, tc.query)
+	}
+}
@@ -107,3 +107,21 @@ func (d *Desc) TokensFor(id string) (tokens, other []uint32) {
 	}
 	return myTokens, takenTokens
 }
+
+// PrimaryIngester returns the ID of the first ACTIVE ingester owning a token
+// after key, i.e. the first replica the distributor writes key to.
+func (d *Desc) PrimaryIngester(key uint32) (string, bool) {
+	if len(d.Tokens) == 0 {
+		return "", false
+	}
+	start := sort.Search(len(d.Tokens), func(x int) bool {
+		return d.Tokens[x].Token > key
+	})
+	for i := 0; i < len(d.Tokens); i++ {
+		token := d.Tokens[(start+i)%len(d.Tokens)]
+		if ingester, ok := d.Ingesters[token.Ingester]; ok && ingester.State == ACTIVE {
+			return token.Ingester, true
+		}
+	}
+	return "", false
+}
@@ -43,3 +43,31 @@ func BenchmarkRing(b *testing.B) {
 		r.BatchGet(keys, 3, Write)
 	}
 }
+
+func TestPrimaryIngester(t *testing.T) {
+	desc := NewDesc()
+	desc.AddIngester("a", "ingester-a", []uint32{10, 30}, ACTIVE)
+	desc.AddIngester("b", "ingester-b", []uint32{20}, ACTIVE)
+	desc.AddIngester("c", "ingester-c", []uint32{40}, LEAVING)
+
+	for _, tc := range []struct {
+		key      uint32
+		expected string
+	}{
+		{5, "a"},
+		{10, "b"},
+		{25, "a"},
+		// c isn't ACTIVE, so we skip it and wrap around.
+		{35, "a"},
+		{45, "a"},
+	} {
+		primary, ok := desc.PrimaryIngester(tc.key)
+		if !ok || primary != tc.expected {
+			t.Errorf("PrimaryIngester(%d) = %q, %v; expected %q", tc.key, primary, ok, tc.expected)
+		}
+	}
+
+	if _, ok := NewDesc().PrimaryIngester(0); ok {
+		t.Errorf("PrimaryIngester on an empty ring should fail")
+	}
+}
@@ -1,11 +1,21 @@
 package ring
 
 import (
+	"hash/fnv"
 	"math/rand"
 	"sort"
 	"time"
 )
 
+// TokenFor returns the token series of the given user and metric name are
+// placed at in the ring.
+func TokenFor(userID string, metricName []byte) uint32 {
+	h := fnv.New32()
+	h.Write([]byte(userID))
+	h.Write(metricName)
+	return h.Sum32()
+}
+
 // GenerateTokens make numTokens random tokens, none of which clash
 // with takenTokens.  Assumes takenTokens is sorted.
 func GenerateTokens(numTokens int, takenTokens []uint32) []uint32 {
@@ -73,6 +73,9 @@ type Config struct {
 	NotificationQueueCapacity int
 	// HTTP timeout duration when sending notifications to the Alertmanager.
 	NotificationTimeout time.Duration
+
+	// Config for the queries rules make.
+	QuerierConfig querier.Config
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
@@ -86,6 +89,7 @@ func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	f.StringVar(&cfg.AlertmanagerURL, "ruler.alertmanager-url", "", "URL of the Alertmanager to send notifications to.")
 	f.IntVar(&cfg.NotificationQueueCapacity, "ruler.notification-queue-capacity", 10000, "Capacity of the queue for notifications to be sent to the Alertmanager.")
 	f.DurationVar(&cfg.NotificationTimeout, "ruler.notification-timeout", 10*time.Second, "HTTP timeout duration when sending notifications to the Alertmanager.")
+	cfg.QuerierConfig.RegisterFlags(f)
 }
 
 // Ruler evaluates rules.
@@ -108,7 +112,7 @@ func NewRuler(cfg Config, d *distributor.Distributor, c *chunk.Store) (*Ruler, e
 		return nil, err
 	}
 	return &Ruler{
-		engine:        querier.NewEngine(d, c),
+		engine:        querier.NewEngine(cfg.QuerierConfig, d, c),
 		pusher:        d,
 		alertURL:      cfg.ExternalURL.URL,
 		notifierCfg:   ncfg,
@@ -74,6 +74,13 @@ type scheduler struct {
 	latestConfig configs.ConfigID
 	latestMutex  sync.RWMutex
 
+	// Users deleted while the scheduler runs, whose work items are dropped
+	// rather than rescheduled.  A work item of a deleted user may still be
+	// being evaluated, so they are never forgotten; as deleted users' configs
+	// can't be set again, there's only one for each user deleted meanwhile.
+	deleted    map[string]struct{}
+	deletedMtx sync.RWMutex
+
 	stop chan struct{}
 	done chan struct{}
 }
@@ -86,6 +93,7 @@ func newScheduler(configsAPI configs.RulesAPI, evaluationInterval, pollInterval
 		pollInterval:       pollInterval,
 		q:                  NewSchedulingQueue(clockwork.NewRealClock()),
 		cfgs:               map[string]configs.CortexConfig{},
+		deleted:            map[string]struct{}{},
 
 		stop: make(chan struct{}),
 		done: make(chan struct{}),
@@ -171,6 +179,11 @@ func (s *scheduler) addNewConfigs(now time.Time, cfgs map[string]configs.CortexC
 	// TODO: instrument how many configs we have, both valid & invalid.
 	log.Debugf("Adding %d configurations", len(cfgs))
 	for userID, config := range cfgs {
+		if config.DeletedAt != nil {
+			s.deleteUser(now, userID)
+			continue
+		}
+
 		rules, err := config.Config.GetRules()
 		if err != nil {
 			// XXX: This means that if a user has a working configuration and
@@ -187,6 +200,19 @@ func (s *scheduler) addNewConfigs(now time.Time, cfgs map[string]configs.CortexC
 	totalConfigs.Set(float64(len(s.cfgs)))
 }
 
+// deleteUser stops evaluating a deleted user's rules.
+func (s *scheduler) deleteUser(now time.Time, userID string) {
+	s.deletedMtx.Lock()
+	s.deleted[userID] = struct{}{}
+	s.deletedMtx.Unlock()
+	delete(s.cfgs, userID)
+
+	// Replace any queued work item with one with no rules, which is dropped
+	// once done.  One being evaluated now is dropped when done, too.
+	s.addWorkItem(workItem{userID, nil, now})
+	log.Infof("Scheduler: deleted user %v", userID)
+}
+
 func (s *scheduler) addWorkItem(i workItem) {
 	// The queue is keyed by user ID, so items for existing user IDs will be replaced.
 	s.q.Enqueue(i)
@@ -213,6 +239,13 @@ func (s *scheduler) nextWorkItem() *workItem {
 
 // workItemDone marks the given item as being ready to be rescheduled.
 func (s *scheduler) workItemDone(i workItem) {
+	s.deletedMtx.RLock()
+	_, deleted := s.deleted[i.userID]
+	s.deletedMtx.RUnlock()
+	if deleted {
+		log.Debugf("Scheduler: work item %v dropped, as its user has been deleted", i)
+		return
+	}
 	next := i.Defer(s.evaluationInterval)
 	log.Debugf("Scheduler: work item %v rescheduled for %v", i, next.scheduled.Format("2006-01-02 15:04:05"))
 	s.addWorkItem(next)
@@ -0,0 +1,26 @@
+package util
+
+import (
+	"sort"
+
+	"github.com/weaveworks/cortex"
+)
+
+// TopCardinalityStats returns the limit names with the highest counts, or
+// all of them if limit is zero.  Names with equal counts are in name order.
+func TopCardinalityStats(counts map[string]uint64, limit int) []cortex.CardinalityStat {
+	stats := make([]cortex.CardinalityStat, 0, len(counts))
+	for name, count := range counts {
+		stats = append(stats, cortex.CardinalityStat{Name: name, Count: count})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Count != stats[j].Count {
+			return stats[i].Count > stats[j].Count
+		}
+		return stats[i].Name < stats[j].Name
+	})
+	if limit > 0 && len(stats) > limit {
+		stats = stats[:limit]
+	}
+	return stats
+}
@@ -167,6 +167,27 @@ func FromMetricsForLabelMatchersResponse(resp *cortex.MetricsForLabelMatchersRes
 	return metrics
 }
 
+// ToCardinalityRequest builds a CardinalityRequest proto
+func ToCardinalityRequest(limit int, matchers []*metric.LabelMatcher) (*cortex.CardinalityRequest, error) {
+	ms, err := toLabelMatchers(matchers)
+	if err != nil {
+		return nil, err
+	}
+	return &cortex.CardinalityRequest{
+		Limit:    int32(limit),
+		Matchers: ms,
+	}, nil
+}
+
+// FromCardinalityRequest unpacks a CardinalityRequest proto
+func FromCardinalityRequest(req *cortex.CardinalityRequest) (int, []*metric.LabelMatcher, error) {
+	matchers, err := fromLabelMatchers(req.Matchers)
+	if err != nil {
+		return 0, nil, err
+	}
+	return int(req.Limit), matchers, nil
+}
+
 func toLabelMatchers(matchers []*metric.LabelMatcher) ([]*cortex.LabelMatcher, error) {
 	result := make([]*cortex.LabelMatcher, 0, len(matchers))
 	for _, matcher := range matchers {
@@ -9,6 +9,9 @@ const (
 	ErrInvalidLabel              = errors.Error("sample invalid label")
 	ErrUserSeriesLimitExceeded   = errors.Error("per-user series limit exceeded")
 	ErrMetricSeriesLimitExceeded = errors.Error("per-metric series limit exceeded")
+	ErrUserMemoryLimitExceeded   = errors.Error("per-user memory limit exceeded")
+	ErrMemoryLimitExceeded       = errors.Error("ingester memory limit exceeded")
 	ErrLabelNameTooLong          = errors.Error("label name too long")
 	ErrLabelValueTooLong         = errors.Error("label value too long")
+	ErrTenantDeleted             = errors.Error("tenant has been deleted")
 )
@@ -22,6 +22,18 @@ func RegisterFlags(rs ...Registerer) {
 	}
 }
 
+// RegisterFlagsWithPrefix registers flags with the provided Registerers, with
+// their names prefixed, so several configs of the same kind can be flags.
+func RegisterFlagsWithPrefix(prefix string, rs ...Registerer) {
+	f := flag.NewFlagSet(prefix, flag.ContinueOnError)
+	for _, r := range rs {
+		r.RegisterFlags(f)
+	}
+	f.VisitAll(func(fl *flag.Flag) {
+		flag.Var(fl.Value, prefix+fl.Name, fl.Usage)
+	})
+}
+
 // DayValue is a model.Time that can be used as a flag.
 // NB it only parses days!
 type DayValue struct {
@@ -58,6 +70,20 @@ func (v *DayValue) IsSet() bool {
 	return v.set
 }
 
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (v *DayValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return v.Set(s)
+}
+
+// MarshalYAML implements yaml.Marshaler.
+func (v DayValue) MarshalYAML() (interface{}, error) {
+	return v.Time.Time().UTC().Format("2006-01-02"), nil
+}
+
 // URLValue is a url.URL that can be used as a flag.
 type URLValue struct {
 	*url.URL
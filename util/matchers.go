@@ -46,3 +46,46 @@ func ExtractMetricNameFromMatchers(matchers []*metric.LabelMatcher) (model.Label
 	}
 	return "", nil, fmt.Errorf("no matcher for MetricNameLabel")
 }
+
+// SplitMetricNameMatchers splits the matchers on the metric name, of any type,
+// from the others.
+func SplitMetricNameMatchers(matchers []*metric.LabelMatcher) (nameMatchers, outMatchers []*metric.LabelMatcher) {
+	for _, matcher := range matchers {
+		if matcher.Name == model.MetricNameLabel {
+			nameMatchers = append(nameMatchers, matcher)
+		} else {
+			outMatchers = append(outMatchers, matcher)
+		}
+	}
+	return
+}
+
+// EqualMetricName returns the metric name of the first equality matcher in
+// nameMatchers.  ok is false if there isn't one.
+func EqualMetricName(nameMatchers []*metric.LabelMatcher) (name model.LabelValue, ok bool) {
+	for _, matcher := range nameMatchers {
+		if matcher.Type == metric.Equal {
+			return matcher.Value, true
+		}
+	}
+	return "", false
+}
+
+// MatchingMetricNames returns the metric names matched by all of nameMatchers.
+// It is an error to match more than limit names, unless limit is zero.
+func MatchingMetricNames(names model.LabelValues, nameMatchers []*metric.LabelMatcher, limit int) (model.LabelValues, error) {
+	result := model.LabelValues{}
+outer:
+	for _, name := range names {
+		for _, matcher := range nameMatchers {
+			if !matcher.Match(name) {
+				continue outer
+			}
+		}
+		result = append(result, name)
+	}
+	if limit > 0 && len(result) > limit {
+		return nil, fmt.Errorf("query matches %d metric names, more than the limit of %d", len(result), limit)
+	}
+	return result, nil
+}
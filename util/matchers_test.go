@@ -50,3 +50,31 @@ func TestExtractMetricNameFromMatchers(t *testing.T) {
 		assert.Equal(t, expOutMatchers, outMatchers, "unexpected outMatchers for test case %d", i)
 	}
 }
+
+func TestMatchingMetricNames(t *testing.T) {
+	names := model.LabelValues{"http_requests_total", "http_request_duration_seconds", "up"}
+
+	matcher, err := metric.NewLabelMatcher(metric.RegexMatch, model.MetricNameLabel, "http_.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notMatcher, err := metric.NewLabelMatcher(metric.NotEqual, model.MetricNameLabel, "http_requests_total")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matched, err := MatchingMetricNames(names, []*metric.LabelMatcher{matcher}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, model.LabelValues{"http_requests_total", "http_request_duration_seconds"}, matched)
+
+	matched, err = MatchingMetricNames(names, []*metric.LabelMatcher{matcher, notMatcher}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, model.LabelValues{"http_request_duration_seconds"}, matched)
+
+	matched, err = MatchingMetricNames(names, nil, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, names, matched)
+
+	_, err = MatchingMetricNames(names, []*metric.LabelMatcher{matcher}, 1)
+	assert.Error(t, err)
+}
@@ -1,6 +1,10 @@
 package util
 
-import "github.com/prometheus/common/model"
+import (
+	"sort"
+
+	"github.com/prometheus/common/model"
+)
 
 // MergeSamples merges and dedupes two sets of already sorted sample pairs.
 func MergeSamples(a, b []model.SamplePair) []model.SamplePair {
@@ -27,3 +31,10 @@ func MergeSamples(a, b []model.SamplePair) []model.SamplePair {
 	}
 	return result
 }
+
+// SamplesBetween returns the sorted samples in [from, through).
+func SamplesBetween(samples []model.SamplePair, from, through model.Time) []model.SamplePair {
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].Timestamp >= from })
+	j := sort.Search(len(samples), func(j int) bool { return samples[j].Timestamp >= through })
+	return samples[i:j]
+}